@@ -0,0 +1,147 @@
+package firewall
+
+import (
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"strings"
+)
+
+// AddressRange is an inclusive range of IPv4 addresses, matched by a single
+// WFP condition of type FWP_RANGE_TYPE.
+type AddressRange struct {
+	From, To netip.Addr
+}
+
+func (r AddressRange) IsValid() bool {
+	return r.From.Is4() && r.To.Is4() && r.From.Compare(r.To) <= 0
+}
+
+func (r AddressRange) String() string {
+	return r.From.String() + "-" + r.To.String()
+}
+
+func (r AddressRange) Contains(addr netip.Addr) bool {
+	return addr.Is4() && r.From.Compare(addr) <= 0 && addr.Compare(r.To) <= 0
+}
+
+func (r AddressRange) span() span {
+	return span{addrUint32(r.From), addrUint32(r.To)}
+}
+
+// Prefixes returns the fewest prefixes covering exactly r.
+func (r AddressRange) Prefixes() []netip.Prefix {
+	return rangePrefixes([]span{r.span()})
+}
+
+/*
+ * ParseCIDR parses an IPv4 network in any of the notations found in existing
+ * firewall configurations:
+ *
+ *	10.0.0.0/8             CIDR
+ *	192.168.1.10           single address, as a /32
+ *	10.0.0.0 255.255.0.0   netmask, also 10.0.0.0/255.255.0.0
+ *	10.0.0.0 0.0.255.255   Cisco-style wildcard mask, also with a slash
+ *
+ * A mask whose first bit is set is a netmask, any other a wildcard. Masks
+ * must be contiguous. 0.0.0.0 and 255.255.255.255 are either, so they are
+ * read from the address: /0 for 0.0.0.0 (Cisco "0.0.0.0 255.255.255.255" and
+ * the "0.0.0.0 0.0.0.0" default route), /32 for any other.
+ */
+func ParseCIDR(network string) (netip.Prefix, error) {
+	s := strings.TrimSpace(network)
+	addrPart, maskPart, hasMask := strings.Cut(s, "/")
+	if !hasMask {
+		if fields := strings.Fields(s); len(fields) == 2 {
+			addrPart, maskPart, hasMask = fields[0], fields[1], true
+		}
+	}
+
+	var prefix netip.Prefix
+	switch {
+	case !hasMask:
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid address %q: must be a CIDR, an address, a range, or an address and a mask", network)
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	case strings.Contains(maskPart, "."):
+		addr, err := netip.ParseAddr(addrPart)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid address %q: %w", network, err)
+		}
+		n, err := maskBits(addr, maskPart)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid address %q: %w", network, err)
+		}
+		prefix = netip.PrefixFrom(addr, n)
+	default:
+		var err error
+		if prefix, err = netip.ParsePrefix(s); err != nil {
+			return netip.Prefix{}, err
+		}
+	}
+	if !prefix.Addr().Is4() {
+		return netip.Prefix{}, fmt.Errorf("%s: only IPv4 networks are supported", network)
+	}
+	return prefix, nil
+}
+
+// maskBits returns the prefix length given by a netmask or a wildcard mask
+// of addr.
+func maskBits(addr netip.Addr, s string) (int, error) {
+	mask, err := netip.ParseAddr(s)
+	if err != nil || !mask.Is4() {
+		return 0, fmt.Errorf("invalid mask %q", s)
+	}
+	m := addrUint32(mask)
+	if m == 0 || m == 0xffffffff {
+		if addr == netip.IPv4Unspecified() {
+			return 0, nil
+		}
+		return 32, nil
+	}
+	if m&(1<<31) != 0 {
+		if inv := ^m; inv&(inv+1) != 0 {
+			return 0, fmt.Errorf("netmask %s is not contiguous", s)
+		}
+		return bits.OnesCount32(m), nil
+	}
+	if m&(m+1) != 0 {
+		return 0, fmt.Errorf("wildcard mask %s is not contiguous", s)
+	}
+	return 32 - bits.OnesCount32(m), nil
+}
+
+/*
+ * ParseAddress parses what ParseCIDR does, and ranges such as
+ * 10.0.0.1-10.0.0.77. It returns either a prefix or, for a range that is not
+ * a single prefix, the range: one range filter is never more filters than
+ * the prefixes covering it.
+ */
+func ParseAddress(s string) (netip.Prefix, AddressRange, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	if !isRange {
+		prefix, err := ParseCIDR(s)
+		return prefix, AddressRange{}, err
+	}
+
+	var r AddressRange
+	var err error
+	if r.From, err = netip.ParseAddr(strings.TrimSpace(from)); err != nil {
+		return netip.Prefix{}, AddressRange{}, fmt.Errorf("invalid range %q: %w", s, err)
+	}
+	if r.To, err = netip.ParseAddr(strings.TrimSpace(to)); err != nil {
+		return netip.Prefix{}, AddressRange{}, fmt.Errorf("invalid range %q: %w", s, err)
+	}
+	if !r.From.Is4() || !r.To.Is4() {
+		return netip.Prefix{}, AddressRange{}, fmt.Errorf("%s: only IPv4 ranges are supported", s)
+	}
+	if !r.IsValid() {
+		return netip.Prefix{}, AddressRange{}, fmt.Errorf("invalid range %q: %s is after %s", s, r.From, r.To)
+	}
+	if prefixes := r.Prefixes(); len(prefixes) == 1 {
+		return prefixes[0], AddressRange{}, nil
+	}
+	return netip.Prefix{}, r, nil
+}
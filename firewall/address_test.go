@@ -0,0 +1,83 @@
+package firewall
+
+import "testing"
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // Empty for an error.
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{"192.168.1.10", "192.168.1.10/32"},
+		{"10.0.0.0 255.255.0.0", "10.0.0.0/16"},
+		{"10.0.0.0/255.255.0.0", "10.0.0.0/16"},
+		{"10.0.0.0 0.0.255.255", "10.0.0.0/16"},
+		{"10.0.0.0/0.0.255.255", "10.0.0.0/16"},
+		{"10.0.0.0 255.0.255.0", ""},
+		{"10.0.0.0 0.255.0.255", ""},
+		{"2001:db8::/32", ""},
+
+		// The masks that are both a netmask and a wildcard.
+		{"0.0.0.0 255.255.255.255", "0.0.0.0/0"},
+		{"0.0.0.0 0.0.0.0", "0.0.0.0/0"},
+		{"10.1.2.3 0.0.0.0", "10.1.2.3/32"},
+		{"10.1.2.3 255.255.255.255", "10.1.2.3/32"},
+		{"10.0.0.0/0.0.0.0", "10.0.0.0/32"},
+	}
+	for _, tt := range tests {
+		got, err := ParseCIDR(tt.in)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("ParseCIDR(%q) = %v, want an error", tt.in, got)
+		case tt.want != "" && err != nil:
+			t.Errorf("ParseCIDR(%q): %v", tt.in, err)
+		case tt.want != "" && got.String() != tt.want:
+			t.Errorf("ParseCIDR(%q) = %v, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func FuzzParseAddress(f *testing.F) {
+	for _, s := range []string{
+		"10.0.0.0/8",
+		"10.0.0.5/8",
+		"192.168.1.10",
+		"0.0.0.0/0",
+		"10.0.0.0 255.255.0.0",
+		"10.0.0.0/0.0.255.255",
+		"0.0.0.0 255.255.255.255",
+		"10.1.2.3 0.0.0.0",
+		"10.0.0.1-10.0.0.77",
+		"10.0.0.0-10.0.0.255",
+		"0.0.0.0-255.255.255.255",
+		" 10.0.0.1 - 10.0.0.1 ",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		prefix, r, err := ParseAddress(s)
+		if err != nil {
+			return
+		}
+		if prefix.IsValid() == r.IsValid() {
+			t.Fatalf("ParseAddress(%q) = %v, %v: want either a prefix or a range", s, prefix, r)
+		}
+		if r.IsValid() {
+			if len(r.Prefixes()) == 1 {
+				t.Fatalf("ParseAddress(%q) = range %v, which is a single prefix", s, r)
+			}
+			gotPrefix, got, err := ParseAddress(r.String())
+			if err != nil || gotPrefix.IsValid() || got != r {
+				t.Fatalf("ParseAddress(%q) = %v, %v, %v; want range %v", r.String(), gotPrefix, got, err, r)
+			}
+			return
+		}
+		if !prefix.Addr().Is4() {
+			t.Fatalf("ParseAddress(%q) = %v, not IPv4", s, prefix)
+		}
+		got, gotRange, err := ParseAddress(prefix.String())
+		if err != nil || gotRange.IsValid() || got != prefix {
+			t.Fatalf("ParseAddress(%q) = %v, %v, %v; want prefix %v", prefix.String(), got, gotRange, err, prefix)
+		}
+	})
+}
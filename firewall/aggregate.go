@@ -0,0 +1,296 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"slices"
+	"sort"
+)
+
+/*
+ * Aggregate reduces the number of filters of a set of rules, without changing
+ * what any address gets. Rules are taken in the order WFP evaluates them, and
+ * each run of consecutive rules with the same action, group and constraints
+ * (protocols, ports) is replaced by a single filter, whose remote address
+ * conditions are the fewest covering the same addresses: adjacent prefixes
+ * are merged (10.0.0.0/25 and 10.0.0.128/25 into 10.0.0.0/24), contained ones
+ * dropped (a /24 inside a /16), and what is not a single prefix becomes a
+ * range. The merged rule takes the weight and position of the first rule of
+ * the run; since no other rule is evaluated between the rules of a run, every
+ * address is still decided by a rule of the same action and group.
+ *
+ * The result is then checked against the address-set model of both rule sets,
+ * which gives the rule deciding every address of the IPv4 space.
+ * Exceptions are expanded first, and the counts are of filters. Hostname
+ * rules and rules on Ethernet frames are kept as they are, and no run goes
+ * across one.
+ */
+func Aggregate(specs []RuleSpec) (*Aggregation, error) {
+	specs = ExpandExceptions(specs)
+	order := precedenceOrder(specs)
+
+	// Runs of the precedence order, as lists of indexes into specs.
+	var runs [][]int
+	for k, i := range order {
+		if k > 0 && specs[i].addressed() {
+			prev := specs[order[k-1]]
+			if prev.addressed() && prev.Action == specs[i].Action && prev.Group == specs[i].Group &&
+				prev.constraintKey() == specs[i].constraintKey() {
+				runs[len(runs)-1] = append(runs[len(runs)-1], i)
+				continue
+			}
+		}
+		runs = append(runs, []int{i})
+	}
+
+	merged := make(map[int][]RuleSpec) // By index of the first rule of the run.
+	for _, run := range runs {
+		if !specs[run[0]].addressed() {
+			// Its addresses are only known once resolved, or it has none.
+			merged[run[0]] = specs[run[0] : run[0]+1]
+			continue
+		}
+		var ranges []span
+		for _, i := range run {
+			ranges = append(ranges, specs[i].spans()...)
+		}
+		first := specs[run[0]]
+		for _, i := range run {
+			if specs[i].Meta.Intent != first.Meta.Intent {
+				// The merged filters no longer stand for a single rule.
+				first.Meta.Intent = ""
+			}
+		}
+		merged[run[0]] = []RuleSpec{first.withSpans(mergeRanges(ranges))}
+	}
+
+	a := &Aggregation{Before: len(specs)}
+	for i := range specs {
+		a.Specs = append(a.Specs, merged[i]...)
+	}
+	a.After = len(a.Specs)
+	for _, spec := range a.Specs {
+		a.Ranges += len(spec.spans())
+	}
+
+	if err := EquivalentRules(specs, a.Specs); err != nil {
+		return nil, fmt.Errorf("aggregation changed the policy, nothing applied: %w", err)
+	}
+	return a, nil
+}
+
+// Aggregation is the outcome of Aggregate.
+type Aggregation struct {
+	Specs  []RuleSpec // Rules to apply instead of the original ones.
+	Before int        // Number of filters of the rules given.
+	After  int        // Number of filters once aggregated.
+	Ranges int        // Number of remote address conditions of those filters.
+}
+
+// addressed reports whether the addresses s matches are known: it is neither
+// a hostname rule nor a rule on Ethernet frames.
+func (s RuleSpec) addressed() bool {
+	return s.Host == "" && !s.frame()
+}
+
+// precedenceOrder returns the indexes of specs in the order WFP evaluates
+// them: highest weight first, the first added first on equal weights.
+func precedenceOrder(specs []RuleSpec) []int {
+	order := make([]int, len(specs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return specs[order[i]].Weight > specs[order[j]].Weight
+	})
+	return order
+}
+
+// span is an inclusive range of IPv4 addresses.
+type span struct {
+	first, last uint32
+}
+
+func addrUint32(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func uint32Addr(n uint32) netip.Addr {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	return netip.AddrFrom4(b)
+}
+
+func prefixRange(prefix netip.Prefix) span {
+	first := addrUint32(prefix.Masked().Addr())
+	return span{first, first | uint32(uint64(1)<<(32-prefix.Bits())-1)}
+}
+
+// mergeRanges sorts ranges and merges the overlapping and adjacent ones.
+func mergeRanges(ranges []span) []span {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].first < ranges[j].first })
+	var merged []span
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && uint64(r.first) <= uint64(merged[n-1].last)+1 {
+			merged[n-1].last = max(merged[n-1].last, r.last)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// rangePrefixes returns the fewest prefixes covering exactly ranges.
+func rangePrefixes(ranges []span) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, r := range ranges {
+		start, end := uint64(r.first), uint64(r.last)+1
+		for start < end {
+			// Largest block aligned on start that does not go past end.
+			size := 32
+			if start != 0 {
+				size = bits.TrailingZeros64(start)
+			}
+			for size > 0 && start+uint64(1)<<size > end {
+				size--
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(uint32Addr(uint32(start)), 32-size))
+			start += uint64(1) << size
+		}
+	}
+	return prefixes
+}
+
+// decidedRange is a range of addresses that a rule of the given action and
+// group decides, or the layer default when rule is -1.
+type decidedRange struct {
+	span
+	rule   int
+	action string
+	group  string
+}
+
+/*
+ * addressModel gives, for the whole IPv4 space, the rule that decides each
+ * address, as ranges in address order. Adjacent ranges decided by rules of
+ * the same action and group are merged, so that two rule sets are equivalent
+ * exactly when their models are equal. Hostname rules are left out, their
+ * addresses being unknown, and so are rules on Ethernet frames. The model is of the traffic matching the
+ * constraints of profile: only the rules whose constraints cover it take part.
+ */
+func addressModel(specs []RuleSpec, profile RuleSpec) []decidedRange {
+	var static []RuleSpec
+	for _, spec := range ExpandExceptions(specs) {
+		if spec.addressed() && constraintsCover(spec, profile) {
+			static = append(static, spec)
+		}
+	}
+	specs = static
+	ranges := make([][]span, len(specs))
+	for i, spec := range specs {
+		ranges[i] = spec.spans()
+	}
+
+	// Every address where the deciding rule can change.
+	cuts := map[uint64]bool{0: true}
+	for _, spans := range ranges {
+		for _, r := range spans {
+			cuts[uint64(r.first)] = true
+			cuts[uint64(r.last)+1] = true
+		}
+	}
+	starts := make([]uint64, 0, len(cuts))
+	for cut := range cuts {
+		if cut <= 0xffffffff {
+			starts = append(starts, cut)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	order := precedenceOrder(specs)
+	var model []decidedRange
+	for k, start := range starts {
+		end := uint64(0xffffffff)
+		if k+1 < len(starts) {
+			end = starts[k+1] - 1
+		}
+		d := decidedRange{span: span{uint32(start), uint32(end)}, rule: -1, action: "permit"}
+		for _, i := range order {
+			if slices.ContainsFunc(ranges[i], func(r span) bool { return r.first <= d.first && d.first <= r.last }) {
+				d.rule, d.action, d.group = i, specs[i].Action, specs[i].Group
+				break
+			}
+		}
+		if n := len(model); n > 0 && (model[n-1].rule == -1) == (d.rule == -1) &&
+			model[n-1].action == d.action && model[n-1].group == d.group {
+			model[n-1].last = d.last
+			continue
+		}
+		model = append(model, d)
+	}
+	return model
+}
+
+/*
+ * EquivalentRules checks that every IPv4 address gets the same action, from a
+ * rule of the same group, under both rule sets. Rules with constraints are
+ * checked for the traffic matching each set of constraints found in the
+ * rules, against the rules that cover all of that traffic; rules that only
+ * partly overlap it are not taken into account.
+ */
+func EquivalentRules(a, b []RuleSpec) error {
+	profiles := map[string]RuleSpec{"": {}}
+	for _, spec := range append(slices.Clone(a), b...) {
+		profiles[spec.constraintKey()] = spec
+	}
+	keys := make([]string, 0, len(profiles))
+	for key := range profiles {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := equivalentModels(addressModel(a, profiles[key]), addressModel(b, profiles[key])); err != nil {
+			if key != "" {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func equivalentModels(ma, mb []decidedRange) error {
+	for k := 0; k < len(ma) && k < len(mb); k++ {
+		// The ranges before are equal, so both start at the same address.
+		x, y := ma[k], mb[k]
+		if (x.rule == -1) != (y.rule == -1) || x.action != y.action || x.group != y.group {
+			return fmt.Errorf("%s: %s instead of %s", uint32Addr(x.first), describeDecided(y), describeDecided(x))
+		}
+		if x.last != y.last {
+			addr := min(x.last, y.last) + 1
+			return fmt.Errorf("%s: %s instead of %s", uint32Addr(addr), describeDecided(decidedAt(mb, addr)), describeDecided(decidedAt(ma, addr)))
+		}
+	}
+	if len(ma) != len(mb) {
+		return fmt.Errorf("%d address ranges instead of %d", len(mb), len(ma))
+	}
+	return nil
+}
+
+func decidedAt(model []decidedRange, addr uint32) decidedRange {
+	k := sort.Search(len(model), func(k int) bool { return model[k].last >= addr })
+	return model[k]
+}
+
+func describeDecided(d decidedRange) string {
+	if d.rule == -1 {
+		return "layer default"
+	}
+	if d.group != "" {
+		return fmt.Sprintf("%s (group %s)", d.action, d.group)
+	}
+	return d.action
+}
@@ -0,0 +1,91 @@
+package firewall
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func aggSpec(action, cidr string, weight uint8, conditions ...Condition) RuleSpec {
+	return RuleSpec{Action: action, Network: netip.MustParsePrefix(cidr), Weight: weight, Conditions: conditions}
+}
+
+func TestAggregate(t *testing.T) {
+	inbound := aggSpec("block", "10.0.0.128/25", 11)
+	inbound.Direction = "inbound"
+	grouped := aggSpec("block", "10.0.0.128/25", 11)
+	grouped.Group = "g"
+	except := aggSpec("block", "10.0.0.0/8", 10)
+	except.Except = []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}
+
+	tests := []struct {
+		name          string
+		specs         []RuleSpec
+		want          []string // The rules once aggregated.
+		before, after int
+		ranges        int // Remote address conditions once aggregated.
+	}{
+		{"adjacent prefixes", []RuleSpec{aggSpec("block", "10.0.0.0/25", 10), aggSpec("block", "10.0.0.128/25", 11)},
+			[]string{"block 10.0.0.0/24"}, 2, 1, 1},
+		{"contained prefix", []RuleSpec{aggSpec("block", "10.0.0.0/16", 10), aggSpec("block", "10.0.5.0/24", 11)},
+			[]string{"block 10.0.0.0/16"}, 2, 1, 1},
+		{"interleaved rule of the other action", []RuleSpec{aggSpec("block", "10.0.0.0/25", 12), aggSpec("permit", "10.0.0.0/24", 11), aggSpec("block", "10.0.0.128/25", 10)},
+			[]string{"block 10.0.0.0/25", "permit 10.0.0.0/24", "block 10.0.0.128/25"}, 3, 3, 3},
+		{"interleaved by weight", []RuleSpec{aggSpec("block", "10.0.0.0/25", 10), aggSpec("block", "10.0.0.128/25", 12), aggSpec("permit", "10.0.0.0/24", 11)},
+			[]string{"block 10.0.0.0/25", "block 10.0.0.128/25", "permit 10.0.0.0/24"}, 3, 3, 3},
+		{"other constraints", []RuleSpec{aggSpec("block", "10.0.0.0/25", 10, Protocol(6)), aggSpec("block", "10.0.0.128/25", 11, Protocol(17))},
+			[]string{"block 10.0.0.0/25 protocol=tcp", "block 10.0.0.128/25 protocol=udp"}, 2, 2, 2},
+		{"same constraints", []RuleSpec{aggSpec("block", "10.0.0.0/25", 10, Protocol(6)), aggSpec("block", "10.0.0.128/25", 11, Protocol(6))},
+			[]string{"block 10.0.0.0/24 protocol=tcp"}, 2, 1, 1},
+		{"other direction", []RuleSpec{aggSpec("block", "10.0.0.0/25", 10), inbound},
+			[]string{"block 10.0.0.0/25", "block inbound 10.0.0.128/25"}, 2, 2, 2},
+		{"other group", []RuleSpec{aggSpec("block", "10.0.0.0/25", 10), grouped},
+			[]string{"block 10.0.0.0/25", "block 10.0.0.128/25"}, 2, 2, 2},
+		{"exceptions", []RuleSpec{except},
+			[]string{"block 10.0.0.0/16,10.2.0.0-10.255.255.255"}, 2, 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := Aggregate(tt.specs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, spec := range a.Specs {
+				got = append(got, spec.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Aggregate = %q, want %q", got, tt.want)
+			}
+			if a.Before != tt.before || a.After != tt.after || a.Ranges != tt.ranges {
+				t.Errorf("Before, After, Ranges = %d, %d, %d; want %d, %d, %d", a.Before, a.After, a.Ranges, tt.before, tt.after, tt.ranges)
+			}
+		})
+	}
+}
+
+func TestEquivalentRules(t *testing.T) {
+	policy := []RuleSpec{aggSpec("block", "10.0.0.0/25", 12), aggSpec("permit", "10.0.0.0/24", 11), aggSpec("block", "10.0.0.128/25", 10)}
+	grouped := aggSpec("permit", "10.0.0.0/24", 11)
+	grouped.Group = "g"
+
+	for _, tt := range []struct {
+		name  string
+		other []RuleSpec
+		ok    bool
+	}{
+		{"same rules in another order", []RuleSpec{policy[2], policy[0], policy[1]}, true},
+		// The last block is shadowed by the permit.
+		{"shadowed rule dropped", policy[:2], true},
+		// Merging the blocks across the permit blocks 10.0.0.128/25.
+		{"merged across a permit", []RuleSpec{aggSpec("block", "10.0.0.0/24", 12), policy[1]}, false},
+		{"permit dropped", []RuleSpec{policy[0], policy[2]}, false},
+		{"other group", []RuleSpec{policy[0], grouped, policy[2]}, false},
+		{"constraint added", []RuleSpec{policy[0], aggSpec("permit", "10.0.0.0/24", 11, Protocol(6)), policy[2]}, false},
+	} {
+		err := EquivalentRules(policy, tt.other)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: EquivalentRules = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package firewall
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+/*
+ * Analyze looks for mistakes in a set of rules without applying it. All the
+ * rules share a sublayer, where the matching rule of highest weight decides
+ * (the one added first on equal weights, as in the simulator), and two IPv4
+ * prefixes overlap only when one contains the other, so every overlap is
+ * found by walking a prefix trie from each rule up to the broader ones. Rules
+ * with exceptions are walked through the prefixes they compile to, but
+ * reported as written. Rules with constraints (protocols, ports) conflict
+ * only when some traffic matches both, and a rule is shadowed only by rules
+ * matching all of its traffic.
+ */
+
+type FindingKind string
+
+const (
+	FindingHostBits  FindingKind = "host-bits" // A CIDR has bits set after the prefix length.
+	FindingDuplicate FindingKind = "duplicate" // Same networks, constraints and action as a rule that takes precedence.
+	FindingShadowed  FindingKind = "shadowed"  // Broader or equal rules taking precedence cover all the networks.
+	FindingConflict  FindingKind = "conflict"  // Overlaps a rule of the other action.
+)
+
+// Finding is one problem found by Analyze.
+type Finding struct {
+	Kind   FindingKind
+	Rule   int // Index of the rule in the analyzed specs.
+	Other  int // Index of the other rule involved, -1 for none.
+	Winner int // For conflicts, the rule that decides the overlap; -1 otherwise.
+	Detail string
+}
+
+type Analysis struct {
+	Specs    []RuleSpec
+	Findings []Finding
+}
+
+// analyzedPrefix is a prefix a rule compiles to.
+type analyzedPrefix struct {
+	network netip.Prefix
+	rule    int
+}
+
+func Analyze(specs []RuleSpec) *Analysis {
+	a := &Analysis{Specs: specs}
+	var trie prefixTrie
+	var prefixes []analyzedPrefix
+	for i, spec := range specs {
+		for _, network := range spec.Networks() {
+			trie.insert(network.Masked(), len(prefixes))
+			prefixes = append(prefixes, analyzedPrefix{network.Masked(), i})
+		}
+	}
+
+	// Duplicates, taking the rules in precedence order so that the first one
+	// seen is the one that takes effect.
+	duplicateOf := make(map[int]int)
+	seen := make(map[string]int)
+	for _, i := range precedenceOrder(specs) {
+		key := specs[i].Action + " " + specs[i].Host + " " + fmt.Sprint(specs[i].Networks()) + " " + specs[i].constraintKey()
+		if first, ok := seen[key]; ok {
+			duplicateOf[i] = first
+			a.add(Finding{Kind: FindingDuplicate, Rule: i, Other: first, Winner: -1,
+				Detail: fmt.Sprintf("same as %s", a.label(first))})
+			continue
+		}
+		seen[key] = i
+	}
+	isDuplicate := func(i, j int) bool {
+		first, ok := duplicateOf[i]
+		other, ok2 := duplicateOf[j]
+		return (ok && first == j) || (ok2 && other == i) || (ok && ok2 && first == other)
+	}
+
+	conflicts := make(map[[2]int]bool)
+	for i, spec := range specs {
+		for _, cidr := range append([]netip.Prefix{spec.Network}, spec.Except...) {
+			if network := cidr.Masked(); network != cidr {
+				a.add(Finding{Kind: FindingHostBits, Rule: i, Other: -1, Winner: -1,
+					Detail: fmt.Sprintf("%s has host bits set; it matches %s", cidr, network)})
+			}
+		}
+	}
+
+	// Overlaps of every prefix with the broader or equal ones.
+	covered := make(map[int]int)     // Prefixes of each rule covered by a rule that takes precedence.
+	shadowers := make(map[int][]int) // Those rules, by rule.
+	for _, p := range prefixes {
+		i := p.rule
+		isCovered := false
+		for _, k := range trie.covering(p.network) {
+			j := prefixes[k].rule
+			if j == i || isDuplicate(i, j) {
+				continue
+			}
+			if specs[j].Action != specs[i].Action && constraintsOverlap(specs[i], specs[j]) {
+				pair := [2]int{min(i, j), max(i, j)}
+				if !conflicts[pair] {
+					conflicts[pair] = true
+					winner, loser := i, j
+					if a.precedes(j, i) {
+						winner, loser = j, i
+					}
+					a.add(Finding{Kind: FindingConflict, Rule: max(i, j), Other: min(i, j), Winner: winner,
+						Detail: fmt.Sprintf("overlaps %s on %s; %s wins (%s)", a.label(min(i, j)), p.network, a.label(winner), a.reason(winner, loser))})
+				}
+			}
+			if !isCovered && a.precedes(j, i) && constraintsCover(specs[j], specs[i]) {
+				isCovered = true
+				covered[i]++
+				if !slices.Contains(shadowers[i], j) {
+					shadowers[i] = append(shadowers[i], j)
+				}
+			}
+		}
+	}
+	for i, spec := range specs {
+		if _, dup := duplicateOf[i]; dup || covered[i] == 0 || covered[i] < len(spec.Networks()) {
+			continue
+		}
+		labels := make([]string, len(shadowers[i]))
+		for k, j := range shadowers[i] {
+			labels[k] = a.label(j)
+		}
+		a.add(Finding{Kind: FindingShadowed, Rule: i, Other: shadowers[i][0], Winner: -1,
+			Detail: fmt.Sprintf("never takes effect: %s covers it and takes precedence", strings.Join(labels, " and "))})
+	}
+
+	sort.SliceStable(a.Findings, func(i, j int) bool { return a.Findings[i].Rule < a.Findings[j].Rule })
+	return a
+}
+
+func (a *Analysis) add(f Finding) {
+	a.Findings = append(a.Findings, f)
+}
+
+// precedes reports whether rule i is evaluated before rule j.
+func (a *Analysis) precedes(i, j int) bool {
+	if a.Specs[i].Weight != a.Specs[j].Weight {
+		return a.Specs[i].Weight > a.Specs[j].Weight
+	}
+	return i < j
+}
+
+func (a *Analysis) reason(winner, loser int) string {
+	if a.Specs[winner].Weight != a.Specs[loser].Weight {
+		return fmt.Sprintf("weight %d over %d", a.Specs[winner].Weight, a.Specs[loser].Weight)
+	}
+	return fmt.Sprintf("same weight %d, added first", a.Specs[winner].Weight)
+}
+
+func (a *Analysis) label(i int) string {
+	return fmt.Sprintf("rule %d (%s)", i+1, a.Specs[i])
+}
+
+/*
+ * WriteReport prints one line per finding, in rule order, and a summary:
+ *
+ *	RULE  ACTION  CIDR         KIND      DETAIL
+ *	2     permit  10.1.0.0/16  conflict  overlaps rule 1 (block 10.0.0.0/8) on 10.1.0.0/16; rule 2 (permit 10.1.0.0/16) wins (weight 11 over 10)
+ */
+func (a *Analysis) WriteReport(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if len(a.Findings) > 0 {
+		fmt.Fprintln(tw, "RULE\tACTION\tCIDR\tKIND\tDETAIL")
+	}
+	rules := make(map[int]bool)
+	for _, f := range a.Findings {
+		spec := a.Specs[f.Rule]
+		rules[f.Rule] = true
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", f.Rule+1, spec.Action, spec.networkString(), f.Kind, f.Detail)
+	}
+	fmt.Fprintf(tw, "%d findings in %d of %d rules\n", len(a.Findings), len(rules), len(a.Specs))
+	return tw.Flush()
+}
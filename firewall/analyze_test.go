@@ -0,0 +1,104 @@
+package firewall
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func exceptSpec(action, cidr string, weight uint8, except ...string) RuleSpec {
+	spec := aggSpec(action, cidr, weight)
+	for _, e := range except {
+		spec.Except = append(spec.Except, netip.MustParsePrefix(e))
+	}
+	return spec
+}
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		name   string
+		specs  []RuleSpec
+		want   []string // Kind, rule, other and winner of each finding.
+		detail []string // Text in the detail of each finding.
+	}{
+		{"host bits", []RuleSpec{aggSpec("block", "10.0.0.5/8", 10)},
+			[]string{"host-bits 0 -1 -1"}, []string{"10.0.0.5/8 has host bits set; it matches 10.0.0.0/8"}},
+		{"host bits of an exception", []RuleSpec{exceptSpec("block", "10.0.0.0/8", 10, "10.1.0.5/16")},
+			[]string{"host-bits 0 -1 -1"}, []string{"it matches 10.1.0.0/16"}},
+		{"duplicate", []RuleSpec{aggSpec("block", "10.0.0.0/8", 10), aggSpec("block", "10.0.0.0/8", 10)},
+			[]string{"duplicate 1 0 -1"}, []string{"same as rule 1 (block 10.0.0.0/8)"}},
+		// The rule of higher weight takes effect, whatever the order.
+		{"duplicate of higher weight", []RuleSpec{aggSpec("block", "10.0.0.0/8", 10), aggSpec("block", "10.0.0.0/8", 11)},
+			[]string{"duplicate 0 1 -1"}, []string{"same as rule 2"}},
+		{"shadowed by a broader rule", []RuleSpec{aggSpec("block", "10.1.0.0/16", 10), aggSpec("block", "10.0.0.0/8", 11)},
+			[]string{"shadowed 0 1 -1"}, []string{"never takes effect: rule 2 (block 10.0.0.0/8) covers it"}},
+		{"broader rule added first", []RuleSpec{aggSpec("block", "10.0.0.0/8", 10), aggSpec("block", "10.1.0.0/16", 10)},
+			[]string{"shadowed 1 0 -1"}, []string{"rule 1 (block 10.0.0.0/8)"}},
+		{"narrower rule of higher weight", []RuleSpec{aggSpec("block", "10.0.0.0/8", 10), aggSpec("block", "10.1.0.0/16", 11)},
+			nil, nil},
+		{"conflict won by weight", []RuleSpec{aggSpec("block", "10.0.0.0/8", 10), aggSpec("permit", "10.1.0.0/16", 11)},
+			[]string{"conflict 1 0 1"}, []string{"overlaps rule 1 (block 10.0.0.0/8) on 10.1.0.0/16; rule 2 (permit 10.1.0.0/16) wins (weight 11 over 10)"}},
+		{"conflict won by order", []RuleSpec{aggSpec("block", "10.0.0.0/8", 10), aggSpec("permit", "10.1.0.0/16", 10)},
+			[]string{"conflict 1 0 0", "shadowed 1 0 -1"}, []string{"rule 1 (block 10.0.0.0/8) wins (same weight 10, added first)", "rule 1"}},
+		{"disjoint protocols", []RuleSpec{aggSpec("block", "10.0.0.0/8", 10, Protocol(6)), aggSpec("permit", "10.1.0.0/16", 11, Protocol(17))},
+			nil, nil},
+		{"overlapping constraints", []RuleSpec{aggSpec("block", "10.0.0.0/8", 10, Protocol(6)), aggSpec("permit", "10.1.0.0/16", 11, Protocol(6), RemotePort(443))},
+			[]string{"conflict 1 0 1"}, []string{"weight 11 over 10"}},
+		// A rule without constraints matches all the traffic of one with.
+		{"constrained rule shadowed", []RuleSpec{aggSpec("permit", "10.1.0.0/16", 10, Protocol(6)), aggSpec("block", "10.0.0.0/8", 11)},
+			[]string{"shadowed 0 1 -1", "conflict 1 0 1"}, []string{"rule 2", "weight 11 over 10"}},
+		{"constrained rule not shadowing", []RuleSpec{aggSpec("permit", "10.1.0.0/16", 10), aggSpec("block", "10.0.0.0/8", 11, Protocol(6))},
+			[]string{"conflict 1 0 1"}, []string{"weight 11 over 10"}},
+		{"inside an exception", []RuleSpec{exceptSpec("block", "10.0.0.0/8", 10, "10.1.0.0/16"), aggSpec("permit", "10.1.2.0/24", 11)},
+			nil, nil},
+		{"outside an exception", []RuleSpec{exceptSpec("block", "10.0.0.0/8", 10, "10.1.0.0/16"), aggSpec("permit", "10.2.0.0/16", 11)},
+			[]string{"conflict 1 0 1"}, []string{"overlaps rule 1 (block 10.0.0.0/8 except 10.1.0.0/16) on 10.2.0.0/16"}},
+		{"rule with an exception shadowed", []RuleSpec{exceptSpec("block", "10.0.0.0/8", 10, "10.1.0.0/16"), aggSpec("block", "10.0.0.0/8", 11)},
+			[]string{"shadowed 0 1 -1"}, []string{"rule 2 (block 10.0.0.0/8)"}},
+		// Only some of the prefixes of the exception are covered.
+		{"rule with an exception partly covered", []RuleSpec{exceptSpec("block", "10.0.0.0/8", 10, "10.1.0.0/16"), aggSpec("block", "10.128.0.0/9", 11)},
+			nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := Analyze(tt.specs)
+			var got []string
+			for _, f := range a.Findings {
+				got = append(got, fmt.Sprintf("%s %d %d %d", f.Kind, f.Rule, f.Other, f.Winner))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("findings = %+v, want %v", a.Findings, tt.want)
+			}
+			for i, f := range a.Findings {
+				if !strings.Contains(f.Detail, tt.detail[i]) {
+					t.Errorf("finding %d: detail %q, want %q in it", i, f.Detail, tt.detail[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPrefixTrieCovering(t *testing.T) {
+	var trie prefixTrie
+	for i, s := range []string{"10.0.0.0/8", "0.0.0.0/0", "10.1.0.0/16", "10.1.0.0/16", "10.2.0.0/16", "10.1.2.3/32"} {
+		trie.insert(netip.MustParsePrefix(s), i)
+	}
+	tests := []struct {
+		prefix string
+		want   []int
+	}{
+		{"10.1.2.0/24", []int{1, 0, 2, 3}},
+		{"10.1.0.0/16", []int{1, 0, 2, 3}},
+		{"10.1.2.3/32", []int{1, 0, 2, 3, 5}},
+		{"10.0.0.0/7", []int{1}},
+		{"192.168.0.0/16", []int{1}},
+		{"10.3.0.0/16", []int{1, 0}},
+	}
+	for _, tt := range tests {
+		if got := trie.covering(netip.MustParsePrefix(tt.prefix)); !slices.Equal(got, tt.want) {
+			t.Errorf("covering(%s) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
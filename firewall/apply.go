@@ -0,0 +1,239 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Weight of the first rule; each following rule gets the next weight, so
+// that every rule is unique within the sublayer.
+const firstRuleWeight = 10
+
+// RuleSpec is a validated rule, ready to be applied.
+type RuleSpec struct {
+	Action    string         // "permit" or "block".
+	Direction string         // "outbound" (the default if empty) or "inbound".
+	Network   netip.Prefix   // IPv4 network, as given by the user, or an address of Host.
+	Range     AddressRange   // Set instead of Network for a range that is not a single prefix.
+	Host      string         // Set instead of Network for a hostname, see HostRules.
+	Except    []netip.Prefix // Networks carved out of Network, see ExpandExceptions.
+	Weight    uint8
+	Group     string       // Named group, empty for none.
+	Meta      RuleMetadata // Stored with the filter; name, group and action are filled in when it is added.
+
+	// Further conditions of the filter: protocols and remote ports, and
+	// remote addresses OR'd with Network (see Condition). A rule without
+	// Network, Range and Host matches Ethernet frames, by their conditions
+	// alone, see frame.
+	Conditions []Condition
+}
+
+// OnError tells Apply what to do with the rules already added when one fails.
+type OnError string
+
+const (
+	OnErrorAbort    OnError = "abort"    // Roll back every rule of the batch.
+	OnErrorContinue OnError = "continue" // Keep what was added and go on with the rest.
+)
+
+func ParseOnError(s string) (OnError, error) {
+	switch p := OnError(s); p {
+	case OnErrorAbort, OnErrorContinue:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid on-error policy %q: must be abort or continue", s)
+}
+
+/*
+ * ParseRuleSpecs validates every CIDR and assigns weights, without touching
+ * WFP. All invalid inputs are reported at once, so that nothing is applied
+ * until the whole command line is known to be good. Networks are anything
+ * ParseAddress accepts; one may be followed by "except" and a comma-separated
+ * list of networks carved out of it. A MAC address gives a rule on the
+ * Ethernet frames of that peer. Anything else that is a hostname gives a
+ * rule with Host set, to be resolved by HostRules:
+ *
+ *	10.0.0.0/8 except 10.1.0.0/16,10.2.3.0/24 192.168.0.0/16 updates.vendor.example 00:15:5d:01:02:03
+ */
+func ParseRuleSpecs(action, group string, networks []string) ([]RuleSpec, error) {
+	if action != "permit" && action != "block" {
+		return nil, fmt.Errorf("invalid action %q: must be permit or block", action)
+	}
+	if group != "" {
+		if err := ValidateGroupName(group); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []error
+	var specs []RuleSpec
+	valid := true // The last CIDR was valid, so that its exceptions can be checked.
+	for i := 0; i < len(networks); i++ {
+		if networks[i] == "except" {
+			if i == 0 || networks[i-1] == "except" || i+1 == len(networks) {
+				errs = append(errs, fmt.Errorf("argument %d: except must come between a CIDR and a list of CIDRs", i+1))
+				continue
+			}
+			i++
+			if !valid {
+				continue
+			}
+			spec := &specs[len(specs)-1]
+			if spec.Host != "" {
+				errs = append(errs, fmt.Errorf("argument %d: except cannot follow a hostname", i))
+				continue
+			}
+			if spec.Range.IsValid() {
+				errs = append(errs, fmt.Errorf("argument %d: except cannot follow a range", i))
+				continue
+			}
+			if spec.frame() {
+				errs = append(errs, fmt.Errorf("argument %d: except cannot follow a MAC address", i))
+				continue
+			}
+			if len(spec.Except) > 0 {
+				errs = append(errs, fmt.Errorf("argument %d: %s already has exceptions, give them all in one comma-separated list", i+1, spec.Network))
+				continue
+			}
+			except, err := ParseExcept(spec.Network, strings.Split(networks[i], ","))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("argument %d: %w", i+1, err))
+				continue
+			}
+			spec.Except = except
+			continue
+		}
+
+		spec := RuleSpec{Action: action, Weight: uint8(min(firstRuleWeight+len(specs), 0xff)), Group: group}
+		var err error
+		if spec.Network, spec.Range, err = ParseAddress(networks[i]); err != nil {
+			if mac, macErr := ParseMAC(networks[i]); macErr == nil {
+				spec.Conditions, err = []Condition{RemoteMAC(mac)}, nil
+			} else if host, hostErr := ParseHostname(networks[i]); hostErr == nil {
+				spec.Host, err = host, nil
+			}
+		}
+		if valid = err == nil; !valid {
+			errs = append(errs, fmt.Errorf("argument %d: %w", i+1, err))
+			specs = append(specs, RuleSpec{})
+			continue
+		}
+		specs = append(specs, spec)
+	}
+	if len(specs) > 0xff-firstRuleWeight+1 {
+		errs = append(errs, fmt.Errorf("too many CIDRs: at most %d are supported", 0xff-firstRuleWeight+1))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return specs, nil
+}
+
+// ApplyResult is the outcome of one rule of a batch.
+type ApplyResult struct {
+	Spec RuleSpec
+	Rule RuleInfo // Set when the rule was added.
+	Err  error    // Set when the rule failed.
+}
+
+// ApplySummary is the outcome of a whole batch.
+type ApplySummary struct {
+	Results    []ApplyResult
+	Applied    int  // Rules in place once Apply returns.
+	Failed     int  // Rules that could not be added.
+	Replaced   int  // Rules of the replaced group that were deleted.
+	Removed    int  // Rules deleted by ID, see Engine.Update.
+	RolledBack bool // Rules that were added have been removed again, and replaced ones restored.
+}
+
+/*
+ * apply adds specs within a single transaction. When a rule fails, the abort
+ * policy aborts the transaction, so no rule of the batch is left in place; the
+ * continue policy keeps going and commits the rules that were added. With
+ * replaceGroup set, the current rules of that group are deleted first, in the
+ * same transaction, so that with the abort policy a failure leaves the group
+ * as it was. The filters with the IDs in remove are deleted in the same way.
+ * The returned error is only about the transaction itself: per-rule failures
+ * are in the summary.
+ */
+func apply(session Session, baseObjects *baseObjects, specs []RuleSpec, policy OnError, replaceGroup string, remove []uint64) (*ApplySummary, error) {
+	summary := &ApplySummary{Results: make([]ApplyResult, 0, len(specs))}
+
+	err := session.BeginTransaction()
+	if err != nil {
+		return summary, err
+	}
+
+	if replaceGroup != "" {
+		err := replaceGroupRules(session, baseObjects, replaceGroup, summary)
+		if err != nil {
+			if abortErr := session.AbortTransaction(); abortErr != nil {
+				logger.Warn("failed to abort transaction", ErrAttr(abortErr))
+			}
+			summary.RolledBack = true
+			return summary, err
+		}
+	}
+	for _, id := range remove {
+		if err := deleteFilter(session, id); err != nil {
+			if abortErr := session.AbortTransaction(); abortErr != nil {
+				logger.Warn("failed to abort transaction", ErrAttr(abortErr))
+			}
+			summary.RolledBack = true
+			return summary, err
+		}
+		summary.Removed++
+	}
+
+	for _, spec := range specs {
+		rule, err := addCIDRFilter(session, baseObjects, spec, false)
+		summary.Results = append(summary.Results, ApplyResult{Spec: spec, Rule: rule, Err: err})
+		if err != nil {
+			summary.Failed++
+			if policy == OnErrorAbort {
+				break
+			}
+		}
+	}
+
+	if summary.Failed > 0 && policy == OnErrorAbort {
+		err = session.AbortTransaction()
+		if err != nil {
+			return summary, err
+		}
+		summary.RolledBack = true
+		logger.Debug("transaction aborted", "rules", len(summary.Results)-summary.Failed)
+		return summary, nil
+	}
+
+	err = session.CommitTransaction()
+	if err != nil {
+		summary.RolledBack = true
+		return summary, err
+	}
+	summary.Applied = len(summary.Results) - summary.Failed
+	logger.Debug("transaction committed", "rules", summary.Applied)
+
+	return summary, nil
+}
+
+// replaceGroupRules deletes the current rules of group, within the
+// transaction of apply.
+func replaceGroupRules(session Session, baseObjects *baseObjects, group string, summary *ApplySummary) error {
+	rules, err := listRules(session, baseObjects)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.Group != group {
+			continue
+		}
+		if err := deleteFilter(session, rule.FilterID); err != nil {
+			return err
+		}
+		summary.Replaced++
+	}
+	return nil
+}
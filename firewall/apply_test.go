@@ -0,0 +1,104 @@
+package firewall
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+)
+
+// applySpecs returns three block rules of group, the second of which the
+// engine rejects: a MAC address is not a field of the ALE layers.
+func applySpecs(group string) []RuleSpec {
+	specs := make([]RuleSpec, 3)
+	for i := range specs {
+		specs[i] = RuleSpec{
+			Action:  "block",
+			Network: netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i), 0, 0}), 16),
+			Weight:  firstRuleWeight + uint8(i),
+			Group:   group,
+		}
+	}
+	specs[1].Conditions = []Condition{RemoteMAC([6]byte{2, 0, 0, 0, 0, 1})}
+	return specs
+}
+
+func TestApplyOnError(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("abort", func(t *testing.T) {
+		backend := NewMemoryBackend()
+		engine := openMemoryEngine(t, backend)
+		old, err := engine.AddRule(ctx, Rule{Action: ActionBlock, Group: "g", Conditions: []Condition{RemoteAddress(netip.MustParsePrefix("192.0.2.0/24"))}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		summary, err := apply(engine.session, engine.baseObjects, applySpecs("g"), OnErrorAbort, "g", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !summary.RolledBack || summary.Applied != 0 || summary.Failed != 1 {
+			t.Errorf("summary = %+v, want rolled back with 1 failure", summary)
+		}
+		// The rules after the failing one are not tried.
+		if len(summary.Results) != 2 || summary.Results[0].Err != nil || !hasCode(summary.Results[1].Err, FWP_E_CONDITION_NOT_FOUND) {
+			t.Errorf("results = %+v, want the second failing with FWP_E_CONDITION_NOT_FOUND", summary.Results)
+		}
+		// The replaced group is back as it was.
+		if filters := backend.Filters(); len(filters) != 1 || filters[0].ID != old.ID {
+			t.Errorf("filters = %v, want only %d", filters, old.ID)
+		}
+	})
+
+	t.Run("continue", func(t *testing.T) {
+		backend := NewMemoryBackend()
+		engine := openMemoryEngine(t, backend)
+		if _, err := engine.AddRule(ctx, Rule{Action: ActionBlock, Group: "g", Conditions: []Condition{RemoteAddress(netip.MustParsePrefix("192.0.2.0/24"))}}); err != nil {
+			t.Fatal(err)
+		}
+
+		summary, err := apply(engine.session, engine.baseObjects, applySpecs("g"), OnErrorContinue, "g", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary.RolledBack || summary.Applied != 2 || summary.Failed != 1 || summary.Replaced != 1 {
+			t.Errorf("summary = %+v, want 2 applied, 1 failed and 1 replaced", summary)
+		}
+		if len(summary.Results) != 3 || summary.Results[1].Err == nil || summary.Results[2].Err != nil {
+			t.Errorf("results = %+v, want only the second failing", summary.Results)
+		}
+		filters := backend.Filters()
+		if len(filters) != 2 {
+			t.Fatalf("filters = %v, want 2", filters)
+		}
+		for i, f := range filters {
+			if want := summary.Results[2*i].Rule.FilterID; f.ID != want {
+				t.Errorf("filter %d = %d, want %d", i, f.ID, want)
+			}
+		}
+	})
+}
+
+func TestParseRuleSpecsExcept(t *testing.T) {
+	specs, err := ParseRuleSpecs("block", "", []string{"10.0.0.0/8", "except", "10.1.0.0/16,10.2.0.0/16", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 2 || specs[0].String() != "block 10.0.0.0/8 except 10.1.0.0/16,10.2.0.0/16" || specs[1].String() != "block 192.168.0.0/16" {
+		t.Errorf("ParseRuleSpecs = %v", specs)
+	}
+
+	for _, args := range [][]string{
+		// A second list would otherwise replace the first one.
+		{"10.0.0.0/8", "except", "10.1.0.0/16", "except", "10.2.0.0/16"},
+		{"except", "10.1.0.0/16"},
+		{"10.0.0.0/8", "except"},
+		{"10.0.0.0/8", "except", "192.168.0.0/16"},
+		{"10.0.0.1-10.0.0.77", "except", "10.0.0.8/29"},
+		{"updates.example", "except", "10.0.0.0/8"},
+	} {
+		if specs, err := ParseRuleSpecs("block", "", args); err == nil {
+			t.Errorf("ParseRuleSpecs(%q) = %v, want an error", args, specs)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package firewall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+ * Audit mode evaluates block rules without enforcing them. WFP has no way to
+ * add a filter that matches but does not act: FWPM_FILTER_FLAG_DISABLED can
+ * only be set by the engine itself, and non-terminating actions need a callout
+ * driver. So no filter is added for an audit rule. Instead, the connections
+ * that WFP allowed are reported through classify-allow net events and matched
+ * against the audit rules here, in user mode. Every match is recorded as
+ * "would have been blocked by rule X".
+ *
+ * Audit rules are limited to what an allow event tells reliably: the remote
+ * IPv4 address of an outbound connection. They have no protocol, port or
+ * other conditions, and there are none for inbound traffic, IPv6, hostnames,
+ * Ethernet frames or policy files; the CLI rejects those with -audit.
+ */
+
+// Upper bound of distinct remote addresses and apps kept per rule, so a report
+// accumulated over weeks stays small. Further values are counted as "other".
+const auditMaxDistinct = 256
+
+// AuditRule is a block rule that is evaluated but not enforced.
+type AuditRule struct {
+	Name    string
+	Network netip.Prefix
+	Weight  uint8  // Weight the filter would have had; the highest matching weight wins.
+	Layer   string // Name of the WFP layer the filter would have lived in.
+}
+
+func NewAuditRule(weight uint8, network string) (AuditRule, error) {
+	ipNet, err := ParseCIDR(network)
+	if err != nil {
+		return AuditRule{}, err
+	}
+	return AuditRule{
+		Name:    fmt.Sprintf("Block traffic to %s", network),
+		Network: ipNet,
+		Weight:  weight,
+		Layer:   "ALE_AUTH_CONNECT_V4",
+	}, nil
+}
+
+// Match reports whether an event is one the rule would have blocked.
+func (r AuditRule) Match(ev DropEvent) bool {
+	return ev.Direction == "outbound" && ev.RemoteAddr.Is4() && r.Network.Contains(ev.RemoteAddr)
+}
+
+/*
+ * Auditor matches classify-allow events against audit rules, logs every would-be
+ * block and records it in a report.
+ */
+type Auditor struct {
+	Rules  []AuditRule
+	Report *AuditReport
+	Logger *slog.Logger
+}
+
+func (a *Auditor) HandleNetEvent(ev NetEvent) {
+	if ev.Type != NetEventClassifyAllow {
+		return
+	}
+	d := DecodeNetEvent(ev)
+	if d.Time.IsZero() {
+		d.Time = time.Now().UTC()
+	}
+
+	var winner *AuditRule
+	for i := range a.Rules {
+		rule := &a.Rules[i]
+		if rule.Match(d) && (winner == nil || rule.Weight > winner.Weight) {
+			winner = rule
+		}
+	}
+	if winner == nil {
+		return
+	}
+
+	a.Report.Record(*winner, d)
+	a.Logger.LogAttrs(context.Background(), slog.LevelWarn, "would have been blocked",
+		slog.String("rule", winner.Name),
+		slog.String("cidr", winner.Network.String()),
+		slog.String("layer", winner.Layer),
+		slog.Time("event_time", d.Time),
+		slog.Int("protocol", int(d.Protocol)),
+		slog.String("remote", netip.AddrPortFrom(d.RemoteAddr, d.RemotePort).String()),
+		slog.String("app_id", d.AppID),
+	)
+}
+
+// AuditReport accumulates audit hits. It is stored as JSON so it can be carried
+// across restarts of the program for the whole audit period.
+type AuditReport struct {
+	mu    sync.Mutex
+	Since time.Time                  `json:"since"`
+	Until time.Time                  `json:"until"`
+	Rules map[string]*AuditRuleStats `json:"rules"`
+}
+
+type AuditRuleStats struct {
+	Rule      string            `json:"rule"`
+	CIDR      string            `json:"cidr"`
+	Hits      uint64            `json:"hits"`
+	FirstSeen time.Time         `json:"first_seen,omitzero"`
+	LastSeen  time.Time         `json:"last_seen,omitzero"`
+	Remotes   map[string]uint64 `json:"remotes"`
+	Apps      map[string]uint64 `json:"apps"`
+}
+
+func NewAuditReport() *AuditReport {
+	now := time.Now().UTC()
+	return &AuditReport{
+		Since: now,
+		Until: now,
+		Rules: make(map[string]*AuditRuleStats),
+	}
+}
+
+// LoadAuditReport reads a report saved by Save, or starts a new one if path
+// does not exist yet.
+func LoadAuditReport(path string) (*AuditReport, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NewAuditReport(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := NewAuditReport()
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if r.Rules == nil {
+		r.Rules = make(map[string]*AuditRuleStats)
+	}
+	return r, nil
+}
+
+// Save writes the report to path, replacing the previous one atomically.
+func (r *AuditReport) Save(path string) error {
+	r.mu.Lock()
+	r.Until = time.Now().UTC()
+	data, err := json.MarshalIndent(r, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Track makes sure a rule shows up in the report even if it never matches,
+// which is the outcome that makes a rule safe to enforce.
+func (r *AuditReport) Track(rule AuditRule) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats(rule)
+}
+
+func (r *AuditReport) Record(rule AuditRule, ev DropEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.stats(rule)
+	s.Hits++
+	if s.FirstSeen.IsZero() || ev.Time.Before(s.FirstSeen) {
+		s.FirstSeen = ev.Time
+	}
+	if ev.Time.After(s.LastSeen) {
+		s.LastSeen = ev.Time
+	}
+	countDistinct(s.Remotes, ev.RemoteAddr.String())
+	if ev.AppID != "" {
+		countDistinct(s.Apps, ev.AppID)
+	}
+	if ev.Time.After(r.Until) {
+		r.Until = ev.Time
+	}
+}
+
+func (r *AuditReport) stats(rule AuditRule) *AuditRuleStats {
+	s, ok := r.Rules[rule.Name]
+	if !ok {
+		s = &AuditRuleStats{
+			Rule: rule.Name,
+			CIDR: rule.Network.String(),
+		}
+		r.Rules[rule.Name] = s
+	}
+	if s.Remotes == nil {
+		s.Remotes = make(map[string]uint64)
+	}
+	if s.Apps == nil {
+		s.Apps = make(map[string]uint64)
+	}
+	return s
+}
+
+func countDistinct(m map[string]uint64, key string) {
+	if _, ok := m[key]; !ok && len(m) >= auditMaxDistinct {
+		key = "other"
+	}
+	m[key]++
+}
+
+// WriteSummary prints a human-readable summary of the report: how often each
+// rule would have blocked traffic, and the top remote addresses and apps.
+func (r *AuditReport) WriteSummary(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.Rules))
+	for name := range r.Rules {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := r.Rules[names[i]], r.Rules[names[j]]
+		if a.Hits != b.Hits {
+			return a.Hits > b.Hits
+		}
+		return a.Rule < b.Rule
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Audit period: %s - %s (%s)\n\n", r.Since.Format(time.RFC3339), r.Until.Format(time.RFC3339), r.Until.Sub(r.Since).Round(time.Minute))
+	fmt.Fprintln(tw, "RULE\tCIDR\tWOULD BLOCK\tFIRST SEEN\tLAST SEEN\tTOP REMOTES\tTOP APPS")
+	for _, name := range names {
+		s := r.Rules[name]
+		first, last := "-", "-"
+		if s.Hits > 0 {
+			first = s.FirstSeen.Format(time.RFC3339)
+			last = s.LastSeen.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", s.Rule, s.CIDR, s.Hits, first, last, topCounts(s.Remotes, 3), topCounts(s.Apps, 3))
+	}
+	return tw.Flush()
+}
+
+func topCounts(m map[string]uint64, n int) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]] != m[keys[j]] {
+			return m[keys[i]] > m[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	out := ""
+	for i, k := range keys {
+		if i > 0 {
+			out += ", "
+		}
+		out += fmt.Sprintf("%s (%d)", k, m[k])
+	}
+	if out == "" {
+		out = "-"
+	}
+	return out
+}
@@ -0,0 +1,178 @@
+package firewall
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+/*
+ * A Backend is a filter engine that sessions can be opened on: WFP itself on
+ * Windows, or the in-memory emulator of NewMemoryBackend anywhere. Everything
+ * above it (rules, groups, transactions, metadata) only deals with the objects
+ * below, which carry what the FWPM_* structures do without their memory
+ * layout, so that it can run, and be tested, on any platform.
+ */
+type Backend interface {
+	Open(config SessionConfig) (Session, error)
+}
+
+// SessionConfig is the FWPM_SESSION0 of a session, and the machine it is
+// opened on.
+type SessionConfig struct {
+	Name       string
+	Dynamic    bool          // Objects added by the session are deleted when it is closed.
+	TxnTimeout time.Duration // How long to wait for the transaction lock; 0 waits forever.
+	Remote     Remote
+}
+
+/*
+ * Session is an open session with a Backend. Its methods mirror the Fwpm*
+ * functions of the same name, and fail with an *Error carrying the FWP_E_*
+ * code WFP would return.
+ */
+type Session interface {
+	AddProvider(provider *Provider) error
+	AddSublayer(sublayer *Sublayer) error
+	AddFilter(filter *Filter) (uint64, error)
+	DeleteFilter(id uint64) error
+	// Filters returns the filters of provider in layer.
+	Filters(provider GUID, layer string) ([]Filter, error)
+
+	// SetProviderSecurity, SetSublayerSecurity and SetFilterSecurity
+	// replace the owner, group and DACL of an object by those of sd.
+	SetProviderSecurity(key GUID, sd SecurityDescriptor) error
+	SetSublayerSecurity(key GUID, sd SecurityDescriptor) error
+	SetFilterSecurity(key GUID, sd SecurityDescriptor) error
+
+	BeginTransaction() error
+	CommitTransaction() error
+	AbortTransaction() error
+
+	// SubscribeNetEvents turns on net event collection, and classify-allow
+	// events too if allow is set, then subscribes to them.
+	SubscribeNetEvents(allow bool) (NetEventSource, error)
+	// SubscribeFilterChanges subscribes to the additions and deletions of
+	// the filters of provider, whichever session makes them.
+	SubscribeFilterChanges(provider GUID) (FilterChangeSource, error)
+
+	Close() error
+}
+
+// GUID has the layout of the Windows GUID, so that the two convert to each
+// other.
+type GUID struct {
+	Data1 uint32
+	Data2 uint16
+	Data3 uint16
+	Data4 [8]byte
+}
+
+// NewGUID returns a random (version 4) GUID.
+func NewGUID() (GUID, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return GUID{}, err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	g := GUID{
+		Data1: uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]),
+		Data2: uint16(b[4])<<8 | uint16(b[5]),
+		Data3: uint16(b[6])<<8 | uint16(b[7]),
+	}
+	copy(g.Data4[:], b[8:])
+	return g, nil
+}
+
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+// String formats g like windows.GUID does, e.g.
+// "{B75A2369-C9F3-4340-B9DA-C698A06388A1}".
+func (g GUID) String() string {
+	return fmt.Sprintf("{%08X-%04X-%04X-%02X%02X-%02X%02X%02X%02X%02X%02X}",
+		g.Data1, g.Data2, g.Data3, g.Data4[0], g.Data4[1],
+		g.Data4[2], g.Data4[3], g.Data4[4], g.Data4[5], g.Data4[6], g.Data4[7])
+}
+
+// Provider is an FWPM_PROVIDER0.
+type Provider struct {
+	Key         GUID
+	Name        string
+	Description string
+	Persistent  bool
+
+	SecurityDescriptor SecurityDescriptor // Nil for the default one.
+}
+
+// Sublayer is an FWPM_SUBLAYER0.
+type Sublayer struct {
+	Key         GUID
+	Provider    GUID // Zero for none.
+	Name        string
+	Description string
+	Weight      uint16
+	Persistent  bool
+
+	SecurityDescriptor SecurityDescriptor // Nil for the default one.
+}
+
+// Filter is an FWPM_FILTER0.
+type Filter struct {
+	ID           uint64 // Assigned by the engine when the filter is added.
+	Key          GUID   // Generated by the engine if zero.
+	Name         string
+	Description  string
+	Provider     GUID
+	ProviderData []byte
+	Layer        string // e.g. "ALE_AUTH_CONNECT_V4".
+	Sublayer     GUID
+	Weight       uint8 // Rank within the sublayer, sent to WFP as a 64-bit weight with the rank in its high byte.
+	Conditions   []Condition
+	Action       Action
+	HardAction   bool // FWPM_FILTER_FLAG_CLEAR_ACTION_RIGHT: lower-weight sublayers cannot override the action.
+	Persistent   bool
+
+	SecurityDescriptor SecurityDescriptor // Nil for the default one.
+}
+
+// Layers filters can be added to.
+var knownLayers = []string{
+	"ALE_AUTH_CONNECT_V4",
+	"ALE_AUTH_CONNECT_V6",
+	"ALE_AUTH_RECV_ACCEPT_V4",
+	"ALE_AUTH_RECV_ACCEPT_V6",
+	"INBOUND_MAC_FRAME_ETHERNET",
+	"OUTBOUND_MAC_FRAME_ETHERNET",
+}
+
+var (
+	aleFields   = []ConditionField{FieldRemoteAddress, FieldLocalAddress, FieldLocalInterface, FieldProtocol, FieldRemotePort, FieldFlags, FieldApp}
+	frameFields = []ConditionField{FieldLocalMAC, FieldRemoteMAC, FieldEtherType, FieldL2Flags}
+)
+
+/*
+ * layerFields gives the fields of the conditions of each known layer, as
+ * listed by
+ * https://learn.microsoft.com/en-us/windows/win32/fwp/filtering-condition-identifiers-:
+ * the ALE layers see connections, the MAC frame layers Ethernet frames.
+ */
+var layerFields = map[string][]ConditionField{
+	"ALE_AUTH_CONNECT_V4":         aleFields,
+	"ALE_AUTH_CONNECT_V6":         aleFields,
+	"ALE_AUTH_RECV_ACCEPT_V4":     aleFields,
+	"ALE_AUTH_RECV_ACCEPT_V6":     aleFields,
+	"INBOUND_MAC_FRAME_ETHERNET":  frameFields,
+	"OUTBOUND_MAC_FRAME_ETHERNET": frameFields,
+}
+
+func isKnownLayer(layer string) bool {
+	for _, known := range knownLayers {
+		if layer == known {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package firewall
+
+// There is no WFP engine outside Windows: Open needs WithBackend.
+func defaultBackend() Backend {
+	return nil
+}
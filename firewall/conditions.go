@@ -0,0 +1,824 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Rules match a remote address, and optionally protocols and remote ports,
+ * compiled into a single filter: WFP ORs the conditions of a filter on the
+ * same field and ANDs the fields, so "tcp to port 80 or 443 of 10.0.0.0/8 or
+ * 192.168.0.0/16" is one filter of five conditions rather than four filters.
+ * The conditions other than remote addresses are called the constraints of a
+ * rule here. Rules on Ethernet frames match MAC addresses, EtherTypes and
+ * L2 flags instead, and have nothing but constraints.
+ */
+
+// ParseConstraints parses comma-separated protocols ("tcp,udp"), remote
+// ports ("80,443", or ranges such as "1024-65535") and other conditions in
+// the syntax of ParseCondition into conditions. Any may be empty. Whether
+// they fit the layer of a rule is checked by RuleSpec.Validate.
+func ParseConstraints(protocols, ports string, matches ...string) ([]Condition, error) {
+	var conditions []Condition
+	if protocols != "" {
+		parsed, err := ParseCondition(FieldProtocol.String() + "=" + protocols)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, parsed...)
+	}
+	if ports != "" {
+		parsed, err := ParseCondition(FieldRemotePort.String() + "=" + ports)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, parsed...)
+	}
+	for _, s := range matches {
+		parsed, err := ParseCondition(s)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, parsed...)
+	}
+	if err := validateConstraints(conditions); err != nil {
+		return nil, err
+	}
+	return conditions, nil
+}
+
+/*
+ * ParseCondition parses conditions written as String writes them, a field,
+ * an operator and comma-separated values, one condition each:
+ *
+ *	remote_address!=10.0.0.0/8     not within 10.0.0.0/8
+ *	protocol=tcp,udp               TCP or UDP
+ *	remote_port=1024-65535         a range of ports
+ *	remote_port!=53                any port but 53
+ *	flags&=loopback+ipsec-secured  all of these flags set; |= any, !|= none
+ *	app=C:\Tools\curl.exe          the application; ^= under a directory, !^= not
+ *	local_address=10.50.0.0/16     from a local address, written as remote ones
+ *	local_interface=Ethernet 2     through an interface, see ParseInterface
+ *	remote_mac=00:15:5d:01:02:03   Ethernet frames to or from a peer; local_mac for this machine
+ *	ether_type=arp,0x88cc          Ethernet frames of an EtherType, by name or number
+ *	l2_flags|=vm2vm                Ethernet frames between virtual machines; !|= the others
+ *
+ * The value of app is a single path, commas included.
+ */
+func ParseCondition(s string) ([]Condition, error) {
+	end := strings.IndexFunc(s, func(r rune) bool { return !(r >= 'a' && r <= 'z' || r == '_') })
+	if end < 0 {
+		end = len(s)
+	}
+	name, rest := s[:end], s[end:]
+	var field ConditionField
+	for f := range fieldMatches {
+		if f.String() == name {
+			field = f
+		}
+	}
+	if field == 0 {
+		return nil, fmt.Errorf("invalid condition %q: unknown field %q", s, name)
+	}
+	eq := strings.IndexByte(rest, '=')
+	if eq < 0 {
+		return nil, fmt.Errorf("invalid condition %q: must be FIELD OPERATOR VALUE, e.g. remote_port!=53", s)
+	}
+	operator, values := rest[:eq+1], rest[eq+1:]
+	match, known := MatchEqual, false
+	for m := MatchEqual; m <= MatchFlagsNoneSet; m++ {
+		if m != MatchRange && m.operator() == operator {
+			match, known = m, true
+		}
+	}
+	if !known {
+		return nil, fmt.Errorf("invalid condition %q: unknown operator %q", s, operator)
+	}
+	if values == "" {
+		return nil, fmt.Errorf("invalid condition %q: no value", s)
+	}
+
+	list := strings.Split(values, ",")
+	if field == FieldApp {
+		list = []string{values}
+	}
+	conditions := make([]Condition, 0, len(list))
+	for _, value := range list {
+		c, err := parseConditionValue(field, match, strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition %q: %w", s, err)
+		}
+		if err := validateCondition(c); err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
+
+// parseConditionValue parses the value of one condition; with the operator
+// "=", a range of addresses, protocols, ports or EtherTypes makes it a
+// MatchRange condition.
+func parseConditionValue(field ConditionField, match MatchType, value string) (Condition, error) {
+	c := Condition{Field: field, Match: match}
+	first, last, isRange := strings.Cut(value, "-")
+	if field != FieldProtocol && field != FieldRemotePort && field != FieldEtherType || !isRange {
+		first, last = value, ""
+	} else if match == MatchEqual {
+		c.Match = MatchRange
+	}
+	switch field {
+	case FieldRemoteAddress, FieldLocalAddress:
+		prefix, addrs, err := ParseAddress(value)
+		if err != nil {
+			return Condition{}, err
+		}
+		c.Network, c.Range = prefix, addrs
+		if addrs.IsValid() && match == MatchEqual {
+			c.Match = MatchRange
+		}
+	case FieldProtocol:
+		protocol, err := ParseProtocol(first)
+		if err != nil {
+			return Condition{}, err
+		}
+		c.Protocol = protocol
+		if last != "" {
+			to, err := ParseProtocol(last)
+			if err != nil {
+				return Condition{}, err
+			}
+			c.To = uint32(to)
+		}
+	case FieldRemotePort:
+		for i, s := range []string{first, last} {
+			if i == 1 && s == "" {
+				break
+			}
+			port, err := strconv.ParseUint(s, 10, 16)
+			if err != nil || port == 0 {
+				return Condition{}, fmt.Errorf("invalid port %q: must be a number from 1 to 65535", s)
+			}
+			if i == 0 {
+				c.Port = uint16(port)
+			} else {
+				c.To = uint32(port)
+			}
+		}
+	case FieldFlags:
+		flags, err := ParseFlags(value)
+		if err != nil {
+			return Condition{}, err
+		}
+		c.Flags = flags
+	case FieldL2Flags:
+		flags, err := ParseL2Flags(value)
+		if err != nil {
+			return Condition{}, err
+		}
+		c.Flags = flags
+	case FieldApp:
+		c.App = value
+	case FieldLocalInterface:
+		luid, err := ParseInterface(value)
+		if err != nil {
+			return Condition{}, err
+		}
+		c.Interface = luid
+	case FieldLocalMAC, FieldRemoteMAC:
+		mac, err := ParseMAC(value)
+		if err != nil {
+			return Condition{}, err
+		}
+		c.MAC = mac
+	case FieldEtherType:
+		for i, s := range []string{first, last} {
+			if i == 1 && s == "" {
+				break
+			}
+			etherType, err := ParseEtherType(s)
+			if err != nil {
+				return Condition{}, err
+			}
+			if i == 0 {
+				c.EtherType = etherType
+			} else {
+				c.To = uint32(etherType)
+			}
+		}
+	}
+	return c, nil
+}
+
+// ParseMAC parses a 48-bit MAC address, e.g. "00:15:5d:01:02:03" or
+// "00-15-5D-01-02-03".
+func ParseMAC(s string) ([6]byte, error) {
+	hw, err := net.ParseMAC(s)
+	if err != nil || len(hw) != 6 {
+		return [6]byte{}, fmt.Errorf("invalid MAC address %q: must be six bytes such as 00:15:5d:01:02:03", s)
+	}
+	return [6]byte(hw), nil
+}
+
+// EtherTypes of FieldEtherType.
+const (
+	EtherTypeIPv4 uint16 = 0x0800
+	EtherTypeARP  uint16 = 0x0806
+	EtherTypeVLAN uint16 = 0x8100
+	EtherTypeIPv6 uint16 = 0x86dd
+	EtherTypeLLDP uint16 = 0x88cc
+)
+
+var etherTypeNames = map[uint16]string{
+	EtherTypeIPv4: "ipv4",
+	EtherTypeARP:  "arp",
+	EtherTypeVLAN: "vlan",
+	EtherTypeIPv6: "ipv6",
+	EtherTypeLLDP: "lldp",
+}
+
+// EtherTypeName returns the name of an EtherType, or its number in hex.
+func EtherTypeName(etherType uint16) string {
+	if name, ok := etherTypeNames[etherType]; ok {
+		return name
+	}
+	return fmt.Sprintf("%#04x", etherType)
+}
+
+// ParseEtherType parses an EtherType name ("ipv4", "arp", "vlan", "ipv6",
+// "lldp") or number, e.g. 0x88e5.
+func ParseEtherType(s string) (uint16, error) {
+	for etherType, name := range etherTypeNames {
+		if strings.EqualFold(s, name) {
+			return etherType, nil
+		}
+	}
+	n, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid EtherType %q: must be ipv4, arp, vlan, ipv6, lldp or a number such as 0x88e5", s)
+	}
+	return uint16(n), nil
+}
+
+// ParseVM2VM returns the condition of a VM-to-VM mode: "only" matches the
+// Ethernet frames between virtual machines, "exclude" the others.
+func ParseVM2VM(mode string) (Condition, error) {
+	switch mode {
+	case "only":
+		return VM2VM(), nil
+	case "exclude":
+		c, _ := Not(VM2VM())
+		return c, nil
+	}
+	return Condition{}, fmt.Errorf("invalid VM-to-VM mode %q: must be only or exclude", mode)
+}
+
+// Flags of FieldFlags, the FWP_CONDITION_FLAG values of fwpmtypes.h.
+const (
+	FlagLoopback             uint32 = 0x00000001
+	FlagIPsecSecured         uint32 = 0x00000002
+	FlagReauthorize          uint32 = 0x00000004
+	FlagWildcardBind         uint32 = 0x00000008
+	FlagRawEndpoint          uint32 = 0x00000010
+	FlagImplicitBind         uint32 = 0x00000200
+	FlagNameAppSpecified     uint32 = 0x00004000
+	FlagPromiscuous          uint32 = 0x00008000
+	FlagAuthFirewall         uint32 = 0x00010000
+	FlagReclassify           uint32 = 0x00020000
+	FlagConnectionRedirected uint32 = 0x00100000
+)
+
+// flagName is the name of a flag in conditions, e.g. "loopback".
+type flagName struct {
+	flag uint32
+	name string
+}
+
+var flagNames = []flagName{
+	{FlagLoopback, "loopback"},
+	{FlagIPsecSecured, "ipsec-secured"},
+	{FlagReauthorize, "reauthorize"},
+	{FlagWildcardBind, "wildcard-bind"},
+	{FlagRawEndpoint, "raw-endpoint"},
+	{FlagImplicitBind, "implicit-bind"},
+	{FlagNameAppSpecified, "name-app-specified"},
+	{FlagPromiscuous, "promiscuous"},
+	{FlagAuthFirewall, "auth-firewall"},
+	{FlagReclassify, "reclassify"},
+	{FlagConnectionRedirected, "connection-redirected"},
+}
+
+// Flags of FieldL2Flags, the FWP_CONDITION_L2 values of fwpmtypes.h.
+const (
+	L2FlagNativeEthernet     uint32 = 0x00000001
+	L2FlagWiFi               uint32 = 0x00000002
+	L2FlagMobileBroadband    uint32 = 0x00000004
+	L2FlagWiFiDirectData     uint32 = 0x00000008
+	L2FlagVM2VM              uint32 = 0x00000010 // Between virtual machines of a Hyper-V switch.
+	L2FlagMalformedPacket    uint32 = 0x00000020
+	L2FlagIPFragmentGroup    uint32 = 0x00000040
+	L2FlagIfConnectorPresent uint32 = 0x00000080
+)
+
+var l2FlagNames = []flagName{
+	{L2FlagNativeEthernet, "native-ethernet"},
+	{L2FlagWiFi, "wifi"},
+	{L2FlagMobileBroadband, "mobile-broadband"},
+	{L2FlagWiFiDirectData, "wifi-direct-data"},
+	{L2FlagVM2VM, "vm2vm"},
+	{L2FlagMalformedPacket, "malformed-packet"},
+	{L2FlagIPFragmentGroup, "ip-fragment-group"},
+	{L2FlagIfConnectorPresent, "if-connector-present"},
+}
+
+// FlagsString writes flags as their names joined by "+", e.g.
+// "loopback+ipsec-secured", and those without a name as a number.
+func FlagsString(flags uint32) string {
+	return formatFlags(flagNames, flags)
+}
+
+// L2FlagsString writes L2 flags as FlagsString writes flags, e.g. "vm2vm".
+func L2FlagsString(flags uint32) string {
+	return formatFlags(l2FlagNames, flags)
+}
+
+func formatFlags(flagNames []flagName, flags uint32) string {
+	var names []string
+	for _, f := range flagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+			flags &^= f.flag
+		}
+	}
+	if flags != 0 || len(names) == 0 {
+		names = append(names, fmt.Sprintf("%#x", flags))
+	}
+	return strings.Join(names, "+")
+}
+
+// ParseFlags parses flags written as FlagsString writes them.
+func ParseFlags(s string) (uint32, error) {
+	return parseFlags(flagNames, s)
+}
+
+// ParseL2Flags parses L2 flags written as L2FlagsString writes them.
+func ParseL2Flags(s string) (uint32, error) {
+	return parseFlags(l2FlagNames, s)
+}
+
+func parseFlags(flagNames []flagName, s string) (uint32, error) {
+	var flags uint32
+	for _, name := range strings.Split(s, "+") {
+		known := false
+		for _, f := range flagNames {
+			if strings.EqualFold(f.name, name) {
+				flags, known = flags|f.flag, true
+			}
+		}
+		if known {
+			continue
+		}
+		n, err := strconv.ParseUint(name, 0, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid flag %q: must be a name such as %s, or a number", name, flagNames[0].name)
+		}
+		flags |= uint32(n)
+	}
+	return flags, nil
+}
+
+/*
+ * Data types of the fields, which tell the match types WFP accepts for them
+ * (https://learn.microsoft.com/en-us/windows/win32/api/fwptypes/ne-fwptypes-fwp_match_type):
+ * addresses, FWP_V4_ADDR_MASK and FWP_V6_ADDR_MASK, are compared for
+ * equality or with ranges; unsigned integers also bit by bit with flags; byte
+ * blobs for equality or by prefix. Interfaces, FWP_UINT64 identifiers, are
+ * only compared for equality: WFP would take ranges and flags, which mean
+ * nothing for a LUID. The same goes for protocols and ports, FWP_UINT8 and
+ * FWP_UINT16 numbers, and EtherTypes, FWP_UINT16 codes, that are compared
+ * with values and ranges only, and MAC addresses, FWP_BYTE_ARRAY6, for
+ * equality.
+ */
+var fieldMatches = map[ConditionField][]MatchType{
+	FieldRemoteAddress:  {MatchEqual, MatchNotEqual, MatchRange},
+	FieldLocalAddress:   {MatchEqual, MatchNotEqual, MatchRange},
+	FieldLocalInterface: {MatchEqual, MatchNotEqual},
+	FieldProtocol:       {MatchEqual, MatchNotEqual, MatchRange},
+	FieldRemotePort:     {MatchEqual, MatchNotEqual, MatchRange},
+	FieldFlags:          {MatchEqual, MatchNotEqual, MatchRange, MatchFlagsAllSet, MatchFlagsAnySet, MatchFlagsNoneSet},
+	FieldL2Flags:        {MatchEqual, MatchNotEqual, MatchRange, MatchFlagsAllSet, MatchFlagsAnySet, MatchFlagsNoneSet},
+	FieldApp:            {MatchEqual, MatchNotEqual, MatchPrefix, MatchNotPrefix},
+	FieldLocalMAC:       {MatchEqual, MatchNotEqual},
+	FieldRemoteMAC:      {MatchEqual, MatchNotEqual},
+	FieldEtherType:      {MatchEqual, MatchNotEqual, MatchRange},
+}
+
+// Largest value of the unsigned integer fields.
+var fieldMax = map[ConditionField]uint32{FieldProtocol: 0xff, FieldRemotePort: 0xffff, FieldFlags: 0xffffffff, FieldL2Flags: 0xffffffff, FieldEtherType: 0xffff}
+
+// validateCondition checks that c has a match type its field accepts, and a
+// value for it.
+func validateCondition(c Condition) error {
+	matches, ok := fieldMatches[c.Field]
+	if !ok {
+		return fmt.Errorf("unsupported condition %s: %w", c, ErrNotSupported)
+	}
+	if !slices.Contains(matches, c.Match) {
+		return fmt.Errorf("condition %s: %s does not accept the match type %s: %w", c, c.Field, c.Match, ErrInvalidCondition)
+	}
+	switch c.Field {
+	case FieldRemoteAddress, FieldLocalAddress:
+		if c.Range.IsValid() != (c.Match == MatchRange) {
+			return fmt.Errorf("condition %s: a range of addresses needs the match type range, and only it: %w", c, ErrInvalidCondition)
+		}
+		if !c.Range.IsValid() && (!c.Network.IsValid() || c.Network.Addr().Is4In6()) {
+			return fmt.Errorf("invalid network %s", c.Network)
+		}
+	case FieldApp:
+		if c.App == "" {
+			return fmt.Errorf("condition %s: no application: %w", c, ErrInvalidCondition)
+		}
+	case FieldLocalInterface:
+		if c.Interface == 0 {
+			return fmt.Errorf("condition %s: no interface: %w", c, ErrInvalidCondition)
+		}
+	case FieldLocalMAC, FieldRemoteMAC:
+		if c.MAC == [6]byte{} {
+			return fmt.Errorf("condition %s: no MAC address: %w", c, ErrInvalidCondition)
+		}
+	default:
+		if c.Match == MatchRange && (c.To < c.number() || c.To > fieldMax[c.Field]) {
+			return fmt.Errorf("condition %s: invalid range: %w", c, ErrInvalidCondition)
+		}
+		if c.Match >= MatchFlagsAllSet && c.number() == 0 {
+			return fmt.Errorf("condition %s: no flags: %w", c, ErrInvalidCondition)
+		}
+	}
+	return nil
+}
+
+// number returns the value of a condition on an unsigned integer field.
+func (c Condition) number() uint32 {
+	switch c.Field {
+	case FieldProtocol:
+		return uint32(c.Protocol)
+	case FieldRemotePort:
+		return uint32(c.Port)
+	case FieldEtherType:
+		return uint32(c.EtherType)
+	}
+	return c.Flags
+}
+
+// setNumber sets the value of a condition on an unsigned integer field.
+func (c *Condition) setNumber(n uint32) {
+	switch c.Field {
+	case FieldProtocol:
+		c.Protocol = uint8(n)
+	case FieldRemotePort:
+		c.Port = uint16(n)
+	case FieldEtherType:
+		c.EtherType = uint16(n)
+	default:
+		c.Flags = n
+	}
+}
+
+// isAddress reports whether c selects remote addresses, rather than
+// excluding some.
+func (c Condition) isAddress() bool {
+	return c.Field == FieldRemoteAddress && !c.Match.negated()
+}
+
+/*
+ * validateConstraints checks every condition, and that ports are only
+ * matched for TCP and UDP: WFP compares the remote port field of ICMP with
+ * the ICMP code, so a port condition without a protocol would match ICMP
+ * codes too.
+ */
+func validateConstraints(conditions []Condition) error {
+	var ports, transport, other bool
+	for _, c := range conditions {
+		if err := validateCondition(c); err != nil {
+			return err
+		}
+		switch c.Field {
+		case FieldProtocol:
+			if c.Match == MatchEqual && (c.Protocol == 6 || c.Protocol == 17) {
+				transport = true
+			} else {
+				other = true
+			}
+		case FieldRemotePort:
+			ports = true
+		}
+	}
+	if ports && (!transport || other) {
+		return fmt.Errorf("remote ports need the protocols to be tcp or udp")
+	}
+	return nil
+}
+
+/*
+ * conditionsSpec converts the conditions of a rule to a spec: the first
+ * remote address it selects becomes its Network or Range, the other
+ * conditions are kept as they are. A rule must match remote addresses: one
+ * that only excludes some, such as remote_address!=10.0.0.0/8, matches every
+ * other address of their family. Without any, a rule with conditions on
+ * Ethernet frames is a rule on frames, all conditions kept.
+ */
+func conditionsSpec(conditions []Condition) (RuleSpec, error) {
+	var spec RuleSpec
+	primary := slices.IndexFunc(conditions, Condition.isAddress)
+	if primary < 0 && slices.ContainsFunc(conditions, Condition.isFrame) &&
+		!slices.ContainsFunc(conditions, func(c Condition) bool { return c.Field == FieldRemoteAddress }) {
+		spec.Conditions = slices.Clone(conditions)
+		if err := spec.Validate(); err != nil {
+			return RuleSpec{}, err
+		}
+		return spec, nil
+	}
+	if primary < 0 {
+		negated := slices.IndexFunc(conditions, func(c Condition) bool { return c.Field == FieldRemoteAddress })
+		if negated < 0 {
+			return RuleSpec{}, fmt.Errorf("a remote address or Ethernet frame condition is required: %w", ErrNotSupported)
+		}
+		all := netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+		if conditions[negated].Network.Addr().Is6() {
+			all = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+		}
+		conditions = append([]Condition{RemoteAddress(all)}, conditions...)
+		primary = 0
+	}
+	for i, c := range conditions {
+		if (c.Field == FieldRemoteAddress || c.Field == FieldLocalAddress) && c.Range.IsValid() {
+			c.Network = netip.Prefix{}
+			if c.Match == MatchEqual {
+				c.Match = MatchRange
+			}
+		}
+		if i == primary {
+			if err := validateCondition(c); err != nil {
+				return RuleSpec{}, err
+			}
+			spec.Network, spec.Range = c.Network, c.Range
+			continue
+		}
+		spec.Conditions = append(spec.Conditions, c)
+	}
+	if err := spec.Validate(); err != nil {
+		return RuleSpec{}, err
+	}
+	// A filter is in the layer of one address family, see addCIDRFilter.
+	v6 := !spec.Range.IsValid() && spec.Network.Addr().Is6()
+	for _, c := range spec.Conditions {
+		if (c.Field == FieldRemoteAddress || c.Field == FieldLocalAddress) && (!c.Range.IsValid() && c.Network.Addr().Is6()) != v6 {
+			return RuleSpec{}, fmt.Errorf("condition %s: the addresses of a rule must all be IPv4 or all IPv6: %w", c, ErrInvalidCondition)
+		}
+	}
+	return spec, nil
+}
+
+/*
+ * Validate checks the direction and conditions of s, and that every
+ * condition is on a field of its layer (see layerFields): a rule on
+ * connections cannot match MAC addresses, nor a rule on Ethernet frames
+ * ports or applications.
+ */
+func (s RuleSpec) Validate() error {
+	if s.Direction != "" && s.Direction != "outbound" && s.Direction != "inbound" {
+		return fmt.Errorf("invalid direction %q: must be outbound or inbound", s.Direction)
+	}
+	if s.frame() && len(s.Conditions) == 0 {
+		return fmt.Errorf("a rule needs a network, a hostname or a MAC address")
+	}
+	layer := s.layer()
+	for _, c := range s.Conditions {
+		if slices.Contains(layerFields[layer], c.Field) {
+			continue
+		}
+		if s.frame() {
+			return fmt.Errorf("condition %s: rules on Ethernet frames (layer %s) only match MAC addresses, EtherTypes and L2 flags: %w", c, layer, ErrInvalidCondition)
+		}
+		return fmt.Errorf("condition %s: rules on IP addresses (layer %s) cannot match Ethernet frames: %w", c, layer, ErrInvalidCondition)
+	}
+	return validateConstraints(s.Conditions)
+}
+
+// isFrame reports whether c is on a field of Ethernet frames.
+func (c Condition) isFrame() bool {
+	switch c.Field {
+	case FieldLocalMAC, FieldRemoteMAC, FieldEtherType, FieldL2Flags:
+		return true
+	}
+	return false
+}
+
+// frame reports whether s is a rule on Ethernet frames: it has no address
+// nor hostname, only conditions.
+func (s RuleSpec) frame() bool {
+	return !s.Network.IsValid() && !s.Range.IsValid() && s.Host == ""
+}
+
+func (s RuleSpec) inbound() bool {
+	return s.Direction == "inbound"
+}
+
+// conditions returns every condition of the filter of s, its address first.
+func (s RuleSpec) conditions() []Condition {
+	if s.frame() {
+		return s.Conditions
+	}
+	return append([]Condition{s.condition()}, s.Conditions...)
+}
+
+// constraints returns the conditions of s other than the remote addresses it
+// selects.
+func (s RuleSpec) constraints() []Condition {
+	var constraints []Condition
+	for _, c := range s.Conditions {
+		if !c.isAddress() {
+			constraints = append(constraints, c)
+		}
+	}
+	return constraints
+}
+
+// constraintKey identifies the constraints of s, whatever their order, and
+// its direction if inbound, e.g. "inbound protocol=tcp".
+func (s RuleSpec) constraintKey() string {
+	if s.inbound() {
+		return strings.TrimSpace("inbound " + conditionsKey(s.constraints()))
+	}
+	return conditionsKey(s.constraints())
+}
+
+// conditionsKey identifies a set of conditions, whatever their order.
+func conditionsKey(conditions []Condition) string {
+	values := make([]string, 0, len(conditions))
+	for _, c := range conditions {
+		values = append(values, c.String())
+	}
+	slices.Sort(values)
+	return strings.Join(slices.Compact(values), " ")
+}
+
+// fieldValues groups conditions by field, in the order the fields first
+// appear.
+func fieldValues(conditions []Condition) ([]ConditionField, map[ConditionField][]Condition) {
+	var fields []ConditionField
+	byField := make(map[ConditionField][]Condition)
+	for _, c := range conditions {
+		if _, ok := byField[c.Field]; !ok {
+			fields = append(fields, c.Field)
+		}
+		byField[c.Field] = append(byField[c.Field], c)
+	}
+	return fields, byField
+}
+
+/*
+ * valueSpans returns the values conditions on an unsigned integer field
+ * match, as ranges in order, and false if some condition is of another match
+ * type than MatchEqual and MatchRange, whose values are not worked out.
+ */
+func valueSpans(conditions []Condition) ([]span, bool) {
+	spans := make([]span, 0, len(conditions))
+	for _, c := range conditions {
+		if _, ok := fieldMax[c.Field]; !ok {
+			return nil, false
+		}
+		switch c.Match {
+		case MatchEqual:
+			spans = append(spans, span{c.number(), c.number()})
+		case MatchRange:
+			spans = append(spans, span{c.number(), c.To})
+		default:
+			return nil, false
+		}
+	}
+	return mergeRanges(spans), true
+}
+
+/*
+ * constraintsOverlap reports whether some traffic can match the constraints
+ * of both a and b: they are of the same direction and, on every field both
+ * constrain, some value of one is a value of the other. Fields with
+ * conditions other than values and ranges, such as negated ones, are taken
+ * to overlap.
+ */
+func constraintsOverlap(a, b RuleSpec) bool {
+	if a.inbound() != b.inbound() {
+		return false
+	}
+	_, av := fieldValues(a.constraints())
+	_, bv := fieldValues(b.constraints())
+	for field, values := range av {
+		others, ok := bv[field]
+		if !ok {
+			continue
+		}
+		as, aok := valueSpans(values)
+		bs, bok := valueSpans(others)
+		if !aok || !bok {
+			continue
+		}
+		if !slices.ContainsFunc(as, func(r span) bool {
+			return slices.ContainsFunc(bs, func(o span) bool { return r.first <= o.last && o.first <= r.last })
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * constraintsCover reports whether all the traffic matching the constraints
+ * of b matches those of a: they are of the same direction and every field a
+ * constrains, b constrains to values of a. Fields with conditions other than
+ * values and ranges are only taken to be covered by the same conditions.
+ */
+func constraintsCover(a, b RuleSpec) bool {
+	if a.inbound() != b.inbound() {
+		return false
+	}
+	_, av := fieldValues(a.constraints())
+	_, bv := fieldValues(b.constraints())
+	for field, values := range av {
+		others, ok := bv[field]
+		if !ok {
+			return false
+		}
+		as, aok := valueSpans(values)
+		bs, bok := valueSpans(others)
+		if !aok || !bok {
+			if conditionsKey(values) != conditionsKey(others) {
+				return false
+			}
+			continue
+		}
+		for _, o := range bs {
+			if !slices.ContainsFunc(as, func(r span) bool { return r.first <= o.first && o.last <= r.last }) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/*
+ * formatConditions describes conditions the way WFP combines them, one field
+ * and operator at a time with its values comma-separated, e.g.
+ * "remote_address=10.0.0.0/8 protocol=tcp remote_port=80,443", in the syntax
+ * of ParseCondition.
+ */
+func formatConditions(conditions []Condition) string {
+	var keys []string
+	values := make(map[string][]string)
+	for _, c := range conditions {
+		key := c.Field.String() + c.Match.operator()
+		if c.Field == FieldApp {
+			key += c.App // Paths may hold commas: one application each.
+		}
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = append(values[key], c.value())
+	}
+	s := make([]string, len(keys))
+	for i, key := range keys {
+		field, _, _ := strings.Cut(key, "=")
+		s[i] = field + "=" + strings.Join(slices.Compact(values[key]), ",")
+	}
+	return strings.Join(s, " ")
+}
+
+// addressesString returns the remote addresses conditions select,
+// comma-separated.
+func addressesString(conditions []Condition) string {
+	var addrs []string
+	for _, c := range conditions {
+		if c.isAddress() {
+			addrs = append(addrs, c.value())
+		}
+	}
+	return strings.Join(addrs, ",")
+}
+
+// Constraints describes the conditions of the filter other than the remote
+// addresses it selects, e.g. "protocol=tcp remote_port=80,443"; empty for
+// none.
+func (r RuleInfo) Constraints() string {
+	var constraints []Condition
+	for _, c := range r.Conditions {
+		if !c.isAddress() {
+			constraints = append(constraints, c)
+		}
+	}
+	return formatConditions(constraints)
+}
@@ -0,0 +1,273 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseConditionMatchTypes(t *testing.T) {
+	tests := []struct {
+		in string
+		ok bool
+	}{
+		{"protocol=6", true},
+		{"protocol!=17", true},
+		{"protocol=6-17", true},
+		{"remote_port=1024-65535", true},
+		{"remote_port!=53,123", true},
+		{"flags&=loopback", true},
+		{"flags!|=loopback", true},
+
+		// Protocols and ports are numbers, not bit fields.
+		{"protocol&=6", false},
+		{"protocol|=6", false},
+		{"protocol!|=6", false},
+		{"remote_port&=443", false},
+		{"remote_port|=443", false},
+		{"remote_port!|=443", false},
+	}
+	for _, tt := range tests {
+		_, err := ParseCondition(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseCondition(%q) = %v, want ok %v", tt.in, err, tt.ok)
+		}
+	}
+}
+
+func TestParseConstraints(t *testing.T) {
+	tests := []struct {
+		protocols, ports string
+		matches          []string
+		want             string // The conditions formatted.
+		err              bool
+	}{
+		{"tcp,udp", "80,443", nil, "protocol=tcp,udp remote_port=80,443", false},
+		{"tcp", "1024-65535,53", nil, "protocol=tcp remote_port=1024-65535,53", false},
+		{"", "", []string{"protocol=udp", "remote_port!=53,123", "flags&=loopback"}, "protocol=udp remote_port!=53,123 flags&=loopback", false},
+		{"tcp", "", []string{"protocol=udp", "remote_port=22"}, "protocol=tcp,udp remote_port=22", false},
+		{"", "", []string{`app=C:\a,b.exe`, `app=C:\c.exe`}, `app=C:\a,b.exe app=C:\c.exe`, false},
+		{"", "", nil, "", false},
+
+		// Ports need TCP or UDP, and only them.
+		{"", "80", nil, "", true},
+		{"tcp,icmp", "80", nil, "", true},
+		{"tcp", "", []string{"protocol!=17", "remote_port=80"}, "", true},
+		{"tcp", "65536", nil, "", true},
+		{"tcp", "443-80", nil, "", true},
+		{"nosuchproto", "", nil, "", true},
+	}
+	for _, tt := range tests {
+		conditions, err := ParseConstraints(tt.protocols, tt.ports, tt.matches...)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseConstraints(%q, %q, %q) = %v, want an error", tt.protocols, tt.ports, tt.matches, conditions)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseConstraints(%q, %q, %q): %v", tt.protocols, tt.ports, tt.matches, err)
+			continue
+		}
+		got := formatConditions(conditions)
+		if got != tt.want {
+			t.Errorf("ParseConstraints(%q, %q, %q) = %s, want %s", tt.protocols, tt.ports, tt.matches, got, tt.want)
+		}
+
+		// What formatConditions writes parses back to the same conditions.
+		var parsed []Condition
+		for _, word := range strings.Fields(got) {
+			c, err := ParseCondition(word)
+			if err != nil {
+				t.Fatalf("ParseCondition(%q): %v", word, err)
+			}
+			parsed = append(parsed, c...)
+		}
+		if !slices.EqualFunc(parsed, conditions, func(a, b Condition) bool { return a.String() == b.String() }) {
+			t.Errorf("%s parses back to %v, want %v", got, parsed, conditions)
+		}
+	}
+}
+
+// The constraints of a rule are ORed within a field, in a single filter.
+func TestConstraintsSingleFilter(t *testing.T) {
+	backend := NewMemoryBackend()
+	engine := openMemoryEngine(t, backend)
+	constraints, err := ParseConstraints("tcp,udp", "80,443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := blockRule("10.0.0.0/8")
+	rule.Conditions = append(rule.Conditions, RemoteAddress(netip.MustParsePrefix("192.168.0.0/16")))
+	rule.Conditions = append(rule.Conditions, constraints...)
+	if _, err := engine.AddRule(context.Background(), rule); err != nil {
+		t.Fatal(err)
+	}
+
+	filters := backend.Filters()
+	if len(filters) != 1 {
+		t.Fatalf("%d filters, want 1", len(filters))
+	}
+	if got, want := formatConditions(filters[0].Conditions), "remote_address=10.0.0.0/8,192.168.0.0/16 protocol=tcp,udp remote_port=80,443"; got != want {
+		t.Errorf("filter conditions = %s, want %s", got, want)
+	}
+	for _, tt := range []struct {
+		remote   string
+		protocol uint8
+		port     uint16
+		want     Action
+	}{
+		{"10.1.2.3", 6, 80, ActionBlock},
+		{"192.168.1.1", 17, 443, ActionBlock},
+		{"192.168.1.1", 6, 22, ActionPermit},
+		{"10.1.2.3", 1, 0, ActionPermit},
+		{"172.16.0.1", 6, 443, ActionPermit},
+	} {
+		conn := Connection{Direction: "outbound", Protocol: tt.protocol, RemoteAddr: netip.MustParseAddr(tt.remote), RemotePort: tt.port}
+		if d := decide(backend.Sublayers(), filters, conn); d.Verdict != tt.want {
+			t.Errorf("%s: %s, want %s", conn, d.Verdict, tt.want)
+		}
+	}
+}
+
+func TestRuleSpecValidateLayers(t *testing.T) {
+	mac := RemoteMAC([6]byte{0x00, 0x15, 0x5d, 0x01, 0x02, 0x03})
+	frame := func(direction string, conditions ...Condition) RuleSpec {
+		return RuleSpec{Action: "block", Direction: direction, Conditions: conditions}
+	}
+	network := func(direction string, conditions ...Condition) RuleSpec {
+		spec := aggSpec("block", "10.0.0.0/8", firstRuleWeight, conditions...)
+		spec.Direction = direction
+		return spec
+	}
+	tests := []struct {
+		name string
+		spec RuleSpec
+		ok   bool
+	}{
+		{"MAC address of a frame", frame("", mac), true},
+		{"EtherType and L2 flags of an inbound frame", frame("inbound", EtherType(EtherTypeARP), L2Flags(MatchFlagsAnySet, L2FlagVM2VM)), true},
+		{"local MAC of a frame", frame("", LocalMAC([6]byte{2, 0, 0, 0, 0, 1})), true},
+		{"protocol and ports of a network", network("", Protocol(6), RemotePort(443)), true},
+		{"frame without conditions", frame(""), false},
+
+		// IP fields are not on the MAC_FRAME_ETHERNET layers.
+		{"protocol of a frame", frame("", mac, Protocol(6)), false},
+		{"local address of an inbound frame", frame("inbound", mac, LocalAddress(netip.MustParsePrefix("10.0.0.0/8"))), false},
+		{"remote address of a frame", frame("", EtherType(EtherTypeIPv4), RemoteAddress(netip.MustParsePrefix("10.0.0.0/8"))), false},
+		{"application of a frame", frame("", mac, App(`C:\a.exe`)), false},
+
+		// Nor are the Ethernet fields on the ALE layers.
+		{"MAC address of a network", network("", mac), false},
+		{"EtherType of an inbound network", network("inbound", EtherType(EtherTypeARP)), false},
+		{"L2 flags of a network", network("", L2Flags(MatchFlagsAnySet, L2FlagVM2VM)), false},
+	}
+	for _, tt := range tests {
+		err := tt.spec.Validate()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Validate = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if err != nil && len(tt.spec.Conditions) > 0 && !errors.Is(err, ErrInvalidCondition) {
+			t.Errorf("%s: Validate = %v, want %v", tt.name, err, ErrInvalidCondition)
+		}
+	}
+}
+
+func TestParseMAC(t *testing.T) {
+	want := [6]byte{0x00, 0x15, 0x5d, 0x01, 0x02, 0x03}
+	for _, s := range []string{"00:15:5d:01:02:03", "00-15-5D-01-02-03", "0015.5d01.0203"} {
+		if got, err := ParseMAC(s); err != nil || got != want {
+			t.Errorf("ParseMAC(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	// Only 48-bit addresses.
+	for _, s := range []string{"", "00:15:5d:01:02", "00:15:5d:01:02:03:04:05", "00:15:5d:01:02:0g", "10.0.0.1"} {
+		if got, err := ParseMAC(s); err == nil {
+			t.Errorf("ParseMAC(%q) = %v, want an error", s, got)
+		}
+	}
+
+	conditions, err := ParseCondition("remote_mac=00:15:5d:01:02:03,02-00-00-00-00-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conditions) != 2 || conditions[0].MAC != want || conditions[1].MAC != [6]byte{2, 0, 0, 0, 0, 1} {
+		t.Errorf("ParseCondition = %v", conditions)
+	}
+}
+
+func TestParseVM2VM(t *testing.T) {
+	tests := []struct {
+		mode string
+		want string // The condition, empty for an error.
+	}{
+		{"only", "l2_flags|=vm2vm"},
+		{"exclude", "l2_flags!|=vm2vm"},
+		{"", ""},
+		{"Only", ""},
+		{"include", ""},
+		{"vm2vm", ""},
+	}
+	for _, tt := range tests {
+		c, err := ParseVM2VM(tt.mode)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("ParseVM2VM(%q) = %v, want an error", tt.mode, c)
+		case tt.want != "" && (err != nil || c.String() != tt.want):
+			t.Errorf("ParseVM2VM(%q) = %v, %v; want %s", tt.mode, c, err, tt.want)
+		}
+	}
+	if c, _ := ParseVM2VM("only"); c != VM2VM() {
+		t.Errorf("ParseVM2VM(only) = %#v, want VM2VM()", c)
+	}
+}
+
+// The rules of -vm2vm, alone or with a MAC address, as a dry run lists them.
+func TestVM2VMRules(t *testing.T) {
+	ctx := context.Background()
+	engine := openMemoryEngine(t, NewMemoryBackend())
+	only, err := ParseVM2VM("only")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exclude, err := ParseVM2VM("exclude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	specs, err := ParseRuleSpecs("block", "", []string{"00:15:5d:01:02:03"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	specs[0].Conditions = append(specs[0].Conditions, exclude)
+	specs = append(specs, RuleSpec{Action: "block", Direction: "inbound", Conditions: []Condition{only}})
+
+	batch := make([]Rule, len(specs))
+	for i, spec := range specs {
+		if err := spec.Validate(); err != nil {
+			t.Fatalf("Validate(%s): %v", spec, err)
+		}
+		batch[i] = spec.Rule()
+	}
+	if _, err := engine.Apply(ctx, batch, OnErrorAbort); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := engine.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rule := range rules {
+		info := rule.Info()
+		got = append(got, info.Layer+" "+info.Constraints())
+	}
+	want := []string{
+		"OUTBOUND_MAC_FRAME_ETHERNET remote_mac=00:15:5d:01:02:03 l2_flags!|=vm2vm",
+		"INBOUND_MAC_FRAME_ETHERNET l2_flags|=vm2vm",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("rules = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,309 @@
+package firewall
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+/*
+ * Resolver gives the addresses of a hostname, IPv4 and IPv6, and how long
+ * they may be kept before asking again. HostRules takes any Resolver, so
+ * that it can be pointed at a given DNS server, or at a stand-in one.
+ */
+type Resolver interface {
+	Resolve(ctx context.Context, host string) ([]netip.Addr, time.Duration, error)
+}
+
+// Time to live given to the answers of the system resolver, which does not
+// tell the one of the records.
+const defaultSystemTTL = 5 * time.Minute
+
+// SystemResolver resolves through the resolver of the operating system,
+// including the hosts file, with a fixed time to live.
+type SystemResolver struct {
+	TTL time.Duration // 0 for defaultSystemTTL.
+}
+
+func (r SystemResolver) Resolve(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+	ttl := r.TTL
+	if ttl == 0 {
+		ttl = defaultSystemTTL
+	}
+	return addrs, ttl, nil
+}
+
+// Time a DNSResolver waits for each answer by default.
+const defaultDNSTimeout = 5 * time.Second
+
+/*
+ * DNSResolver queries a DNS server directly, for the A and AAAA records of a
+ * hostname, and returns the smallest TTL of the answers. Queries go over UDP,
+ * and again over TCP when the answer is truncated (RFC 1035, section 4.2).
+ * The server must be recursive, as the resolvers of a network are.
+ */
+type DNSResolver struct {
+	Server  string        // HOST:PORT, e.g. "10.0.0.53:53".
+	Timeout time.Duration // For each query; 0 for defaultDNSTimeout.
+}
+
+// DNS record types and response codes, https://www.iana.org/assignments/dns-parameters
+const (
+	dnsTypeA       = 1
+	dnsTypeAAAA    = 28
+	dnsClassIN     = 1
+	dnsRcodeNXName = 3
+)
+
+// DNS header flags.
+const (
+	dnsFlagResponse  = 1 << 15
+	dnsFlagTruncated = 1 << 9
+	dnsFlagRecursion = 1 << 8
+)
+
+var errNXDomain = errors.New("no such host")
+
+/*
+ * Resolve fails unless both queries succeed, so that an address family is
+ * never taken to have no addresses left because its query failed. A name
+ * with no records of a type is not an error.
+ */
+func (r DNSResolver) Resolve(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	var addrs []netip.Addr
+	ttl := time.Duration(-1)
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		answers, answerTTL, err := r.query(ctx, host, qtype)
+		if err != nil {
+			return nil, 0, fmt.Errorf("resolve %s: %w", host, err)
+		}
+		addrs = append(addrs, answers...)
+		if answerTTL >= 0 && (ttl < 0 || answerTTL < ttl) {
+			ttl = answerTTL
+		}
+	}
+	return addrs, max(ttl, 0), nil
+}
+
+// query sends one question to the server and returns the addresses of the
+// answer, with the smallest TTL of its records, -1 if it has none.
+func (r DNSResolver) query(ctx context.Context, host string, qtype uint16) ([]netip.Addr, time.Duration, error) {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = defaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	id := uint16(rand.Uint32())
+	msg, err := dnsQuestion(id, host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := exchangeUDP(ctx, r.Server, id, msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	if binary.BigEndian.Uint16(resp[2:])&dnsFlagTruncated != 0 {
+		if resp, err = exchangeTCP(ctx, r.Server, id, msg); err != nil {
+			return nil, 0, err
+		}
+	}
+	return parseDNSAnswer(resp, qtype)
+}
+
+// dnsQuestion builds a query for the records of type qtype of host.
+func dnsQuestion(id uint16, host string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 12+len(host)+6)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], dnsFlagRecursion)
+	binary.BigEndian.PutUint16(msg[4:], 1) // QDCOUNT
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid hostname %q", host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, dnsClassIN), nil
+}
+
+// exchangeUDP sends msg and waits for the response with the same ID,
+// ignoring anything else received meanwhile.
+func exchangeUDP(ctx context.Context, server string, id uint16, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 12 && binary.BigEndian.Uint16(buf) == id {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeTCP sends msg and reads the response, each preceded by its length.
+func exchangeTCP(ctx context.Context, server string, id uint16, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(msg)))); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 || binary.BigEndian.Uint16(resp) != id {
+		return nil, fmt.Errorf("invalid DNS response")
+	}
+	return resp, nil
+}
+
+/*
+ * parseDNSAnswer returns the addresses of type qtype in the answer section of
+ * resp. Every record of the section counts, CNAME ones included, so that the
+ * addresses a recursive server gives at the end of a chain of aliases are
+ * kept no longer than any alias of the chain.
+ */
+func parseDNSAnswer(resp []byte, qtype uint16) ([]netip.Addr, time.Duration, error) {
+	errInvalid := fmt.Errorf("invalid DNS response")
+	flags := binary.BigEndian.Uint16(resp[2:])
+	if flags&dnsFlagResponse == 0 {
+		return nil, 0, errInvalid
+	}
+	switch rcode := flags & 0xf; rcode {
+	case 0:
+	case dnsRcodeNXName:
+		return nil, 0, errNXDomain
+	default:
+		return nil, 0, fmt.Errorf("DNS server failure (rcode %d)", rcode)
+	}
+
+	qdcount, ancount := int(binary.BigEndian.Uint16(resp[4:])), int(binary.BigEndian.Uint16(resp[6:]))
+	off := 12
+	for range qdcount {
+		if off = skipDNSName(resp, off); off < 0 || off+4 > len(resp) {
+			return nil, 0, errInvalid
+		}
+		off += 4 // QTYPE, QCLASS
+	}
+
+	var addrs []netip.Addr
+	ttl := time.Duration(-1)
+	for range ancount {
+		if off = skipDNSName(resp, off); off < 0 || off+10 > len(resp) {
+			return nil, 0, errInvalid
+		}
+		rtype := binary.BigEndian.Uint16(resp[off:])
+		rttl := time.Duration(binary.BigEndian.Uint32(resp[off+4:])) * time.Second
+		rdlen := int(binary.BigEndian.Uint16(resp[off+8:]))
+		off += 10
+		if off+rdlen > len(resp) {
+			return nil, 0, errInvalid
+		}
+		rdata := resp[off : off+rdlen]
+		off += rdlen
+
+		if ttl < 0 || rttl < ttl {
+			ttl = rttl
+		}
+		if rtype != qtype {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(rdata)
+		if !ok || (qtype == dnsTypeA) != addr.Is4() {
+			return nil, 0, errInvalid
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, ttl, nil
+}
+
+// skipDNSName returns the offset after the name at off, -1 if it is cut
+// short. A compression pointer ends the name.
+func skipDNSName(msg []byte, off int) int {
+	for off < len(msg) {
+		switch n := int(msg[off]); {
+		case n == 0:
+			return off + 1
+		case n&0xc0 == 0xc0:
+			if off+2 > len(msg) {
+				return -1
+			}
+			return off + 2
+		default:
+			off += 1 + n
+		}
+	}
+	return -1
+}
+
+/*
+ * ParseHostname checks that s is a DNS hostname, and not a mistyped address:
+ * labels of letters, digits and hyphens, the last one not all digits. It
+ * returns the name in lower case, without a trailing dot.
+ */
+func ParseHostname(s string) (string, error) {
+	host := strings.ToLower(strings.TrimSuffix(s, "."))
+	if host == "" || len(host) > 253 {
+		return "", fmt.Errorf("invalid hostname %q", s)
+	}
+	labels := strings.Split(host, ".")
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", fmt.Errorf("invalid hostname %q", s)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return "", fmt.Errorf("invalid hostname %q", s)
+			}
+		}
+	}
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return "", fmt.Errorf("invalid hostname %q: looks like an address", s)
+	}
+	return host, nil
+}
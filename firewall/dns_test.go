@@ -0,0 +1,265 @@
+package firewall
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const dnsTypeCNAME = 5
+
+type dnsTestRecord struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	data  []byte
+}
+
+func addrRecord(name string, ttl uint32, addr string) dnsTestRecord {
+	a := netip.MustParseAddr(addr)
+	r := dnsTestRecord{name: name, rtype: dnsTypeA, ttl: ttl, data: a.AsSlice()}
+	if a.Is6() {
+		r.rtype = dnsTypeAAAA
+	}
+	return r
+}
+
+func cnameRecord(name string, ttl uint32, target string) dnsTestRecord {
+	return dnsTestRecord{name: name, rtype: dnsTypeCNAME, ttl: ttl, data: dnsTestName(target)}
+}
+
+// dnsTestName encodes name uncompressed.
+func dnsTestName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(name, ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// dnsTestAnswer returns the response to query, with records as its answer
+// section.
+func dnsTestAnswer(query []byte, rcode uint16, truncated bool, records ...dnsTestRecord) []byte {
+	resp := slices.Clone(query)
+	flags := dnsFlagResponse | dnsFlagRecursion | rcode
+	if truncated {
+		flags |= dnsFlagTruncated
+	}
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(records)))
+	for _, r := range records {
+		resp = append(resp, dnsTestName(r.name)...)
+		resp = binary.BigEndian.AppendUint16(resp, r.rtype)
+		resp = binary.BigEndian.AppendUint16(resp, dnsClassIN)
+		resp = binary.BigEndian.AppendUint32(resp, r.ttl)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(r.data)))
+		resp = append(resp, r.data...)
+	}
+	return resp
+}
+
+func TestParseDNSAnswer(t *testing.T) {
+	chain := []dnsTestRecord{
+		cnameRecord("www.example.com", 300, "www.example.net"),
+		cnameRecord("www.example.net", 60, "edge.example.org"),
+		addrRecord("edge.example.org", 120, "192.0.2.1"),
+		addrRecord("edge.example.org", 120, "192.0.2.2"),
+	}
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   uint16
+		records []dnsTestRecord
+		cut     int // Bytes cut off the end of the response.
+		want    []string
+		ttl     time.Duration
+		err     bool
+	}{
+		{name: "address", qtype: dnsTypeA, records: []dnsTestRecord{addrRecord("www.example.com", 30, "192.0.2.1")}, want: []string{"192.0.2.1"}, ttl: 30 * time.Second},
+		{name: "CNAME chain", qtype: dnsTypeA, records: chain, want: []string{"192.0.2.1", "192.0.2.2"}, ttl: 60 * time.Second},
+		{name: "AAAA", qtype: dnsTypeAAAA, records: []dnsTestRecord{cnameRecord("www.example.com", 300, "edge.example.org"), addrRecord("edge.example.org", 600, "2001:db8::1")}, want: []string{"2001:db8::1"}, ttl: 300 * time.Second},
+		{name: "no records", qtype: dnsTypeAAAA, ttl: -1},
+		{name: "NXDOMAIN", qtype: dnsTypeA, rcode: dnsRcodeNXName, err: true},
+		{name: "server failure", qtype: dnsTypeA, rcode: 2, err: true},
+		{name: "cut short", qtype: dnsTypeA, records: chain, cut: 2, err: true},
+		{name: "address of the other type", qtype: dnsTypeA, records: []dnsTestRecord{{name: "www.example.com", rtype: dnsTypeA, ttl: 30, data: netip.MustParseAddr("2001:db8::1").AsSlice()}}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := dnsQuestion(1, "www.example.com", tt.qtype)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := dnsTestAnswer(query, tt.rcode, false, tt.records...)
+			addrs, ttl, err := parseDNSAnswer(resp[:len(resp)-tt.cut], tt.qtype)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parseDNSAnswer = %v, %v, want an error", addrs, ttl)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, addr := range addrs {
+				got = append(got, addr.String())
+			}
+			if !slices.Equal(got, tt.want) || ttl != tt.ttl {
+				t.Errorf("parseDNSAnswer = %v, %v; want %v, %v", got, ttl, tt.want, tt.ttl)
+			}
+		})
+	}
+}
+
+/*
+ * dnsStandIn is a recursive DNS server on 127.0.0.1, over UDP and TCP on the
+ * same port. It answers a question with the records of its name that are
+ * CNAMEs or of the type asked, and NXDOMAIN for a name it does not have.
+ * Over UDP, the answers of the names in truncate are truncated.
+ */
+type dnsStandIn struct {
+	addr     string
+	zone     map[string][]dnsTestRecord
+	truncate map[string]bool
+}
+
+func startDNSStandIn(t *testing.T, zone map[string][]dnsTestRecord, truncate map[string]bool) *dnsStandIn {
+	t.Helper()
+	var pc net.PacketConn
+	var ln net.Listener
+	for range 10 {
+		var err error
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if ln, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+		pc = nil
+	}
+	if pc == nil {
+		t.Fatal("no port free for both UDP and TCP")
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		ln.Close()
+	})
+
+	s := &dnsStandIn{addr: pc.LocalAddr().String(), zone: zone, truncate: truncate}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(s.answer(buf[:n], true), from)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := s.answer(query, false)
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *dnsStandIn) answer(query []byte, udp bool) []byte {
+	var labels []string
+	off := 12
+	for n := int(query[off]); n != 0; n = int(query[off]) {
+		labels = append(labels, string(query[off+1:off+1+n]))
+		off += 1 + n
+	}
+	name := strings.Join(labels, ".")
+	qtype := binary.BigEndian.Uint16(query[off+1:])
+	query = query[:off+5]
+
+	records, ok := s.zone[name]
+	if !ok {
+		return dnsTestAnswer(query, dnsRcodeNXName, false)
+	}
+	if udp && s.truncate[name] {
+		return dnsTestAnswer(query, 0, true)
+	}
+	var answer []dnsTestRecord
+	for _, r := range records {
+		if r.rtype == qtype || r.rtype == dnsTypeCNAME {
+			answer = append(answer, r)
+		}
+	}
+	return dnsTestAnswer(query, 0, false, answer...)
+}
+
+func TestDNSResolver(t *testing.T) {
+	// More addresses than a UDP answer holds.
+	var many []dnsTestRecord
+	for i := range 100 {
+		many = append(many, addrRecord("many.example", 900, netip.AddrFrom4([4]byte{198, 51, 100, byte(i)}).String()))
+	}
+	server := startDNSStandIn(t, map[string][]dnsTestRecord{
+		"www.example": {
+			cnameRecord("www.example", 300, "cdn.example"),
+			cnameRecord("cdn.example", 45, "edge.example"),
+			addrRecord("edge.example", 600, "192.0.2.10"),
+			addrRecord("edge.example", 600, "2001:db8::10"),
+		},
+		"many.example": many,
+		"v4.example":   {addrRecord("v4.example", 120, "192.0.2.20")},
+	}, map[string]bool{"many.example": true})
+	r := DNSResolver{Server: server.addr, Timeout: time.Second}
+	ctx := context.Background()
+
+	addrs, ttl, err := r.Resolve(ctx, "www.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Addr{netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("2001:db8::10")}
+	if !slices.Equal(addrs, want) || ttl != 45*time.Second {
+		t.Errorf("Resolve(CNAME chain) = %v, %v; want %v, 45s", addrs, ttl, want)
+	}
+
+	addrs, ttl, err = r.Resolve(ctx, "many.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != len(many) || ttl != 900*time.Second {
+		t.Errorf("Resolve(truncated) = %d addresses, %v; want %d, 15m0s", len(addrs), ttl, len(many))
+	}
+
+	// A name without AAAA records is not an error.
+	addrs, ttl, err = r.Resolve(ctx, "v4.example")
+	if err != nil || len(addrs) != 1 || ttl != 120*time.Second {
+		t.Errorf("Resolve(IPv4 only) = %v, %v, %v", addrs, ttl, err)
+	}
+
+	if _, _, err := r.Resolve(ctx, "missing.example"); !errors.Is(err, errNXDomain) {
+		t.Errorf("Resolve(missing) = %v, want %v", err, errNXDomain)
+	}
+}
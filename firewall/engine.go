@@ -0,0 +1,787 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * Engine is a session with a WFP filter engine, together with the provider
+ * and sublayers its rules live in. It is the API for programs embedding this
+ * package:
+ *
+ *	engine, err := firewall.Open(ctx, firewall.WithSessionName("my-service"))
+ *	if err != nil { ... }
+ *	defer engine.Close()
+ *	rule, err := engine.AddRule(ctx, firewall.Rule{
+ *		Action:     firewall.ActionBlock,
+ *		Conditions: []firewall.Condition{firewall.RemoteAddress(netip.MustParsePrefix("203.0.113.0/24"))},
+ *	})
+ *
+ * An Engine is safe for concurrent use; calls are serialized, since a WFP
+ * session can only run one transaction at a time.
+ */
+type Engine struct {
+	mu          sync.Mutex
+	session     Session
+	baseObjects *baseObjects
+	closed      bool
+	opts        engineOptions
+}
+
+var ErrClosed = errors.New("engine closed")
+
+type engineOptions struct {
+	name       string
+	timeout    time.Duration
+	persistent bool
+	remote     Remote
+	backend    Backend
+	sd         SecurityDescriptor
+}
+
+// Option configures Open.
+type Option func(*engineOptions)
+
+// WithSessionName sets the name the session, provider and sublayers are
+// shown with by WFP tools. Persistent objects keep the name they were first
+// registered with.
+func WithSessionName(name string) Option {
+	return func(o *engineOptions) { o.name = name }
+}
+
+// WithTimeout bounds how long calls wait for the transaction lock of the
+// engine, held by other sessions, before failing with ErrTimeout. The default
+// is to wait forever.
+func WithTimeout(d time.Duration) Option {
+	return func(o *engineOptions) { o.timeout = d }
+}
+
+// WithPersistence makes rules outlive the Engine, and reboots. Without it,
+// every rule is removed when the Engine is closed or the process exits.
+func WithPersistence() Option {
+	return func(o *engineOptions) { o.persistent = true }
+}
+
+// WithRemote opens the engine of another machine.
+func WithRemote(remote Remote) Option {
+	return func(o *engineOptions) { o.remote = remote }
+}
+
+// WithBackend opens the engine on backend instead of WFP, e.g. on a
+// MemoryBackend in tests.
+func WithBackend(backend Backend) Option {
+	return func(o *engineOptions) { o.backend = backend }
+}
+
+/*
+ * WithSecurityDescriptor gives the provider, the sublayers and every rule
+ * added through the engine the security descriptor sd, e.g. from ParseSDDL,
+ * instead of the default one, which lets any administrator change or delete
+ * them. Persistent objects registered by an earlier run are given it too; see
+ * SetSecurity for their rules.
+ */
+func WithSecurityDescriptor(sd SecurityDescriptor) Option {
+	return func(o *engineOptions) { o.sd = sd }
+}
+
+func Open(ctx context.Context, opts ...Option) (*Engine, error) {
+	o := engineOptions{name: "Custom WFP Rules Generator"}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if o.sd != nil {
+		if err := o.sd.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	backend := o.backend
+	if backend == nil {
+		backend = defaultBackend()
+	}
+	if backend == nil {
+		return nil, fmt.Errorf("no filter engine on %s: %w", runtime.GOOS, ErrNotSupported)
+	}
+
+	session, err := backend.Open(SessionConfig{
+		Name:       o.name,
+		Dynamic:    !o.persistent,
+		TxnTimeout: o.timeout,
+		Remote:     o.remote,
+	})
+	if err != nil {
+		return nil, err
+	}
+	baseObjects, err := registerBaseObjects(session, o.persistent, o.name, o.sd)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return &Engine{session: session, baseObjects: baseObjects, opts: o}, nil
+}
+
+// Close ends the session. Unless the engine is persistent, this removes
+// every rule added through it.
+func (e *Engine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.session.Close()
+}
+
+// Persistent reports whether the rules of the engine outlive it.
+func (e *Engine) Persistent() bool {
+	return e.opts.persistent
+}
+
+// lock serializes calls and checks that the engine can still be used.
+func (e *Engine) lock(ctx context.Context) error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		e.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// AddRule adds rule and returns it as installed, with its ID set.
+func (e *Engine) AddRule(ctx context.Context, rule Rule) (Rule, error) {
+	spec, err := rule.spec()
+	if err != nil {
+		return Rule{}, err
+	}
+	if err := e.lock(ctx); err != nil {
+		return Rule{}, err
+	}
+	defer e.mu.Unlock()
+
+	info, err := addCIDRFilter(e.session, e.baseObjects, spec, false)
+	if err != nil {
+		return Rule{}, err
+	}
+	return ruleFromInfo(info), nil
+}
+
+// RemoveRule deletes the rule with the given ID. Removing a rule that does not
+// exist, or a filter that is not a rule of the engine, fails with ErrNotFound.
+func (e *Engine) RemoveRule(ctx context.Context, id uint64) error {
+	if err := e.lock(ctx); err != nil {
+		return err
+	}
+	defer e.mu.Unlock()
+	if err := checkOwnFilters(e.session, e.baseObjects, []uint64{id}); err != nil {
+		return err
+	}
+	return deleteFilter(e.session, id)
+}
+
+// List returns the rules of the engine as read back from WFP, ordered by ID.
+func (e *Engine) List(ctx context.Context) ([]Rule, error) {
+	if err := e.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer e.mu.Unlock()
+
+	infos, err := listRules(e.session, e.baseObjects)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]Rule, len(infos))
+	for i, info := range infos {
+		rules[i] = ruleFromInfo(info)
+	}
+	return rules, nil
+}
+
+/*
+ * Apply adds rules in a single transaction. When a rule fails, the abort
+ * policy rolls back the whole batch, the continue policy keeps the others; the
+ * returned error is only about the transaction itself, per-rule failures are in
+ * the summary. Rules without a weight get consecutive weights, in order.
+ * Invalid rules are all reported before anything is applied.
+ */
+func (e *Engine) Apply(ctx context.Context, rules []Rule, policy OnError) (*ApplySummary, error) {
+	return e.apply(ctx, rules, policy, "", nil)
+}
+
+// ReplaceGroup replaces the rules of group with rules, in a single
+// transaction. The rules are put in group whatever their Group field.
+func (e *Engine) ReplaceGroup(ctx context.Context, group string, rules []Rule, policy OnError) (*ApplySummary, error) {
+	if err := ValidateGroupName(group); err != nil {
+		return &ApplySummary{}, err
+	}
+	grouped := make([]Rule, len(rules))
+	for i, rule := range rules {
+		rule.Group = group
+		grouped[i] = rule
+	}
+	return e.apply(ctx, grouped, policy, group, nil)
+}
+
+/*
+ * Update deletes the rules with the IDs in remove and adds rules, in a single
+ * transaction, so that traffic never sees the rule set halfway through the
+ * change. With the abort policy, a rule that fails to be added leaves every
+ * rule of remove in place. IDs that are not rules of the engine fail the whole
+ * update with ErrNotFound, before anything is changed.
+ */
+func (e *Engine) Update(ctx context.Context, remove []uint64, rules []Rule, policy OnError) (*ApplySummary, error) {
+	return e.apply(ctx, rules, policy, "", remove)
+}
+
+func (e *Engine) apply(ctx context.Context, rules []Rule, policy OnError, replaceGroup string, remove []uint64) (*ApplySummary, error) {
+	specs, err := ruleSpecs(rules)
+	if err != nil {
+		return &ApplySummary{}, err
+	}
+	if err := e.lock(ctx); err != nil {
+		return &ApplySummary{}, err
+	}
+	defer e.mu.Unlock()
+	if len(remove) > 0 {
+		if err := checkOwnFilters(e.session, e.baseObjects, remove); err != nil {
+			return &ApplySummary{}, err
+		}
+	}
+	return apply(e.session, e.baseObjects, specs, policy, replaceGroup, remove)
+}
+
+func (e *Engine) EnableGroup(ctx context.Context, group string) (int, error) {
+	if err := e.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer e.mu.Unlock()
+	return enableGroup(e.session, e.baseObjects, group)
+}
+
+func (e *Engine) DisableGroup(ctx context.Context, group string) (int, error) {
+	if err := e.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer e.mu.Unlock()
+	return disableGroup(e.session, e.baseObjects, group)
+}
+
+func (e *Engine) DeleteGroup(ctx context.Context, group string) (int, error) {
+	if err := e.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer e.mu.Unlock()
+	return deleteGroup(e.session, e.baseObjects, group)
+}
+
+/*
+ * SetSecurity replaces the security descriptor of every rule of the engine,
+ * its sublayers and its provider by the parts sd has: owner, group or DACL.
+ * It is how rules from earlier runs get a new descriptor, and the break-glass
+ * path for locked-down ones: their owner can always change their DACL, so an
+ * administrator can give them back with
+ *
+ *	sd, _ := firewall.ParseSDDL(firewall.UnlockedSDDL)
+ *	n, err := engine.SetSecurity(ctx, sd)
+ *
+ * and then delete them. It returns how many rules were changed; it goes on
+ * after a failure, and returns them all.
+ */
+func (e *Engine) SetSecurity(ctx context.Context, sd SecurityDescriptor) (int, error) {
+	if err := sd.Validate(); err != nil {
+		return 0, err
+	}
+	if err := e.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer e.mu.Unlock()
+
+	var errs []error
+	changed := 0
+	for _, layer := range knownLayers {
+		filters, err := e.session.Filters(e.baseObjects.provider, layer)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, filter := range filters {
+			if err := e.session.SetFilterSecurity(filter.Key, sd); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			changed++
+		}
+	}
+	for _, sublayer := range []GUID{e.baseObjects.filters, e.baseObjects.disabled} {
+		if err := e.session.SetSublayerSecurity(sublayer, sd); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := e.session.SetProviderSecurity(e.baseObjects.provider, sd); err != nil {
+		errs = append(errs, err)
+	}
+	e.baseObjects.sd = sd
+	return changed, errors.Join(errs...)
+}
+
+/*
+ * SubscribeNetEvents turns on net event collection, and classify-allow events
+ * too if allow is set, then subscribes to them. The source must be closed
+ * before the engine.
+ */
+func (e *Engine) SubscribeNetEvents(ctx context.Context, allow bool) (NetEventSource, error) {
+	if err := e.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer e.mu.Unlock()
+
+	return e.session.SubscribeNetEvents(allow)
+}
+
+// SubscribeFilterChanges subscribes to the additions and deletions of the
+// filters of the provider of the engine, whoever makes them. The source must
+// be closed before the engine.
+func (e *Engine) SubscribeFilterChanges(ctx context.Context) (FilterChangeSource, error) {
+	if err := e.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer e.mu.Unlock()
+
+	return e.session.SubscribeFilterChanges(e.baseObjects.provider)
+}
+
+// Action is what a rule does with the traffic it matches.
+type Action uint8
+
+const (
+	ActionBlock Action = iota + 1
+	ActionPermit
+	// ActionContinue is non-terminating: evaluation goes on with the next
+	// filter. Rules cannot use it.
+	ActionContinue
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionBlock:
+		return "block"
+	case ActionPermit:
+		return "permit"
+	case ActionContinue:
+		return "continue"
+	}
+	return fmt.Sprintf("Action(%d)", uint8(a))
+}
+
+// Terminating reports whether a matching filter with the action decides the
+// verdict of its sublayer.
+func (a Action) Terminating() bool {
+	return a == ActionBlock || a == ActionPermit
+}
+
+func ParseAction(s string) (Action, error) {
+	switch s {
+	case "block":
+		return ActionBlock, nil
+	case "permit":
+		return ActionPermit, nil
+	}
+	return 0, fmt.Errorf("invalid action %q: must be permit or block", s)
+}
+
+// ConditionField is the property of the traffic a Condition tests.
+type ConditionField uint8
+
+const (
+	FieldRemoteAddress ConditionField = iota + 1
+	FieldProtocol
+	FieldRemotePort
+	FieldFlags // FWPM_CONDITION_FLAGS, e.g. FlagLoopback.
+	FieldApp   // The application, FWPM_CONDITION_ALE_APP_ID.
+	FieldLocalAddress
+	FieldLocalInterface // The interface of the local address, by LUID.
+	FieldLocalMAC       // The MAC address of this machine's side of an Ethernet frame.
+	FieldRemoteMAC      // The MAC address of the peer's side of an Ethernet frame.
+	FieldEtherType      // The EtherType of an Ethernet frame, e.g. EtherTypeARP.
+	FieldL2Flags        // FWPM_CONDITION_L2_FLAGS of an Ethernet frame, e.g. L2FlagVM2VM.
+)
+
+func (f ConditionField) String() string {
+	switch f {
+	case FieldRemoteAddress:
+		return "remote_address"
+	case FieldProtocol:
+		return "protocol"
+	case FieldRemotePort:
+		return "remote_port"
+	case FieldFlags:
+		return "flags"
+	case FieldApp:
+		return "app"
+	case FieldLocalAddress:
+		return "local_address"
+	case FieldLocalInterface:
+		return "local_interface"
+	case FieldLocalMAC:
+		return "local_mac"
+	case FieldRemoteMAC:
+		return "remote_mac"
+	case FieldEtherType:
+		return "ether_type"
+	case FieldL2Flags:
+		return "l2_flags"
+	}
+	return fmt.Sprintf("ConditionField(%d)", uint8(f))
+}
+
+/*
+ * MatchType is how a Condition compares a field with its value, as the
+ * FWP_MATCH_TYPE of WFP. A field only accepts the match types of its data
+ * type, see validateCondition.
+ */
+type MatchType uint8
+
+const (
+	MatchEqual        MatchType = iota // The field is the value, or within the network.
+	MatchNotEqual                      // The field is not the value, nor within the network.
+	MatchRange                         // The field is within a range, bounds included.
+	MatchPrefix                        // The field starts with the value.
+	MatchNotPrefix                     // The field does not start with the value.
+	MatchFlagsAllSet                   // Every flag of the value is set in the field.
+	MatchFlagsAnySet                   // Some flag of the value is set in the field.
+	MatchFlagsNoneSet                  // No flag of the value is set in the field.
+)
+
+var matchNames = []string{"equal", "not_equal", "range", "prefix", "not_prefix", "flags_all_set", "flags_any_set", "flags_none_set"}
+
+func (m MatchType) String() string {
+	if int(m) < len(matchNames) {
+		return matchNames[m]
+	}
+	return fmt.Sprintf("MatchType(%d)", uint8(m))
+}
+
+// operator returns how a condition of the match type is written, between
+// the field and the value, e.g. "!=" in "remote_port!=53".
+func (m MatchType) operator() string {
+	switch m {
+	case MatchNotEqual:
+		return "!="
+	case MatchPrefix:
+		return "^="
+	case MatchNotPrefix:
+		return "!^="
+	case MatchFlagsAllSet:
+		return "&="
+	case MatchFlagsAnySet:
+		return "|="
+	case MatchFlagsNoneSet:
+		return "!|="
+	}
+	return "="
+}
+
+// negated reports whether conditions of the match type exclude traffic
+// rather than select it.
+func (m MatchType) negated() bool {
+	return m == MatchNotEqual || m == MatchNotPrefix
+}
+
+/*
+ * Condition is one test a rule applies to the traffic. As in WFP, the
+ * conditions of a rule on the same field are OR'd, and those on different
+ * fields AND'd: remote addresses 10.0.0.0/8 and 192.168.0.0/16 with protocol
+ * tcp and remote ports 80 and 443 match TCP connections to port 80 or 443 of
+ * either network. Negated conditions (MatchNotEqual, MatchNotPrefix) on a
+ * field must all hold instead, since "not 53 or not 123" would match every
+ * port.
+ */
+type Condition struct {
+	Field     ConditionField
+	Match     MatchType    // MatchEqual if zero.
+	Network   netip.Prefix // For FieldRemoteAddress and FieldLocalAddress.
+	Range     AddressRange // For FieldRemoteAddress and FieldLocalAddress, set instead of Network, with MatchRange.
+	Protocol  uint8        // For FieldProtocol, an IANA protocol number.
+	Port      uint16       // For FieldRemotePort.
+	Flags     uint32       // For FieldFlags, e.g. FlagLoopback, and FieldL2Flags, e.g. L2FlagVM2VM.
+	App       string       // For FieldApp, the path of the application or, with MatchPrefix, of a directory.
+	Interface uint64       // For FieldLocalInterface, the LUID of the interface, see ParseInterface.
+	MAC       [6]byte      // For FieldLocalMAC and FieldRemoteMAC.
+	EtherType uint16       // For FieldEtherType.
+	To        uint32       // With MatchRange on Protocol, Port, Flags or EtherType, the last value of the range.
+}
+
+// RemoteAddress matches traffic to a remote address within network.
+func RemoteAddress(network netip.Prefix) Condition {
+	return Condition{Field: FieldRemoteAddress, Network: network}
+}
+
+// RemoteAddressRange matches traffic to a remote address within r.
+func RemoteAddressRange(r AddressRange) Condition {
+	return Condition{Field: FieldRemoteAddress, Match: MatchRange, Range: r}
+}
+
+// LocalAddress matches traffic from a local address within network.
+func LocalAddress(network netip.Prefix) Condition {
+	return Condition{Field: FieldLocalAddress, Network: network}
+}
+
+// LocalInterface matches traffic through the interface of a LUID.
+func LocalInterface(luid uint64) Condition {
+	return Condition{Field: FieldLocalInterface, Interface: luid}
+}
+
+// LocalMAC matches Ethernet frames whose local MAC address is mac: the
+// destination of inbound frames, the source of outbound ones.
+func LocalMAC(mac [6]byte) Condition {
+	return Condition{Field: FieldLocalMAC, MAC: mac}
+}
+
+// RemoteMAC matches Ethernet frames whose remote MAC address is mac: the
+// source of inbound frames, the destination of outbound ones.
+func RemoteMAC(mac [6]byte) Condition {
+	return Condition{Field: FieldRemoteMAC, MAC: mac}
+}
+
+// EtherType matches Ethernet frames of an EtherType, e.g. EtherTypeARP.
+func EtherType(etherType uint16) Condition {
+	return Condition{Field: FieldEtherType, EtherType: etherType}
+}
+
+// L2Flags matches the Ethernet frames whose L2 flags are set as match, one of
+// the MatchFlags types, tells, like ConditionFlags.
+func L2Flags(match MatchType, flags uint32) Condition {
+	return Condition{Field: FieldL2Flags, Match: match, Flags: flags}
+}
+
+// VM2VM matches the Ethernet frames between virtual machines of a Hyper-V
+// switch; Not(VM2VM()) those to or from the host and the outside.
+func VM2VM() Condition {
+	return L2Flags(MatchFlagsAnySet, L2FlagVM2VM)
+}
+
+// Protocol matches traffic of an IANA protocol number, e.g. 6 for TCP.
+func Protocol(protocol uint8) Condition {
+	return Condition{Field: FieldProtocol, Protocol: protocol}
+}
+
+// RemotePort matches TCP or UDP traffic to a remote port.
+func RemotePort(port uint16) Condition {
+	return Condition{Field: FieldRemotePort, Port: port}
+}
+
+// RemotePortRange matches TCP or UDP traffic to a remote port from first to
+// last.
+func RemotePortRange(first, last uint16) Condition {
+	return Condition{Field: FieldRemotePort, Match: MatchRange, Port: first, To: uint32(last)}
+}
+
+// ConditionFlags matches the traffic whose flags are set as match, one of the
+// MatchFlags types, tells: e.g. MatchFlagsNoneSet and FlagLoopback for
+// traffic other than loopback.
+func ConditionFlags(match MatchType, flags uint32) Condition {
+	return Condition{Field: FieldFlags, Match: match, Flags: flags}
+}
+
+// App matches the traffic of the application at path.
+func App(path string) Condition {
+	return Condition{Field: FieldApp, App: path}
+}
+
+// AppPrefix matches the traffic of the applications under dir.
+func AppPrefix(dir string) Condition {
+	return Condition{Field: FieldApp, Match: MatchPrefix, App: dir}
+}
+
+// Not returns c negated, if its match type has a negated form: MatchEqual,
+// MatchPrefix and MatchFlagsAnySet have, and are their negations' own.
+func Not(c Condition) (Condition, bool) {
+	negations := map[MatchType]MatchType{
+		MatchEqual: MatchNotEqual, MatchNotEqual: MatchEqual,
+		MatchPrefix: MatchNotPrefix, MatchNotPrefix: MatchPrefix,
+		MatchFlagsAnySet: MatchFlagsNoneSet, MatchFlagsNoneSet: MatchFlagsAnySet,
+	}
+	m, ok := negations[c.Match]
+	if !ok {
+		return c, false
+	}
+	c.Match = m
+	return c, true
+}
+
+func (c Condition) String() string {
+	return fmt.Sprintf("%s%s%s", c.Field, c.Match.operator(), c.value())
+}
+
+// value returns what c matches, e.g. a network, a range or a protocol name.
+func (c Condition) value() string {
+	switch c.Field {
+	case FieldProtocol:
+		if c.Match == MatchRange {
+			return fmt.Sprintf("%d-%d", c.Protocol, c.To)
+		}
+		return ProtocolName(c.Protocol)
+	case FieldRemotePort:
+		if c.Match == MatchRange {
+			return fmt.Sprintf("%d-%d", c.Port, c.To)
+		}
+		return strconv.Itoa(int(c.Port))
+	case FieldFlags:
+		if c.Match == MatchRange {
+			return fmt.Sprintf("%#x-%#x", c.Flags, c.To)
+		}
+		return FlagsString(c.Flags)
+	case FieldL2Flags:
+		if c.Match == MatchRange {
+			return fmt.Sprintf("%#x-%#x", c.Flags, c.To)
+		}
+		return L2FlagsString(c.Flags)
+	case FieldApp:
+		return c.App
+	case FieldLocalInterface:
+		return fmt.Sprintf("luid:%d", c.Interface)
+	case FieldLocalMAC, FieldRemoteMAC:
+		return net.HardwareAddr(c.MAC[:]).String()
+	case FieldEtherType:
+		if c.Match == MatchRange {
+			return fmt.Sprintf("%#04x-%#04x", c.EtherType, c.To)
+		}
+		return EtherTypeName(c.EtherType)
+	}
+	if c.Range.IsValid() {
+		return c.Range.String()
+	}
+	return c.Network.String()
+}
+
+/*
+ * Rule is a filter as seen through the Engine. ID, Name, Layer and Disabled
+ * are set by the Engine and ignored when adding rules. The layer follows
+ * from the direction and the conditions: connections of the address family
+ * of the remote addresses, or Ethernet frames for rules on MAC addresses and
+ * EtherTypes only.
+ */
+type Rule struct {
+	ID         uint64
+	Name       string
+	Action     Action
+	Direction  string // "outbound" (the default if empty) or "inbound".
+	Conditions []Condition
+	Weight     uint8 // Order within the sublayer; the highest weight matching wins.
+	Group      string
+	Disabled   bool
+	Layer      string
+	Metadata   RuleMetadata
+}
+
+// spec checks that rule can be expressed as a filter and converts it.
+func (r Rule) spec() (RuleSpec, error) {
+	if r.Action != ActionBlock && r.Action != ActionPermit {
+		return RuleSpec{}, fmt.Errorf("rule: invalid action %d", uint8(r.Action))
+	}
+	if r.Direction != "" && r.Direction != "outbound" && r.Direction != "inbound" {
+		return RuleSpec{}, fmt.Errorf("rule: invalid direction %q: must be outbound or inbound", r.Direction)
+	}
+	spec, err := conditionsSpec(r.Conditions)
+	if err != nil {
+		return RuleSpec{}, fmt.Errorf("rule: %w", err)
+	}
+	if r.Group != "" {
+		if err := ValidateGroupName(r.Group); err != nil {
+			return RuleSpec{}, err
+		}
+	}
+	spec.Action, spec.Host, spec.Weight, spec.Group, spec.Meta = r.Action.String(), r.Metadata.Host, r.Weight, r.Group, r.Metadata
+	spec.Direction = r.Direction
+	return spec, nil
+}
+
+// ruleSpecs converts rules, giving those without a weight consecutive ones;
+// there are weights for 246 of them.
+func ruleSpecs(rules []Rule) ([]RuleSpec, error) {
+	var errs []error
+	specs := make([]RuleSpec, 0, len(rules))
+	for i, rule := range rules {
+		spec, err := rule.spec()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %d: %w", i+1, err))
+			continue
+		}
+		if spec.Weight == 0 {
+			if firstRuleWeight+i > 0xff {
+				errs = append(errs, fmt.Errorf("rule %d: no weight left, at most %d rules can be without one", i+1, 0xff-firstRuleWeight+1))
+				continue
+			}
+			spec.Weight = uint8(firstRuleWeight + i)
+		}
+		specs = append(specs, spec)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return specs, nil
+}
+
+func ruleFromInfo(info RuleInfo) Rule {
+	rule := Rule{
+		ID:         info.FilterID,
+		Name:       info.Name,
+		Direction:  info.Direction,
+		Weight:     info.Weight,
+		Group:      info.Group,
+		Disabled:   info.Disabled,
+		Layer:      info.Layer,
+		Metadata:   info.Metadata,
+		Conditions: info.Conditions,
+	}
+	rule.Action, _ = ParseAction(info.Action)
+	return rule
+}
+
+// Rule converts a spec, as returned by ParseRuleSpecs, to a Rule.
+func (s RuleSpec) Rule() Rule {
+	action, _ := ParseAction(s.Action)
+	rule := Rule{
+		Action:     action,
+		Direction:  s.Direction,
+		Conditions: s.conditions(),
+		Weight:     s.Weight,
+		Group:      s.Group,
+		Metadata:   s.Meta,
+	}
+	rule.Metadata.Host = s.Host
+	return rule
+}
+
+// Info describes rule the way RuleIndex and the loggers expect.
+func (r Rule) Info() RuleInfo {
+	info := RuleInfo{
+		FilterID:   r.ID,
+		Name:       r.Name,
+		Action:     r.Action.String(),
+		Layer:      r.Layer,
+		Direction:  layerDirection(r.Layer),
+		Family:     layerFamily(r.Layer),
+		Weight:     r.Weight,
+		Group:      r.Group,
+		Disabled:   r.Disabled,
+		Metadata:   r.Metadata,
+		Conditions: r.Conditions,
+	}
+	info.Network = addressesString(r.Conditions)
+	return info
+}
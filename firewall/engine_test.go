@@ -0,0 +1,83 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func blockRule(cidr string) Rule {
+	return Rule{Action: ActionBlock, Conditions: []Condition{RemoteAddress(netip.MustParsePrefix(cidr))}}
+}
+
+func openMemoryEngine(t *testing.T, backend Backend, opts ...Option) *Engine {
+	t.Helper()
+	engine, err := Open(context.Background(), append([]Option{WithBackend(backend)}, opts...)...)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { engine.Close() })
+	return engine
+}
+
+func TestEngineRemoveRuleForeignFilter(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	ours := openMemoryEngine(t, backend)
+	theirs := openMemoryEngine(t, backend)
+
+	rule, err := ours.AddRule(ctx, blockRule("10.0.0.0/8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := theirs.AddRule(ctx, blockRule("192.0.2.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ours.RemoveRule(ctx, foreign.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RemoveRule(foreign) = %v, want ErrNotFound", err)
+	}
+	if err := ours.RemoveRule(ctx, 9999); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RemoveRule(unknown) = %v, want ErrNotFound", err)
+	}
+	if _, err := ours.Update(ctx, []uint64{rule.ID, foreign.ID}, nil, OnErrorAbort); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Update(foreign) = %v, want ErrNotFound", err)
+	}
+	if len(backend.Filters()) != 2 {
+		t.Fatalf("filters deleted by rejected calls: %d left, want 2", len(backend.Filters()))
+	}
+
+	if err := ours.RemoveRule(ctx, rule.ID); err != nil {
+		t.Errorf("RemoveRule(own) = %v", err)
+	}
+	if filters := backend.Filters(); len(filters) != 1 || filters[0].ID != foreign.ID {
+		t.Errorf("filters after RemoveRule = %v, want only %d", filters, foreign.ID)
+	}
+}
+
+func TestEngineApplyWeights(t *testing.T) {
+	engine := openMemoryEngine(t, NewMemoryBackend())
+	rules := make([]Rule, 0xff-firstRuleWeight+2)
+	for i := range rules {
+		rules[i] = blockRule(netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i), 0, 0}), 16).String())
+	}
+
+	// One rule too many gets no weight, rather than a duplicate one.
+	if _, err := engine.Apply(context.Background(), rules, OnErrorAbort); err == nil {
+		t.Fatalf("Apply(%d rules) succeeded", len(rules))
+	}
+
+	summary, err := engine.Apply(context.Background(), rules[:len(rules)-1], OnErrorAbort)
+	if err != nil || summary.Applied != len(rules)-1 {
+		t.Fatalf("Apply(%d rules) = %+v, %v", len(rules)-1, summary, err)
+	}
+	seen := make(map[uint8]bool)
+	for _, result := range summary.Results {
+		if seen[result.Rule.Weight] {
+			t.Errorf("weight %d given twice", result.Rule.Weight)
+		}
+		seen[result.Rule.Weight] = true
+	}
+}
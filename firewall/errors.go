@@ -0,0 +1,290 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+/*
+ * Kinds of WFP failures. Every *Error matches exactly one of them with
+ * errors.Is, so callers can decide to retry, skip or give up without looking at
+ * error strings:
+ *
+ *	if errors.Is(err, firewall.ErrAlreadyExists) { ... }
+ */
+var (
+	ErrNotFound         = errors.New("object not found")
+	ErrAlreadyExists    = errors.New("object already exists")
+	ErrInUse            = errors.New("object in use")
+	ErrAccessDenied     = errors.New("access denied")
+	ErrInvalidCondition = errors.New("invalid filter condition")
+	ErrInvalidArgument  = errors.New("invalid argument")
+	ErrTransaction      = errors.New("transaction or session state conflict")
+	ErrTimeout          = errors.New("timed out")
+	ErrLimitReached     = errors.New("limit reached")
+	ErrNotSupported     = errors.New("not supported")
+	ErrUnavailable      = errors.New("filter engine unavailable")
+	ErrEventsDisabled   = errors.New("net event collection disabled")
+	ErrUnknown          = errors.New("unknown WFP error")
+)
+
+// Code is an FWP_E_* HRESULT or a Win32 error code, as returned by the WFP API.
+type Code uint32
+
+// FWP_E_* defined in fwpmu.h/winerror.h, and the Win32 and RPC errors WFP
+// calls commonly return.
+const (
+	FWP_E_CALLOUT_NOT_FOUND                 Code = 0x80320001
+	FWP_E_CONDITION_NOT_FOUND               Code = 0x80320002
+	FWP_E_FILTER_NOT_FOUND                  Code = 0x80320003
+	FWP_E_LAYER_NOT_FOUND                   Code = 0x80320004
+	FWP_E_PROVIDER_NOT_FOUND                Code = 0x80320005
+	FWP_E_PROVIDER_CONTEXT_NOT_FOUND        Code = 0x80320006
+	FWP_E_SUBLAYER_NOT_FOUND                Code = 0x80320007
+	FWP_E_NOT_FOUND                         Code = 0x80320008
+	FWP_E_ALREADY_EXISTS                    Code = 0x80320009
+	FWP_E_IN_USE                            Code = 0x8032000A
+	FWP_E_DYNAMIC_SESSION_IN_PROGRESS       Code = 0x8032000B
+	FWP_E_WRONG_SESSION                     Code = 0x8032000C
+	FWP_E_NO_TXN_IN_PROGRESS                Code = 0x8032000D
+	FWP_E_TXN_IN_PROGRESS                   Code = 0x8032000E
+	FWP_E_TXN_ABORTED                       Code = 0x8032000F
+	FWP_E_SESSION_ABORTED                   Code = 0x80320010
+	FWP_E_INCOMPATIBLE_TXN                  Code = 0x80320011
+	FWP_E_TIMEOUT                           Code = 0x80320012
+	FWP_E_NET_EVENTS_DISABLED               Code = 0x80320013
+	FWP_E_INCOMPATIBLE_LAYER                Code = 0x80320014
+	FWP_E_KM_CLIENTS_ONLY                   Code = 0x80320015
+	FWP_E_LIFETIME_MISMATCH                 Code = 0x80320016
+	FWP_E_BUILTIN_OBJECT                    Code = 0x80320017
+	FWP_E_TOO_MANY_CALLOUTS                 Code = 0x80320018
+	FWP_E_NOTIFICATION_DROPPED              Code = 0x80320019
+	FWP_E_TRAFFIC_MISMATCH                  Code = 0x8032001A
+	FWP_E_INCOMPATIBLE_SA_STATE             Code = 0x8032001B
+	FWP_E_NULL_POINTER                      Code = 0x8032001C
+	FWP_E_INVALID_ENUMERATOR                Code = 0x8032001D
+	FWP_E_INVALID_FLAGS                     Code = 0x8032001E
+	FWP_E_INVALID_NET_MASK                  Code = 0x8032001F
+	FWP_E_INVALID_RANGE                     Code = 0x80320020
+	FWP_E_INVALID_INTERVAL                  Code = 0x80320021
+	FWP_E_ZERO_LENGTH_ARRAY                 Code = 0x80320022
+	FWP_E_NULL_DISPLAY_NAME                 Code = 0x80320023
+	FWP_E_INVALID_ACTION_TYPE               Code = 0x80320024
+	FWP_E_INVALID_WEIGHT                    Code = 0x80320025
+	FWP_E_MATCH_TYPE_MISMATCH               Code = 0x80320026
+	FWP_E_TYPE_MISMATCH                     Code = 0x80320027
+	FWP_E_OUT_OF_BOUNDS                     Code = 0x80320028
+	FWP_E_RESERVED                          Code = 0x80320029
+	FWP_E_DUPLICATE_CONDITION               Code = 0x8032002A
+	FWP_E_DUPLICATE_KEYMOD                  Code = 0x8032002B
+	FWP_E_ACTION_INCOMPATIBLE_WITH_LAYER    Code = 0x8032002C
+	FWP_E_ACTION_INCOMPATIBLE_WITH_SUBLAYER Code = 0x8032002D
+	FWP_E_CONTEXT_INCOMPATIBLE_WITH_LAYER   Code = 0x8032002E
+	FWP_E_CONTEXT_INCOMPATIBLE_WITH_CALLOUT Code = 0x8032002F
+	FWP_E_NEVER_MATCH                       Code = 0x80320033
+	FWP_E_PROVIDER_CONTEXT_MISMATCH         Code = 0x80320034
+	FWP_E_INVALID_PARAMETER                 Code = 0x80320035
+	FWP_E_TOO_MANY_SUBLAYERS                Code = 0x80320036
+	FWP_E_CALLOUT_NOTIFICATION_FAILED       Code = 0x80320037
+	FWP_E_L2_DRIVER_NOT_READY               Code = 0x8032003E
+
+	ERROR_FILE_NOT_FOUND         Code = 2
+	ERROR_ACCESS_DENIED          Code = 5
+	ERROR_INVALID_HANDLE         Code = 6
+	ERROR_NOT_ENOUGH_MEMORY      Code = 8
+	ERROR_NOT_SUPPORTED          Code = 50
+	ERROR_INVALID_PARAMETER      Code = 87
+	ERROR_SERVICE_NOT_ACTIVE     Code = 1062
+	ERROR_INVALID_SECURITY_DESCR Code = 1338
+	RPC_S_SERVER_UNAVAILABLE     Code = 1722
+	RPC_S_CALL_FAILED            Code = 1726
+	EPT_S_NOT_REGISTERED         Code = 1753
+	E_ACCESSDENIED               Code = 0x80070005
+	E_INVALIDARG                 Code = 0x80070057
+	E_OUTOFMEMORY                Code = 0x8007000E
+)
+
+type codeInfo struct {
+	name    string
+	message string
+	kind    error
+}
+
+var codeTable = map[Code]codeInfo{
+	FWP_E_CALLOUT_NOT_FOUND:                 {"FWP_E_CALLOUT_NOT_FOUND", "The callout does not exist.", ErrNotFound},
+	FWP_E_CONDITION_NOT_FOUND:               {"FWP_E_CONDITION_NOT_FOUND", "The filter condition does not exist.", ErrNotFound},
+	FWP_E_FILTER_NOT_FOUND:                  {"FWP_E_FILTER_NOT_FOUND", "The filter does not exist.", ErrNotFound},
+	FWP_E_LAYER_NOT_FOUND:                   {"FWP_E_LAYER_NOT_FOUND", "The layer does not exist.", ErrNotFound},
+	FWP_E_PROVIDER_NOT_FOUND:                {"FWP_E_PROVIDER_NOT_FOUND", "The provider does not exist.", ErrNotFound},
+	FWP_E_PROVIDER_CONTEXT_NOT_FOUND:        {"FWP_E_PROVIDER_CONTEXT_NOT_FOUND", "The provider context does not exist.", ErrNotFound},
+	FWP_E_SUBLAYER_NOT_FOUND:                {"FWP_E_SUBLAYER_NOT_FOUND", "The sublayer does not exist.", ErrNotFound},
+	FWP_E_NOT_FOUND:                         {"FWP_E_NOT_FOUND", "The object does not exist.", ErrNotFound},
+	FWP_E_ALREADY_EXISTS:                    {"FWP_E_ALREADY_EXISTS", "An object with that GUID or LUID already exists.", ErrAlreadyExists},
+	FWP_E_IN_USE:                            {"FWP_E_IN_USE", "The object is referenced by other objects so cannot be deleted.", ErrInUse},
+	FWP_E_DYNAMIC_SESSION_IN_PROGRESS:       {"FWP_E_DYNAMIC_SESSION_IN_PROGRESS", "The call is not allowed from within a dynamic session.", ErrTransaction},
+	FWP_E_WRONG_SESSION:                     {"FWP_E_WRONG_SESSION", "The call was made from the wrong session so cannot be completed.", ErrTransaction},
+	FWP_E_NO_TXN_IN_PROGRESS:                {"FWP_E_NO_TXN_IN_PROGRESS", "The call must be made from within an explicit transaction.", ErrTransaction},
+	FWP_E_TXN_IN_PROGRESS:                   {"FWP_E_TXN_IN_PROGRESS", "The call is not allowed from within an explicit transaction.", ErrTransaction},
+	FWP_E_TXN_ABORTED:                       {"FWP_E_TXN_ABORTED", "The explicit transaction has been forcibly cancelled.", ErrTransaction},
+	FWP_E_SESSION_ABORTED:                   {"FWP_E_SESSION_ABORTED", "The session has been cancelled.", ErrTransaction},
+	FWP_E_INCOMPATIBLE_TXN:                  {"FWP_E_INCOMPATIBLE_TXN", "The call is not allowed from within a read-only transaction.", ErrTransaction},
+	FWP_E_TIMEOUT:                           {"FWP_E_TIMEOUT", "The call timed out while waiting to acquire the transaction lock.", ErrTimeout},
+	FWP_E_NET_EVENTS_DISABLED:               {"FWP_E_NET_EVENTS_DISABLED", "Collection of network diagnostic events is disabled.", ErrEventsDisabled},
+	FWP_E_INCOMPATIBLE_LAYER:                {"FWP_E_INCOMPATIBLE_LAYER", "The operation is not supported by the specified layer.", ErrNotSupported},
+	FWP_E_KM_CLIENTS_ONLY:                   {"FWP_E_KM_CLIENTS_ONLY", "The call is allowed for kernel-mode callers only.", ErrNotSupported},
+	FWP_E_LIFETIME_MISMATCH:                 {"FWP_E_LIFETIME_MISMATCH", "The call tried to associate two objects with incompatible lifetimes.", ErrInvalidArgument},
+	FWP_E_BUILTIN_OBJECT:                    {"FWP_E_BUILTIN_OBJECT", "The object is built in so cannot be deleted.", ErrAccessDenied},
+	FWP_E_TOO_MANY_CALLOUTS:                 {"FWP_E_TOO_MANY_CALLOUTS", "The maximum number of callouts has been reached.", ErrLimitReached},
+	FWP_E_NOTIFICATION_DROPPED:              {"FWP_E_NOTIFICATION_DROPPED", "A notification could not be delivered because a message queue is at its maximum capacity.", ErrLimitReached},
+	FWP_E_TRAFFIC_MISMATCH:                  {"FWP_E_TRAFFIC_MISMATCH", "The traffic parameters do not match those for the security association context.", ErrInvalidArgument},
+	FWP_E_INCOMPATIBLE_SA_STATE:             {"FWP_E_INCOMPATIBLE_SA_STATE", "The call is not allowed for the current security association state.", ErrInvalidArgument},
+	FWP_E_NULL_POINTER:                      {"FWP_E_NULL_POINTER", "A required pointer is null.", ErrInvalidArgument},
+	FWP_E_INVALID_ENUMERATOR:                {"FWP_E_INVALID_ENUMERATOR", "An enumerator is not valid.", ErrInvalidArgument},
+	FWP_E_INVALID_FLAGS:                     {"FWP_E_INVALID_FLAGS", "The flags field contains an invalid value.", ErrInvalidArgument},
+	FWP_E_INVALID_NET_MASK:                  {"FWP_E_INVALID_NET_MASK", "A network mask is not valid.", ErrInvalidCondition},
+	FWP_E_INVALID_RANGE:                     {"FWP_E_INVALID_RANGE", "An FWP_RANGE is not valid.", ErrInvalidCondition},
+	FWP_E_INVALID_INTERVAL:                  {"FWP_E_INVALID_INTERVAL", "The time interval is not valid.", ErrInvalidArgument},
+	FWP_E_ZERO_LENGTH_ARRAY:                 {"FWP_E_ZERO_LENGTH_ARRAY", "An array that must contain at least one element is zero length.", ErrInvalidArgument},
+	FWP_E_NULL_DISPLAY_NAME:                 {"FWP_E_NULL_DISPLAY_NAME", "The displayData.name field cannot be null.", ErrInvalidArgument},
+	FWP_E_INVALID_ACTION_TYPE:               {"FWP_E_INVALID_ACTION_TYPE", "The action type is not one of the allowed action types for a filter.", ErrInvalidArgument},
+	FWP_E_INVALID_WEIGHT:                    {"FWP_E_INVALID_WEIGHT", "The filter weight is not valid.", ErrInvalidArgument},
+	FWP_E_MATCH_TYPE_MISMATCH:               {"FWP_E_MATCH_TYPE_MISMATCH", "A filter condition contains a match type that is not compatible with the operands.", ErrInvalidCondition},
+	FWP_E_TYPE_MISMATCH:                     {"FWP_E_TYPE_MISMATCH", "An FWP_VALUE or FWPM_CONDITION_VALUE is of the wrong type.", ErrInvalidCondition},
+	FWP_E_OUT_OF_BOUNDS:                     {"FWP_E_OUT_OF_BOUNDS", "An integer value is outside the allowed range.", ErrInvalidCondition},
+	FWP_E_RESERVED:                          {"FWP_E_RESERVED", "A reserved field is non-zero.", ErrInvalidArgument},
+	FWP_E_DUPLICATE_CONDITION:               {"FWP_E_DUPLICATE_CONDITION", "A filter cannot contain multiple conditions operating on a single field.", ErrInvalidCondition},
+	FWP_E_DUPLICATE_KEYMOD:                  {"FWP_E_DUPLICATE_KEYMOD", "A policy cannot contain the same keying module more than once.", ErrInvalidArgument},
+	FWP_E_ACTION_INCOMPATIBLE_WITH_LAYER:    {"FWP_E_ACTION_INCOMPATIBLE_WITH_LAYER", "The action type is not compatible with the layer.", ErrInvalidArgument},
+	FWP_E_ACTION_INCOMPATIBLE_WITH_SUBLAYER: {"FWP_E_ACTION_INCOMPATIBLE_WITH_SUBLAYER", "The action type is not compatible with the sublayer.", ErrInvalidArgument},
+	FWP_E_CONTEXT_INCOMPATIBLE_WITH_LAYER:   {"FWP_E_CONTEXT_INCOMPATIBLE_WITH_LAYER", "The raw context or the provider context is not compatible with the layer.", ErrInvalidArgument},
+	FWP_E_CONTEXT_INCOMPATIBLE_WITH_CALLOUT: {"FWP_E_CONTEXT_INCOMPATIBLE_WITH_CALLOUT", "The raw context or the provider context is not compatible with the callout.", ErrInvalidArgument},
+	FWP_E_NEVER_MATCH:                       {"FWP_E_NEVER_MATCH", "The filter conditions can never match.", ErrInvalidCondition},
+	FWP_E_PROVIDER_CONTEXT_MISMATCH:         {"FWP_E_PROVIDER_CONTEXT_MISMATCH", "The provider context is of the wrong type.", ErrInvalidArgument},
+	FWP_E_INVALID_PARAMETER:                 {"FWP_E_INVALID_PARAMETER", "The parameter is incorrect.", ErrInvalidArgument},
+	FWP_E_TOO_MANY_SUBLAYERS:                {"FWP_E_TOO_MANY_SUBLAYERS", "The maximum number of sublayers has been reached.", ErrLimitReached},
+	FWP_E_CALLOUT_NOTIFICATION_FAILED:       {"FWP_E_CALLOUT_NOTIFICATION_FAILED", "The notification function for a callout returned an error.", ErrInvalidArgument},
+	FWP_E_L2_DRIVER_NOT_READY:               {"FWP_E_L2_DRIVER_NOT_READY", "The packet filtering driver for the MAC layers is not ready.", ErrUnavailable},
+
+	ERROR_FILE_NOT_FOUND:         {"ERROR_FILE_NOT_FOUND", "The system cannot find the file specified.", ErrNotFound},
+	ERROR_ACCESS_DENIED:          {"ERROR_ACCESS_DENIED", "Access is denied.", ErrAccessDenied},
+	ERROR_INVALID_HANDLE:         {"ERROR_INVALID_HANDLE", "The handle is invalid.", ErrInvalidArgument},
+	ERROR_NOT_ENOUGH_MEMORY:      {"ERROR_NOT_ENOUGH_MEMORY", "Not enough memory resources are available to process this command.", ErrLimitReached},
+	ERROR_NOT_SUPPORTED:          {"ERROR_NOT_SUPPORTED", "The request is not supported.", ErrNotSupported},
+	ERROR_INVALID_PARAMETER:      {"ERROR_INVALID_PARAMETER", "The parameter is incorrect.", ErrInvalidArgument},
+	ERROR_SERVICE_NOT_ACTIVE:     {"ERROR_SERVICE_NOT_ACTIVE", "The service has not been started.", ErrUnavailable},
+	ERROR_INVALID_SECURITY_DESCR: {"ERROR_INVALID_SECURITY_DESCR", "The security descriptor structure is invalid.", ErrInvalidArgument},
+	RPC_S_SERVER_UNAVAILABLE:     {"RPC_S_SERVER_UNAVAILABLE", "The RPC server is unavailable.", ErrUnavailable},
+	RPC_S_CALL_FAILED:            {"RPC_S_CALL_FAILED", "The remote procedure call failed.", ErrUnavailable},
+	EPT_S_NOT_REGISTERED:         {"EPT_S_NOT_REGISTERED", "There are no more endpoints available from the endpoint mapper (is the BFE service running?).", ErrUnavailable},
+	E_ACCESSDENIED:               {"E_ACCESSDENIED", "Access is denied.", ErrAccessDenied},
+	E_INVALIDARG:                 {"E_INVALIDARG", "One or more arguments are not valid.", ErrInvalidArgument},
+	E_OUTOFMEMORY:                {"E_OUTOFMEMORY", "Not enough memory resources are available to complete this operation.", ErrLimitReached},
+}
+
+// String returns the symbolic name of the code, e.g. "FWP_E_ALREADY_EXISTS".
+func (c Code) String() string {
+	if info, ok := codeTable[c]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("0x%08X", uint32(c))
+}
+
+// Message returns the human-readable description of the code.
+func (c Code) Message() string {
+	if info, ok := codeTable[c]; ok {
+		return info.message
+	}
+	return syscall.Errno(c).Error()
+}
+
+// Kind returns the sentinel error the code belongs to.
+func (c Code) Kind() error {
+	if info, ok := codeTable[c]; ok {
+		return info.kind
+	}
+	return ErrUnknown
+}
+
+/*
+ * Error is returned for a failed WFP call. It carries the function that
+ * failed, the key of the object it operated on (a GUID, or the name of an
+ * engine option), and the returned code.
+ */
+type Error struct {
+	Op   string // WFP function, e.g. "FwpmFilterAdd0".
+	Key  string // Object the call was about, empty if none.
+	Code Code
+}
+
+func (e *Error) Error() string {
+	if e.Key != "" {
+		return fmt.Sprintf("%s %s: %s (0x%08X): %s", e.Op, e.Key, e.Code, uint32(e.Code), e.Code.Message())
+	}
+	return fmt.Sprintf("%s: %s (0x%08X): %s", e.Op, e.Code, uint32(e.Code), e.Code.Message())
+}
+
+// Is makes errors.Is(err, ErrAlreadyExists) and the like work, and also
+// matches the plain syscall.Errno of the same code.
+func (e *Error) Is(target error) bool {
+	if target == e.Code.Kind() {
+		return true
+	}
+	errno, ok := target.(syscall.Errno)
+	return ok && Code(errno) == e.Code
+}
+
+// Temporary reports whether retrying the same call may succeed.
+func (e *Error) Temporary() bool {
+	switch e.Code {
+	case FWP_E_TIMEOUT, FWP_E_TXN_ABORTED, FWP_E_SESSION_ABORTED, FWP_E_NOTIFICATION_DROPPED,
+		RPC_S_SERVER_UNAVAILABLE, RPC_S_CALL_FAILED, EPT_S_NOT_REGISTERED, ERROR_SERVICE_NOT_ACTIVE:
+		return true
+	}
+	return false
+}
+
+// IsTemporary reports whether err is a WFP error worth retrying.
+func IsTemporary(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Temporary()
+}
+
+// wfpErr turns the error returned by the WFP function op into an *Error, counts
+// it in the wfp_call_errors_total metric, and wraps it.
+func wfpErr(op, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		wfpCallErrors.add(1, op, "unknown")
+		return wrapErr(err)
+	}
+	e := &Error{Op: op, Key: key, Code: Code(errno)}
+	wfpCallErrors.add(1, op, errorCode(e))
+	return wrapErr(e)
+}
+
+// hasCode reports whether err is a WFP error with code, before or after wfpErr.
+func hasCode(err error, code Code) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code == code
+	}
+	var errno syscall.Errno
+	return errors.As(err, &errno) && Code(errno) == code
+}
+
+// errorCode formats the Win32/WFP error code carried by err, if any.
+func errorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return fmt.Sprintf("0x%08X", uint32(e.Code))
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return fmt.Sprintf("0x%08X", uint32(errno))
+	}
+	return ""
+}
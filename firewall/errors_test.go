@@ -0,0 +1,82 @@
+package firewall
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+var errorKinds = []error{
+	ErrNotFound, ErrAlreadyExists, ErrInUse, ErrAccessDenied, ErrInvalidCondition, ErrInvalidArgument,
+	ErrTransaction, ErrTimeout, ErrLimitReached, ErrNotSupported, ErrUnavailable, ErrEventsDisabled, ErrUnknown,
+}
+
+func TestErrorIs(t *testing.T) {
+	tests := []struct {
+		code      Code
+		kind      error
+		temporary bool
+	}{
+		{FWP_E_FILTER_NOT_FOUND, ErrNotFound, false},
+		{FWP_E_ALREADY_EXISTS, ErrAlreadyExists, false},
+		{FWP_E_IN_USE, ErrInUse, false},
+		{ERROR_ACCESS_DENIED, ErrAccessDenied, false},
+		{FWP_E_MATCH_TYPE_MISMATCH, ErrInvalidCondition, false},
+		{ERROR_INVALID_SECURITY_DESCR, ErrInvalidArgument, false},
+		{FWP_E_TXN_IN_PROGRESS, ErrTransaction, false},
+		{FWP_E_TXN_ABORTED, ErrTransaction, true},
+		{FWP_E_TIMEOUT, ErrTimeout, true},
+		{FWP_E_NET_EVENTS_DISABLED, ErrEventsDisabled, false},
+		{RPC_S_SERVER_UNAVAILABLE, ErrUnavailable, true},
+		{EPT_S_NOT_REGISTERED, ErrUnavailable, true},
+		{Code(0x8032ffff), ErrUnknown, false},
+	}
+	for _, tt := range tests {
+		// As returned by the backends, wrapped.
+		err := wfpErr("FwpmFilterAdd0", "{key}", syscall.Errno(tt.code))
+
+		// Every error is of exactly one kind.
+		for _, kind := range errorKinds {
+			if got := errors.Is(err, kind); got != (kind == tt.kind) {
+				t.Errorf("%s: errors.Is(%v) = %v", tt.code, kind, got)
+			}
+		}
+		if !errors.Is(err, syscall.Errno(tt.code)) {
+			t.Errorf("%s: not the Errno of its code", tt.code)
+		}
+		if errors.Is(err, syscall.Errno(tt.code+1)) {
+			t.Errorf("%s: the Errno of another code", tt.code)
+		}
+
+		var e *Error
+		if !errors.As(err, &e) || e.Op != "FwpmFilterAdd0" || e.Key != "{key}" || e.Code != tt.code {
+			t.Fatalf("%s: errors.As = %+v", tt.code, e)
+		}
+		if e.Temporary() != tt.temporary || IsTemporary(err) != tt.temporary {
+			t.Errorf("%s: Temporary = %v, IsTemporary = %v; want %v", tt.code, e.Temporary(), IsTemporary(err), tt.temporary)
+		}
+		if !strings.Contains(err.Error(), "FwpmFilterAdd0 {key}: "+tt.code.String()) {
+			t.Errorf("%s: message %q", tt.code, err)
+		}
+	}
+}
+
+func TestWFPErrNotErrno(t *testing.T) {
+	if err := wfpErr("FwpmEngineOpen0", "", nil); err != nil {
+		t.Errorf("wfpErr(nil) = %v", err)
+	}
+
+	// An error without a code is passed through, of no kind.
+	cause := errors.New("no handle")
+	err := wfpErr("FwpmEngineOpen0", "", cause)
+	var e *Error
+	if !errors.Is(err, cause) || errors.As(err, &e) || IsTemporary(err) {
+		t.Errorf("wfpErr(%v) = %v", cause, err)
+	}
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind) {
+			t.Errorf("wfpErr(%v) is %v", cause, kind)
+		}
+	}
+}
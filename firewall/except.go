@@ -0,0 +1,185 @@
+package firewall
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+/*
+ * A rule with exceptions, "block 10.0.0.0/8 except 10.1.0.0/16,10.2.3.0/24",
+ * is compiled into the ranges of addresses left once the exceptions are
+ * taken out, each a filter of the rule's action and weight. Unlike permits of
+ * a higher weight carved into the block, the exceptions are then simply not
+ * matched by the rule, so they get whatever the other rules decide, whatever
+ * their weights.
+ */
+
+// ParseExcept validates the exceptions of network: IPv4 CIDRs inside it that
+// leave some of it.
+func ParseExcept(network netip.Prefix, list []string) ([]netip.Prefix, error) {
+	var except []netip.Prefix
+	for _, s := range list {
+		prefix, err := ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		if prefix.Bits() < network.Bits() || !network.Masked().Contains(prefix.Addr()) {
+			return nil, fmt.Errorf("except %s is not inside %s", prefix, network)
+		}
+		except = append(except, prefix)
+	}
+	if len(except) == 0 {
+		return nil, fmt.Errorf("except needs at least one CIDR")
+	}
+	if len(RuleSpec{Network: network, Except: except}.Networks()) == 0 {
+		return nil, fmt.Errorf("except leaves nothing of %s", network)
+	}
+	return except, nil
+}
+
+// String describes the rule as written, e.g. "block 10.0.0.0/8 except
+// 10.1.0.0/16", "permit 10.0.0.0/8 protocol=tcp remote_port=80,443" or
+// "block inbound remote_mac=00:15:5d:01:02:03".
+func (s RuleSpec) String() string {
+	words := []string{s.Action}
+	if s.inbound() {
+		words = append(words, s.Direction)
+	}
+	if !s.frame() {
+		words = append(words, s.networkString())
+	}
+	if constraints := s.constraints(); len(constraints) > 0 {
+		words = append(words, formatConditions(constraints))
+	}
+	return strings.Join(words, " ")
+}
+
+func (s RuleSpec) networkString() string {
+	if s.Host != "" {
+		return s.Host
+	}
+	if s.frame() {
+		return formatConditions(s.Conditions)
+	}
+	if len(s.Except) == 0 {
+		return s.address()
+	}
+	except := make([]string, len(s.Except))
+	for i, prefix := range s.Except {
+		except[i] = prefix.String()
+	}
+	return fmt.Sprintf("%s except %s", s.Network, strings.Join(except, ","))
+}
+
+// address is what the filters of s match, prefixes or ranges.
+func (s RuleSpec) address() string {
+	return addressesString(s.conditions())
+}
+
+// condition is the remote address condition of the filter of s, which has no
+// exceptions left.
+func (s RuleSpec) condition() Condition {
+	if s.Range.IsValid() {
+		return RemoteAddressRange(s.Range)
+	}
+	return RemoteAddress(s.Network)
+}
+
+// span is the range of addresses of c, a remote address condition.
+func (c Condition) span() span {
+	if c.Range.IsValid() {
+		return c.Range.span()
+	}
+	return prefixRange(c.Network)
+}
+
+// spanCondition matches r, as a prefix if r is one and as a range otherwise,
+// which is then a single condition instead of several.
+func spanCondition(r span) Condition {
+	if prefixes := rangePrefixes([]span{r}); len(prefixes) == 1 {
+		return RemoteAddress(prefixes[0])
+	}
+	return RemoteAddressRange(AddressRange{uint32Addr(r.first), uint32Addr(r.last)})
+}
+
+// withSpans returns s matching the ranges of spans instead, OR'd in a single
+// filter, with the same constraints.
+func (s RuleSpec) withSpans(spans []span) RuleSpec {
+	primary := spanCondition(spans[0])
+	s.Network, s.Range, s.Except = primary.Network, primary.Range, nil
+	constraints := s.constraints()
+	s.Conditions = nil
+	for _, r := range spans[1:] {
+		s.Conditions = append(s.Conditions, spanCondition(r))
+	}
+	s.Conditions = append(s.Conditions, constraints...)
+	return s
+}
+
+// spans returns the ranges of addresses of s minus its exceptions, in
+// address order.
+func (s RuleSpec) spans() []span {
+	if len(s.Except) == 0 {
+		var spans []span
+		for _, c := range s.conditions() {
+			if c.isAddress() {
+				spans = append(spans, c.span())
+			}
+		}
+		return mergeRanges(spans)
+	}
+	holes := make([]span, len(s.Except))
+	for i, prefix := range s.Except {
+		holes[i] = prefixRange(prefix)
+	}
+	r := prefixRange(s.Network)
+	var left []span
+	next := uint64(r.first)
+	for _, hole := range mergeRanges(holes) {
+		if uint64(hole.first) > next {
+			left = append(left, span{uint32(next), hole.first - 1})
+		}
+		next = uint64(hole.last) + 1
+	}
+	if next <= uint64(r.last) {
+		left = append(left, span{uint32(next), r.last})
+	}
+	return left
+}
+
+// Networks returns the fewest prefixes covering the addresses of s minus its
+// exceptions, with host bits cleared. The addresses of a hostname are only
+// known once resolved, see HostRules.
+func (s RuleSpec) Networks() []netip.Prefix {
+	if s.Host != "" {
+		if s.Network.IsValid() {
+			return []netip.Prefix{s.Network}
+		}
+		return nil
+	}
+	return rangePrefixes(s.spans())
+}
+
+/*
+ * ExpandExceptions replaces every rule with exceptions by one rule per range
+ * of addresses left, which is what WFP gets: a prefix where the range is one,
+ * a range condition otherwise. The rule as written is kept in the Intent
+ * metadata of each of them, so that list can show it.
+ */
+func ExpandExceptions(specs []RuleSpec) []RuleSpec {
+	expanded := make([]RuleSpec, 0, len(specs))
+	for _, spec := range specs {
+		if len(spec.Except) == 0 {
+			expanded = append(expanded, spec)
+			continue
+		}
+		intent := spec.String()
+		for _, r := range spec.spans() {
+			piece := spec.withSpans([]span{r})
+			piece.Meta.Intent = intent
+			expanded = append(expanded, piece)
+		}
+	}
+	return expanded
+}
@@ -0,0 +1,79 @@
+package firewall
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpandExceptions(t *testing.T) {
+	tests := []struct {
+		network string
+		except  string
+		want    []string // Address of each expanded rule; nil if ParseExcept fails.
+	}{
+		{"10.0.0.0/8", "10.1.0.0/16", []string{"10.0.0.0/16", "10.2.0.0-10.255.255.255"}},
+		{"10.0.0.0/8", "10.1.0.0/16,10.2.3.0/24", []string{"10.0.0.0/16", "10.2.0.0-10.2.2.255", "10.2.4.0-10.255.255.255"}},
+
+		// Overlapping and adjacent holes are one hole.
+		{"10.0.0.0/8", "10.1.0.0/16,10.1.2.0/24", []string{"10.0.0.0/16", "10.2.0.0-10.255.255.255"}},
+		{"10.0.0.0/8", "10.1.0.0/16,10.2.0.0/16", []string{"10.0.0.0/16", "10.3.0.0-10.255.255.255"}},
+
+		// Holes at the first and last addresses.
+		{"10.0.0.0/8", "10.0.0.0/16", []string{"10.1.0.0-10.255.255.255"}},
+		{"10.0.0.0/8", "10.255.0.0/16", []string{"10.0.0.0-10.254.255.255"}},
+		{"192.168.1.0/24", "192.168.1.0,192.168.1.255", []string{"192.168.1.1-192.168.1.254"}},
+		{"192.168.1.0/24", "192.168.1.0/25", []string{"192.168.1.128/25"}},
+
+		// Exceptions covering all of the network, or outside it.
+		{"10.0.0.0/8", "10.0.0.0/8", nil},
+		{"10.0.0.0/8", "10.0.0.0/9,10.128.0.0/9", nil},
+		{"10.0.0.0/8", "192.168.0.0/16", nil},
+		{"10.0.0.0/16", "10.0.0.0/8", nil},
+		{"10.0.0.0/8", "", nil},
+	}
+	for _, tt := range tests {
+		network := netip.MustParsePrefix(tt.network)
+		except, err := ParseExcept(network, strings.Split(tt.except, ","))
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseExcept(%s, %s) = %v, want an error", tt.network, tt.except, except)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseExcept(%s, %s): %v", tt.network, tt.except, err)
+			continue
+		}
+
+		spec := RuleSpec{Action: "block", Network: network, Except: except, Weight: 12, Group: "g"}
+		intent := spec.String()
+		var got []string
+		for _, piece := range ExpandExceptions([]RuleSpec{spec}) {
+			got = append(got, piece.address())
+			if piece.Meta.Intent != intent || piece.Weight != 12 || piece.Group != "g" || piece.Action != "block" || len(piece.Except) != 0 {
+				t.Errorf("%s: piece %s = %+v, want the intent, weight, group and action of the rule", intent, piece.address(), piece)
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s expands to %v, want %v", intent, got, tt.want)
+		}
+	}
+
+	// Rules without exceptions are kept as they are.
+	plain := RuleSpec{Action: "permit", Network: netip.MustParsePrefix("10.0.0.0/8")}
+	if got := ExpandExceptions([]RuleSpec{plain}); len(got) != 1 || got[0].String() != plain.String() || got[0].Meta.Intent != "" {
+		t.Errorf("ExpandExceptions(%v) = %+v", plain, got)
+	}
+}
+
+func TestRuleSpecNetworks(t *testing.T) {
+	spec := RuleSpec{
+		Network: netip.MustParsePrefix("10.0.0.5/8"),
+		Except:  []netip.Prefix{netip.MustParsePrefix("10.128.0.0/9")},
+	}
+	if got := spec.Networks(); !slices.Equal(got, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/9")}) {
+		t.Errorf("Networks() = %v, want [10.0.0.0/9]", got)
+	}
+}
@@ -0,0 +1,119 @@
+package firewall
+
+import (
+	"sync"
+
+	"golang.org/x/sys/windows"
+)
+
+/*
+ * Like the net event callback, the filter change callback is shared by every
+ * subscription, which the context argument identifies.
+ */
+var (
+	filterChangeCallbackOnce sync.Once
+	filterChangeCallback     uintptr
+
+	filterChangeSubscribersMu sync.Mutex
+	filterChangeSubscribers   = make(map[uintptr]*filterChangeSubscription)
+	filterChangeNextCookie    uintptr
+)
+
+type filterChangeSubscription struct {
+	session   uintptr
+	handles   []uintptr // One per layer.
+	cookie    uintptr
+	changes   chan FilterChange
+	closeOnce sync.Once
+	closeErr  error
+}
+
+/*
+ * Subscribes to the additions and deletions of the filters of provider, in
+ * every layer rules are added to. A subscription is limited by a filter
+ * enumeration template, which names a single layer, so there is one per
+ * layer, all delivering to the same channel. Changes that arrive while the
+ * consumer is not keeping up are discarded rather than blocking the WFP
+ * callback thread.
+ */
+func subscribeFilterChanges(session uintptr, provider GUID) (FilterChangeSource, error) {
+	filterChangeCallbackOnce.Do(func() {
+		filterChangeCallback = windows.NewCallback(filterChangeCallbackProc)
+	})
+
+	filterChangeSubscribersMu.Lock()
+	filterChangeNextCookie++
+	sub := &filterChangeSubscription{
+		session: session,
+		cookie:  filterChangeNextCookie,
+		changes: make(chan FilterChange, 1024),
+	}
+	filterChangeSubscribers[sub.cookie] = sub
+	filterChangeSubscribersMu.Unlock()
+
+	providerKey := windows.GUID(provider)
+	notifyFlags := cFWPM_SUBSCRIPTION_FLAG_NOTIFY_ON_ADD | cFWPM_SUBSCRIPTION_FLAG_NOTIFY_ON_DELETE
+	for _, layer := range knownLayers {
+		template := wtFwpmFilterEnumTemplate0{
+			providerKey: &providerKey,                 // *windows.GUID: Only the filters of provider.
+			layerKey:    layerKeys[layer],             // windows.GUID: The layer to watch.
+			enumType:    cFWP_FILTER_ENUM_OVERLAPPING, // cFWP_FILTER_ENUM_OVERLAPPING: With no conditions, every filter of the layer.
+			actionMask:  0xFFFFFFFF,                   // 0xFFFFFFFF: Filters with any action.
+		}
+		subscription := wtFwpmFilterSubscription0{
+			enumTemplate: &template,   // *wtFwpmFilterEnumTemplate0: A pointer to a FWPM_FILTER_ENUM_TEMPLATE0 structure that limits the subscription.
+			flags:        notifyFlags, // notifyFlags: Notify both the additions and the deletions of filters.
+		}
+
+		// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfiltersubscribechanges0
+		var handle uintptr
+		err := fwpmFilterSubscribeChanges0(session, &subscription, filterChangeCallback, sub.cookie, &handle)
+		if err != nil {
+			sub.Close()
+			return nil, wfpErr("FwpmFilterSubscribeChanges0", layer, err)
+		}
+		sub.handles = append(sub.handles, handle)
+	}
+
+	return sub, nil
+}
+
+func (s *filterChangeSubscription) Changes() <-chan FilterChange {
+	return s.changes
+}
+
+func (s *filterChangeSubscription) Close() error {
+	s.closeOnce.Do(func() {
+		// FwpmFilterUnsubscribeChanges0 waits for in-flight callbacks to
+		// return, so nothing writes to the channel once it has been closed.
+		for _, handle := range s.handles {
+			// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfilterunsubscribechanges0
+			err := fwpmFilterUnsubscribeChanges0(s.session, handle)
+			if err != nil && s.closeErr == nil {
+				s.closeErr = wfpErr("FwpmFilterUnsubscribeChanges0", "", err)
+			}
+		}
+		filterChangeSubscribersMu.Lock()
+		delete(filterChangeSubscribers, s.cookie)
+		filterChangeSubscribersMu.Unlock()
+		close(s.changes)
+	})
+	return s.closeErr
+}
+
+func filterChangeCallbackProc(context uintptr, change *wtFwpmFilterChange0) uintptr {
+	if change == nil {
+		return 0
+	}
+	filterChangeSubscribersMu.Lock()
+	sub := filterChangeSubscribers[context]
+	filterChangeSubscribersMu.Unlock()
+	if sub == nil {
+		return 0
+	}
+	select {
+	case sub.changes <- FilterChange{Type: FilterChangeType(change.changeType), Key: GUID(change.filterKey), ID: change.filterID}:
+	default:
+	}
+	return 0
+}
@@ -0,0 +1,135 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+ * listRules reads back, from the engine itself, every filter of the provider
+ * of baseObjects, ordered by filter ID. In persistent mode this includes the
+ * filters added by earlier runs.
+ */
+func listRules(session Session, baseObjects *baseObjects) ([]RuleInfo, error) {
+	var rules []RuleInfo
+	for _, layer := range knownLayers {
+		filters, err := session.Filters(baseObjects.provider, layer)
+		if err != nil {
+			return nil, err
+		}
+		for _, filter := range filters {
+			rules = append(rules, decodeFilter(baseObjects, filter))
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].FilterID < rules[j].FilterID })
+	return rules, nil
+}
+
+// decodeFilter recovers the rule a filter was added for.
+func decodeFilter(baseObjects *baseObjects, filter Filter) RuleInfo {
+	group, action := parseFilterDescription(filter.Description)
+	var meta RuleMetadata
+	if len(filter.ProviderData) > 0 {
+		if err := meta.UnmarshalBinary(filter.ProviderData); err == nil {
+			group, action = meta.Group, meta.Action
+		} else if err != errNoMetadata {
+			logger.Warn("invalid rule metadata", "filter_id", filter.ID, ErrAttr(err))
+		}
+	}
+	disabled := filter.Sublayer == baseObjects.disabled
+	if !disabled {
+		action = filter.Action.String()
+	}
+
+	rule := RuleInfo{
+		FilterID:   filter.ID,
+		Name:       filter.Name,
+		Action:     action,
+		Layer:      filter.Layer,
+		Direction:  layerDirection(filter.Layer),
+		Family:     layerFamily(filter.Layer),
+		Weight:     filter.Weight,
+		Group:      group,
+		Disabled:   disabled,
+		Metadata:   meta,
+		Conditions: filter.Conditions,
+	}
+	rule.Network = addressesString(filter.Conditions)
+	return rule
+}
+
+// layerFamily returns the address family of the traffic a layer sees, or
+// "ethernet" for the frames of the MAC layers.
+func layerFamily(layer string) string {
+	switch {
+	case strings.Contains(layer, "_MAC_FRAME_"):
+		return "ethernet"
+	case strings.HasSuffix(layer, "_V6"):
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// layerDirection returns the direction of the traffic a layer sees.
+func layerDirection(layer string) string {
+	if strings.HasPrefix(layer, "ALE_AUTH_RECV_ACCEPT_") || strings.HasPrefix(layer, "INBOUND_") {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+/*
+ * checkOwnFilters fails with ErrNotFound, for all of them at once, if some of
+ * ids are not filters of the provider of baseObjects, so that a wrong ID never
+ * deletes the filters of Windows or of other software.
+ */
+func checkOwnFilters(session Session, baseObjects *baseObjects, ids []uint64) error {
+	own := make(map[uint64]bool)
+	for _, layer := range knownLayers {
+		filters, err := session.Filters(baseObjects.provider, layer)
+		if err != nil {
+			return err
+		}
+		for _, filter := range filters {
+			own[filter.ID] = true
+		}
+	}
+	var errs []error
+	for _, id := range ids {
+		if !own[id] {
+			errs = append(errs, fmt.Errorf("filter %d: not a rule of this engine: %w", id, ErrNotFound))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func deleteFilter(session Session, filterID uint64) error {
+	err := session.DeleteFilter(filterID)
+	if err != nil {
+		return fmt.Errorf("filter %d: %w", filterID, err)
+	}
+	logger.Debug("filter deleted", "filter_id", filterID)
+	return nil
+}
+
+/*
+ * inTransaction runs fn in a transaction, committed if fn succeeds and aborted
+ * otherwise.
+ */
+func inTransaction(session Session, fn func() error) error {
+	err := session.BeginTransaction()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		if abortErr := session.AbortTransaction(); abortErr != nil {
+			logger.Warn("failed to abort transaction", ErrAttr(abortErr))
+		}
+		return err
+	}
+
+	return session.CommitTransaction()
+}
@@ -1,100 +1,152 @@
 package firewall
 
-import (
-	"fmt"
-	"unsafe"
-
-	"golang.org/x/sys/windows"
-)
+import "fmt"
 
 /*
- * Responsible for creating a new Windows Filtering Platform (WFP) session.
+ * The provider and sublayers every filter of this package lives in. Dynamic
+ * ones get fresh keys in each session and go away with it; persistent ones
+ * have fixed keys, so that later runs find the filters of earlier ones.
  */
-func CreateWfpSession() (uintptr, error) {
-	sessionDisplayData, err := createWtFwpmDisplayData0("Custom WFP Rules Generator", "Custom WFP Rules Generator - dynamic session")
-	if err != nil {
-		return 0, wrapErr(err)
-	}
+type baseObjects struct {
+	provider   GUID
+	filters    GUID
+	disabled   GUID // Sublayer holding the filters of disabled groups.
+	persistent bool // Objects outlive the session.
 
-	session := wtFwpmSession0{
-		displayData:          *sessionDisplayData,        // *wtFwpmDisplayData0: A pointer to a FWPM_DISPLAY_DATA0 structure that contains the display data for the session.
-		flags:                cFWPM_SESSION_FLAG_DYNAMIC, // cFWPM_SESSION_FLAG_DYNAMIC: The session is dynamic and will be automatically deleted when the session handle is closed.
-		txnWaitTimeoutInMSec: windows.INFINITE,           // windows.INFINITE: The wait time is infinite.
-	}
+	sd SecurityDescriptor // Of the objects and their filters; nil for the default one.
+}
 
-	sessionHandle := uintptr(0)
+// Keys of the persistent base objects. Unlike the dynamic ones they are fixed,
+// so that later runs find the filters added by earlier ones.
+var (
+	// b75a2369-c9f3-4340-b9da-c698a06388a1
+	persistentProviderKey = GUID{
+		Data1: 0xb75a2369,
+		Data2: 0xc9f3,
+		Data3: 0x4340,
+		Data4: [8]byte{0xb9, 0xda, 0xc6, 0x98, 0xa0, 0x63, 0x88, 0xa1},
+	}
 
-	// fwpmEngineOpen0: Opens a session with the filter engine.
-	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmengineopen0
-	err = fwpmEngineOpen0(nil, cRPC_C_AUTHN_WINNT, nil, &session, unsafe.Pointer(&sessionHandle))
-	if err != nil {
-		return 0, wrapErr(err)
+	// 4bb0cb90-c0b9-4a7f-bb56-575ad1efcad8
+	persistentFiltersSublayerKey = GUID{
+		Data1: 0x4bb0cb90,
+		Data2: 0xc0b9,
+		Data3: 0x4a7f,
+		Data4: [8]byte{0xbb, 0x56, 0x57, 0x5a, 0xd1, 0xef, 0xca, 0xd8},
 	}
 
-	return sessionHandle, nil
-}
+	// d525be08-15d5-477e-a961-5c89c3f00b23
+	persistentDisabledSublayerKey = GUID{
+		Data1: 0xd525be08,
+		Data2: 0x15d5,
+		Data3: 0x477e,
+		Data4: [8]byte{0xa9, 0x61, 0x5c, 0x89, 0xc3, 0xf0, 0x0b, 0x23},
+	}
+)
 
-func RegisterBaseObjects(session uintptr) (*baseObjects, error) {
+/*
+ * Registers the provider and sublayers, named after name. Those of a dynamic
+ * session, and every filter added to them, are deleted when the session is
+ * closed. Persistent ones are reused if an earlier run already registered
+ * them, and their filters stay in place, across reboots, until deleted.
+ *
+ * With sd, the objects, and every filter added to them, get it as their
+ * security descriptor; reused persistent objects are given it too.
+ */
+func registerBaseObjects(session Session, persistent bool, name string, sd SecurityDescriptor) (*baseObjects, error) {
 
 	//
 	// Initilize BaseObject structure
 	//
-	bo := &baseObjects{}
-	var err error
-	bo.provider, err = windows.GenerateGUID()
-	if err != nil {
-		return nil, wrapErr(err)
-	}
-	bo.filters, err = windows.GenerateGUID()
-	if err != nil {
-		return nil, wrapErr(err)
-	}
-
-	//
-	// Register provider.
-	//
-	{
-		displayData, err := createWtFwpmDisplayData0("Custom WFP Rules Generator", "Custom WFP Rules Generator - provider")
+	bo := &baseObjects{persistent: persistent, sd: sd}
+	if persistent {
+		bo.provider = persistentProviderKey
+		bo.filters = persistentFiltersSublayerKey
+		bo.disabled = persistentDisabledSublayerKey
+	} else {
+		var err error
+		bo.provider, err = NewGUID()
 		if err != nil {
 			return nil, wrapErr(err)
 		}
-		provider := wtFwpmProvider0{
-			providerKey: bo.provider,  // *windows.GUID: A pointer to a GUID that uniquely identifies the provider.
-			displayData: *displayData, // *wtFwpmDisplayData0: A pointer to a FWPM_DISPLAY_DATA0 structure that contains the display data for the provider.
+		bo.filters, err = NewGUID()
+		if err != nil {
+			return nil, wrapErr(err)
 		}
-
-		// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmprovideradd0
-		err = fwpmProviderAdd0(session, &provider, 0)
+		bo.disabled, err = NewGUID()
 		if err != nil {
 			return nil, wrapErr(err)
 		}
 	}
 
 	//
-	// Register filters sublayer.
+	// Register provider.
 	//
 	{
-		displayData, err := createWtFwpmDisplayData0("Custom WFP Rules Generator", "Custom WFP Rules Generator - Permissive and blocking filters")
-		if err != nil {
-			return nil, wrapErr(err)
+		provider := Provider{
+			Key:         bo.provider,
+			Name:        name,
+			Description: name + " - provider",
+			Persistent:  persistent,
+
+			SecurityDescriptor: sd,
 		}
-		sublayer := wtFwpmSublayer0{
-			subLayerKey: bo.filters,   // *windows.GUID: A pointer to a GUID that uniquely identifies the sublayer.
-			displayData: *displayData, // *wtFwpmDisplayData0: A pointer to a FWPM_DISPLAY_DATA0 structure that contains the display data for the sublayer.
-			providerKey: &bo.provider, // *windows.GUID: A pointer to a GUID that uniquely identifies the provider.
-			weight:      ^uint16(0),   // ^uint16(0): The weight of the sublayer.
+		err := session.AddProvider(&provider)
+		if err != nil && persistent && hasCode(err, FWP_E_ALREADY_EXISTS) {
+			err = nil
+			if sd != nil {
+				err = session.SetProviderSecurity(bo.provider, sd)
+			}
 		}
-
-		// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmsublayeradd0
-		err = fwpmSubLayerAdd0(session, &sublayer, 0)
 		if err != nil {
-			return nil, wrapErr(err)
+			return nil, err
 		}
 	}
 
+	//
+	// Register filters sublayer.
+	//
+	err := addSublayer(session, bo, bo.filters, name, name+" - Permissive and blocking filters", ^uint16(0))
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	// Register the sublayer of disabled groups. Its filters are soft permits in
+	// the lowest-weight sublayer, which never change the verdict: any block
+	// from another sublayer overrides them, and permit is the default anyway.
+	//
+	err = addSublayer(session, bo, bo.disabled, name, name+" - Disabled filters", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("base objects registered", "provider", bo.provider.String(), "sublayer", bo.filters.String(), "disabled_sublayer", bo.disabled.String(), "persistent", persistent)
+
 	return bo, nil
 }
 
+func addSublayer(session Session, bo *baseObjects, key GUID, name, description string, weight uint16) error {
+	sublayer := Sublayer{
+		Key:         key,
+		Provider:    bo.provider,
+		Name:        name,
+		Description: description,
+		Weight:      weight,
+		Persistent:  bo.persistent,
+
+		SecurityDescriptor: bo.sd,
+	}
+	err := session.AddSublayer(&sublayer)
+	if err != nil && bo.persistent && hasCode(err, FWP_E_ALREADY_EXISTS) {
+		if bo.sd == nil {
+			return nil
+		}
+		return session.SetSublayerSecurity(key, bo.sd)
+	}
+	return err
+}
+
 /*
 func ipNetMaskToUint32(ipNet netip.Prefix) uint32 {
 	ones := ipNet.Bits()
@@ -112,13 +164,6 @@ func wrapErr(err error) error {
 	return fmt.Errorf("WFP operation failed: %w", err)
 }
 
-func createWtFwpmDisplayData0(name, description string) (*wtFwpmDisplayData0, error) {
-	return &wtFwpmDisplayData0{
-		name:        windows.StringToUTF16Ptr(name),        // windows.StringToUTF16Ptr(name): A pointer to a null-terminated Unicode string that contains the name of the object.
-		description: windows.StringToUTF16Ptr(description), // windows.StringToUTF16Ptr(description): A pointer to a null-terminated Unicode string that contains the description of the object.
-	}, nil
-}
-
 /*
 func checkWindowsError(err error) error {
 	if err != nil && err != windows.ERROR_SUCCESS {
@@ -127,10 +172,3 @@ func checkWindowsError(err error) error {
 	return nil
 }
 */
-
-func filterWeight(weight uint8) wtFwpValue0 {
-	return wtFwpValue0{
-		_type: cFWP_UINT8,      // cFWP_UINT8: The data type of the value.
-		value: uintptr(weight), // uintptr(weight): The value.
-	}
-}
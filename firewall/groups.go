@@ -0,0 +1,150 @@
+package firewall
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+ * Rules can be put in named groups ("quarantine", "office-hours",
+ * "feed:spamhaus"), which are then enabled, disabled, replaced or deleted as a
+ * unit, each operation in a single WFP transaction.
+ *
+ * Membership is kept in the description of the filter, so that it can be read
+ * back from WFP alone, e.g. by a later run in persistent mode. A disabled group
+ * keeps its filters, turned into soft permits in the disabled sublayer (see
+ * registerBaseObjects), and the description also records their real action.
+ */
+
+const maxGroupNameLen = 64
+
+func ValidateGroupName(group string) error {
+	if group == "" {
+		return fmt.Errorf("empty group name")
+	}
+	if len(group) > maxGroupNameLen {
+		return fmt.Errorf("group name %q is longer than %d characters", group, maxGroupNameLen)
+	}
+	for _, c := range group {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return fmt.Errorf("group name %q: invalid character %q", group, c)
+		}
+	}
+	return nil
+}
+
+// filterDescription encodes the group of a filter and its action, e.g.
+// "group=quarantine action=block". Filters outside any group have no
+// description.
+func filterDescription(group, action string) string {
+	if group == "" {
+		return ""
+	}
+	return fmt.Sprintf("group=%s action=%s", group, action)
+}
+
+func parseFilterDescription(description string) (group, action string) {
+	for _, field := range strings.Fields(description) {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "group":
+			group = value
+		case "action":
+			action = value
+		}
+	}
+	return group, action
+}
+
+// groupRules lists the rules of group, failing with ErrNotFound if it has none.
+func groupRules(session Session, baseObjects *baseObjects, group string) ([]RuleInfo, error) {
+	rules, err := listRules(session, baseObjects)
+	if err != nil {
+		return nil, err
+	}
+	var members []RuleInfo
+	for _, rule := range rules {
+		if rule.Group == group {
+			members = append(members, rule)
+		}
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("group %q: %w", group, ErrNotFound)
+	}
+	return members, nil
+}
+
+// deleteGroup deletes every filter of group, returning how many there were.
+func deleteGroup(session Session, baseObjects *baseObjects, group string) (int, error) {
+	var n int
+	err := inTransaction(session, func() error {
+		members, err := groupRules(session, baseObjects, group)
+		if err != nil {
+			return err
+		}
+		for _, rule := range members {
+			if err := deleteFilter(session, rule.FilterID); err != nil {
+				return err
+			}
+		}
+		n = len(members)
+		return nil
+	})
+	if err == nil {
+		logger.Info("group deleted", "group", group, "rules", n)
+	}
+	return n, err
+}
+
+// enableGroup puts the filters of a disabled group back into effect,
+// returning how many were changed.
+func enableGroup(session Session, baseObjects *baseObjects, group string) (int, error) {
+	return setGroupDisabled(session, baseObjects, group, false)
+}
+
+// disableGroup takes the filters of group out of effect, without deleting
+// them, returning how many were changed.
+func disableGroup(session Session, baseObjects *baseObjects, group string) (int, error) {
+	return setGroupDisabled(session, baseObjects, group, true)
+}
+
+/*
+ * WFP filters cannot be modified, and FWPM_FILTER_FLAG_DISABLED can only be
+ * set by the system, so each filter is deleted and added again, in or out of
+ * the disabled sublayer, within one transaction.
+ */
+func setGroupDisabled(session Session, baseObjects *baseObjects, group string, disabled bool) (int, error) {
+	var n int
+	err := inTransaction(session, func() error {
+		members, err := groupRules(session, baseObjects, group)
+		if err != nil {
+			return err
+		}
+		for _, rule := range members {
+			if rule.Disabled == disabled {
+				continue
+			}
+			spec, err := conditionsSpec(rule.Conditions)
+			if err != nil {
+				return &RuleError{Rule: rule.Name, CIDR: rule.Network, Layer: rule.Layer, Err: fmt.Errorf("filter %d: %w", rule.FilterID, err)}
+			}
+			if err := deleteFilter(session, rule.FilterID); err != nil {
+				return err
+			}
+			spec.Action, spec.Host, spec.Weight, spec.Group, spec.Meta = rule.Action, rule.Metadata.Host, rule.Weight, group, rule.Metadata
+			spec.Direction = rule.Direction
+			if _, err := addCIDRFilter(session, baseObjects, spec, disabled); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err == nil {
+		logger.Info("group updated", "group", group, "disabled", disabled, "rules", n)
+	}
+	return n, err
+}
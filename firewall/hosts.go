@@ -0,0 +1,247 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+/*
+ * HostRules keeps the filters of hostname rules in line with what the names
+ * resolve to. Every address of a name, IPv4 or IPv6 (only those of the family
+ * of its local addresses, if the rule has some), gets a filter of the rule's
+ * action, weight and group, with the hostname in its metadata. When a
+ * name resolves to other addresses, the filters of the addresses gone are
+ * deleted and those of the new ones added in a single transaction, together
+ * with the changes of every other name due at the same time.
+ *
+ * A name is resolved again when the TTL of its records expires, kept between
+ * minHostRefresh and maxHostRefresh, or every Interval if set. A failed
+ * resolution leaves the filters of the name as they are and is retried after
+ * minHostRefresh, so that a DNS outage does not open a blocked host.
+ *
+ * Refresh and Run must not be called concurrently.
+ */
+type HostRules struct {
+	Engine   *Engine
+	Resolver Resolver
+	Interval time.Duration // Fixed time between resolutions; 0 to follow the TTL.
+	Rules    *RuleIndex    // Kept up to date with the filters, if set.
+	Metrics  *Metrics      // Resolutions and updates are counted, if set.
+
+	hosts []*hostRule
+}
+
+// Bounds of the time between two resolutions of a name, when following the
+// TTL of its records.
+const (
+	minHostRefresh = 30 * time.Second
+	maxHostRefresh = time.Hour
+)
+
+type hostRule struct {
+	spec    RuleSpec
+	filters map[netip.Addr]uint64 // Filter of each address; nil until those in place are known.
+	next    time.Time             // When to resolve the name again.
+}
+
+// NewHostRules manages the rules of specs that have a Host; the others are
+// left out.
+func NewHostRules(engine *Engine, resolver Resolver, specs []RuleSpec) *HostRules {
+	h := &HostRules{Engine: engine, Resolver: resolver}
+	for _, spec := range specs {
+		if spec.Host != "" {
+			h.hosts = append(h.hosts, &hostRule{spec: spec})
+		}
+	}
+	return h
+}
+
+/*
+ * Refresh resolves the names that are due and applies the changes. The first
+ * time, the filters already in place for a rule, added by an earlier run in
+ * persistent mode, are taken over rather than added again. Failures are
+ * logged, and returned all at once.
+ */
+func (h *HostRules) Refresh(ctx context.Context) error {
+	now := time.Now()
+	var due []*hostRule
+	for _, host := range h.hosts {
+		if !now.Before(host.next) {
+			due = append(due, host)
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+	if err := h.adopt(ctx, due); err != nil {
+		logger.Warn("failed to list host rules in place", ErrAttr(err))
+		return err
+	}
+
+	var errs []error
+	var remove []uint64
+	var add []Rule
+	var addedAddrs []netip.Addr
+	var addedHosts []*hostRule
+	resolved := make(map[*hostRule]map[netip.Addr]bool)
+	for _, host := range due {
+		addrs, ttl, err := h.Resolver.Resolve(ctx, host.spec.Host)
+		if err == nil && len(addrs) == 0 {
+			err = fmt.Errorf("resolve %s: no addresses", host.spec.Host)
+		}
+		if h.Metrics != nil {
+			h.Metrics.ObserveFeedRefresh("dns:"+host.spec.Host, err)
+		}
+		if err != nil {
+			logger.Warn("failed to resolve host, its rules are kept", "host", host.spec.Host, "rules", len(host.filters), ErrAttr(err))
+			host.next = now.Add(minHostRefresh)
+			errs = append(errs, err)
+			continue
+		}
+		host.next = now.Add(h.refreshAfter(ttl))
+
+		want := make(map[netip.Addr]bool, len(addrs))
+		for _, addr := range addrs {
+			addr = addr.Unmap()
+			if want[addr] || !host.accepts(addr) {
+				continue
+			}
+			want[addr] = true
+			if _, ok := host.filters[addr]; !ok {
+				add = append(add, host.rule(addr))
+				addedAddrs = append(addedAddrs, addr)
+				addedHosts = append(addedHosts, host)
+			}
+		}
+		for addr, id := range host.filters {
+			if !want[addr] {
+				remove = append(remove, id)
+			}
+		}
+		resolved[host] = want
+	}
+	if len(remove) == 0 && len(add) == 0 {
+		return errors.Join(errs...)
+	}
+
+	start := time.Now()
+	summary, err := h.Engine.Update(ctx, remove, add, OnErrorAbort)
+	if err == nil && summary.RolledBack {
+		for _, result := range summary.Results {
+			if result.Err != nil {
+				err = result.Err
+			}
+		}
+	}
+	if h.Metrics != nil {
+		h.Metrics.ObserveReload(time.Since(start), err)
+	}
+	if err != nil {
+		// Nothing changed: try again soon.
+		for host := range resolved {
+			host.next = now.Add(minHostRefresh)
+		}
+		logger.Warn("failed to update host rules, the previous ones are kept", ErrAttr(err))
+		return errors.Join(append(errs, err)...)
+	}
+
+	for host, want := range resolved {
+		for addr, id := range host.filters {
+			if !want[addr] {
+				delete(host.filters, addr)
+				if h.Rules != nil {
+					h.Rules.Remove(id)
+				}
+				logger.Info("host rule removed", "host", host.spec.Host, "address", addr, "filter_id", id)
+			}
+		}
+	}
+	for i, result := range summary.Results {
+		addedHosts[i].filters[addedAddrs[i]] = result.Rule.FilterID
+		if h.Rules != nil {
+			h.Rules.Add(result.Rule)
+		}
+		logger.Info("host rule added", "host", addedHosts[i].spec.Host, "address", addedAddrs[i], "filter_id", result.Rule.FilterID)
+	}
+	return errors.Join(errs...)
+}
+
+// Run refreshes the rules whenever a name is due, until ctx is done.
+func (h *HostRules) Run(ctx context.Context) {
+	if len(h.hosts) == 0 {
+		return
+	}
+	for {
+		next := h.hosts[0].next
+		for _, host := range h.hosts[1:] {
+			if host.next.Before(next) {
+				next = host.next
+			}
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		h.Refresh(ctx) // Failures are logged, and retried.
+	}
+}
+
+// refreshAfter returns how long the answer of a resolution is kept.
+func (h *HostRules) refreshAfter(ttl time.Duration) time.Duration {
+	if h.Interval > 0 {
+		return h.Interval
+	}
+	return min(max(ttl, minHostRefresh), maxHostRefresh)
+}
+
+// adopt finds the filters in place for the hosts not seen yet: those of the
+// same hostname, action, direction, weight and group.
+func (h *HostRules) adopt(ctx context.Context, hosts []*hostRule) error {
+	var rules []Rule
+	for _, host := range hosts {
+		if host.filters != nil {
+			continue
+		}
+		if rules == nil {
+			var err error
+			if rules, err = h.Engine.List(ctx); err != nil {
+				return err
+			}
+		}
+		host.filters = make(map[netip.Addr]uint64)
+		for _, rule := range rules {
+			spec, err := rule.spec()
+			if err != nil || spec.Host != host.spec.Host || spec.Action != host.spec.Action ||
+				spec.inbound() != host.spec.inbound() || spec.Weight != host.spec.Weight || spec.Group != host.spec.Group || spec.Range.IsValid() {
+				continue
+			}
+			host.filters[spec.Network.Addr()] = rule.ID
+		}
+	}
+	return nil
+}
+
+// accepts reports whether addr can be matched along with the local addresses
+// of the rule, if any, which are of one address family.
+func (r *hostRule) accepts(addr netip.Addr) bool {
+	for _, c := range r.spec.Conditions {
+		if c.Field == FieldLocalAddress && (!c.Range.IsValid() && c.Network.Addr().Is6()) != addr.Is6() {
+			return false
+		}
+	}
+	return true
+}
+
+// rule is the rule of addr, one of the addresses of the host.
+func (r *hostRule) rule(addr netip.Addr) Rule {
+	spec := r.spec
+	spec.Network = netip.PrefixFrom(addr, addr.BitLen())
+	spec.Meta.Intent = r.spec.String()
+	return spec.Rule()
+}
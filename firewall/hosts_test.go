@@ -0,0 +1,146 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers from a map, which tests change between refreshes.
+type fakeResolver map[string]fakeAnswer
+
+type fakeAnswer struct {
+	addrs []string
+	err   error
+}
+
+func (r fakeResolver) Resolve(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	answer, ok := r[host]
+	if !ok {
+		return nil, 0, errNXDomain
+	}
+	if answer.err != nil {
+		return nil, 0, answer.err
+	}
+	var addrs []netip.Addr
+	for _, s := range answer.addrs {
+		addrs = append(addrs, netip.MustParseAddr(s))
+	}
+	return addrs, time.Minute, nil
+}
+
+// hostFilters returns the filter of each remote address in backend.
+func hostFilters(t *testing.T, backend *MemoryBackend) map[netip.Addr]uint64 {
+	t.Helper()
+	filters := make(map[netip.Addr]uint64)
+	for _, f := range backend.Filters() {
+		for _, c := range f.Conditions {
+			if c.Field == FieldRemoteAddress {
+				filters[c.Network.Addr()] = f.ID
+			}
+		}
+	}
+	return filters
+}
+
+// refreshNow refreshes every name of h, whether due or not.
+func refreshNow(h *HostRules) error {
+	for _, host := range h.hosts {
+		host.next = time.Time{}
+	}
+	return h.Refresh(context.Background())
+}
+
+func addrList(s ...string) []netip.Addr {
+	var addrs []netip.Addr
+	for _, a := range s {
+		addrs = append(addrs, netip.MustParseAddr(a))
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	return addrs
+}
+
+func TestHostRulesRefresh(t *testing.T) {
+	backend := NewMemoryBackend()
+	engine := openMemoryEngine(t, backend)
+	resolver := fakeResolver{"updates.example": {addrs: []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}}}
+	h := NewHostRules(engine, resolver, []RuleSpec{{Action: "block", Host: "updates.example", Weight: firstRuleWeight}})
+
+	if err := h.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	first := hostFilters(t, backend)
+	if got := slices.SortedFunc(maps.Keys(first), netip.Addr.Compare); !slices.Equal(got, addrList("192.0.2.1", "192.0.2.2", "2001:db8::1")) {
+		t.Fatalf("filters of %v, want both families", got)
+	}
+	rules, err := engine.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range rules {
+		if rule.Metadata.Host != "updates.example" {
+			t.Errorf("rule %d: host %q, want updates.example", rule.ID, rule.Metadata.Host)
+		}
+	}
+
+	// Only the addresses that changed are deleted and added.
+	resolver["updates.example"] = fakeAnswer{addrs: []string{"192.0.2.2", "192.0.2.3"}}
+	if err := refreshNow(h); err != nil {
+		t.Fatal(err)
+	}
+	second := hostFilters(t, backend)
+	if got := slices.SortedFunc(maps.Keys(second), netip.Addr.Compare); !slices.Equal(got, addrList("192.0.2.2", "192.0.2.3")) {
+		t.Fatalf("filters of %v after the change, want 192.0.2.2 and 192.0.2.3", got)
+	}
+	if second[netip.MustParseAddr("192.0.2.2")] != first[netip.MustParseAddr("192.0.2.2")] {
+		t.Errorf("filter of an unchanged address replaced")
+	}
+
+	// A failed resolution keeps the filters, and is retried soon.
+	failure := errors.New("server unreachable")
+	resolver["updates.example"] = fakeAnswer{err: failure}
+	before := time.Now()
+	if err := refreshNow(h); !errors.Is(err, failure) {
+		t.Errorf("Refresh = %v, want %v", err, failure)
+	}
+	if got := hostFilters(t, backend); !maps.Equal(got, second) {
+		t.Errorf("filters after a failed resolution = %v, want %v", got, second)
+	}
+	if next := h.hosts[0].next; next.Before(before.Add(minHostRefresh)) || next.After(time.Now().Add(minHostRefresh)) {
+		t.Errorf("next resolution at %v, want in %v", next, minHostRefresh)
+	}
+
+	// Nor does a resolution without addresses delete them.
+	resolver["updates.example"] = fakeAnswer{}
+	if err := refreshNow(h); err == nil {
+		t.Error("Refresh without addresses succeeded")
+	}
+	if got := hostFilters(t, backend); !maps.Equal(got, second) {
+		t.Errorf("filters after an empty resolution = %v, want %v", got, second)
+	}
+}
+
+func TestHostRulesLocalFamily(t *testing.T) {
+	backend := NewMemoryBackend()
+	engine := openMemoryEngine(t, backend)
+	resolver := fakeResolver{"updates.example": {addrs: []string{"192.0.2.1", "2001:db8::1", "2001:db8::2"}}}
+	spec := RuleSpec{
+		Action:     "block",
+		Host:       "updates.example",
+		Weight:     firstRuleWeight,
+		Conditions: []Condition{LocalAddress(netip.MustParsePrefix("10.0.0.0/8"))},
+	}
+	h := NewHostRules(engine, resolver, []RuleSpec{spec})
+
+	// The AAAA answers cannot be matched along with an IPv4 local address.
+	if err := h.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := slices.SortedFunc(maps.Keys(hostFilters(t, backend)), netip.Addr.Compare); !slices.Equal(got, addrList("192.0.2.1")) {
+		t.Errorf("filters of %v, want only 192.0.2.1", got)
+	}
+}
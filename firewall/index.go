@@ -0,0 +1,79 @@
+package firewall
+
+import (
+	"sort"
+	"sync"
+)
+
+/*
+ * RuleInfo describes a filter added by this package. It is what the rest of
+ * the tool knows about a filter once it has been handed to WFP, and it is the
+ * key used to correlate WFP net events (which only carry a filter ID) back to
+ * the rule that produced them.
+ */
+type RuleInfo struct {
+	FilterID   uint64 // Runtime filter ID assigned by fwpmFilterAdd0.
+	Name       string // Display name of the filter.
+	Action     string // "permit" or "block".
+	Network    string // CIDR or range the filter matches, as given by the user; several are comma-separated. Empty for Ethernet frames.
+	Layer      string // Name of the WFP layer the filter lives in.
+	Direction  string // "outbound" or "inbound".
+	Family     string // "ipv4", "ipv6" or "ethernet".
+	Weight     uint8  // Weight of the filter within the sublayer.
+	Group      string // Named group the rule belongs to, if any.
+	Disabled   bool   // The group is disabled: the filter does not affect traffic.
+	Metadata   RuleMetadata
+	Conditions []Condition // Every condition of the filter, the remote addresses included.
+}
+
+// RuleIndex maps WFP filter IDs to the rules that created them. It is safe for
+// concurrent use, since net event callbacks run on WFP-owned threads.
+type RuleIndex struct {
+	mu    sync.RWMutex
+	rules map[uint64]RuleInfo
+}
+
+func NewRuleIndex() *RuleIndex {
+	return &RuleIndex{rules: make(map[uint64]RuleInfo)}
+}
+
+func (x *RuleIndex) Add(rule RuleInfo) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.rules[rule.FilterID] = rule
+}
+
+func (x *RuleIndex) Remove(filterID uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.rules, filterID)
+}
+
+func (x *RuleIndex) Lookup(filterID uint64) (RuleInfo, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	rule, ok := x.rules[filterID]
+	return rule, ok
+}
+
+// Set replaces the content of the index, e.g. with what Engine.List read back.
+func (x *RuleIndex) Set(rules []RuleInfo) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.rules = make(map[uint64]RuleInfo, len(rules))
+	for _, rule := range rules {
+		x.rules[rule.FilterID] = rule
+	}
+}
+
+// Rules returns a snapshot of the indexed rules ordered by filter ID.
+func (x *RuleIndex) Rules() []RuleInfo {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	rules := make([]RuleInfo, 0, len(x.rules))
+	for _, rule := range x.rules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].FilterID < rules[j].FilterID })
+	return rules
+}
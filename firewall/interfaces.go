@@ -0,0 +1,91 @@
+package firewall
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+ * InterfaceResolver finds the LUID of a network interface, the 64-bit
+ * identifier local interface conditions match, from its alias ("Ethernet 2")
+ * or its index. The system resolver asks Windows about the interfaces of the
+ * local machine; SetInterfaceResolver replaces it, e.g. with
+ * StaticInterfaces where there is no Windows to ask.
+ */
+type InterfaceResolver interface {
+	LUIDByAlias(alias string) (uint64, error)
+	LUIDByIndex(index uint32) (uint64, error)
+}
+
+// interfaces resolves the interfaces of conditions; systemInterfaces unless
+// the embedding program calls SetInterfaceResolver.
+var interfaces InterfaceResolver = systemInterfaces{}
+
+func SetInterfaceResolver(r InterfaceResolver) {
+	interfaces = r
+}
+
+// Interface is a network interface of StaticInterfaces.
+type Interface struct {
+	Alias string
+	Index uint32
+	LUID  uint64
+}
+
+// StaticInterfaces resolves a fixed set of interfaces, such as those of
+// another machine.
+type StaticInterfaces []Interface
+
+func (s StaticInterfaces) LUIDByAlias(alias string) (uint64, error) {
+	for _, i := range s {
+		if strings.EqualFold(i.Alias, alias) {
+			return i.LUID, nil
+		}
+	}
+	return 0, fmt.Errorf("no interface with alias %q", alias)
+}
+
+func (s StaticInterfaces) LUIDByIndex(index uint32) (uint64, error) {
+	for _, i := range s {
+		if i.Index == index {
+			return i.LUID, nil
+		}
+	}
+	return 0, fmt.Errorf("no interface with index %d", index)
+}
+
+/*
+ * ParseInterface returns the LUID of the interface s names: "luid:N" gives
+ * it directly, "index:N" by index, anything else is an alias. Indexes and
+ * aliases are resolved through the resolver of SetInterfaceResolver.
+ */
+func ParseInterface(s string) (uint64, error) {
+	kind, value, _ := strings.Cut(s, ":")
+	switch kind {
+	case "luid":
+		luid, err := strconv.ParseUint(value, 0, 64)
+		if err != nil || luid == 0 {
+			return 0, fmt.Errorf("invalid interface LUID %q", value)
+		}
+		return luid, nil
+	case "index":
+		index, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || index == 0 {
+			return 0, fmt.Errorf("invalid interface index %q", value)
+		}
+		luid, err := interfaces.LUIDByIndex(uint32(index))
+		if err != nil {
+			return 0, fmt.Errorf("interface index %d: %w", index, err)
+		}
+		return luid, nil
+	}
+	if s == "" {
+		return 0, fmt.Errorf("invalid interface: must be an alias, index:N or luid:N")
+	}
+	luid, err := interfaces.LUIDByAlias(s)
+	if err != nil {
+		return 0, fmt.Errorf("interface %q: %w", s, err)
+	}
+	return luid, nil
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package firewall
+
+import "fmt"
+
+// systemInterfaces has no interfaces to resolve outside Windows: a LUID must
+// be given, or another resolver set with SetInterfaceResolver.
+type systemInterfaces struct{}
+
+func (systemInterfaces) LUIDByAlias(alias string) (uint64, error) {
+	return 0, fmt.Errorf("resolving interface aliases: %w", ErrNotSupported)
+}
+
+func (systemInterfaces) LUIDByIndex(index uint32) (uint64, error) {
+	return 0, fmt.Errorf("resolving interface indexes: %w", ErrNotSupported)
+}
@@ -0,0 +1,74 @@
+package firewall
+
+import "testing"
+
+// countingInterfaces is a StaticInterfaces counting the lookups made.
+type countingInterfaces struct {
+	StaticInterfaces
+	lookups int
+}
+
+func (c *countingInterfaces) LUIDByAlias(alias string) (uint64, error) {
+	c.lookups++
+	return c.StaticInterfaces.LUIDByAlias(alias)
+}
+
+func (c *countingInterfaces) LUIDByIndex(index uint32) (uint64, error) {
+	c.lookups++
+	return c.StaticInterfaces.LUIDByIndex(index)
+}
+
+func TestParseInterface(t *testing.T) {
+	resolver := &countingInterfaces{StaticInterfaces: StaticInterfaces{
+		{Alias: "Ethernet 2", Index: 7, LUID: 0x6008001000000},
+		{Alias: "vEthernet (Default Switch)", Index: 31, LUID: 0x83000000000},
+	}}
+	SetInterfaceResolver(resolver)
+	t.Cleanup(func() { SetInterfaceResolver(systemInterfaces{}) })
+
+	tests := []struct {
+		in      string
+		want    uint64 // Zero for an error.
+		lookups int
+	}{
+		{"Ethernet 2", 0x6008001000000, 1},
+		{"ethernet 2", 0x6008001000000, 1}, // Aliases ignore case, as in Windows.
+		{"vEthernet (Default Switch)", 0x83000000000, 1},
+		{"index:7", 0x6008001000000, 1},
+		{"luid:0x6008001000000", 0x6008001000000, 0},
+		{"luid:12345", 12345, 0}, // Not checked against the interfaces.
+
+		{"Wi-Fi", 0, 1},
+		{"index:8", 0, 1},
+		{"index:0", 0, 0},
+		{"index:eth0", 0, 0},
+		{"luid:0", 0, 0},
+		{"luid:", 0, 0},
+		{"", 0, 0},
+	}
+	for _, tt := range tests {
+		resolver.lookups = 0
+		got, err := ParseInterface(tt.in)
+		switch {
+		case tt.want == 0 && err == nil:
+			t.Errorf("ParseInterface(%q) = %#x, want an error", tt.in, got)
+		case tt.want != 0 && (err != nil || got != tt.want):
+			t.Errorf("ParseInterface(%q) = %#x, %v; want %#x", tt.in, got, err, tt.want)
+		}
+		if resolver.lookups != tt.lookups {
+			t.Errorf("ParseInterface(%q): %d lookups, want %d", tt.in, resolver.lookups, tt.lookups)
+		}
+	}
+
+	// Conditions resolve the interface when parsed.
+	conditions, err := ParseCondition("local_interface!=Ethernet 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conditions) != 1 || conditions[0].Interface != 0x6008001000000 || conditions[0].Match != MatchNotEqual {
+		t.Errorf("ParseCondition = %v, want local_interface!=luid:%d", conditions, uint64(0x6008001000000))
+	}
+	if _, err := ParseCondition("local_interface=Wi-Fi"); err == nil {
+		t.Error("ParseCondition of an unknown interface succeeded")
+	}
+}
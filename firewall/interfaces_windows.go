@@ -0,0 +1,30 @@
+package firewall
+
+import "golang.org/x/sys/windows"
+
+// systemInterfaces resolves the interfaces of the local machine.
+type systemInterfaces struct{}
+
+func (systemInterfaces) LUIDByAlias(alias string) (uint64, error) {
+	name, err := windows.UTF16PtrFromString(alias)
+	if err != nil {
+		return 0, err
+	}
+	var luid uint64
+
+	// https://learn.microsoft.com/en-us/windows/win32/api/netioapi/nf-netioapi-convertinterfacealiastoluid
+	if err := convertInterfaceAliasToLuid(name, &luid); err != nil {
+		return 0, err
+	}
+	return luid, nil
+}
+
+func (systemInterfaces) LUIDByIndex(index uint32) (uint64, error) {
+	var luid uint64
+
+	// https://learn.microsoft.com/en-us/windows/win32/api/netioapi/nf-netioapi-convertinterfaceindextoluid
+	if err := convertInterfaceIndexToLuid(index, &luid); err != nil {
+		return 0, err
+	}
+	return luid, nil
+}
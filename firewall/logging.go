@@ -0,0 +1,66 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// logger is what the package logs through. It discards everything until the
+// embedding program calls SetLogger.
+var logger = slog.New(slog.DiscardHandler)
+
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// RuleError tells which rule an operation failed on.
+type RuleError struct {
+	Rule  string // Display name of the filter.
+	CIDR  string
+	Layer string
+	Err   error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("rule %q (%s, layer %s): %v", e.Rule, e.CIDR, e.Layer, e.Err)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+/*
+ * ErrAttr turns err into a structured "error" attribute, with the rule it
+ * happened on and the Win32/WFP error code as separate fields when known:
+ *
+ *	error.msg="..." error.rule="Block traffic to 10.0.0.0/8" error.cidr=10.0.0.0/8 error.layer=ALE_AUTH_CONNECT_V4 error.op=FwpmFilterAdd0 error.key={...} error.code=0x80320009 error.name=FWP_E_ALREADY_EXISTS
+ */
+func ErrAttr(err error) slog.Attr {
+	if err == nil {
+		return slog.Attr{}
+	}
+	attrs := []any{slog.String("msg", err.Error())}
+	var re *RuleError
+	if errors.As(err, &re) {
+		attrs = append(attrs,
+			slog.String("rule", re.Rule),
+			slog.String("cidr", re.CIDR),
+			slog.String("layer", re.Layer),
+		)
+	}
+	var we *Error
+	if errors.As(err, &we) {
+		attrs = append(attrs, slog.String("op", we.Op))
+		if we.Key != "" {
+			attrs = append(attrs, slog.String("key", we.Key))
+		}
+	}
+	if code := errorCode(err); code != "" {
+		attrs = append(attrs, slog.String("code", code))
+	}
+	if we != nil {
+		attrs = append(attrs, slog.String("name", we.Code.String()))
+	}
+	return slog.Group("error", attrs...)
+}
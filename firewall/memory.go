@@ -0,0 +1,694 @@
+package firewall
+
+import (
+	"bytes"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+ * MemoryBackend emulates the WFP engine in memory, so that everything above
+ * the Backend interface can run on any platform. It enforces the object
+ * semantics the rest of the package relies on:
+ *
+ *   - adding an object whose key is already used fails with FWP_E_ALREADY_EXISTS;
+ *   - a sublayer or filter referring to an unknown provider, sublayer or layer
+ *     is rejected with the matching FWP_E_*_NOT_FOUND;
+ *   - persistent objects cannot be added by dynamic sessions, nor refer to
+ *     objects that are not persistent (FWP_E_LIFETIME_MISMATCH);
+ *   - a filter condition must be on a field of the layer of the filter
+ *     (FWP_E_CONDITION_NOT_FOUND), have a match type the field accepts
+ *     (FWP_E_MATCH_TYPE_MISMATCH) and a value of the right type;
+ *   - a transaction holds the engine-wide transaction lock until it is
+ *     committed or aborted, and aborting it undoes every change made in it;
+ *   - the objects of a dynamic session are deleted when it is closed;
+ *   - filter changes are notified once committed, those of an aborted
+ *     transaction never;
+ *   - security descriptors must be well formed (ERROR_INVALID_SECURITY_DESCR),
+ *     but are only stored: sessions have no identity to check access for.
+ *
+ * Its state outlives the sessions, like that of the real engine, so a later
+ * session sees the persistent objects of an earlier one.
+ */
+type MemoryBackend struct {
+	txnLock chan struct{} // Held by the session in a transaction, or by a single call outside one.
+
+	mu        sync.Mutex
+	state     memoryState
+	nextID    uint64
+	listeners map[*memorySession]*memorySubscription
+	watchers  map[*memoryWatcher]bool
+}
+
+type memoryState struct {
+	providers map[GUID]memoryObject[Provider]
+	sublayers map[GUID]memoryObject[Sublayer]
+	filters   map[uint64]memoryObject[Filter]
+}
+
+// memoryObject is an object and the dynamic session that owns it, if any.
+type memoryObject[T any] struct {
+	value T
+	owner *memorySession
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		txnLock: make(chan struct{}, 1),
+		state: memoryState{
+			providers: make(map[GUID]memoryObject[Provider]),
+			sublayers: make(map[GUID]memoryObject[Sublayer]),
+			filters:   make(map[uint64]memoryObject[Filter]),
+		},
+		listeners: make(map[*memorySession]*memorySubscription),
+		watchers:  make(map[*memoryWatcher]bool),
+	}
+}
+
+func (m *MemoryBackend) Open(config SessionConfig) (Session, error) {
+	if err := config.Remote.Validate(); err != nil {
+		return nil, err
+	}
+	return &memorySession{backend: m, config: config}, nil
+}
+
+// Sublayers returns a copy of every sublayer in the engine.
+func (m *MemoryBackend) Sublayers() []Sublayer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sublayers := make([]Sublayer, 0, len(m.state.sublayers))
+	for _, obj := range m.state.sublayers {
+		sublayers = append(sublayers, obj.value)
+	}
+	return sublayers
+}
+
+// Filters returns a copy of every filter in the engine, whatever its provider,
+// ordered by ID.
+func (m *MemoryBackend) Filters() []Filter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	filters := make([]Filter, 0, len(m.state.filters))
+	for _, obj := range m.state.filters {
+		filters = append(filters, cloneFilter(obj.value))
+	}
+	sort.Slice(filters, func(i, j int) bool { return filters[i].ID < filters[j].ID })
+	return filters
+}
+
+// Emit delivers ev to the sessions subscribed to net events. Classify-allow
+// events only reach the subscriptions that asked for them.
+func (m *MemoryBackend) Emit(ev NetEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, sub := range m.listeners {
+		if ev.Type == NetEventClassifyAllow && !sub.allow {
+			continue
+		}
+		select {
+		case sub.events <- ev:
+		default:
+		}
+	}
+}
+
+/*
+ * DeleteFilter deletes the filter with the given ID as another program would,
+ * e.g. "netsh wfp" or a third-party firewall: outside every session, once the
+ * transaction lock is free, and notified to the subscribers of filter changes.
+ */
+func (m *MemoryBackend) DeleteFilter(id uint64) error {
+	const op = "FwpmFilterDeleteById0"
+	m.txnLock <- struct{}{}
+	defer func() { <-m.txnLock }()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.state.filters[id]
+	if !ok {
+		return memoryErr(op, "", FWP_E_FILTER_NOT_FOUND)
+	}
+	delete(m.state.filters, id)
+	m.notifyLocked(memoryChange{FilterChange{Type: FilterDeleted, Key: obj.value.Key, ID: id}, obj.value.Provider})
+	return nil
+}
+
+// notifyLocked delivers changes to the watchers of the provider of each;
+// m.mu must be held.
+func (m *MemoryBackend) notifyLocked(changes ...memoryChange) {
+	for w := range m.watchers {
+		for _, change := range changes {
+			if change.provider != w.provider {
+				continue
+			}
+			select {
+			case w.changes <- change.FilterChange:
+			default:
+			}
+		}
+	}
+}
+
+func (s memoryState) clone() memoryState {
+	c := memoryState{
+		providers: make(map[GUID]memoryObject[Provider], len(s.providers)),
+		sublayers: make(map[GUID]memoryObject[Sublayer], len(s.sublayers)),
+		filters:   make(map[uint64]memoryObject[Filter], len(s.filters)),
+	}
+	for k, v := range s.providers {
+		c.providers[k] = v
+	}
+	for k, v := range s.sublayers {
+		c.sublayers[k] = v
+	}
+	for k, v := range s.filters {
+		c.filters[k] = v
+	}
+	return c
+}
+
+func cloneFilter(f Filter) Filter {
+	f.ProviderData = bytes.Clone(f.ProviderData)
+	f.Conditions = slices.Clone(f.Conditions)
+	f.SecurityDescriptor = bytes.Clone(f.SecurityDescriptor)
+	return f
+}
+
+type memorySession struct {
+	backend  *MemoryBackend
+	config   SessionConfig
+	closed   bool
+	snapshot *memoryState   // State at the start of the transaction in progress, if any.
+	changes  []memoryChange // Filter changes of the transaction in progress, notified on commit.
+}
+
+type memorySubscription struct {
+	allow  bool
+	events chan NetEvent
+}
+
+// memoryChange is a filter change and the provider of the filter.
+type memoryChange struct {
+	FilterChange
+	provider GUID
+}
+
+// memoryWatcher is a subscription to the filter changes of a provider.
+type memoryWatcher struct {
+	backend  *MemoryBackend
+	session  *memorySession
+	provider GUID
+	changes  chan FilterChange
+}
+
+func memoryErr(op, key string, code Code) error {
+	return wfpErr(op, key, syscall.Errno(code))
+}
+
+/*
+ * conditionCode returns the error WFP gives for a condition of a filter of
+ * layer, 0 if it has none: the field must exist in the layer, its data type
+ * accept the match type, and the value be valid for both.
+ */
+func conditionCode(c Condition, layer string) Code {
+	matches, ok := fieldMatches[c.Field]
+	if !ok || !slices.Contains(layerFields[layer], c.Field) {
+		return FWP_E_CONDITION_NOT_FOUND
+	}
+	if !slices.Contains(matches, c.Match) {
+		return FWP_E_MATCH_TYPE_MISMATCH
+	}
+	switch c.Field {
+	case FieldRemoteAddress, FieldLocalAddress:
+		if c.Range != (AddressRange{}) {
+			if c.Match != MatchRange {
+				return FWP_E_MATCH_TYPE_MISMATCH
+			}
+			if !c.Range.IsValid() {
+				return FWP_E_INVALID_RANGE
+			}
+			if strings.HasSuffix(layer, "_V6") {
+				return FWP_E_TYPE_MISMATCH
+			}
+		} else if c.Match == MatchRange {
+			return FWP_E_MATCH_TYPE_MISMATCH
+		} else if !c.Network.IsValid() {
+			return FWP_E_INVALID_NET_MASK
+		} else if c.Network.Addr().Is6() != strings.HasSuffix(layer, "_V6") {
+			return FWP_E_TYPE_MISMATCH
+		}
+	case FieldApp:
+		if c.App == "" {
+			return FWP_E_NULL_POINTER
+		}
+	case FieldLocalInterface, FieldLocalMAC, FieldRemoteMAC:
+	default:
+		if c.Match == MatchRange && (c.To < c.number() || c.To > fieldMax[c.Field]) {
+			return FWP_E_INVALID_RANGE
+		}
+	}
+	return 0
+}
+
+/*
+ * acquire takes the transaction lock for a call made outside a transaction,
+ * waiting at most the transaction timeout of the session, as the real engine
+ * does. Calls within a transaction of the session already hold it. The
+ * returned function releases it.
+ */
+func (s *memorySession) acquire(op string) (func(), error) {
+	if s.closed {
+		return nil, memoryErr(op, "", ERROR_INVALID_HANDLE)
+	}
+	if s.snapshot != nil {
+		return func() {}, nil
+	}
+	if err := s.lockTxn(op); err != nil {
+		return nil, err
+	}
+	return func() { <-s.backend.txnLock }, nil
+}
+
+func (s *memorySession) lockTxn(op string) error {
+	if s.config.TxnTimeout <= 0 {
+		s.backend.txnLock <- struct{}{}
+		return nil
+	}
+	timer := time.NewTimer(s.config.TxnTimeout)
+	defer timer.Stop()
+	select {
+	case s.backend.txnLock <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return memoryErr(op, "", FWP_E_TIMEOUT)
+	}
+}
+
+// owner is what the objects added by the session are owned by.
+func (s *memorySession) owner() *memorySession {
+	if s.config.Dynamic {
+		return s
+	}
+	return nil
+}
+
+func (s *memorySession) AddProvider(provider *Provider) error {
+	const op = "FwpmProviderAdd0"
+	release, err := s.acquire(op)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	m := s.backend
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := provider.Key.String()
+	if provider.Key.IsZero() {
+		return memoryErr(op, key, FWP_E_NULL_POINTER)
+	}
+	if _, ok := m.state.providers[provider.Key]; ok {
+		return memoryErr(op, key, FWP_E_ALREADY_EXISTS)
+	}
+	if provider.SecurityDescriptor != nil && provider.SecurityDescriptor.Validate() != nil {
+		return memoryErr(op, key, ERROR_INVALID_SECURITY_DESCR)
+	}
+	if provider.Persistent && s.config.Dynamic {
+		return memoryErr(op, key, FWP_E_DYNAMIC_SESSION_IN_PROGRESS)
+	}
+	p := *provider
+	p.SecurityDescriptor = bytes.Clone(p.SecurityDescriptor)
+	m.state.providers[provider.Key] = memoryObject[Provider]{value: p, owner: s.owner()}
+	return nil
+}
+
+func (s *memorySession) AddSublayer(sublayer *Sublayer) error {
+	const op = "FwpmSubLayerAdd0"
+	release, err := s.acquire(op)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	m := s.backend
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := sublayer.Key.String()
+	if sublayer.Key.IsZero() {
+		return memoryErr(op, key, FWP_E_NULL_POINTER)
+	}
+	if _, ok := m.state.sublayers[sublayer.Key]; ok {
+		return memoryErr(op, key, FWP_E_ALREADY_EXISTS)
+	}
+	if sublayer.SecurityDescriptor != nil && sublayer.SecurityDescriptor.Validate() != nil {
+		return memoryErr(op, key, ERROR_INVALID_SECURITY_DESCR)
+	}
+	if sublayer.Persistent && s.config.Dynamic {
+		return memoryErr(op, key, FWP_E_DYNAMIC_SESSION_IN_PROGRESS)
+	}
+	if !sublayer.Provider.IsZero() {
+		provider, ok := m.state.providers[sublayer.Provider]
+		if !ok {
+			return memoryErr(op, key, FWP_E_PROVIDER_NOT_FOUND)
+		}
+		if sublayer.Persistent && !provider.value.Persistent {
+			return memoryErr(op, key, FWP_E_LIFETIME_MISMATCH)
+		}
+	}
+	l := *sublayer
+	l.SecurityDescriptor = bytes.Clone(l.SecurityDescriptor)
+	m.state.sublayers[sublayer.Key] = memoryObject[Sublayer]{value: l, owner: s.owner()}
+	return nil
+}
+
+func (s *memorySession) AddFilter(filter *Filter) (uint64, error) {
+	const op = "FwpmFilterAdd0"
+	release, err := s.acquire(op)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	m := s.backend
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := cloneFilter(*filter)
+	if f.Key.IsZero() {
+		if f.Key, err = NewGUID(); err != nil {
+			return 0, wrapErr(err)
+		}
+	}
+	key := f.Key.String()
+	for _, obj := range m.state.filters {
+		if obj.value.Key == f.Key {
+			return 0, memoryErr(op, key, FWP_E_ALREADY_EXISTS)
+		}
+	}
+	if f.Persistent && s.config.Dynamic {
+		return 0, memoryErr(op, key, FWP_E_DYNAMIC_SESSION_IN_PROGRESS)
+	}
+	if f.SecurityDescriptor != nil && f.SecurityDescriptor.Validate() != nil {
+		return 0, memoryErr(op, key, ERROR_INVALID_SECURITY_DESCR)
+	}
+	if !isKnownLayer(f.Layer) {
+		return 0, memoryErr(op, key, FWP_E_LAYER_NOT_FOUND)
+	}
+	sublayer, ok := m.state.sublayers[f.Sublayer]
+	if !ok {
+		return 0, memoryErr(op, key, FWP_E_SUBLAYER_NOT_FOUND)
+	}
+	if f.Persistent && !sublayer.value.Persistent {
+		return 0, memoryErr(op, key, FWP_E_LIFETIME_MISMATCH)
+	}
+	if !f.Provider.IsZero() {
+		provider, ok := m.state.providers[f.Provider]
+		if !ok {
+			return 0, memoryErr(op, key, FWP_E_PROVIDER_NOT_FOUND)
+		}
+		if f.Persistent && !provider.value.Persistent {
+			return 0, memoryErr(op, key, FWP_E_LIFETIME_MISMATCH)
+		}
+	}
+	if !f.Action.Terminating() && f.Action != ActionContinue {
+		return 0, memoryErr(op, key, FWP_E_INVALID_ACTION_TYPE)
+	}
+	for _, condition := range f.Conditions {
+		if code := conditionCode(condition, f.Layer); code != 0 {
+			return 0, memoryErr(op, key, code)
+		}
+	}
+
+	m.nextID++
+	f.ID = m.nextID
+	m.state.filters[f.ID] = memoryObject[Filter]{value: f, owner: s.owner()}
+	s.notifyLocked(memoryChange{FilterChange{Type: FilterAdded, Key: f.Key, ID: f.ID}, f.Provider})
+	return f.ID, nil
+}
+
+// notifyLocked notifies changes, or keeps them for the commit of the
+// transaction in progress; s.backend.mu must be held.
+func (s *memorySession) notifyLocked(changes ...memoryChange) {
+	if s.snapshot != nil {
+		s.changes = append(s.changes, changes...)
+		return
+	}
+	s.backend.notifyLocked(changes...)
+}
+
+func (s *memorySession) DeleteFilter(id uint64) error {
+	const op = "FwpmFilterDeleteById0"
+	release, err := s.acquire(op)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	m := s.backend
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.state.filters[id]
+	if !ok {
+		return memoryErr(op, "", FWP_E_FILTER_NOT_FOUND)
+	}
+	delete(m.state.filters, id)
+	s.notifyLocked(memoryChange{FilterChange{Type: FilterDeleted, Key: obj.value.Key, ID: id}, obj.value.Provider})
+	return nil
+}
+
+func (s *memorySession) Filters(provider GUID, layer string) ([]Filter, error) {
+	const op = "FwpmFilterEnum0"
+	release, err := s.acquire(op)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	m := s.backend
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !isKnownLayer(layer) {
+		return nil, memoryErr(op, layer, FWP_E_LAYER_NOT_FOUND)
+	}
+	var filters []Filter
+	for _, obj := range m.state.filters {
+		if obj.value.Provider == provider && obj.value.Layer == layer {
+			filters = append(filters, cloneFilter(obj.value))
+		}
+	}
+	sort.Slice(filters, func(i, j int) bool { return filters[i].ID < filters[j].ID })
+	return filters, nil
+}
+
+func (s *memorySession) SetProviderSecurity(key GUID, sd SecurityDescriptor) error {
+	return s.setSecurity("FwpmProviderSetSecurityInfoByKey0", key, sd, func(state memoryState) (*SecurityDescriptor, func(), bool) {
+		obj, ok := state.providers[key]
+		return &obj.value.SecurityDescriptor, func() { state.providers[key] = obj }, ok
+	}, FWP_E_PROVIDER_NOT_FOUND)
+}
+
+func (s *memorySession) SetSublayerSecurity(key GUID, sd SecurityDescriptor) error {
+	return s.setSecurity("FwpmSubLayerSetSecurityInfoByKey0", key, sd, func(state memoryState) (*SecurityDescriptor, func(), bool) {
+		obj, ok := state.sublayers[key]
+		return &obj.value.SecurityDescriptor, func() { state.sublayers[key] = obj }, ok
+	}, FWP_E_SUBLAYER_NOT_FOUND)
+}
+
+func (s *memorySession) SetFilterSecurity(key GUID, sd SecurityDescriptor) error {
+	return s.setSecurity("FwpmFilterSetSecurityInfoByKey0", key, sd, func(state memoryState) (*SecurityDescriptor, func(), bool) {
+		for id, obj := range state.filters {
+			if obj.value.Key == key {
+				return &obj.value.SecurityDescriptor, func() { state.filters[id] = obj }, true
+			}
+		}
+		return nil, nil, false
+	}, FWP_E_FILTER_NOT_FOUND)
+}
+
+/*
+ * setSecurity replaces the parts sd has of the security descriptor of the
+ * object find returns, with a pointer to a copy of it and a function storing
+ * the copy back. Descriptors are checked to be well formed, but access is
+ * never checked against them: memory sessions have no identity.
+ */
+func (s *memorySession) setSecurity(op string, key GUID, sd SecurityDescriptor, find func(memoryState) (*SecurityDescriptor, func(), bool), notFound Code) error {
+	release, err := s.acquire(op)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	update, err := sd.parts()
+	if err != nil {
+		return memoryErr(op, key.String(), ERROR_INVALID_SECURITY_DESCR)
+	}
+	m := s.backend
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, store, ok := find(m.state)
+	if !ok {
+		return memoryErr(op, key.String(), notFound)
+	}
+	var parts securityParts
+	if *current != nil {
+		parts, _ = current.parts()
+	}
+	*current = parts.update(update).encode()
+	store()
+	return nil
+}
+
+func (s *memorySession) BeginTransaction() error {
+	const op = "FwpmTransactionBegin0"
+	if s.closed {
+		return memoryErr(op, "", ERROR_INVALID_HANDLE)
+	}
+	if s.snapshot != nil {
+		return memoryErr(op, "", FWP_E_TXN_IN_PROGRESS)
+	}
+	if err := s.lockTxn(op); err != nil {
+		return err
+	}
+	m := s.backend
+	m.mu.Lock()
+	snapshot := m.state.clone()
+	m.mu.Unlock()
+	s.snapshot = &snapshot
+	return nil
+}
+
+func (s *memorySession) CommitTransaction() error {
+	if s.snapshot == nil {
+		return memoryErr("FwpmTransactionCommit0", "", FWP_E_NO_TXN_IN_PROGRESS)
+	}
+	m := s.backend
+	m.mu.Lock()
+	m.notifyLocked(s.changes...)
+	m.mu.Unlock()
+	s.snapshot, s.changes = nil, nil
+	<-m.txnLock
+	return nil
+}
+
+func (s *memorySession) AbortTransaction() error {
+	if s.snapshot == nil {
+		return memoryErr("FwpmTransactionAbort0", "", FWP_E_NO_TXN_IN_PROGRESS)
+	}
+	m := s.backend
+	m.mu.Lock()
+	m.state = *s.snapshot
+	m.mu.Unlock()
+	s.snapshot, s.changes = nil, nil
+	<-m.txnLock
+	return nil
+}
+
+// SubscribeNetEvents replaces the subscription of the session, if any: the
+// events of the old one end as if it was closed.
+func (s *memorySession) SubscribeNetEvents(allow bool) (NetEventSource, error) {
+	if s.closed {
+		return nil, memoryErr("FwpmNetEventSubscribe0", "", ERROR_INVALID_HANDLE)
+	}
+	m := s.backend
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.listeners[s]; ok {
+		close(old.events)
+	}
+	sub := &memorySubscription{allow: allow, events: make(chan NetEvent, 1024)}
+	m.listeners[s] = sub
+	return &memoryEventSource{session: s, sub: sub}, nil
+}
+
+func (s *memorySession) SubscribeFilterChanges(provider GUID) (FilterChangeSource, error) {
+	if s.closed {
+		return nil, memoryErr("FwpmFilterSubscribeChanges0", "", ERROR_INVALID_HANDLE)
+	}
+	m := s.backend
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w := &memoryWatcher{backend: m, session: s, provider: provider, changes: make(chan FilterChange, 1024)}
+	m.watchers[w] = true
+	return w, nil
+}
+
+// Close aborts the transaction in progress, if any, and deletes the objects
+// the session owns.
+func (s *memorySession) Close() error {
+	if s.closed {
+		return memoryErr("FwpmEngineClose0", "", ERROR_INVALID_HANDLE)
+	}
+	if s.snapshot != nil {
+		s.AbortTransaction()
+	}
+	s.closed = true
+
+	m := s.backend
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, obj := range m.state.filters {
+		if obj.owner == s {
+			delete(m.state.filters, id)
+			m.notifyLocked(memoryChange{FilterChange{Type: FilterDeleted, Key: obj.value.Key, ID: id}, obj.value.Provider})
+		}
+	}
+	for key, obj := range m.state.sublayers {
+		if obj.owner == s {
+			delete(m.state.sublayers, key)
+		}
+	}
+	for key, obj := range m.state.providers {
+		if obj.owner == s {
+			delete(m.state.providers, key)
+		}
+	}
+	if sub, ok := m.listeners[s]; ok {
+		delete(m.listeners, s)
+		close(sub.events)
+	}
+	for w := range m.watchers {
+		if w.session == s {
+			delete(m.watchers, w)
+			close(w.changes)
+		}
+	}
+	return nil
+}
+
+type memoryEventSource struct {
+	session *memorySession
+	sub     *memorySubscription
+}
+
+func (src *memoryEventSource) Events() <-chan NetEvent {
+	return src.sub.events
+}
+
+func (src *memoryEventSource) Close() error {
+	m := src.session.backend
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.listeners[src.session] == src.sub {
+		delete(m.listeners, src.session)
+		close(src.sub.events)
+	}
+	return nil
+}
+
+func (w *memoryWatcher) Changes() <-chan FilterChange {
+	return w.changes
+}
+
+func (w *memoryWatcher) Close() error {
+	m := w.backend
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.watchers[w] {
+		delete(m.watchers, w)
+		close(w.changes)
+	}
+	return nil
+}
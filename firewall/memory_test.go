@@ -0,0 +1,379 @@
+package firewall
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func openMemorySession(t *testing.T, backend *MemoryBackend, config SessionConfig) Session {
+	t.Helper()
+	s, err := backend.Open(config)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func mustGUID(t *testing.T) GUID {
+	t.Helper()
+	key, err := NewGUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// addMemoryBase adds a provider and a sublayer of it in s.
+func addMemoryBase(t *testing.T, s Session, persistent bool) (provider, sublayer GUID) {
+	t.Helper()
+	provider, sublayer = mustGUID(t), mustGUID(t)
+	if err := s.AddProvider(&Provider{Key: provider, Name: "test", Persistent: persistent}); err != nil {
+		t.Fatalf("AddProvider: %v", err)
+	}
+	if err := s.AddSublayer(&Sublayer{Key: sublayer, Provider: provider, Name: "test", Persistent: persistent}); err != nil {
+		t.Fatalf("AddSublayer: %v", err)
+	}
+	return provider, sublayer
+}
+
+func testFilter(provider, sublayer GUID) *Filter {
+	return &Filter{
+		Name:       "test",
+		Provider:   provider,
+		Layer:      "ALE_AUTH_CONNECT_V4",
+		Sublayer:   sublayer,
+		Conditions: []Condition{RemoteAddress(netip.MustParsePrefix("10.0.0.0/8"))},
+		Action:     ActionBlock,
+	}
+}
+
+func TestMemoryBackendErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		dynamic bool // Make the call in a dynamic session rather than a static one.
+		call    func(s Session, provider, sublayer GUID) error
+		want    Code
+	}{
+		{"duplicate provider", false, func(s Session, provider, sublayer GUID) error {
+			return s.AddProvider(&Provider{Key: provider})
+		}, FWP_E_ALREADY_EXISTS},
+		{"duplicate sublayer", false, func(s Session, provider, sublayer GUID) error {
+			return s.AddSublayer(&Sublayer{Key: sublayer, Provider: provider})
+		}, FWP_E_ALREADY_EXISTS},
+		{"duplicate filter", false, func(s Session, provider, sublayer GUID) error {
+			f := testFilter(provider, sublayer)
+			f.Key = GUID{Data1: 3}
+			if _, err := s.AddFilter(f); err != nil {
+				return err
+			}
+			_, err := s.AddFilter(f)
+			return err
+		}, FWP_E_ALREADY_EXISTS},
+		{"zero provider key", false, func(s Session, provider, sublayer GUID) error {
+			return s.AddProvider(&Provider{})
+		}, FWP_E_NULL_POINTER},
+		{"sublayer of unknown provider", false, func(s Session, provider, sublayer GUID) error {
+			return s.AddSublayer(&Sublayer{Key: GUID{Data1: 1}, Provider: GUID{Data1: 2}})
+		}, FWP_E_PROVIDER_NOT_FOUND},
+		{"filter of unknown provider", false, func(s Session, provider, sublayer GUID) error {
+			_, err := s.AddFilter(testFilter(GUID{Data1: 2}, sublayer))
+			return err
+		}, FWP_E_PROVIDER_NOT_FOUND},
+		{"filter in unknown sublayer", false, func(s Session, provider, sublayer GUID) error {
+			_, err := s.AddFilter(testFilter(provider, GUID{Data1: 2}))
+			return err
+		}, FWP_E_SUBLAYER_NOT_FOUND},
+		{"filter in unknown layer", false, func(s Session, provider, sublayer GUID) error {
+			f := testFilter(provider, sublayer)
+			f.Layer = "ALE_AUTH_LISTEN_V4"
+			_, err := s.AddFilter(f)
+			return err
+		}, FWP_E_LAYER_NOT_FOUND},
+		{"persistent provider of dynamic session", true, func(s Session, provider, sublayer GUID) error {
+			return s.AddProvider(&Provider{Key: GUID{Data1: 1}, Persistent: true})
+		}, FWP_E_DYNAMIC_SESSION_IN_PROGRESS},
+		{"persistent filter of dynamic session", true, func(s Session, provider, sublayer GUID) error {
+			f := testFilter(provider, sublayer)
+			f.Persistent = true
+			_, err := s.AddFilter(f)
+			return err
+		}, FWP_E_DYNAMIC_SESSION_IN_PROGRESS},
+		{"persistent sublayer of non-persistent provider", false, func(s Session, provider, sublayer GUID) error {
+			if err := s.AddProvider(&Provider{Key: GUID{Data1: 1}}); err != nil {
+				return err
+			}
+			return s.AddSublayer(&Sublayer{Key: GUID{Data1: 2}, Provider: GUID{Data1: 1}, Persistent: true})
+		}, FWP_E_LIFETIME_MISMATCH},
+		{"persistent filter in non-persistent sublayer", false, func(s Session, provider, sublayer GUID) error {
+			if err := s.AddSublayer(&Sublayer{Key: GUID{Data1: 2}, Provider: provider}); err != nil {
+				return err
+			}
+			f := testFilter(provider, GUID{Data1: 2})
+			f.Persistent = true
+			_, err := s.AddFilter(f)
+			return err
+		}, FWP_E_LIFETIME_MISMATCH},
+		{"condition on a field of another layer", false, func(s Session, provider, sublayer GUID) error {
+			f := testFilter(provider, sublayer)
+			f.Conditions = append(f.Conditions, RemoteMAC([6]byte{2, 0, 0, 0, 0, 1}))
+			_, err := s.AddFilter(f)
+			return err
+		}, FWP_E_CONDITION_NOT_FOUND},
+		{"IP condition on Ethernet frames", false, func(s Session, provider, sublayer GUID) error {
+			f := testFilter(provider, sublayer)
+			f.Layer = "OUTBOUND_MAC_FRAME_ETHERNET"
+			f.Conditions = []Condition{RemoteMAC([6]byte{2, 0, 0, 0, 0, 1}), Protocol(6)}
+			_, err := s.AddFilter(f)
+			return err
+		}, FWP_E_CONDITION_NOT_FOUND},
+		{"match type of another field", false, func(s Session, provider, sublayer GUID) error {
+			f := testFilter(provider, sublayer)
+			f.Conditions = []Condition{{Field: FieldApp, Match: MatchRange, App: "a"}}
+			_, err := s.AddFilter(f)
+			return err
+		}, FWP_E_MATCH_TYPE_MISMATCH},
+		{"IPv6 network in IPv4 layer", false, func(s Session, provider, sublayer GUID) error {
+			f := testFilter(provider, sublayer)
+			f.Conditions = []Condition{RemoteAddress(netip.MustParsePrefix("2001:db8::/32"))}
+			_, err := s.AddFilter(f)
+			return err
+		}, FWP_E_TYPE_MISMATCH},
+		{"invalid action", false, func(s Session, provider, sublayer GUID) error {
+			f := testFilter(provider, sublayer)
+			f.Action = 0
+			_, err := s.AddFilter(f)
+			return err
+		}, FWP_E_INVALID_ACTION_TYPE},
+		{"invalid security descriptor", false, func(s Session, provider, sublayer GUID) error {
+			f := testFilter(provider, sublayer)
+			f.SecurityDescriptor = SecurityDescriptor{1, 0, 4}
+			_, err := s.AddFilter(f)
+			return err
+		}, ERROR_INVALID_SECURITY_DESCR},
+		{"delete unknown filter", false, func(s Session, provider, sublayer GUID) error {
+			return s.DeleteFilter(9999)
+		}, FWP_E_FILTER_NOT_FOUND},
+		{"commit outside transaction", false, func(s Session, provider, sublayer GUID) error {
+			return s.CommitTransaction()
+		}, FWP_E_NO_TXN_IN_PROGRESS},
+		{"nested transaction", false, func(s Session, provider, sublayer GUID) error {
+			if err := s.BeginTransaction(); err != nil {
+				return err
+			}
+			defer s.AbortTransaction()
+			return s.BeginTransaction()
+		}, FWP_E_TXN_IN_PROGRESS},
+		{"closed session", true, func(s Session, provider, sublayer GUID) error {
+			if err := s.Close(); err != nil {
+				return err
+			}
+			_, err := s.AddFilter(testFilter(provider, sublayer))
+			return err
+		}, ERROR_INVALID_HANDLE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := NewMemoryBackend()
+			s := openMemorySession(t, backend, SessionConfig{Name: "static"})
+			provider, sublayer := addMemoryBase(t, s, true)
+			if tt.dynamic {
+				s = openMemorySession(t, backend, SessionConfig{Name: "dynamic", Dynamic: true})
+			}
+			before := len(backend.Filters())
+
+			err := tt.call(s, provider, sublayer)
+			if !hasCode(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if tt.want != FWP_E_ALREADY_EXISTS && len(backend.Filters()) != before {
+				t.Errorf("failed call left %d filters, want %d", len(backend.Filters()), before)
+			}
+		})
+	}
+}
+
+func TestMemoryBackendTransaction(t *testing.T) {
+	backend := NewMemoryBackend()
+	s := openMemorySession(t, backend, SessionConfig{Name: "test"})
+	provider, sublayer := addMemoryBase(t, s, false)
+	kept, err := s.AddFilter(testFilter(provider, sublayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := s.SubscribeFilterChanges(provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer changes.Close()
+
+	// Abort restores the snapshot taken by BeginTransaction, and the changes
+	// made in the transaction are never notified.
+	if err := s.BeginTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddFilter(testFilter(provider, sublayer)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteFilter(kept); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddProvider(&Provider{Key: GUID{Data1: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AbortTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	if filters := backend.Filters(); len(filters) != 1 || filters[0].ID != kept {
+		t.Errorf("filters after abort = %v, want only %d", filters, kept)
+	}
+	if err := s.AddProvider(&Provider{Key: GUID{Data1: 1}}); err != nil {
+		t.Errorf("provider of aborted transaction still there: %v", err)
+	}
+	select {
+	case change := <-changes.Changes():
+		t.Errorf("change of aborted transaction notified: %+v", change)
+	default:
+	}
+
+	// Commit keeps the changes, and notifies them.
+	if err := s.BeginTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	added, err := s.AddFilter(testFilter(provider, sublayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CommitTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.Filters()) != 2 {
+		t.Errorf("filters after commit = %v, want 2", backend.Filters())
+	}
+	select {
+	case change := <-changes.Changes():
+		if change.Type != FilterAdded || change.ID != added {
+			t.Errorf("change = %+v, want addition of %d", change, added)
+		}
+	case <-time.After(time.Second):
+		t.Error("change of committed transaction not notified")
+	}
+}
+
+func TestMemoryBackendTransactionLock(t *testing.T) {
+	backend := NewMemoryBackend()
+	s := openMemorySession(t, backend, SessionConfig{Name: "holder"})
+	provider, sublayer := addMemoryBase(t, s, false)
+	other := openMemorySession(t, backend, SessionConfig{Name: "waiter", TxnTimeout: 10 * time.Millisecond})
+
+	if err := s.BeginTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.AddFilter(testFilter(provider, sublayer)); !hasCode(err, FWP_E_TIMEOUT) {
+		t.Errorf("AddFilter during another transaction = %v, want FWP_E_TIMEOUT", err)
+	}
+	if err := other.BeginTransaction(); !hasCode(err, FWP_E_TIMEOUT) {
+		t.Errorf("BeginTransaction during another transaction = %v, want FWP_E_TIMEOUT", err)
+	}
+	if err := s.CommitTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.AddFilter(testFilter(provider, sublayer)); err != nil {
+		t.Errorf("AddFilter after commit = %v", err)
+	}
+}
+
+func TestMemoryBackendClose(t *testing.T) {
+	backend := NewMemoryBackend()
+	static := openMemorySession(t, backend, SessionConfig{Name: "static"})
+	provider, sublayer := addMemoryBase(t, static, true)
+
+	closing := openMemorySession(t, backend, SessionConfig{Name: "closing", Dynamic: true})
+	ownProvider, ownSublayer := addMemoryBase(t, closing, false)
+	if _, err := closing.AddFilter(testFilter(ownProvider, ownSublayer)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := closing.AddFilter(testFilter(provider, sublayer)); err != nil {
+		t.Fatal(err)
+	}
+	other := openMemorySession(t, backend, SessionConfig{Name: "other", Dynamic: true})
+	kept, err := other.AddFilter(testFilter(provider, sublayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Close aborts the transaction in progress, then deletes every object of
+	// the session, and only those.
+	if err := closing.BeginTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := closing.AddFilter(testFilter(provider, sublayer)); err != nil {
+		t.Fatal(err)
+	}
+	if err := closing.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if filters := backend.Filters(); len(filters) != 1 || filters[0].ID != kept {
+		t.Errorf("filters after Close = %v, want only %d", filters, kept)
+	}
+	sublayers := backend.Sublayers()
+	if !slices.ContainsFunc(sublayers, func(l Sublayer) bool { return l.Key == sublayer }) {
+		t.Errorf("persistent sublayer deleted by Close")
+	}
+	if slices.ContainsFunc(sublayers, func(l Sublayer) bool { return l.Key == ownSublayer }) {
+		t.Errorf("dynamic sublayer kept after Close")
+	}
+	if err := static.AddProvider(&Provider{Key: ownProvider}); err != nil {
+		t.Errorf("dynamic provider kept after Close: %v", err)
+	}
+
+	if err := closing.Close(); !hasCode(err, ERROR_INVALID_HANDLE) {
+		t.Errorf("second Close = %v, want ERROR_INVALID_HANDLE", err)
+	}
+	// The transaction lock was released.
+	if err := other.BeginTransaction(); err != nil {
+		t.Errorf("BeginTransaction after Close = %v", err)
+	} else {
+		other.AbortTransaction()
+	}
+}
+
+func TestMemoryBackendResubscribe(t *testing.T) {
+	backend := NewMemoryBackend()
+	s := openMemorySession(t, backend, SessionConfig{Name: "events", Dynamic: true})
+	old, err := s.SubscribeNetEvents(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := s.SubscribeNetEvents(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The events of the replaced subscription end; the new one gets them all.
+	if _, ok := <-old.Events(); ok {
+		t.Error("event on a replaced subscription")
+	}
+	backend.Emit(NetEvent{Type: NetEventClassifyAllow, FilterID: 1})
+	if ev, ok := <-current.Events(); !ok || ev.FilterID != 1 {
+		t.Errorf("event = %+v, %v; want the allow event of filter 1", ev, ok)
+	}
+
+	// Closing the replaced one leaves the new one be.
+	if err := old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	backend.Emit(NetEvent{Type: NetEventClassifyDrop, FilterID: 2})
+	if ev, ok := <-current.Events(); !ok || ev.FilterID != 2 {
+		t.Errorf("event = %+v, %v; want the drop event of filter 2", ev, ok)
+	}
+	if err := current.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-current.Events(); ok {
+		t.Error("event on a closed subscription")
+	}
+}
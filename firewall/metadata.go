@@ -0,0 +1,171 @@
+package firewall
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+/*
+ * RuleMetadata is stored in the providerData blob of every filter, so that
+ * what a filter is for can be told from WFP state alone.
+ *
+ * The encoding is a 4-byte magic, a version byte, then a sequence of fields,
+ * each a tag byte, a uvarint length and the value:
+ *
+ *	"wfpr" 0x01 | 0x01 len "Block traffic to 10.0.0.0/8" | 0x04 len varint(unix) | ...
+ *
+ * Strings are UTF-8, times are varint Unix seconds, and tags repeat. Decoders
+ * skip the fields they do not know, so new fields only need a new tag; the
+ * version changes only if existing fields change meaning.
+ */
+type RuleMetadata struct {
+	Name       string    // Display name of the filter.
+	Source     string    // What produced the rule, e.g. "cli", "policy:rules.json" or "feed:spamhaus".
+	Owner      string    // Who added it, as user@host.
+	Created    time.Time // When the filter was added.
+	Expires    time.Time // Zero if the rule does not expire.
+	Tags       []string  // Free-form labels.
+	PolicyHash []byte    // SHA-256 of the policy the rule is part of, see PolicyHash.
+	Group      string    // Named group, empty for none.
+	Action     string    // "permit" or "block", kept for disabled groups.
+	Intent     string    // Rule as written when it compiled to several filters, e.g. "block 10.0.0.0/8 except 10.1.0.0/16".
+	Host       string    // Hostname the address of the filter was resolved from.
+}
+
+const (
+	metadataMagic   = "wfpr"
+	metadataVersion = 1
+)
+
+// Field tags. Never reuse a tag.
+const (
+	metaName       = 0x01
+	metaSource     = 0x02
+	metaOwner      = 0x03
+	metaCreated    = 0x04
+	metaExpires    = 0x05
+	metaTag        = 0x06
+	metaPolicyHash = 0x07
+	metaGroup      = 0x08
+	metaAction     = 0x09
+	metaIntent     = 0x0a
+	metaHost       = 0x0b
+)
+
+var errNoMetadata = errors.New("no rule metadata")
+
+func (m *RuleMetadata) MarshalBinary() ([]byte, error) {
+	b := append([]byte(metadataMagic), metadataVersion)
+	field := func(tag byte, value []byte) {
+		if len(value) == 0 {
+			return
+		}
+		b = append(b, tag)
+		b = binary.AppendUvarint(b, uint64(len(value)))
+		b = append(b, value...)
+	}
+	timeField := func(tag byte, t time.Time) {
+		if !t.IsZero() {
+			field(tag, binary.AppendVarint(nil, t.Unix()))
+		}
+	}
+
+	field(metaName, []byte(m.Name))
+	field(metaSource, []byte(m.Source))
+	field(metaOwner, []byte(m.Owner))
+	timeField(metaCreated, m.Created)
+	timeField(metaExpires, m.Expires)
+	for _, tag := range m.Tags {
+		field(metaTag, []byte(tag))
+	}
+	field(metaPolicyHash, m.PolicyHash)
+	field(metaGroup, []byte(m.Group))
+	field(metaAction, []byte(m.Action))
+	field(metaIntent, []byte(m.Intent))
+	field(metaHost, []byte(m.Host))
+	return b, nil
+}
+
+func (m *RuleMetadata) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, []byte(metadataMagic)) {
+		return errNoMetadata
+	}
+	data = data[len(metadataMagic):]
+	if len(data) < 1 {
+		return fmt.Errorf("rule metadata: truncated header")
+	}
+	if data[0] != metadataVersion {
+		return fmt.Errorf("rule metadata: unsupported version %d", data[0])
+	}
+	data = data[1:]
+
+	*m = RuleMetadata{}
+	for len(data) > 0 {
+		tag := data[0]
+		n, size := binary.Uvarint(data[1:])
+		if size <= 0 || n > uint64(len(data)-1-size) {
+			return fmt.Errorf("rule metadata: field 0x%02x: bad length", tag)
+		}
+		value := data[1+size : 1+size+int(n)]
+		data = data[1+size+int(n):]
+
+		switch tag {
+		case metaName:
+			m.Name = string(value)
+		case metaSource:
+			m.Source = string(value)
+		case metaOwner:
+			m.Owner = string(value)
+		case metaCreated, metaExpires:
+			sec, size := binary.Varint(value)
+			if size != len(value) {
+				return fmt.Errorf("rule metadata: field 0x%02x: bad time", tag)
+			}
+			if tag == metaCreated {
+				m.Created = time.Unix(sec, 0).UTC()
+			} else {
+				m.Expires = time.Unix(sec, 0).UTC()
+			}
+		case metaTag:
+			m.Tags = append(m.Tags, string(value))
+		case metaPolicyHash:
+			m.PolicyHash = bytes.Clone(value)
+		case metaGroup:
+			m.Group = string(value)
+		case metaAction:
+			m.Action = string(value)
+		case metaIntent:
+			m.Intent = string(value)
+		case metaHost:
+			m.Host = string(value)
+		}
+	}
+	return nil
+}
+
+// Expired reports whether the rule had an expiry and it has passed at now.
+func (m *RuleMetadata) Expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+/*
+ * PolicyHash identifies a set of rules independently of the order they were
+ * given in, so that filters can be matched to the policy that produced them.
+ */
+func PolicyHash(specs []RuleSpec) []byte {
+	lines := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		lines = append(lines, fmt.Sprintf("%s %d %s", spec, spec.Weight, spec.Group))
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, line := range lines {
+		fmt.Fprintln(h, line)
+	}
+	return h.Sum(nil)
+}
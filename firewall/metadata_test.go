@@ -0,0 +1,127 @@
+package firewall
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRuleMetadataRoundTrip(t *testing.T) {
+	full := RuleMetadata{
+		Name:       "Block 10.0.0.0/8",
+		Source:     "policy:rules.json",
+		Owner:      "admin@host",
+		Created:    time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		Expires:    time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC),
+		Tags:       []string{"lab", "temporary", "lab"},
+		PolicyHash: PolicyHash([]RuleSpec{aggSpec("block", "10.0.0.0/8", 10)}),
+		Group:      "lab",
+		Action:     "block",
+		Intent:     "block 10.0.0.0/8 except 10.1.0.0/16",
+		Host:       "updates.example",
+	}
+	// Times before 1970 are negative varints.
+	early := RuleMetadata{Name: "early", Created: time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	for _, m := range []RuleMetadata{full, early, {}} {
+		b, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got RuleMetadata
+		if err := got.UnmarshalBinary(b); err != nil {
+			t.Fatalf("UnmarshalBinary(%x): %v", b, err)
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("round trip = %+v, want %+v", got, m)
+		}
+	}
+}
+
+func TestRuleMetadataUnmarshal(t *testing.T) {
+	header := []byte("wfpr\x01")
+	tests := []struct {
+		name string
+		data []byte
+		want RuleMetadata
+		err  bool
+	}{
+		{"unknown tag skipped", append(header, "\x7f\x03abc\x01\x04name"...), RuleMetadata{Name: "name"}, false},
+		{"repeated field", append(header, "\x01\x01a\x01\x01b"...), RuleMetadata{Name: "b"}, false},
+		{"truncated value", append(header, "\x01\x05abc"...), RuleMetadata{}, true},
+		{"truncated length", append(header, "\x01\x80"...), RuleMetadata{}, true},
+		{"tag without length", append(header, "\x01"...), RuleMetadata{}, true},
+		{"bad time", append(header, "\x04\x02\x02\x00"...), RuleMetadata{}, true},
+		{"wrong version", []byte("wfpr\x02\x01\x01a"), RuleMetadata{}, true},
+		{"no version", []byte("wfpr"), RuleMetadata{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got RuleMetadata
+			err := got.UnmarshalBinary(tt.data)
+			if tt.err {
+				if err == nil || errors.Is(err, errNoMetadata) {
+					t.Fatalf("UnmarshalBinary = %+v, %v; want a decoding error", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("UnmarshalBinary = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// Data from another tool is not metadata rather than bad metadata.
+	for _, data := range [][]byte{nil, []byte("wfp"), []byte("\x01\x04name")} {
+		var m RuleMetadata
+		if err := m.UnmarshalBinary(data); !errors.Is(err, errNoMetadata) {
+			t.Errorf("UnmarshalBinary(%q) = %v, want %v", data, err, errNoMetadata)
+		}
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	full := RuleMetadata{Name: "n", Source: "cli", Created: time.Unix(1700000000, 0), Tags: []string{"a", "b"}, PolicyHash: []byte{1, 2}}
+	b, err := full.MarshalBinary()
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, data := range [][]byte{
+		b,
+		[]byte("wfpr\x01"),
+		[]byte("wfpr\x01\x7f\x03abc"),
+		[]byte("wfpr\x01\x04\x01\x00"),
+		[]byte("wfpr\x01\x01\x80"),
+		[]byte("wfpr\x02"),
+	} {
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m RuleMetadata
+		if err := m.UnmarshalBinary(data); err != nil {
+			return
+		}
+		// Encoding drops empty fields and unknown tags, after which the
+		// encoding is stable.
+		first, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var again RuleMetadata
+		if err := again.UnmarshalBinary(first); err != nil {
+			t.Fatalf("UnmarshalBinary(%x) of a marshaled %+v: %v", first, m, err)
+		}
+		second, err := again.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first, second) {
+			t.Fatalf("MarshalBinary = %x after a round trip, want %x", second, first)
+		}
+	})
+}
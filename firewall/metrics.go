@@ -0,0 +1,263 @@
+package firewall
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * A minimal implementation of the Prometheus text exposition format
+ * (https://prometheus.io/docs/instrumenting/exposition_formats/), enough for
+ * the handful of counters and histograms the tool exports without pulling in
+ * the client library.
+ */
+
+// Default histogram buckets, in seconds, matching the Prometheus client default.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// WFP call errors are counted package-wide, since the calls that fail are made
+// deep inside functions that are not handed a Metrics value.
+var wfpCallErrors = newCounterVec("wfp_call_errors_total", "Failed WFP API calls by function and error code.", "call", "code")
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64 // Keyed by the encoded label set.
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := encodeLabels(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // Cumulative counts are computed when writing.
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, labels ...string) *histogram {
+	return &histogram{name: name, help: help, labels: labels, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogram) observe(v float64, labelValues ...string) {
+	key := encodeLabels(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(durationBuckets))}
+		h.series[key] = s
+	}
+	for i, le := range durationBuckets {
+		if v <= le {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, le := range durationBuckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+/*
+ * Metrics collects what the long-running process exposes on /metrics. Rule
+ * counts are computed from the rule index at scrape time, so they never drift
+ * from what was actually added.
+ */
+type Metrics struct {
+	Rules *RuleIndex
+
+	applyDuration  *histogram
+	reloadDuration *histogram
+	reloads        *counterVec
+	feedRefreshes  *counterVec
+	dropEvents     *counterVec
+	tamperEvents   *counterVec
+}
+
+func NewMetrics(rules *RuleIndex) *Metrics {
+	return &Metrics{
+		Rules:          rules,
+		applyDuration:  newHistogram("wfp_apply_duration_seconds", "Time taken to apply the rule set."),
+		reloadDuration: newHistogram("wfp_reload_duration_seconds", "Time taken to re-apply rules after a change.", "outcome"),
+		reloads:        newCounterVec("wfp_reloads_total", "Rule reloads by outcome.", "outcome"),
+		feedRefreshes:  newCounterVec("wfp_feed_refreshes_total", "Refreshes of external rule sources by feed and outcome.", "feed", "outcome"),
+		dropEvents:     newCounterVec("wfp_drop_events_total", "Classify-drop net events by the rule that dropped the packet.", "rule"),
+		tamperEvents:   newCounterVec("wfp_tamper_events_total", "Rules deleted or replaced by someone else, by change.", "change"),
+	}
+}
+
+func (m *Metrics) ObserveApply(d time.Duration) {
+	m.applyDuration.observe(d.Seconds())
+}
+
+func (m *Metrics) ObserveReload(d time.Duration, err error) {
+	m.reloadDuration.observe(d.Seconds(), outcome(err))
+	m.reloads.add(1, outcome(err))
+}
+
+func (m *Metrics) ObserveTamper(change string) {
+	m.tamperEvents.add(1, change)
+}
+
+func (m *Metrics) ObserveFeedRefresh(feed string, err error) {
+	m.feedRefreshes.add(1, feed, outcome(err))
+}
+
+// HandleNetEvent counts drops per rule; drops by filters that are not ours
+// are counted under rule="".
+func (m *Metrics) HandleNetEvent(ev NetEvent) {
+	if ev.Type != NetEventClassifyDrop {
+		return
+	}
+	rule, _ := m.Rules.Lookup(ev.FilterID)
+	m.dropEvents.add(1, rule.Name)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WritePrometheus(w)
+}
+
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	installed := make(map[string]float64)
+	for _, rule := range m.Rules.Rules() {
+		if rule.Disabled {
+			continue // Inert until its group is enabled again.
+		}
+		installed[encodeLabels([]string{"action", "direction", "family"}, []string{rule.Action, rule.Direction, rule.Family})]++
+	}
+	fmt.Fprintf(bw, "# HELP wfp_rules_installed Filters currently installed by this process.\n# TYPE wfp_rules_installed gauge\n")
+	for _, key := range sortedKeys(installed) {
+		fmt.Fprintf(bw, "wfp_rules_installed%s %s\n", key, formatFloat(installed[key]))
+	}
+	if len(installed) == 0 {
+		// Always export a sample, so that "no rules" can be alerted on.
+		fmt.Fprintf(bw, "wfp_rules_installed 0\n")
+	}
+
+	m.applyDuration.write(bw)
+	m.reloadDuration.write(bw)
+	m.reloads.write(bw)
+	wfpCallErrors.write(bw)
+	m.feedRefreshes.write(bw)
+	m.dropEvents.write(bw)
+	m.tamperEvents.write(bw)
+
+	return bw.Flush()
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+func encodeLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func withLabel(key, name, value string) string {
+	label := name + `="` + escapeLabelValue(value) + `"`
+	if key == "" {
+		return "{" + label + "}"
+	}
+	return key[:len(key)-1] + "," + label + "}"
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
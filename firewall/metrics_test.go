@@ -0,0 +1,90 @@
+package firewall
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape returns the samples m serves, by series.
+func scrape(t *testing.T, m *Metrics) map[string]string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the text format", ct)
+	}
+	samples := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			t.Fatalf("malformed line %q", line)
+		}
+		samples[line[:i]] = line[i+1:]
+	}
+	return samples
+}
+
+func TestMetricsScrape(t *testing.T) {
+	rules := NewRuleIndex()
+	m := NewMetrics(rules)
+	if got := scrape(t, m)["wfp_rules_installed"]; got != "0" {
+		t.Errorf("wfp_rules_installed without rules = %q, want 0", got)
+	}
+
+	rules.Set([]RuleInfo{
+		{FilterID: 1, Name: "a", Action: "block", Direction: "outbound", Family: "ipv4"},
+		{FilterID: 2, Name: "b", Action: "block", Direction: "outbound", Family: "ipv4"},
+		{FilterID: 3, Name: "c", Action: "permit", Direction: "inbound", Family: "ipv6"},
+		{FilterID: 4, Name: "d", Action: "block", Direction: "outbound", Family: "ipv4", Disabled: true},
+		{FilterID: 5, Name: `say "hi"` + "\n" + `C:\x`, Action: "block", Direction: "inbound", Family: "ipv4"},
+	})
+	m.ObserveFeedRefresh("spamhaus", nil)
+	m.ObserveFeedRefresh("spamhaus", nil)
+	m.ObserveFeedRefresh("spamhaus", errors.New("timeout"))
+	m.ObserveFeedRefresh(`a\b"c`, nil)
+	m.HandleNetEvent(NetEvent{Type: NetEventClassifyDrop, FilterID: 5})
+	m.HandleNetEvent(NetEvent{Type: NetEventClassifyDrop, FilterID: 99})
+
+	// The error counter is package-wide: only the calls made here count.
+	const op = "FwpmMetricsTest0"
+	errorSeries := `wfp_call_errors_total{call="` + op + `",code="0x80320003"}`
+	unknownSeries := `wfp_call_errors_total{call="` + op + `",code="unknown"}`
+	before := scrape(t, m)
+	memoryErr(op, "", FWP_E_FILTER_NOT_FOUND)
+	memoryErr(op, "", FWP_E_FILTER_NOT_FOUND)
+	wfpErr(op, "", errors.New("not an errno"))
+
+	samples := scrape(t, m)
+	for series, want := range map[string]string{
+		// Filter 4, disabled, is not counted.
+		`wfp_rules_installed{action="block",direction="outbound",family="ipv4"}`: "2",
+		`wfp_rules_installed{action="permit",direction="inbound",family="ipv6"}`: "1",
+		`wfp_rules_installed{action="block",direction="inbound",family="ipv4"}`:  "1",
+		`wfp_feed_refreshes_total{feed="spamhaus",outcome="success"}`:            "2",
+		`wfp_feed_refreshes_total{feed="spamhaus",outcome="failure"}`:            "1",
+		`wfp_feed_refreshes_total{feed="a\\b\"c",outcome="success"}`:             "1",
+		`wfp_drop_events_total{rule="say \"hi\"\nC:\\x"}`:                        "1",
+		// Drops by filters that are not ours.
+		`wfp_drop_events_total{rule=""}`: "1",
+	} {
+		if got := samples[series]; got != want {
+			t.Errorf("%s = %q, want %s", series, got, want)
+		}
+	}
+	if _, ok := samples["wfp_rules_installed"]; ok {
+		t.Error("wfp_rules_installed 0 exported along with rules")
+	}
+	for series, delta := range map[string]int{errorSeries: 2, unknownSeries: 1} {
+		got, _ := strconv.Atoi(samples[series])
+		was, _ := strconv.Atoi(before[series])
+		if got-was != delta {
+			t.Errorf("%s = %q after %d errors, was %q", series, samples[series], delta, before[series])
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package firewall
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net/netip"
+	"time"
+	"unicode/utf16"
+)
+
+// NetEventType mirrors FWPM_NET_EVENT_TYPE defined in fwpmtypes.h.
+type NetEventType uint32
+
+const (
+	NetEventClassifyDrop  NetEventType = 3 // FWPM_NET_EVENT_TYPE_CLASSIFY_DROP
+	NetEventClassifyAllow NetEventType = 6 // FWPM_NET_EVENT_TYPE_CLASSIFY_ALLOW
+)
+
+// Values of FWPM_NET_EVENT_FLAG_* defined in fwpmtypes.h. They tell which
+// header fields of a net event carry data.
+const (
+	netEventFlagIPProtocolSet = 0x00000001
+	netEventFlagLocalAddrSet  = 0x00000002
+	netEventFlagRemoteAddrSet = 0x00000004
+	netEventFlagLocalPortSet  = 0x00000008
+	netEventFlagRemotePortSet = 0x00000010
+	netEventFlagAppIDSet      = 0x00000020
+	netEventFlagIPVersionSet  = 0x00000100
+)
+
+// Values of FWP_IP_VERSION and of the msFwpDirection field (FWP_DIRECTION_IN
+// and FWP_DIRECTION_OUT defined in fwpmtypes.h).
+const (
+	netEventIPVersionV4 = 0
+	netEventIPVersionV6 = 1
+
+	netEventDirectionIn  = 0x00003900
+	netEventDirectionOut = 0x00003901
+)
+
+// Number of 100-nanosecond intervals between 1601-01-01 (FILETIME epoch) and
+// 1970-01-01 (Unix epoch).
+const filetimeUnixEpoch = 116444736000000000
+
+/*
+ * NetEvent is a copy of a WFP net event header and its classify payload, as
+ * delivered by a net event subscription. Values are kept in their WFP encoding
+ * (FILETIME, host-order IPv4 addresses, UTF-16 app ID) so that the whole
+ * decoding path can be fed synthetic events on any platform.
+ */
+type NetEvent struct {
+	Type       NetEventType
+	Timestamp  uint64 // FILETIME
+	Flags      uint32 // FWPM_NET_EVENT_FLAG_*
+	IPVersion  uint32 // FWP_IP_VERSION
+	IPProtocol uint8
+	LocalAddr  [16]byte // First 4 bytes hold a host-order UINT32 for IPv4.
+	RemoteAddr [16]byte // First 4 bytes hold a host-order UINT32 for IPv4.
+	LocalPort  uint16
+	RemotePort uint16
+	AppID      []byte // NUL-terminated UTF-16LE device path.
+	FilterID   uint64
+	LayerID    uint16
+	Direction  uint32 // msFwpDirection
+}
+
+// DropEvent is the decoded form of a classify net event.
+type DropEvent struct {
+	Time       time.Time
+	Type       NetEventType
+	FilterID   uint64
+	LayerID    uint16
+	Direction  string // "inbound", "outbound" or empty if unknown.
+	Protocol   uint8
+	LocalAddr  netip.Addr
+	LocalPort  uint16
+	RemoteAddr netip.Addr
+	RemotePort uint16
+	AppID      string
+}
+
+// NetEventSource delivers net events until it is closed. The Windows
+// implementation is backed by FwpmNetEventSubscribe0; NetEventChan can be used
+// to feed synthetic events.
+type NetEventSource interface {
+	Events() <-chan NetEvent
+	Close() error
+}
+
+// NetEventChan is a NetEventSource backed by a plain channel.
+type NetEventChan chan NetEvent
+
+func (c NetEventChan) Events() <-chan NetEvent { return c }
+
+func (c NetEventChan) Close() error {
+	close(c)
+	return nil
+}
+
+// NetEventHandler is implemented by the consumers of net events, such as
+// DropLogger and Auditor.
+type NetEventHandler interface {
+	HandleNetEvent(ev NetEvent)
+}
+
+// DispatchNetEvents hands every event from src to each of the handlers, until
+// ctx is done or src is exhausted.
+func DispatchNetEvents(ctx context.Context, src NetEventSource, handlers ...NetEventHandler) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-src.Events():
+			if !ok {
+				return
+			}
+			for _, h := range handlers {
+				h.HandleNetEvent(ev)
+			}
+		}
+	}
+}
+
+func DecodeNetEvent(ev NetEvent) DropEvent {
+	d := DropEvent{
+		Type:     ev.Type,
+		FilterID: ev.FilterID,
+		LayerID:  ev.LayerID,
+	}
+	if ev.Timestamp != 0 {
+		d.Time = time.Unix(0, (int64(ev.Timestamp)-filetimeUnixEpoch)*100).UTC()
+	}
+	switch ev.Direction {
+	case netEventDirectionIn:
+		d.Direction = "inbound"
+	case netEventDirectionOut:
+		d.Direction = "outbound"
+	}
+	if ev.Flags&netEventFlagIPProtocolSet != 0 {
+		d.Protocol = ev.IPProtocol
+	}
+	if ev.Flags&netEventFlagIPVersionSet != 0 {
+		if ev.Flags&netEventFlagLocalAddrSet != 0 {
+			d.LocalAddr = decodeNetEventAddr(ev.IPVersion, ev.LocalAddr)
+		}
+		if ev.Flags&netEventFlagRemoteAddrSet != 0 {
+			d.RemoteAddr = decodeNetEventAddr(ev.IPVersion, ev.RemoteAddr)
+		}
+	}
+	if ev.Flags&netEventFlagLocalPortSet != 0 {
+		d.LocalPort = ev.LocalPort
+	}
+	if ev.Flags&netEventFlagRemotePortSet != 0 {
+		d.RemotePort = ev.RemotePort
+	}
+	if ev.Flags&netEventFlagAppIDSet != 0 {
+		d.AppID = decodeUTF16Blob(ev.AppID)
+	}
+	return d
+}
+
+func decodeNetEventAddr(version uint32, raw [16]byte) netip.Addr {
+	switch version {
+	case netEventIPVersionV4:
+		var v4 [4]byte
+		binary.BigEndian.PutUint32(v4[:], binary.LittleEndian.Uint32(raw[:4]))
+		return netip.AddrFrom4(v4)
+	case netEventIPVersionV6:
+		return netip.AddrFrom16(raw)
+	}
+	return netip.Addr{}
+}
+
+func decodeUTF16Blob(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+func protocolName(proto uint8) string {
+	switch proto {
+	case 1:
+		return "icmp"
+	case 6:
+		return "tcp"
+	case 17:
+		return "udp"
+	case 58:
+		return "icmpv6"
+	}
+	return ""
+}
+
+/*
+ * DropLogger turns classify-drop net events into structured log lines and
+ * correlates each of them with the rule that caused the drop, if the filter
+ * belongs to us.
+ */
+type DropLogger struct {
+	Rules  *RuleIndex
+	Logger *slog.Logger
+}
+
+func (l *DropLogger) HandleNetEvent(ev NetEvent) {
+	if ev.Type != NetEventClassifyDrop {
+		return
+	}
+	d := DecodeNetEvent(ev)
+	attrs := []slog.Attr{
+		slog.Time("event_time", d.Time),
+		slog.Uint64("filter_id", d.FilterID),
+		slog.Int("layer_id", int(d.LayerID)),
+		slog.String("direction", d.Direction),
+		slog.Int("protocol", int(d.Protocol)),
+	}
+	if name := protocolName(d.Protocol); name != "" {
+		attrs = append(attrs, slog.String("protocol_name", name))
+	}
+	if d.LocalAddr.IsValid() {
+		attrs = append(attrs, slog.String("local", netip.AddrPortFrom(d.LocalAddr, d.LocalPort).String()))
+	}
+	if d.RemoteAddr.IsValid() {
+		attrs = append(attrs, slog.String("remote", netip.AddrPortFrom(d.RemoteAddr, d.RemotePort).String()))
+	}
+	if d.AppID != "" {
+		attrs = append(attrs, slog.String("app_id", d.AppID))
+	}
+	if rule, ok := l.Rules.Lookup(d.FilterID); ok {
+		attrs = append(attrs,
+			slog.String("rule", rule.Name),
+			slog.String("action", rule.Action),
+			slog.String("cidr", rule.Network),
+			slog.String("layer", rule.Layer),
+		)
+		if rule.Group != "" {
+			attrs = append(attrs, slog.String("group", rule.Group))
+		}
+	} else {
+		attrs = append(attrs, slog.Bool("foreign_filter", true))
+	}
+	l.Logger.LogAttrs(context.Background(), slog.LevelInfo, "packet dropped", attrs...)
+}
@@ -0,0 +1,139 @@
+package firewall
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"net/netip"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// syntheticDrop returns an outbound TCP classify-drop event of filterID, in
+// the WFP encoding.
+func syntheticDrop(filterID uint64, local, remote netip.AddrPort, app string) NetEvent {
+	ev := NetEvent{
+		Type:       NetEventClassifyDrop,
+		Timestamp:  uint64(time.Date(2026, 10, 19, 9, 12, 44, 0, time.UTC).UnixNano()/100) + filetimeUnixEpoch,
+		Flags:      netEventFlagIPProtocolSet | netEventFlagLocalAddrSet | netEventFlagRemoteAddrSet | netEventFlagLocalPortSet | netEventFlagRemotePortSet | netEventFlagAppIDSet | netEventFlagIPVersionSet,
+		IPVersion:  netEventIPVersionV4,
+		IPProtocol: 6,
+		LocalPort:  local.Port(),
+		RemotePort: remote.Port(),
+		FilterID:   filterID,
+		LayerID:    48,
+		Direction:  netEventDirectionOut,
+	}
+	// IPv4 addresses are host-order UINT32s.
+	l, r := local.Addr().As4(), remote.Addr().As4()
+	binary.LittleEndian.PutUint32(ev.LocalAddr[:4], binary.BigEndian.Uint32(l[:]))
+	binary.LittleEndian.PutUint32(ev.RemoteAddr[:4], binary.BigEndian.Uint32(r[:]))
+	for _, u := range utf16.Encode([]rune(app)) {
+		ev.AppID = binary.LittleEndian.AppendUint16(ev.AppID, u)
+	}
+	ev.AppID = append(ev.AppID, 0, 0)
+	return ev
+}
+
+func TestDecodeNetEvent(t *testing.T) {
+	local := netip.MustParseAddrPort("10.0.0.7:50123")
+	remote := netip.MustParseAddrPort("10.1.2.3:443")
+	d := DecodeNetEvent(syntheticDrop(68921, local, remote, `\device\harddiskvolume3\curl.exe`))
+
+	if want := time.Date(2026, 10, 19, 9, 12, 44, 0, time.UTC); !d.Time.Equal(want) {
+		t.Errorf("Time = %v, want %v", d.Time, want)
+	}
+	if d.LocalAddr != local.Addr() || d.LocalPort != local.Port() {
+		t.Errorf("local = %v:%d, want %v", d.LocalAddr, d.LocalPort, local)
+	}
+	if d.RemoteAddr != remote.Addr() || d.RemotePort != remote.Port() {
+		t.Errorf("remote = %v:%d, want %v", d.RemoteAddr, d.RemotePort, remote)
+	}
+	if d.Direction != "outbound" || d.Protocol != 6 || d.FilterID != 68921 {
+		t.Errorf("direction, protocol, filter = %q, %d, %d; want outbound, 6, 68921", d.Direction, d.Protocol, d.FilterID)
+	}
+	if d.AppID != `\device\harddiskvolume3\curl.exe` {
+		t.Errorf("AppID = %q", d.AppID)
+	}
+
+	// Fields whose flag is not set are left out.
+	ev := syntheticDrop(1, local, remote, "app")
+	ev.Flags = netEventFlagIPProtocolSet
+	if d := DecodeNetEvent(ev); d.LocalAddr.IsValid() || d.RemoteAddr.IsValid() || d.AppID != "" || d.RemotePort != 0 {
+		t.Errorf("unflagged fields decoded: %+v", d)
+	}
+}
+
+func TestDropLogger(t *testing.T) {
+	rules := NewRuleIndex()
+	rules.Add(RuleInfo{
+		FilterID: 68921,
+		Name:     "Block traffic to 10.1.0.0/16",
+		Action:   "block",
+		Network:  "10.1.0.0/16",
+		Layer:    "ALE_AUTH_CONNECT_V4",
+		Group:    "quarantine",
+	})
+	var out bytes.Buffer
+	logger := &DropLogger{Rules: rules, Logger: slog.New(slog.NewJSONHandler(&out, nil))}
+
+	local := netip.MustParseAddrPort("10.0.0.7:50123")
+	remote := netip.MustParseAddrPort("10.1.2.3:443")
+	src := make(NetEventChan, 4)
+	src <- syntheticDrop(68921, local, remote, `\device\harddiskvolume3\curl.exe`)
+	src <- syntheticDrop(5, local, remote, "")
+	allow := syntheticDrop(68921, local, remote, "")
+	allow.Type = NetEventClassifyAllow
+	src <- allow // Not a drop: ignored.
+	close(src)
+	DispatchNetEvents(context.Background(), src, logger)
+
+	var lines []map[string]any
+	for dec := json.NewDecoder(&out); dec.More(); {
+		var line map[string]any
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2: %v", len(lines), lines)
+	}
+
+	ours := map[string]any{
+		"msg":           "packet dropped",
+		"filter_id":     float64(68921),
+		"direction":     "outbound",
+		"protocol":      float64(6),
+		"protocol_name": "tcp",
+		"local":         "10.0.0.7:50123",
+		"remote":        "10.1.2.3:443",
+		"app_id":        `\device\harddiskvolume3\curl.exe`,
+		"rule":          "Block traffic to 10.1.0.0/16",
+		"action":        "block",
+		"cidr":          "10.1.0.0/16",
+		"layer":         "ALE_AUTH_CONNECT_V4",
+		"group":         "quarantine",
+		"event_time":    "2026-10-19T09:12:44Z",
+	}
+	for k, want := range ours {
+		if got := lines[0][k]; got != want {
+			t.Errorf("rule drop: %s = %v, want %v", k, got, want)
+		}
+	}
+	if _, ok := lines[0]["foreign_filter"]; ok {
+		t.Errorf("rule drop logged as foreign_filter")
+	}
+
+	if lines[1]["foreign_filter"] != true {
+		t.Errorf("foreign drop: foreign_filter = %v, want true", lines[1]["foreign_filter"])
+	}
+	for _, k := range []string{"rule", "app_id", "group"} {
+		if _, ok := lines[1][k]; ok {
+			t.Errorf("foreign drop: unexpected %s", k)
+		}
+	}
+}
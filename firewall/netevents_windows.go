@@ -0,0 +1,294 @@
+package firewall
+
+import (
+	"errors"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+/*
+ * WFP invokes the net event callback on its own RPC threads. Callbacks created
+ * with windows.NewCallback are never released, so a single one is shared by
+ * every subscription and the context argument is used to find the subscriber.
+ */
+var (
+	netEventCallbackOnce sync.Once
+	netEventCallback0    uintptr
+	netEventCallback1    uintptr
+
+	netEventSubscribersMu sync.Mutex
+	netEventSubscribers   = make(map[uintptr]*netEventSubscription)
+	netEventNextCookie    uintptr
+)
+
+type netEventSubscription struct {
+	session   uintptr
+	handle    uintptr
+	cookie    uintptr
+	events    chan NetEvent
+	restore   []func() error // Undo the engine options changed for the subscription, in reverse order.
+	closeOnce sync.Once
+	closeErr  error
+}
+
+/*
+ * Turns on net event collection in the base filtering engine. This is a
+ * machine-wide, persistent setting; classify-drop events are in addition only
+ * generated when the "Filtering Platform Packet Drop" audit subcategory is
+ * enabled. It returns the function that turns collection off again if it was
+ * off, nil if there is nothing to undo.
+ */
+func enableNetEvents(session uintptr) (func() error, error) {
+	previous, err := engineOptionUint32(session, cFWPM_ENGINE_COLLECT_NET_EVENTS, "FWPM_ENGINE_COLLECT_NET_EVENTS")
+	if err != nil {
+		return nil, err
+	}
+	if previous != 0 {
+		return nil, nil
+	}
+	if err := setEngineOptionUint32(session, cFWPM_ENGINE_COLLECT_NET_EVENTS, "FWPM_ENGINE_COLLECT_NET_EVENTS", 1); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return setEngineOptionUint32(session, cFWPM_ENGINE_COLLECT_NET_EVENTS, "FWPM_ENGINE_COLLECT_NET_EVENTS", previous)
+	}, nil
+}
+
+// engineOptionUint32 returns the value of an engine option of type
+// FWP_UINT32, 0 if it has none.
+func engineOptionUint32(session uintptr, option wtFwpmEngineOption, name string) (uint32, error) {
+	var current *wtFwpValue0
+
+	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmenginegetoption0
+	err := fwpmEngineGetOption0(session, option, &current)
+	if err != nil {
+		return 0, wfpErr("FwpmEngineGetOption0", name, err)
+	}
+	var value uint32
+	if current != nil {
+		if current._type == cFWP_UINT32 {
+			value = uint32(current.value)
+		}
+		fwpmFreeMemory0(unsafe.Pointer(&current))
+	}
+	return value, nil
+}
+
+func setEngineOptionUint32(session uintptr, option wtFwpmEngineOption, name string, v uint32) error {
+	value := wtFwpValue0{
+		_type: cFWP_UINT32, // cFWP_UINT32: The data type of the value.
+		value: uintptr(v),  // uintptr(v): The value of the option.
+	}
+
+	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmenginesetoption0
+	err := fwpmEngineSetOption0(session, option, &value)
+	if err != nil {
+		return wfpErr("FwpmEngineSetOption0", name, err)
+	}
+	return nil
+}
+
+/*
+ * Asks the engine to also report classify-allow events, on top of the
+ * keywords already enabled on the machine. Allow events are what audit mode
+ * evaluates; they are only generated when the "Filtering Platform Connection"
+ * audit subcategory is enabled for success. Like collection, the keywords are
+ * a machine-wide, persistent setting: it returns the function that puts back
+ * the previous ones, nil if the keyword was already set.
+ */
+func enableAllowEvents(session uintptr) (func() error, error) {
+	previous, err := engineOptionUint32(session, cFWPM_ENGINE_NET_EVENT_MATCH_ANY_KEYWORDS, "FWPM_ENGINE_NET_EVENT_MATCH_ANY_KEYWORDS")
+	if err != nil {
+		return nil, err
+	}
+	if wtFwpmNetEventKeyword(previous)&cFWPM_NET_EVENT_KEYWORD_CLASSIFY_ALLOW != 0 {
+		return nil, nil
+	}
+	keywords := uint32(wtFwpmNetEventKeyword(previous) | cFWPM_NET_EVENT_KEYWORD_CLASSIFY_ALLOW)
+	if err := setEngineOptionUint32(session, cFWPM_ENGINE_NET_EVENT_MATCH_ANY_KEYWORDS, "FWPM_ENGINE_NET_EVENT_MATCH_ANY_KEYWORDS", keywords); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return setEngineOptionUint32(session, cFWPM_ENGINE_NET_EVENT_MATCH_ANY_KEYWORDS, "FWPM_ENGINE_NET_EVENT_MATCH_ANY_KEYWORDS", previous)
+	}, nil
+}
+
+/*
+ * Subscribes to the net events of the engine behind session. Events that
+ * arrive while the consumer is not keeping up are discarded rather than
+ * blocking the WFP callback thread. The engine options in restore are undone
+ * when the subscription is closed, or fails.
+ *
+ * FwpmNetEventSubscribe1 (Windows 8 and later) is preferred since it is the
+ * first version that delivers classify-allow events; FwpmNetEventSubscribe0
+ * only delivers drops.
+ */
+func subscribeNetEvents(session uintptr, restore []func() error) (NetEventSource, error) {
+	netEventCallbackOnce.Do(func() {
+		netEventCallback0 = windows.NewCallback(netEventCallbackProc0)
+		netEventCallback1 = windows.NewCallback(netEventCallbackProc1)
+	})
+
+	netEventSubscribersMu.Lock()
+	netEventNextCookie++
+	sub := &netEventSubscription{
+		session: session,
+		cookie:  netEventNextCookie,
+		events:  make(chan NetEvent, 1024),
+		restore: restore,
+	}
+	netEventSubscribers[sub.cookie] = sub
+	netEventSubscribersMu.Unlock()
+
+	// An empty template matches every net event.
+	template := wtFwpmNetEventEnumTemplate0{}
+	subscription := wtFwpmNetEventSubscription0{
+		enumTemplate: &template, // *wtFwpmNetEventEnumTemplate0: A pointer to a FWPM_NET_EVENT_ENUM_TEMPLATE0 structure that limits the subscription.
+	}
+
+	var err error
+	if procFwpmNetEventSubscribe1.Find() == nil {
+		// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmneteventsubscribe1
+		err = fwpmNetEventSubscribe1(session, &subscription, netEventCallback1, sub.cookie, &sub.handle)
+	} else {
+		// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmneteventsubscribe0
+		err = fwpmNetEventSubscribe0(session, &subscription, netEventCallback0, sub.cookie, &sub.handle)
+	}
+	if err != nil {
+		netEventSubscribersMu.Lock()
+		delete(netEventSubscribers, sub.cookie)
+		netEventSubscribersMu.Unlock()
+		return nil, errors.Join(wfpErr("FwpmNetEventSubscribe", "", err), restoreEngineOptions(restore))
+	}
+
+	return sub, nil
+}
+
+func (s *netEventSubscription) Events() <-chan NetEvent {
+	return s.events
+}
+
+func (s *netEventSubscription) Close() error {
+	s.closeOnce.Do(func() {
+		// FwpmNetEventUnsubscribe0 waits for in-flight callbacks to return,
+		// so nothing writes to the channel once it has been closed.
+		err := fwpmNetEventUnsubscribe0(s.session, s.handle)
+		if err != nil {
+			s.closeErr = wfpErr("FwpmNetEventUnsubscribe0", "", err)
+		}
+		netEventSubscribersMu.Lock()
+		delete(netEventSubscribers, s.cookie)
+		netEventSubscribersMu.Unlock()
+		close(s.events)
+		if err := restoreEngineOptions(s.restore); err != nil && s.closeErr == nil {
+			s.closeErr = err
+		}
+	})
+	return s.closeErr
+}
+
+// restoreEngineOptions undoes the engine option changes of restore, the last
+// one first.
+func restoreEngineOptions(restore []func() error) error {
+	var errs []error
+	for i := len(restore) - 1; i >= 0; i-- {
+		if err := restore[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func netEventCallbackProc0(context uintptr, event *wtFwpmNetEvent1) uintptr {
+	if event != nil {
+		if ev, ok := copyNetEvent1(event); ok {
+			deliverNetEvent(context, ev)
+		}
+	}
+	return 0
+}
+
+func netEventCallbackProc1(context uintptr, event *wtFwpmNetEvent2) uintptr {
+	if event != nil {
+		if ev, ok := copyNetEvent2(event); ok {
+			deliverNetEvent(context, ev)
+		}
+	}
+	return 0
+}
+
+func deliverNetEvent(context uintptr, ev NetEvent) {
+	netEventSubscribersMu.Lock()
+	sub := netEventSubscribers[context]
+	netEventSubscribersMu.Unlock()
+	if sub == nil {
+		return
+	}
+	select {
+	case sub.events <- ev:
+	default:
+	}
+}
+
+// copyNetEvent1 copies the parts of an FWPM_NET_EVENT1 we understand out of
+// WFP-owned memory, which is only valid for the duration of the callback.
+func copyNetEvent1(event *wtFwpmNetEvent1) (NetEvent, bool) {
+	if event._type != cFWPM_NET_EVENT_TYPE_CLASSIFY_DROP || event.classifyDrop == nil {
+		return NetEvent{}, false
+	}
+
+	h := &event.header
+	ev := NetEvent{
+		Type:       NetEventType(event._type),
+		Timestamp:  uint64(h.timeStamp.HighDateTime)<<32 | uint64(h.timeStamp.LowDateTime),
+		Flags:      uint32(h.flags),
+		IPVersion:  uint32(h.ipVersion),
+		IPProtocol: h.ipProtocol,
+		LocalAddr:  h.localAddr,
+		RemoteAddr: h.remoteAddr,
+		LocalPort:  h.localPort,
+		RemotePort: h.remotePort,
+		FilterID:   event.classifyDrop.filterID,
+		LayerID:    event.classifyDrop.layerID,
+		Direction:  event.classifyDrop.msFwpDirection,
+	}
+	if h.appID.size > 0 && h.appID.data != nil {
+		ev.AppID = append([]byte(nil), unsafe.Slice(h.appID.data, h.appID.size)...)
+	}
+	return ev, true
+}
+
+// copyNetEvent2 is the FWPM_NET_EVENT2 counterpart of copyNetEvent1. It also
+// understands classify-allow events.
+func copyNetEvent2(event *wtFwpmNetEvent2) (NetEvent, bool) {
+	switch event._type {
+	case cFWPM_NET_EVENT_TYPE_CLASSIFY_DROP, cFWPM_NET_EVENT_TYPE_CLASSIFY_ALLOW:
+	default:
+		return NetEvent{}, false
+	}
+	if event.classify == nil {
+		return NetEvent{}, false
+	}
+
+	h := &event.header
+	ev := NetEvent{
+		Type:       NetEventType(event._type),
+		Timestamp:  uint64(h.timeStamp.HighDateTime)<<32 | uint64(h.timeStamp.LowDateTime),
+		Flags:      uint32(h.flags),
+		IPVersion:  uint32(h.ipVersion),
+		IPProtocol: h.ipProtocol,
+		LocalAddr:  h.localAddr,
+		RemoteAddr: h.remoteAddr,
+		LocalPort:  h.localPort,
+		RemotePort: h.remotePort,
+		FilterID:   event.classify.filterID,
+		LayerID:    event.classify.layerID,
+		Direction:  event.classify.msFwpDirection,
+	}
+	if h.appID.size > 0 && h.appID.data != nil {
+		ev.AppID = append([]byte(nil), unsafe.Slice(h.appID.data, h.appID.size)...)
+	}
+	return ev, true
+}
@@ -0,0 +1,145 @@
+package firewall
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+)
+
+/*
+ * Policy is a set of rules kept in a JSON file, for the rules that do not fit
+ * on a command line, mix actions, or are checked before being applied:
+ *
+ *	{
+ *	  "rules": [
+ *	    {"action": "block", "cidr": "10.0.0.0/8"},
+ *	    {"action": "permit", "cidr": "10.1.0.0/16", "group": "ops"},
+ *	    {"action": "block", "cidr": "172.16.0.0/12", "except": ["172.16.5.0/24"]},
+ *	    {"action": "permit", "cidr": "10.2.0.0/16", "proto": "tcp", "ports": "80,443"},
+ *	    {"action": "block", "cidr": "0.0.0.0/0", "match": ["remote_address!=10.0.0.0/8", "remote_port!=53"]},
+ *	    {"action": "block", "mac": "00:15:5d:01:02:03", "direction": "inbound"},
+ *	    {"action": "permit", "vm2vm": "only", "direction": "inbound"}
+ *	  ]
+ *	}
+ *
+ * As on the command line, rules without a weight get consecutive ones, so a
+ * rule takes precedence over the rules before it.
+ */
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+type PolicyRule struct {
+	Action    string   `json:"action"`              // "permit" or "block".
+	Direction string   `json:"direction,omitempty"` // "outbound" (default) or "inbound".
+	CIDR      string   `json:"cidr"`                // IPv4 network or range, see ParseAddress.
+	MAC       string   `json:"mac,omitempty"`       // Remote MAC address, instead of CIDR for a rule on Ethernet frames.
+	Except    []string `json:"except,omitempty"`    // Networks carved out of CIDR.
+	Proto     string   `json:"proto,omitempty"`     // Comma-separated protocols, e.g. "tcp,udp"; empty for any.
+	Ports     string   `json:"ports,omitempty"`     // Comma-separated remote ports, e.g. "80,443"; empty for any.
+	Match     []string `json:"match,omitempty"`     // Other conditions, see ParseCondition, e.g. "remote_port!=53".
+	VM2VM     string   `json:"vm2vm,omitempty"`     // "only" or "exclude" the Ethernet frames between virtual machines, see ParseVM2VM.
+	Weight    uint8    `json:"weight,omitempty"`    // 0 for the next consecutive weight.
+	Group     string   `json:"group,omitempty"`
+}
+
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", path, err)
+	}
+	return &policy, nil
+}
+
+/*
+ * Specs validates every rule of the policy, reporting all invalid ones at
+ * once like ParseRuleSpecs, and assigns the missing weights.
+ */
+func (p *Policy) Specs() ([]RuleSpec, error) {
+	if len(p.Rules) > 0xff-firstRuleWeight+1 {
+		return nil, fmt.Errorf("too many rules: at most %d are supported", 0xff-firstRuleWeight+1)
+	}
+
+	var errs []error
+	specs := make([]RuleSpec, 0, len(p.Rules))
+	for i, rule := range p.Rules {
+		spec, err := rule.spec(uint8(firstRuleWeight + i))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %d: %w", i+1, err))
+			continue
+		}
+		specs = append(specs, spec)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return specs, nil
+}
+
+func (r PolicyRule) spec(weight uint8) (RuleSpec, error) {
+	if r.Action != "permit" && r.Action != "block" {
+		return RuleSpec{}, fmt.Errorf("invalid action %q: must be permit or block", r.Action)
+	}
+	if r.Group != "" {
+		if err := ValidateGroupName(r.Group); err != nil {
+			return RuleSpec{}, err
+		}
+	}
+	constraints, err := ParseConstraints(r.Proto, r.Ports, r.Match...)
+	if err != nil {
+		return RuleSpec{}, err
+	}
+	if r.VM2VM != "" {
+		vm2vm, err := ParseVM2VM(r.VM2VM)
+		if err != nil {
+			return RuleSpec{}, err
+		}
+		constraints = append(constraints, vm2vm)
+	}
+	if r.Weight != 0 {
+		weight = r.Weight
+	}
+	spec := RuleSpec{Action: r.Action, Direction: r.Direction, Weight: weight, Group: r.Group, Conditions: constraints}
+	if r.MAC != "" || r.CIDR == "" && slices.ContainsFunc(constraints, Condition.isFrame) {
+		// A rule on Ethernet frames, by their remote MAC address or the conditions alone.
+		if r.CIDR != "" || r.Except != nil {
+			return RuleSpec{}, fmt.Errorf("mac cannot be used with cidr or except")
+		}
+		if r.MAC != "" {
+			mac, err := ParseMAC(r.MAC)
+			if err != nil {
+				return RuleSpec{}, err
+			}
+			spec.Conditions = append([]Condition{RemoteMAC(mac)}, constraints...)
+		}
+		if err := spec.Validate(); err != nil {
+			return RuleSpec{}, err
+		}
+		return spec, nil
+	}
+	prefix, addrs, err := ParseAddress(r.CIDR)
+	if err != nil {
+		return RuleSpec{}, err
+	}
+	var except []netip.Prefix
+	if r.Except != nil {
+		if addrs.IsValid() {
+			return RuleSpec{}, fmt.Errorf("except cannot be used with a range")
+		}
+		if except, err = ParseExcept(prefix, r.Except); err != nil {
+			return RuleSpec{}, err
+		}
+	}
+	spec.Network, spec.Range, spec.Except = prefix, addrs, except
+	if err := spec.Validate(); err != nil {
+		return RuleSpec{}, err
+	}
+	return spec, nil
+}
@@ -0,0 +1,330 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+/*
+ * PolicyTest is a file of test cases for a policy, run against the simulator
+ * so that a policy change that, say, blocks the monitoring endpoints fails in
+ * CI before it reaches a machine:
+ *
+ *	{
+ *	  "cases": [
+ *	    {"name": "dns", "proto": "udp", "remote": "10.1.0.53:53", "expect": "permit"},
+ *	    {"name": "lab", "remote": "10.2.0.0/16", "sample": 8, "expect": "block"}
+ *	  ],
+ *	  "tables": [
+ *	    {
+ *	      "name": "monitoring",
+ *	      "defaults": {"proto": "tcp", "expect": "permit"},
+ *	      "columns": ["remote", "app"],
+ *	      "rows": [
+ *	        ["10.1.2.3:443", "C:\\Program Files\\Agent\\agent.exe"],
+ *	        ["10.1.2.4:9100", ""]
+ *	      ]
+ *	    }
+ *	  ]
+ *	}
+ *
+ * A remote given as a CIDR stands for a sample of its addresses: the first,
+ * the last and evenly spaced ones in between, "sample" in all (3 by default),
+ * so that the whole range is covered in a reproducible way.
+ */
+type PolicyTest struct {
+	Cases  []TestCase  `json:"cases"`
+	Tables []TestTable `json:"tables"`
+}
+
+type TestCase struct {
+	Name      string `json:"name"`
+	Direction string `json:"direction"` // "outbound" (default) or "inbound".
+	Proto     string `json:"proto"`     // Default "tcp".
+	Local     string `json:"local"`     // ADDR or ADDR:PORT, may be empty.
+	Remote    string `json:"remote"`    // ADDR, ADDR:PORT or a CIDR to sample.
+	App       string `json:"app"`
+	Expect    string `json:"expect"` // "permit" or "block".
+	Sample    int    `json:"sample"` // Number of addresses taken from a remote CIDR.
+}
+
+// TestTable is a compact way to write many cases: each row gives the values
+// of the columns, on top of the defaults.
+type TestTable struct {
+	Name     string     `json:"name"`
+	Defaults TestCase   `json:"defaults"`
+	Columns  []string   `json:"columns"` // Names of TestCase fields, as in JSON.
+	Rows     [][]string `json:"rows"`
+}
+
+// Default number of addresses taken from a remote CIDR.
+const defaultTestSample = 3
+
+// Upper bound of the addresses taken from a single remote CIDR.
+const maxTestSample = 4096
+
+func LoadPolicyTest(path string) (*PolicyTest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var test PolicyTest
+	if err := json.Unmarshal(data, &test); err != nil {
+		return nil, fmt.Errorf("policy test %s: %w", path, err)
+	}
+	return &test, nil
+}
+
+// set assigns the field of c named as in JSON.
+func (c *TestCase) set(field, value string) error {
+	switch field {
+	case "name":
+		c.Name = value
+	case "direction":
+		c.Direction = value
+	case "proto":
+		c.Proto = value
+	case "local":
+		c.Local = value
+	case "remote":
+		c.Remote = value
+	case "app":
+		c.App = value
+	case "expect":
+		c.Expect = value
+	case "sample":
+		if _, err := fmt.Sscan(value, &c.Sample); err != nil {
+			return fmt.Errorf("invalid sample %q", value)
+		}
+	default:
+		return fmt.Errorf("unknown column %q", field)
+	}
+	return nil
+}
+
+// TestConnection is a single connection to check, once tables and CIDRs have
+// been expanded.
+type TestConnection struct {
+	Name       string
+	Connection Connection
+	Expect     Action
+}
+
+/*
+ * Connections expands the tables and the sampled CIDRs into the connections
+ * to check. Invalid cases are all reported at once.
+ */
+func (t *PolicyTest) Connections() ([]TestConnection, error) {
+	var conns []TestConnection
+	var errs []error
+	add := func(label string, c TestCase) {
+		expanded, err := c.connections(label)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", label, err))
+			return
+		}
+		conns = append(conns, expanded...)
+	}
+
+	for i, c := range t.Cases {
+		label := c.Name
+		if label == "" {
+			label = fmt.Sprintf("case %d", i+1)
+		}
+		add(label, c)
+	}
+	for i, table := range t.Tables {
+		name := table.Name
+		if name == "" {
+			name = fmt.Sprintf("table %d", i+1)
+		}
+		for j, row := range table.Rows {
+			label := fmt.Sprintf("%s row %d", name, j+1)
+			if len(row) != len(table.Columns) {
+				errs = append(errs, fmt.Errorf("%s: %d values for %d columns", label, len(row), len(table.Columns)))
+				continue
+			}
+			c := table.Defaults
+			c.Name = ""
+			var err error
+			for k, column := range table.Columns {
+				if err = c.set(column, row[k]); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", label, err))
+				continue
+			}
+			if c.Name != "" {
+				label = name + " " + c.Name
+			}
+			add(label, c)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return conns, nil
+}
+
+func (c TestCase) connections(label string) ([]TestConnection, error) {
+	base := TestConnection{Name: label, Connection: Connection{Direction: "outbound", App: c.App}}
+	switch c.Direction {
+	case "", "outbound":
+	case "inbound":
+		base.Connection.Direction = "inbound"
+	default:
+		return nil, fmt.Errorf("invalid direction %q: must be outbound or inbound", c.Direction)
+	}
+	proto := c.Proto
+	if proto == "" {
+		proto = "tcp"
+	}
+	var err error
+	if base.Connection.Protocol, err = ParseProtocol(proto); err != nil {
+		return nil, err
+	}
+	if c.Local != "" {
+		if base.Connection.LocalAddr, base.Connection.LocalPort, err = ParseEndpoint(c.Local); err != nil {
+			return nil, err
+		}
+	}
+	switch c.Expect {
+	case "permit":
+		base.Expect = ActionPermit
+	case "block":
+		base.Expect = ActionBlock
+	default:
+		return nil, fmt.Errorf("invalid expect %q: must be permit or block", c.Expect)
+	}
+	if c.Remote == "" {
+		return nil, fmt.Errorf("no remote address")
+	}
+
+	if !strings.Contains(c.Remote, "/") {
+		if base.Connection.RemoteAddr, base.Connection.RemotePort, err = ParseEndpoint(c.Remote); err != nil {
+			return nil, err
+		}
+		return []TestConnection{base}, nil
+	}
+
+	prefix, err := netip.ParsePrefix(c.Remote)
+	if err != nil {
+		return nil, err
+	}
+	n := c.Sample
+	if n <= 0 {
+		n = defaultTestSample
+	}
+	addrs, err := samplePrefix(prefix, n)
+	if err != nil {
+		return nil, err
+	}
+	conns := make([]TestConnection, len(addrs))
+	for i, addr := range addrs {
+		conns[i] = base
+		conns[i].Name = fmt.Sprintf("%s [%s]", label, addr)
+		conns[i].Connection.RemoteAddr = addr
+	}
+	return conns, nil
+}
+
+/*
+ * samplePrefix returns n addresses of prefix: the first, the last and evenly
+ * spaced ones in between, or every address if there are no more than n.
+ */
+func samplePrefix(prefix netip.Prefix, n int) ([]netip.Addr, error) {
+	if !prefix.Addr().Is4() {
+		return nil, fmt.Errorf("%s: only IPv4 networks can be sampled", prefix)
+	}
+	if n > maxTestSample {
+		return nil, fmt.Errorf("sample of %d is more than %d", n, maxTestSample)
+	}
+	prefix = prefix.Masked()
+	first := prefix.Addr().As4()
+	start := uint64(binary.BigEndian.Uint32(first[:]))
+	size := uint64(1) << (32 - prefix.Bits())
+	if size <= uint64(n) {
+		n = int(size)
+	}
+
+	addrs := make([]netip.Addr, 0, n)
+	for i := 0; i < n; i++ {
+		offset := uint64(0)
+		if n > 1 {
+			offset = uint64(i) * (size - 1) / uint64(n-1)
+		}
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(start+offset))
+		addrs = append(addrs, netip.AddrFrom4(b))
+	}
+	return addrs, nil
+}
+
+// TestResult is the outcome of one connection of a policy test.
+type TestResult struct {
+	TestConnection
+	Decision *Decision
+}
+
+func (r TestResult) Passed() bool {
+	return r.Decision.Verdict == r.Expect
+}
+
+// RunPolicyTest checks every connection of test against sim.
+func RunPolicyTest(sim *Simulator, test *PolicyTest) ([]TestResult, error) {
+	conns, err := test.Connections()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]TestResult, len(conns))
+	for i, conn := range conns {
+		results[i] = TestResult{TestConnection: conn, Decision: sim.Decide(conn.Connection)}
+	}
+	return results, nil
+}
+
+/*
+ * WriteTestReport prints the failed cases, with the rule that decided them,
+ * then a summary line; with verbose, passed cases too.
+ */
+func WriteTestReport(w io.Writer, results []TestResult, verbose bool) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	failed := 0
+	for _, r := range results {
+		status := "ok"
+		if !r.Passed() {
+			status = "FAIL"
+			failed++
+		} else if !verbose {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\texpected %s, got %s\t%s\n", status, r.Name, r.Connection, r.Expect, r.Decision.Verdict, decidedBy(r.Decision))
+	}
+	if failed > 0 {
+		fmt.Fprintf(tw, "FAIL: %d of %d cases failed\n", failed, len(results))
+	} else {
+		fmt.Fprintf(tw, "ok: %d cases passed\n", len(results))
+	}
+	return tw.Flush()
+}
+
+// decidedBy describes the rule that gave a verdict.
+func decidedBy(d *Decision) string {
+	if d.Filter == nil {
+		return "by the layer default"
+	}
+	s := fmt.Sprintf("by filter %d %q", d.Filter.ID, d.Filter.Name)
+	if group, _ := parseFilterDescription(d.Filter.Description); group != "" {
+		s += " in group " + group
+	}
+	return s
+}
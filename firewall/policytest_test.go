@@ -0,0 +1,163 @@
+package firewall
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPolicyTestConnections(t *testing.T) {
+	test := &PolicyTest{
+		Cases: []TestCase{
+			{Name: "dns", Proto: "udp", Remote: "10.1.0.53:53", Expect: "permit"},
+			{Remote: "192.0.2.1", Direction: "inbound", Local: "10.0.0.7:22", Expect: "block"},
+		},
+		Tables: []TestTable{{
+			Name:     "monitoring",
+			Defaults: TestCase{Name: "ignored", Proto: "udp", Expect: "permit"},
+			Columns:  []string{"remote", "app", "proto", "name"},
+			Rows: [][]string{
+				{"10.1.2.3:443", `C:\agent.exe`, "tcp", "agent"},
+				{"10.1.2.4:9100", "", "", ""},
+			},
+		}},
+	}
+	conns, err := test.Connections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range conns {
+		got = append(got, fmt.Sprintf("%s: %s app=%q %s", c.Name, c.Connection, c.Connection.App, c.Expect))
+	}
+	want := []string{
+		"dns: " + Connection{Direction: "outbound", Protocol: 17, RemoteAddr: netip.MustParseAddr("10.1.0.53"), RemotePort: 53}.String() + ` app="" permit`,
+		"case 2: " + Connection{Direction: "inbound", Protocol: 6, LocalAddr: netip.MustParseAddr("10.0.0.7"), LocalPort: 22, RemoteAddr: netip.MustParseAddr("192.0.2.1")}.String() + ` app="" block`,
+		// Columns override the defaults, even with an empty value.
+		"monitoring agent: " + Connection{Direction: "outbound", Protocol: 6, RemoteAddr: netip.MustParseAddr("10.1.2.3"), RemotePort: 443, App: `C:\agent.exe`}.String() + ` app="C:\\agent.exe" permit`,
+		"monitoring row 2: " + Connection{Direction: "outbound", Protocol: 6, RemoteAddr: netip.MustParseAddr("10.1.2.4"), RemotePort: 9100}.String() + ` app="" permit`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Connections =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Every invalid case is reported.
+	test = &PolicyTest{
+		Cases: []TestCase{{Name: "no expect", Remote: "10.0.0.1"}},
+		Tables: []TestTable{{
+			Name:     "t",
+			Defaults: TestCase{Expect: "block"},
+			Columns:  []string{"remote", "port"},
+			Rows:     [][]string{{"10.0.0.1", "80"}, {"10.0.0.2"}},
+		}},
+	}
+	_, err = test.Connections()
+	if err == nil {
+		t.Fatal("Connections of invalid cases succeeded")
+	}
+	for _, s := range []string{`no expect: invalid expect ""`, `t row 1: unknown column "port"`, "t row 2: 1 values for 2 columns"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error %q does not report %q", err, s)
+		}
+	}
+}
+
+func TestPolicyTestSample(t *testing.T) {
+	tests := []struct {
+		remote string
+		sample int
+		want   []string // Nil for an error.
+	}{
+		{"10.0.0.0/24", 0, []string{"10.0.0.0", "10.0.0.127", "10.0.0.255"}},
+		{"10.0.0.0/24", 5, []string{"10.0.0.0", "10.0.0.63", "10.0.0.127", "10.0.0.191", "10.0.0.255"}},
+		{"10.0.0.0/24", 1, []string{"10.0.0.0"}},
+		{"10.0.0.7/24", 2, []string{"10.0.0.0", "10.0.0.255"}},
+		{"10.0.0.0/30", 8, []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{"10.0.0.9/32", 0, []string{"10.0.0.9"}},
+		{"0.0.0.0/0", 3, []string{"0.0.0.0", "127.255.255.255", "255.255.255.255"}},
+		{"10.0.0.0/8", maxTestSample + 1, nil},
+		{"2001:db8::/32", 0, nil},
+	}
+	for _, tt := range tests {
+		test := &PolicyTest{Cases: []TestCase{{Name: "c", Remote: tt.remote, Sample: tt.sample, Expect: "block"}}}
+		conns, err := test.Connections()
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("sample %d of %s = %d connections, want an error", tt.sample, tt.remote, len(conns))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("sample %d of %s: %v", tt.sample, tt.remote, err)
+			continue
+		}
+		var got []string
+		for _, c := range conns {
+			got = append(got, c.Connection.RemoteAddr.String())
+			if want := fmt.Sprintf("c [%s]", c.Connection.RemoteAddr); c.Name != want {
+				t.Errorf("connection named %q, want %q", c.Name, want)
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("sample %d of %s = %v, want %v", tt.sample, tt.remote, got, tt.want)
+		}
+	}
+
+	// The cap is on the sample, not on the size of the network.
+	addrs, err := samplePrefix(netip.MustParsePrefix("0.0.0.0/0"), maxTestSample)
+	if err != nil || len(addrs) != maxTestSample || addrs[len(addrs)-1] != netip.MustParseAddr("255.255.255.255") {
+		t.Errorf("samplePrefix(0.0.0.0/0, %d) = %d addresses, %v", maxTestSample, len(addrs), err)
+	}
+}
+
+func TestRunPolicyTest(t *testing.T) {
+	lab := aggSpec("block", "10.0.0.0/8", firstRuleWeight)
+	lab.Group = "lab"
+	sim, err := NewSimulator(context.Background(), []RuleSpec{lab, aggSpec("permit", "10.1.0.0/16", firstRuleWeight+1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	test := &PolicyTest{Cases: []TestCase{
+		{Name: "allowed", Remote: "10.1.2.3:443", Expect: "permit"},
+		{Name: "lab", Remote: "10.2.0.1:443", Expect: "permit"},
+		{Name: "internet", Remote: "192.0.2.1:443", Expect: "permit"},
+	}}
+	results, err := RunPolicyTest(sim, test)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var passed []bool
+	for _, r := range results {
+		passed = append(passed, r.Passed())
+	}
+	if !slices.Equal(passed, []bool{true, false, true}) {
+		t.Fatalf("passed = %v, want only lab failing", passed)
+	}
+
+	var out bytes.Buffer
+	if err := WriteTestReport(&out, results, false); err != nil {
+		t.Fatal(err)
+	}
+	blocking := results[1].Decision.Filter
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "FAIL  lab ") || !strings.HasPrefix(lines[1], "FAIL: 1 of 3 cases failed") {
+		t.Fatalf("report:\n%s\nwant the lab case and the summary", out.String())
+	}
+	if want := fmt.Sprintf("expected permit, got block  by filter %d %q in group lab", blocking.ID, blocking.Name); !strings.HasSuffix(lines[0], want) {
+		t.Errorf("report line %q, want it to end in %q", lines[0], want)
+	}
+
+	out.Reset()
+	if err := WriteTestReport(&out, results, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "by the layer default") || strings.Count("\n"+out.String(), "\nok  ") != 2 {
+		t.Errorf("verbose report:\n%s\nwant the passed cases too", out.String())
+	}
+}
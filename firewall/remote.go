@@ -0,0 +1,78 @@
+package firewall
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+ * Remote selects the filter engine a session is opened on. The zero value is
+ * the local engine with the credentials of the calling process.
+ *
+ * Remote engines are reached over RPC, so the BFE service of the target must
+ * accept remote management (the "Windows Defender Firewall Remote Management"
+ * rules group) and the account must be an administrator there.
+ */
+type Remote struct {
+	Host     string `json:"host"`   // Name or address of the machine; empty for the local engine.
+	User     string `json:"user"`   // Account name, without the domain. Empty to use the caller's credentials.
+	Domain   string `json:"domain"` // Domain of User, or the machine name for a local account.
+	Password string `json:"password"`
+	Auth     string `json:"auth"` // RPC authentication service: "winnt" (NTLM, default) or "default" (negotiate, Kerberos if available).
+}
+
+// IsLocal reports whether r designates the local engine.
+func (r Remote) IsLocal() bool {
+	return r.Host == "" || strings.EqualFold(r.Host, "localhost") || r.Host == "." || r.Host == "127.0.0.1"
+}
+
+// SetUser splits a "DOMAIN\user" or "user@domain" account name into User and Domain.
+func (r *Remote) SetUser(account string) {
+	if domain, user, ok := strings.Cut(account, `\`); ok {
+		r.Domain, r.User = domain, user
+	} else if user, domain, ok := strings.Cut(account, "@"); ok {
+		r.User, r.Domain = user, domain
+	} else {
+		r.User = account
+	}
+}
+
+func (r Remote) Validate() error {
+	switch r.Auth {
+	case "", "winnt", "default":
+	default:
+		return fmt.Errorf("invalid auth %q: must be winnt or default", r.Auth)
+	}
+	if r.User == "" && (r.Domain != "" || r.Password != "") {
+		return fmt.Errorf("a domain or password was given without a user")
+	}
+	return nil
+}
+
+/*
+ * LoadRemote reads a credentials file, so that passwords do not have to be
+ * given on the command line:
+ *
+ *	{"host": "srv01", "user": "CORP\\wfpadmin", "password": "...", "auth": "default"}
+ *
+ * A "DOMAIN\user" or "user@domain" user is split as by SetUser.
+ */
+func LoadRemote(path string) (Remote, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Remote{}, err
+	}
+	var r Remote
+	if err := json.Unmarshal(data, &r); err != nil {
+		return Remote{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if r.Domain == "" {
+		r.SetUser(r.User)
+	}
+	if err := r.Validate(); err != nil {
+		return Remote{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
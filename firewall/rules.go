@@ -1,131 +1,128 @@
 package firewall
 
 import (
-	"encoding/binary"
 	"fmt"
-	"net"
-	"net/netip"
-	"unsafe"
-
-	"golang.org/x/sys/windows"
+	"strings"
+	"time"
 )
 
-func PermitCIDR(session uintptr, baseObjects *baseObjects, weight uint8, network string) error {
-	ipNet, err := netip.ParsePrefix(network)
-	if err != nil {
-		return wrapErr(err)
+func ruleName(action, direction, network string) string {
+	verb, preposition := "Block", "to"
+	if action == "permit" {
+		verb = "Permit"
 	}
-
-	// Convert the IP address and Mask to a 4-byte array
-	addr := ipNet.Addr().As4()
-	mask := net.CIDRMask(ipNet.Bits(), 32) // e.g.: 255.255.255.0 if ipNet.Bits() = 24
-
-	// Convert the IP address and Mask to UINT32
-	addrMask := struct {
-		addr uint32
-		mask uint32
-	}{
-		addr: binary.BigEndian.Uint32(addr[:]),
-		mask: binary.BigEndian.Uint32(mask),
-	}
-
-	conditions := make([]wtFwpmFilterCondition0, 1)
-	conditions[0].fieldKey = cFWPM_CONDITION_IP_REMOTE_ADDRESS              // cFWPM_CONDITION_IP_REMOTE_ADDRESS: The remote IP address of the connection.
-	conditions[0].matchType = cFWP_MATCH_EQUAL                              // cFWP_MATCH_EQUAL: The match type of the condition.
-	conditions[0].conditionValue._type = cFWP_V4_ADDR_MASK                  // cFWP_V4_ADDR_MASK: The data type of the condition value.
-	conditions[0].conditionValue.value = uintptr(unsafe.Pointer(&addrMask)) // uintptr(unsafe.Pointer(&addrMask)): The value of the condition.
-
-	filterKey, err := windows.GenerateGUID()
-	if err != nil {
-		return wrapErr(err)
+	if direction == "inbound" {
+		preposition = "from"
 	}
+	return fmt.Sprintf("%s traffic %s %s", verb, preposition, network)
+}
 
-	displayName := fmt.Sprintf("Permit traffic to %s", network)
-	displayData, err := createWtFwpmDisplayData0(displayName, "")
-	if err != nil {
-		return wrapErr(err)
+/*
+ * layer returns the layer of the filter of s: the ALE layer authorizing the
+ * connections of its direction and address family, or the Ethernet MAC
+ * frame layer of its direction for a rule on frames.
+ */
+func (s RuleSpec) layer() string {
+	if s.frame() {
+		if s.inbound() {
+			return "INBOUND_MAC_FRAME_ETHERNET"
+		}
+		return "OUTBOUND_MAC_FRAME_ETHERNET"
 	}
-
-	filter := wtFwpmFilter0{
-		filterKey:           filterKey,                            // *windows.GUID: A pointer to a GUID that uniquely identifies the filter.
-		displayData:         *displayData,                         // *wtFwpmDisplayData0: A pointer to a FWPM_DISPLAY_DATA0 structure that contains the display data for the filter.
-		flags:               cFWPM_FILTER_FLAG_CLEAR_ACTION_RIGHT, // Added FWPM_FILTER_FLAG_CLEAR_ACTION_RIGHT flag to make the rule an "hard permit" rule (complex to overwrite)
-		providerKey:         &baseObjects.provider,                // *windows.GUID: A pointer to a GUID that uniquely identifies the provider.
-		layerKey:            cFWPM_LAYER_ALE_AUTH_CONNECT_V4,      // *windows.GUID: A pointer to a GUID that uniquely identifies the layer.
-		subLayerKey:         baseObjects.filters,                  // *windows.GUID: A pointer to a GUID that uniquely identifies the sublayer.
-		weight:              filterWeight(weight),                 // wtFwpValue0: The weight of the filter.
-		numFilterConditions: uint32(len(conditions)),              // uint32(len(conditions)): The number of conditions in the filter.
-		filterCondition:     &conditions[0],                       // *wtFwpmFilterCondition0: A pointer to an array of FWPM_FILTER_CONDITION0 structures that contain the conditions for the filter.
-		action: wtFwpmAction0{
-			_type: cFWP_ACTION_PERMIT, // cFWP_ACTION_PERMIT: The action type of the filter.
-		},
+	family := "V4"
+	if !s.Range.IsValid() && s.Network.Addr().Is6() {
+		family = "V6"
 	}
-
-	var filterID uint64
-	err = fwpmFilterAdd0(session, &filter, 0, &filterID)
-	if err != nil {
-		return wrapErr(err)
+	if s.inbound() {
+		return "ALE_AUTH_RECV_ACCEPT_" + family
 	}
-
-	return nil
+	return "ALE_AUTH_CONNECT_" + family
 }
 
-func BlockCIDR(session uintptr, baseObjects *baseObjects, weight uint8, network string) error {
-	ipNet, err := netip.ParsePrefix(network)
-	if err != nil {
-		return wrapErr(err)
+/*
+ * Adds the filter of spec. A disabled filter goes to the disabled sublayer as a
+ * soft permit, which has no effect on traffic; its real action is kept in the
+ * description so that enabling the group can restore it.
+ */
+func addCIDRFilter(session Session, baseObjects *baseObjects, spec RuleSpec, disabled bool) (RuleInfo, error) {
+	network := spec.address()
+	target := network
+	if spec.Host != "" {
+		target = fmt.Sprintf("%s (%s)", spec.Host, spec.Network.Addr())
+	} else if n := len(spec.conditions()) - len(spec.constraints()); n > 1 {
+		target = fmt.Sprintf("%s and %d more", spec.condition().value(), n-1)
 	}
-
-	// Convert the IP address and Mask to a 4-byte array
-	addr := ipNet.Addr().As4()
-	mask := net.CIDRMask(ipNet.Bits(), 32) // e.g.: 255.255.255.0 if ipNet.Bits() = 24
-
-	// Convert the IP address and Mask to UINT32
-	addrMask := struct {
-		addr uint32
-		mask uint32
-	}{
-		addr: binary.BigEndian.Uint32(addr[:]),
-		mask: binary.BigEndian.Uint32(mask),
+	if constraints := spec.constraints(); len(constraints) > 0 {
+		target = strings.TrimSpace(target + " " + formatConditions(constraints))
+	}
+	layer := spec.layer()
+	displayName := ruleName(spec.Action, layerDirection(layer), target)
+	ruleErr := func(err error) *RuleError {
+		return &RuleError{Rule: displayName, CIDR: network, Layer: layer, Err: err}
 	}
 
-	conditions := make([]wtFwpmFilterCondition0, 1)
-	conditions[0].fieldKey = cFWPM_CONDITION_IP_REMOTE_ADDRESS              // cFWPM_CONDITION_IP_REMOTE_ADDRESS: The remote IP address of the connection.
-	conditions[0].matchType = cFWP_MATCH_EQUAL                              // cFWP_MATCH_EQUAL: The match type of the condition.
-	conditions[0].conditionValue._type = cFWP_V4_ADDR_MASK                  // cFWP_V4_ADDR_MASK: The data type of the condition value.
-	conditions[0].conditionValue.value = uintptr(unsafe.Pointer(&addrMask)) // uintptr(unsafe.Pointer(&addrMask)): The value of the condition.
-
-	filterKey, err := windows.GenerateGUID()
+	filterKey, err := NewGUID()
 	if err != nil {
-		return wrapErr(err)
+		return RuleInfo{}, ruleErr(wrapErr(err))
 	}
 
-	displayName := fmt.Sprintf("Block traffic to %s", network)
-	displayData, err := createWtFwpmDisplayData0(displayName, "")
+	meta := spec.Meta
+	meta.Name = displayName
+	meta.Group = spec.Group
+	meta.Action = spec.Action
+	meta.Host = spec.Host
+	if meta.Created.IsZero() {
+		meta.Created = time.Now().UTC()
+	}
+	providerData, err := meta.MarshalBinary()
 	if err != nil {
-		return wrapErr(err)
+		return RuleInfo{}, ruleErr(wrapErr(err))
 	}
 
-	filter := wtFwpmFilter0{
-		filterKey:           filterKey,                            // *windows.GUID: A pointer to a GUID that uniquely identifies the filter.
-		displayData:         *displayData,                         // *wtFwpmDisplayData0: A pointer to a FWPM_DISPLAY_DATA0 structure that contains the display data for the filter.
-		flags:               cFWPM_FILTER_FLAG_CLEAR_ACTION_RIGHT, // Added FWPM_FILTER_FLAG_CLEAR_ACTION_RIGHT flag to make the rule an "hard permit" rule (complex to overwrite)
-		providerKey:         &baseObjects.provider,                // *windows.GUID: A pointer to a GUID that uniquely identifies the provider.
-		layerKey:            cFWPM_LAYER_ALE_AUTH_CONNECT_V4,      // *windows.GUID: A pointer to a GUID that uniquely identifies the layer.
-		subLayerKey:         baseObjects.filters,                  // *windows.GUID: A pointer to a GUID that uniquely identifies the sublayer.
-		weight:              filterWeight(weight),                 // wtFwpValue0: The weight of the filter.
-		numFilterConditions: uint32(len(conditions)),              // uint32(len(conditions)): The number of conditions in the filter.
-		filterCondition:     &conditions[0],                       // *wtFwpmFilterCondition0: A pointer to an array of FWPM_FILTER_CONDITION0 structures that contain the conditions for the filter.
-		action: wtFwpmAction0{
-			_type: cFWP_ACTION_BLOCK, // cFWP_ACTION_BLOCK: The action type of the filter.
-		},
+	filter := Filter{
+		Key:          filterKey,
+		Name:         displayName,
+		Description:  filterDescription(spec.Group, spec.Action),
+		Provider:     baseObjects.provider,
+		ProviderData: providerData, // The rule metadata, see RuleMetadata.
+		Layer:        layer,
+		Sublayer:     baseObjects.filters,
+		Weight:       spec.Weight,
+		Conditions:   spec.conditions(),
+		Action:       ActionBlock,
+		HardAction:   true, // A "hard permit" rule (complex to overwrite)
+		Persistent:   baseObjects.persistent,
+
+		SecurityDescriptor: baseObjects.sd,
+	}
+	if spec.Action == "permit" {
+		filter.Action = ActionPermit
+	}
+	if disabled {
+		filter.HardAction = false              // A soft permit, overridden by any block.
+		filter.Sublayer = baseObjects.disabled // The lowest-weight sublayer.
+		filter.Action = ActionPermit
 	}
 
-	var filterID uint64
-	err = fwpmFilterAdd0(session, &filter, 0, &filterID)
+	filterID, err := session.AddFilter(&filter)
 	if err != nil {
-		return wrapErr(err)
+		return RuleInfo{}, ruleErr(err)
 	}
 
-	return nil
+	logger.Debug("filter added", "rule", displayName, "cidr", network, "layer", layer, "filter_id", filterID, "weight", spec.Weight, "group", spec.Group, "disabled", disabled)
+
+	return RuleInfo{
+		FilterID:   filterID,
+		Name:       displayName,
+		Action:     spec.Action,
+		Network:    network,
+		Layer:      layer,
+		Direction:  layerDirection(layer),
+		Family:     layerFamily(layer),
+		Weight:     spec.Weight,
+		Group:      spec.Group,
+		Disabled:   disabled,
+		Metadata:   meta,
+		Conditions: filter.Conditions,
+	}, nil
 }
@@ -0,0 +1,459 @@
+package firewall
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+/*
+ * SecurityDescriptor is a self-relative SECURITY_DESCRIPTOR, as taken by the
+ * sd argument of FwpmProviderAdd0, FwpmSubLayerAdd0 and FwpmFilterAdd0. Those
+ * of the objects of this package are built from SDDL by ParseSDDL, in Go
+ * rather than with ConvertStringSecurityDescriptorToSecurityDescriptor, so
+ * that they are validated before anything is applied, on any platform.
+ *
+ * Only owner, group and DACL are supported, with allow and deny ACEs: the
+ * objects are protected against being changed or deleted, not audited.
+ */
+type SecurityDescriptor []byte
+
+// Bits of the Control field of a SECURITY_DESCRIPTOR.
+const (
+	seDACLPresent        = 0x0004
+	seDACLAutoInheritReq = 0x0100
+	seDACLAutoInherited  = 0x0400
+	seDACLProtected      = 0x1000
+	seSelfRelative       = 0x8000
+)
+
+/*
+ * Access rights of WFP objects (FWPM_ACTRL_* of fwpmu.h), and the standard
+ * ones. Generic rights in SDDL are mapped to them as the engine maps them
+ * (FWPM_GENERIC_*), so that the descriptor means the same whoever reads it.
+ */
+const (
+	fwpmActrlAdd           = 0x00000001
+	fwpmActrlAddLink       = 0x00000002
+	fwpmActrlBeginReadTxn  = 0x00000004
+	fwpmActrlBeginWriteTxn = 0x00000008
+	fwpmActrlClassify      = 0x00000010
+	fwpmActrlEnum          = 0x00000020
+	fwpmActrlOpen          = 0x00000040
+	fwpmActrlRead          = 0x00000080
+	fwpmActrlReadStats     = 0x00000100
+	fwpmActrlSubscribe     = 0x00000200
+	fwpmActrlWrite         = 0x00000400
+
+	rightDelete      = 0x00010000
+	rightReadControl = 0x00020000
+	rightWriteDAC    = 0x00040000
+	rightWriteOwner  = 0x00080000
+
+	fwpmGenericRead    = rightReadControl | fwpmActrlBeginReadTxn | fwpmActrlClassify | fwpmActrlOpen | fwpmActrlRead | fwpmActrlReadStats
+	fwpmGenericExecute = rightReadControl | fwpmActrlEnum | fwpmActrlSubscribe
+	fwpmGenericWrite   = rightReadControl | fwpmActrlAdd | fwpmActrlAddLink | fwpmActrlBeginWriteTxn | fwpmActrlWrite
+	fwpmGenericAll     = rightDelete | rightReadControl | rightWriteDAC | rightWriteOwner | 0x7ff
+)
+
+// sddlRights are the access right codes of SDDL; the directory service ones
+// (CC to CR) are the bits that WFP gives to FWPM_ACTRL_ADD to READ_STATS.
+var sddlRights = map[string]uint32{
+	"GA": fwpmGenericAll, "GR": fwpmGenericRead, "GW": fwpmGenericWrite, "GX": fwpmGenericExecute,
+	"SD": rightDelete, "RC": rightReadControl, "WD": rightWriteDAC, "WO": rightWriteOwner,
+	"CC": 0x001, "DC": 0x002, "LC": 0x004, "SW": 0x008, "RP": 0x010, "WP": 0x020, "DT": 0x040, "LO": 0x080, "CR": 0x100,
+}
+
+// sddlACEFlags are the inheritance flags of ACEs; WFP objects have no
+// children, but the flags are kept as given.
+var sddlACEFlags = map[string]byte{"OI": 0x01, "CI": 0x02, "NP": 0x04, "IO": 0x08, "ID": 0x10}
+
+// sddlAliases are the well-known SIDs SDDL names by two letters.
+var sddlAliases = map[string]string{
+	"AN": "S-1-5-7",      // Anonymous
+	"AU": "S-1-5-11",     // Authenticated users
+	"BA": "S-1-5-32-544", // Built-in administrators
+	"BG": "S-1-5-32-546", // Built-in guests
+	"BU": "S-1-5-32-545", // Built-in users
+	"CG": "S-1-3-1",      // Creator group
+	"CO": "S-1-3-0",      // Creator owner
+	"IU": "S-1-5-4",      // Interactive users
+	"LS": "S-1-5-19",     // Local service
+	"NO": "S-1-5-32-556", // Network configuration operators
+	"NS": "S-1-5-20",     // Network service
+	"NU": "S-1-5-2",      // Network logon users
+	"OW": "S-1-3-4",      // Owner rights
+	"SU": "S-1-5-6",      // Service logon users
+	"SY": "S-1-5-18",     // Local system
+	"WD": "S-1-1-0",      // Everyone
+}
+
+/*
+ * ParseSDDL builds the security descriptor of s, in the Security Descriptor
+ * Definition Language:
+ *
+ *	O:BAG:BAD:P(A;;GA;;;S-1-5-80-...)(A;;GRGX;;;BA)
+ *
+ * is owned by the administrators, whose members keep the implicit right to
+ * change the DACL, and lets only the given SID change or delete the object,
+ * the administrators only read it. SIDs are given as S-1-... or by their
+ * two-letter aliases. Rights are codes or numbers such as 0xf07ff.
+ */
+func ParseSDDL(s string) (SecurityDescriptor, error) {
+	if s == "" {
+		return nil, fmt.Errorf("invalid SDDL: empty")
+	}
+	var owner, group, dacl []byte
+	var control uint16
+	for rest := s; rest != ""; {
+		if len(rest) < 2 || rest[1] != ':' {
+			return nil, fmt.Errorf("invalid SDDL %q: expected O:, G: or D: at %q", s, rest)
+		}
+		kind := rest[0]
+		value := rest[2:]
+		end := sddlComponentEnd(value)
+		value, rest = value[:end], value[end:]
+		var err error
+		switch kind {
+		case 'O':
+			owner, err = sddlSID(value)
+		case 'G':
+			group, err = sddlSID(value)
+		case 'D':
+			var flags uint16
+			dacl, flags, err = sddlACL(value)
+			control |= seDACLPresent | flags
+		case 'S':
+			err = fmt.Errorf("system ACLs are not supported")
+		default:
+			err = fmt.Errorf("unknown component %c:", kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid SDDL %q: %w", s, err)
+		}
+	}
+
+	return securityParts{control: control, owner: owner, group: group, dacl: dacl}.encode(), nil
+}
+
+// sddlComponentEnd returns where the component starting s ends: at the next
+// "O:", "G:", "D:" or "S:" outside of an ACE.
+func sddlComponentEnd(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && i+1 < len(s) && s[i+1] == ':' && strings.IndexByte("OGDS", c) >= 0:
+			return i
+		}
+	}
+	return len(s)
+}
+
+// sddlSID encodes a SID given as S-1-... or by its alias.
+func sddlSID(s string) ([]byte, error) {
+	if alias, ok := sddlAliases[strings.ToUpper(s)]; ok {
+		s = alias
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) < 3 || !strings.EqualFold(parts[0], "S") || parts[1] != "1" || len(parts) > 3+15 {
+		return nil, fmt.Errorf("invalid SID %q: must be S-1-... or an alias such as BA or SY", s)
+	}
+	authority, err := strconv.ParseUint(parts[2], 0, 48)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SID %q: %w", s, err)
+	}
+	subs := parts[3:]
+	sid := make([]byte, 8, 8+4*len(subs))
+	sid[0] = 1 // SID_REVISION
+	sid[1] = byte(len(subs))
+	for i := 0; i < 6; i++ {
+		sid[2+i] = byte(authority >> (8 * (5 - i)))
+	}
+	for _, sub := range subs {
+		n, err := strconv.ParseUint(sub, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SID %q: %w", s, err)
+		}
+		sid = binary.LittleEndian.AppendUint32(sid, uint32(n))
+	}
+	return sid, nil
+}
+
+// sddlACL encodes an ACL given as its flags and ACEs, and returns the
+// control bits of the flags.
+func sddlACL(s string) ([]byte, uint16, error) {
+	var control uint16
+	flags, aces, _ := strings.Cut(s, "(")
+	if aces != "" {
+		aces = "(" + aces
+	}
+	for flags != "" {
+		switch {
+		case strings.HasPrefix(flags, "P"):
+			control |= seDACLProtected
+			flags = flags[1:]
+		case strings.HasPrefix(flags, "AI"):
+			control |= seDACLAutoInherited
+			flags = flags[2:]
+		case strings.HasPrefix(flags, "AR"):
+			control |= seDACLAutoInheritReq
+			flags = flags[2:]
+		default:
+			return nil, 0, fmt.Errorf("invalid ACL flags %q: must be P, AI or AR", flags)
+		}
+	}
+
+	acl := make([]byte, 8)
+	acl[0] = 2 // ACL_REVISION
+	count := 0
+	for aces != "" {
+		end := strings.IndexByte(aces, ')')
+		if aces[0] != '(' || end < 0 {
+			return nil, 0, fmt.Errorf("invalid ACEs %q: must be (TYPE;FLAGS;RIGHTS;;;SID)...", aces)
+		}
+		ace, err := sddlACE(aces[1:end])
+		if err != nil {
+			return nil, 0, err
+		}
+		acl = append(acl, ace...)
+		aces = aces[end+1:]
+		count++
+	}
+	if len(acl) > 0xffff {
+		return nil, 0, fmt.Errorf("ACL too large: %d bytes", len(acl))
+	}
+	binary.LittleEndian.PutUint16(acl[2:], uint16(len(acl)))
+	binary.LittleEndian.PutUint16(acl[4:], uint16(count))
+	return acl, control, nil
+}
+
+// sddlACE encodes an allow or deny ACE, "TYPE;FLAGS;RIGHTS;;;SID".
+func sddlACE(s string) ([]byte, error) {
+	fields := strings.Split(s, ";")
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid ACE %q: must be TYPE;FLAGS;RIGHTS;;;SID", s)
+	}
+	var aceType byte
+	switch fields[0] {
+	case "A":
+		aceType = 0 // ACCESS_ALLOWED_ACE_TYPE
+	case "D":
+		aceType = 1 // ACCESS_DENIED_ACE_TYPE
+	default:
+		return nil, fmt.Errorf("invalid ACE %q: type must be A (allow) or D (deny)", s)
+	}
+	var aceFlags byte
+	for f := fields[1]; f != ""; f = f[2:] {
+		flag, ok := sddlACEFlags[f[:min(2, len(f))]]
+		if !ok {
+			return nil, fmt.Errorf("invalid ACE %q: unknown flag %q", s, f[:min(2, len(f))])
+		}
+		aceFlags |= flag
+	}
+	mask, err := sddlMask(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ACE %q: %w", s, err)
+	}
+	if fields[3] != "" || fields[4] != "" {
+		return nil, fmt.Errorf("invalid ACE %q: object ACEs are not supported", s)
+	}
+	sid, err := sddlSID(fields[5])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ACE %q: %w", s, err)
+	}
+
+	ace := make([]byte, 8, 8+len(sid))
+	ace[0] = aceType
+	ace[1] = aceFlags
+	binary.LittleEndian.PutUint16(ace[2:], uint16(8+len(sid)))
+	binary.LittleEndian.PutUint32(ace[4:], mask)
+	return append(ace, sid...), nil
+}
+
+// sddlMask parses access rights given as a number or as concatenated codes.
+func sddlMask(s string) (uint32, error) {
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") || s != "" && s[0] >= '0' && s[0] <= '9' {
+		n, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid rights %q: %w", s, err)
+		}
+		return uint32(n), nil
+	}
+	if s == "" {
+		return 0, fmt.Errorf("no rights")
+	}
+	var mask uint32
+	for r := s; r != ""; r = r[2:] {
+		right, ok := sddlRights[r[:min(2, len(r))]]
+		if !ok {
+			return 0, fmt.Errorf("invalid rights %q: unknown right %q", s, r[:min(2, len(r))])
+		}
+		mask |= right
+	}
+	return mask, nil
+}
+
+/*
+ * ServiceSID returns the SID of a Windows service, "NT SERVICE\name", which
+ * is derived from its name alone: S-1-5-80 followed by the SHA-1 hash of the
+ * upper-case name in UTF-16LE. It is in the token of the service process when
+ * the service SID type is unrestricted or restricted (sc sidtype).
+ */
+func ServiceSID(name string) string {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(strings.ToUpper(name))) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	sum := sha1.Sum(b)
+	sid := "S-1-5-80"
+	for i := 0; i < len(sum); i += 4 {
+		sid += "-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(sum[i:])), 10)
+	}
+	return sid
+}
+
+// ParsePrincipal returns the SID of a principal given as a SID, an SDDL alias
+// or "NT SERVICE\name".
+func ParsePrincipal(s string) (string, error) {
+	if name, ok := strings.CutPrefix(strings.ToUpper(s), `NT SERVICE\`); ok && name != "" {
+		return ServiceSID(s[len(`NT SERVICE\`):]), nil
+	}
+	if _, err := sddlSID(s); err != nil {
+		return "", fmt.Errorf("invalid principal %q: must be a SID, an alias such as SY, or NT SERVICE\\name", s)
+	}
+	if alias, ok := sddlAliases[strings.ToUpper(s)]; ok {
+		return alias, nil
+	}
+	return s, nil
+}
+
+// ProtectedSDDL returns the SDDL that lets only principal, a SID, change or
+// delete the objects; administrators and the system can still read them, and
+// the administrators, their owner, change their DACL (see Engine.SetSecurity).
+func ProtectedSDDL(principal string) string {
+	return "O:BAG:BAD:P(A;;GA;;;" + principal + ")(A;;GRGX;;;BA)(A;;GRGX;;;SY)"
+}
+
+// UnlockedSDDL gives the objects back to the administrators and the system,
+// as they are without a security descriptor. It has only a DACL: the owner of
+// locked objects may change it, but not their owner.
+const UnlockedSDDL = "D:(A;;GA;;;BA)(A;;GA;;;SY)"
+
+// securityParts are the parts of a SecurityDescriptor, nil when absent.
+type securityParts struct {
+	control            uint16
+	owner, group, dacl []byte
+}
+
+// encode returns the self-relative descriptor: header, owner, group, DACL.
+func (p securityParts) encode() SecurityDescriptor {
+	sd := make([]byte, 20, 20+len(p.owner)+len(p.group)+len(p.dacl))
+	sd[0] = 1 // SECURITY_DESCRIPTOR_REVISION
+	binary.LittleEndian.PutUint16(sd[2:], p.control|seSelfRelative)
+	for i, part := range [][]byte{p.owner, p.group, nil, p.dacl} {
+		if part == nil {
+			continue
+		}
+		binary.LittleEndian.PutUint32(sd[4+4*i:], uint32(len(sd)))
+		sd = append(sd, part...)
+	}
+	return sd
+}
+
+// update returns p with the parts with has replaced by them.
+func (p securityParts) update(with securityParts) securityParts {
+	if with.owner != nil {
+		p.owner = with.owner
+	}
+	if with.group != nil {
+		p.group = with.group
+	}
+	if with.dacl != nil {
+		const daclBits = seDACLPresent | seDACLAutoInheritReq | seDACLAutoInherited | seDACLProtected
+		p.dacl = with.dacl
+		p.control = p.control&^daclBits | with.control&daclBits
+	}
+	return p
+}
+
+// parts returns the parts of sd, or an error if it is not a well-formed
+// self-relative descriptor.
+func (sd SecurityDescriptor) parts() (securityParts, error) {
+	if len(sd) < 20 || sd[0] != 1 {
+		return securityParts{}, fmt.Errorf("invalid security descriptor: bad header")
+	}
+	p := securityParts{control: binary.LittleEndian.Uint16(sd[2:])}
+	if p.control&seSelfRelative == 0 {
+		return securityParts{}, fmt.Errorf("invalid security descriptor: not self-relative")
+	}
+	p.control &^= seSelfRelative
+	for _, part := range []struct {
+		at   int
+		dest *[]byte
+		size func([]byte, uint32) int
+	}{{4, &p.owner, sidSize}, {8, &p.group, sidSize}, {16, &p.dacl, aclSize}} {
+		off := binary.LittleEndian.Uint32(sd[part.at:])
+		if off == 0 {
+			continue
+		}
+		n := part.size(sd, off)
+		if n < 0 {
+			return securityParts{}, fmt.Errorf("invalid security descriptor: bad SID or ACL at %d", off)
+		}
+		*part.dest = sd[off : int(off)+n]
+	}
+	if p.dacl == nil && p.control&seDACLPresent != 0 {
+		return securityParts{}, fmt.Errorf("invalid security descriptor: DACL present but missing")
+	}
+	return p, nil
+}
+
+// Validate reports whether sd is a well-formed self-relative descriptor.
+func (sd SecurityDescriptor) Validate() error {
+	_, err := sd.parts()
+	return err
+}
+
+// sidSize returns the size of the SID at off in b, -1 if it is not valid.
+func sidSize(b []byte, off uint32) int {
+	if uint64(off)+8 > uint64(len(b)) || b[off] != 1 {
+		return -1
+	}
+	n := 8 + 4*int(b[off+1])
+	if uint64(off)+uint64(n) > uint64(len(b)) {
+		return -1
+	}
+	return n
+}
+
+// aclSize returns the size of the ACL at off in b, -1 if it or one of its
+// ACEs is not valid.
+func aclSize(b []byte, off uint32) int {
+	if uint64(off)+8 > uint64(len(b)) {
+		return -1
+	}
+	size := uint32(binary.LittleEndian.Uint16(b[off+2:]))
+	count := int(binary.LittleEndian.Uint16(b[off+4:]))
+	if size < 8 || uint64(off)+uint64(size) > uint64(len(b)) {
+		return -1
+	}
+	at := off + 8
+	for i := 0; i < count; i++ {
+		if at+8 > off+size {
+			return -1
+		}
+		aceSize := uint32(binary.LittleEndian.Uint16(b[at+2:]))
+		if aceSize < 8 || at+aceSize > off+size || sidSize(b[:at+aceSize], at+8) != int(aceSize)-8 {
+			return -1
+		}
+		at += aceSize
+	}
+	return int(size)
+}
@@ -0,0 +1,180 @@
+package firewall
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestParseSDDL(t *testing.T) {
+	tests := []struct {
+		sddl string
+		want []byte
+	}{
+		{"D:(A;;GA;;;SY)", []byte{
+			1, 0, 0x04, 0x80, // Revision, control: DACL present, self-relative.
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // No owner, group or SACL.
+			20, 0, 0, 0, // DACL offset.
+			2, 0, 28, 0, 1, 0, 0, 0, // ACL: revision, size, one ACE.
+			0, 0, 20, 0, 0xff, 0x07, 0x0f, 0x00, // Allow, size, FWPM_GENERIC_ALL.
+			1, 1, 0, 0, 0, 0, 0, 5, 18, 0, 0, 0, // S-1-5-18
+		}},
+		{"O:BAG:SYD:P(D;OICI;0x1;;;WD)", []byte{
+			1, 0, 0x04, 0x90, // Control: DACL present and protected, self-relative.
+			20, 0, 0, 0, 36, 0, 0, 0, 0, 0, 0, 0, 48, 0, 0, 0,
+			1, 2, 0, 0, 0, 0, 0, 5, 32, 0, 0, 0, 0x20, 0x02, 0, 0, // S-1-5-32-544
+			1, 1, 0, 0, 0, 0, 0, 5, 18, 0, 0, 0, // S-1-5-18
+			2, 0, 28, 0, 1, 0, 0, 0,
+			1, 3, 20, 0, 1, 0, 0, 0, // Deny, OI|CI, FWPM_ACTRL_ADD.
+			1, 1, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, // S-1-1-0
+		}},
+	}
+	for _, tt := range tests {
+		sd, err := ParseSDDL(tt.sddl)
+		if err != nil {
+			t.Errorf("ParseSDDL(%q): %v", tt.sddl, err)
+			continue
+		}
+		if !bytes.Equal(sd, tt.want) {
+			t.Errorf("ParseSDDL(%q) =\n% x\nwant\n% x", tt.sddl, []byte(sd), tt.want)
+		}
+		if err := sd.Validate(); err != nil {
+			t.Errorf("ParseSDDL(%q).Validate(): %v", tt.sddl, err)
+		}
+		// Every truncation of it is invalid.
+		for n := range len(sd) {
+			if err := sd[:n].Validate(); err == nil {
+				t.Errorf("ParseSDDL(%q) cut to %d bytes is valid", tt.sddl, n)
+			}
+		}
+	}
+}
+
+func TestParseSDDLGenericRights(t *testing.T) {
+	// FWPM_GENERIC_* of fwpmu.h.
+	for rights, want := range map[string]uint32{
+		"GA":   0x000f07ff,
+		"GR":   0x000201d4,
+		"GW":   0x0002040b,
+		"GX":   0x00020220,
+		"GRGX": 0x000203f4,
+		"SDRC": 0x00030000,
+		"CCCR": 0x00000101,
+	} {
+		sd, err := ParseSDDL("D:(A;;" + rights + ";;;SY)")
+		if err != nil {
+			t.Errorf("%s: %v", rights, err)
+			continue
+		}
+		if got := binary.LittleEndian.Uint32(sd[20+8+4:]); got != want {
+			t.Errorf("%s = %#x, want %#x", rights, got, want)
+		}
+	}
+}
+
+func TestParseSDDLErrors(t *testing.T) {
+	for _, sddl := range []string{
+		"",
+		"X:BA",
+		"S:(AU;;GA;;;SY)",
+		"D:Q(A;;GA;;;SY)",
+		"D:(A;;GA;;;SY",
+		"D:A;;GA;;;SY)",
+		"D:(U;;GA;;;SY)",
+		"D:(A;;GA;;SY)",
+		"D:(A;XX;GA;;;SY)",
+		"D:(A;;;;;SY)",
+		"D:(A;;ZZ;;;SY)",
+		"D:(A;;0xfffffffff;;;SY)",
+		"D:(A;;GA;f3a7c3d2-0000-0000-0000-000000000000;;SY)",
+		"D:(A;;GA;;;XY)",
+		"D:(A;;GA;;;S-2-5-18)",
+		"D:(A;;GA;;;S-1)",
+		"D:(A;;GA;;;S-1-5-4294967296)",
+		"D:(A;;GA;;;S-1-5-1-2-3-4-5-6-7-8-9-10-11-12-13-14-15-16)",
+		"O:S-1-x",
+		"G:WHO",
+	} {
+		if sd, err := ParseSDDL(sddl); err == nil {
+			t.Errorf("ParseSDDL(%q) = % x, want an error", sddl, []byte(sd))
+		}
+	}
+}
+
+func TestSecurityDescriptorValidate(t *testing.T) {
+	sd, err := ParseSDDL("O:BAD:(A;;GA;;;SY)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func(at int, b byte) SecurityDescriptor {
+		c := bytes.Clone(sd)
+		c[at] = b
+		return c
+	}
+	for name, bad := range map[string]SecurityDescriptor{
+		"revision":          corrupt(0, 2),
+		"not self-relative": corrupt(3, 0),
+		"owner offset":      corrupt(4, 0xff),
+		"SID revision":      corrupt(20, 2),
+		"ACL size":          corrupt(36+2, 0xff),
+		"ACE count":         corrupt(36+4, 2),
+		"ACE size":          corrupt(36+8+2, 4),
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("%s: Validate succeeded on % x", name, []byte(bad))
+		}
+	}
+}
+
+func TestSecurityDescriptorUpdate(t *testing.T) {
+	locked, err := ParseSDDL(ProtectedSDDL(ServiceSID("prg")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlocked, err := ParseSDDL(UnlockedSDDL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := locked.parts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	with, err := unlocked.parts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The owner and group are kept, the DACL and its protection replaced.
+	want, err := ParseSDDL("O:BAG:BAD:(A;;GA;;;BA)(A;;GA;;;SY)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.update(with).encode(); !bytes.Equal(got, want) {
+		t.Errorf("update =\n% x\nwant\n% x", []byte(got), []byte(want))
+	}
+}
+
+func TestServiceSID(t *testing.T) {
+	// The documented SID of NT SERVICE\TrustedInstaller.
+	const trustedInstaller = "S-1-5-80-956008885-3418522649-1831038044-1853292631-2271478464"
+	for _, name := range []string{"TrustedInstaller", "trustedinstaller"} {
+		if got := ServiceSID(name); got != trustedInstaller {
+			t.Errorf("ServiceSID(%q) = %s, want %s", name, got, trustedInstaller)
+		}
+	}
+
+	for s, want := range map[string]string{
+		`NT SERVICE\TrustedInstaller`: trustedInstaller,
+		"SY":                          "S-1-5-18",
+		"S-1-5-32-544":                "S-1-5-32-544",
+	} {
+		if got, err := ParsePrincipal(s); err != nil || got != want {
+			t.Errorf("ParsePrincipal(%q) = %s, %v; want %s", s, got, err, want)
+		}
+	}
+	for _, s := range []string{`NT SERVICE\`, "administrators", "S-1-x"} {
+		if got, err := ParsePrincipal(s); err == nil {
+			t.Errorf("ParsePrincipal(%q) = %s, want an error", s, got)
+		}
+	}
+}
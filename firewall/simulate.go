@@ -0,0 +1,420 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+/*
+ * The simulator answers "what would WFP do with this connection?" from the
+ * rule model alone, following the filter arbitration of WFP
+ * (https://learn.microsoft.com/en-us/windows/win32/fwp/filter-arbitration):
+ *
+ *   - every sublayer of the layer is evaluated, from the highest weight down;
+ *   - within a sublayer, filters are evaluated from the highest weight down,
+ *     and the first matching filter with a terminating action (permit or
+ *     block) gives the verdict of the sublayer; non-terminating ones
+ *     (continue) let evaluation go on;
+ *   - across sublayers, a block overrides a permit, unless the permit was
+ *     hard (FWPM_FILTER_FLAG_CLEAR_ACTION_RIGHT), which no lower sublayer can
+ *     override; a block is always final;
+ *   - with no verdict from any sublayer, the layer default applies: permit.
+ *
+ * Only the objects of the engine being simulated take part: the rules of the
+ * Windows Firewall, or of any other provider, are not known to it.
+ */
+
+// Connection is what the simulator classifies: a connection, or an Ethernet
+// frame when a MAC address or EtherType is set.
+type Connection struct {
+	Direction  string // "outbound" or "inbound".
+	Protocol   uint8  // IANA protocol number, e.g. 6 for TCP.
+	LocalAddr  netip.Addr
+	LocalPort  uint16
+	RemoteAddr netip.Addr
+	RemotePort uint16
+	App        string // Path of the application, empty if unknown.
+	Flags      uint32 // FWPM_CONDITION_FLAGS of the connection, e.g. FlagLoopback.
+	Interface  uint64 // LUID of the local interface, 0 if unknown.
+	LocalMAC   [6]byte
+	RemoteMAC  [6]byte
+	EtherType  uint16 // e.g. EtherTypeARP.
+	L2Flags    uint32 // FWPM_CONDITION_L2_FLAGS of the frame, e.g. L2FlagVM2VM.
+}
+
+// Frame reports whether c is an Ethernet frame rather than a connection.
+func (c Connection) Frame() bool {
+	return c.LocalMAC != [6]byte{} || c.RemoteMAC != [6]byte{} || c.EtherType != 0 || c.L2Flags != 0
+}
+
+// Layer returns the WFP layer that authorizes conn.
+func (c Connection) Layer() string {
+	if c.Frame() {
+		if c.Direction == "inbound" {
+			return "INBOUND_MAC_FRAME_ETHERNET"
+		}
+		return "OUTBOUND_MAC_FRAME_ETHERNET"
+	}
+	family := "V4"
+	if c.RemoteAddr.Is6() && !c.RemoteAddr.Is4In6() {
+		family = "V6"
+	}
+	if c.Direction == "inbound" {
+		return "ALE_AUTH_RECV_ACCEPT_" + family
+	}
+	return "ALE_AUTH_CONNECT_" + family
+}
+
+func (c Connection) String() string {
+	if c.Frame() {
+		s := fmt.Sprintf("%s frame %s -> %s ether_type %s", c.Direction, macString(c.LocalMAC), macString(c.RemoteMAC), EtherTypeName(c.EtherType))
+		if c.L2Flags != 0 {
+			s += " l2_flags " + L2FlagsString(c.L2Flags)
+		}
+		return s
+	}
+	s := fmt.Sprintf("%s %s %s -> %s", c.Direction, ProtocolName(c.Protocol),
+		endpointString(c.LocalAddr, c.LocalPort), endpointString(c.RemoteAddr, c.RemotePort))
+	if c.App != "" {
+		s += " app " + c.App
+	}
+	return s
+}
+
+func macString(mac [6]byte) string {
+	if mac == [6]byte{} {
+		return "*"
+	}
+	return net.HardwareAddr(mac[:]).String()
+}
+
+func endpointString(addr netip.Addr, port uint16) string {
+	host := "*"
+	if addr.IsValid() {
+		host = addr.String()
+	}
+	if port == 0 {
+		return host
+	}
+	return netip.AddrPortFrom(addr, port).String()
+}
+
+// matches reports whether conn satisfies c.
+func (c Condition) matches(conn Connection) bool {
+	switch c.Field {
+	case FieldRemoteAddress:
+		return c.matchesAddress(conn.RemoteAddr)
+	case FieldLocalAddress:
+		return c.matchesAddress(conn.LocalAddr)
+	case FieldLocalInterface:
+		return (conn.Interface == c.Interface) != (c.Match == MatchNotEqual)
+	case FieldProtocol:
+		return c.matchesNumber(uint32(conn.Protocol))
+	case FieldRemotePort:
+		return c.matchesNumber(uint32(conn.RemotePort))
+	case FieldFlags:
+		return c.matchesNumber(conn.Flags)
+	case FieldEtherType:
+		return c.matchesNumber(uint32(conn.EtherType))
+	case FieldL2Flags:
+		return c.matchesNumber(conn.L2Flags)
+	case FieldLocalMAC:
+		return (conn.LocalMAC == c.MAC) != (c.Match == MatchNotEqual)
+	case FieldRemoteMAC:
+		return (conn.RemoteMAC == c.MAC) != (c.Match == MatchNotEqual)
+	case FieldApp:
+		// WFP compares application IDs in lower case.
+		app, value := strings.ToLower(conn.App), strings.ToLower(c.App)
+		switch c.Match {
+		case MatchEqual:
+			return app == value
+		case MatchNotEqual:
+			return app != value
+		case MatchPrefix:
+			return strings.HasPrefix(app, value)
+		case MatchNotPrefix:
+			return !strings.HasPrefix(app, value)
+		}
+	}
+	return false
+}
+
+// matchesAddress reports whether addr, the value of an address field,
+// satisfies c.
+func (c Condition) matchesAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if c.Range.IsValid() {
+		return c.Range.Contains(addr)
+	}
+	return (addr.IsValid() && c.Network.Contains(addr)) != (c.Match == MatchNotEqual)
+}
+
+// matchesNumber reports whether v, the value of an unsigned integer field,
+// satisfies c.
+func (c Condition) matchesNumber(v uint32) bool {
+	n := c.number()
+	switch c.Match {
+	case MatchEqual:
+		return v == n
+	case MatchNotEqual:
+		return v != n
+	case MatchRange:
+		return n <= v && v <= c.To
+	case MatchFlagsAllSet:
+		return v&n == n
+	case MatchFlagsAnySet:
+		return v&n != 0
+	case MatchFlagsNoneSet:
+		return v&n == 0
+	}
+	return false
+}
+
+var protocolNames = map[uint8]string{1: "icmp", 6: "tcp", 17: "udp", 58: "icmpv6"}
+
+// ProtocolName returns the name of an IANA protocol number, or the number.
+func ProtocolName(protocol uint8) string {
+	if name, ok := protocolNames[protocol]; ok {
+		return name
+	}
+	return strconv.Itoa(int(protocol))
+}
+
+// ParseProtocol parses a protocol name ("tcp", "udp", "icmp", "icmpv6") or number.
+func ParseProtocol(s string) (uint8, error) {
+	for protocol, name := range protocolNames {
+		if strings.EqualFold(s, name) {
+			return protocol, nil
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid protocol %q: must be tcp, udp, icmp, icmpv6 or a number", s)
+	}
+	return uint8(n), nil
+}
+
+// ParseEndpoint parses "10.1.2.3", "10.1.2.3:443" or "[2001:db8::1]:443".
+func ParseEndpoint(s string) (netip.Addr, uint16, error) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr(), addrPort.Port(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, 0, fmt.Errorf("invalid endpoint %q: must be ADDR or ADDR:PORT", s)
+	}
+	return addr, 0, nil
+}
+
+// Decision is the verdict of the simulator on a connection, and how it was
+// reached.
+type Decision struct {
+	Connection Connection
+	Layer      string
+	Verdict    Action  // ActionPermit or ActionBlock.
+	Filter     *Filter // Filter that gave the verdict, nil for the layer default.
+	Hard       bool    // The verdict could not be overridden by lower sublayers.
+	Steps      []DecisionStep
+}
+
+// DecisionStep is one filter of the chain that was evaluated.
+type DecisionStep struct {
+	Sublayer Sublayer
+	Filter   Filter
+	Matched  bool
+	Outcome  string // What the filter did, e.g. "decides" or "overridden by an earlier hard permit".
+}
+
+/*
+ * decide classifies conn against sublayers and filters, which are the whole
+ * content of an engine.
+ */
+func decide(sublayers []Sublayer, filters []Filter, conn Connection) *Decision {
+	d := &Decision{Connection: conn, Layer: conn.Layer()}
+
+	sublayers = append([]Sublayer(nil), sublayers...)
+	sort.Slice(sublayers, func(i, j int) bool {
+		if sublayers[i].Weight != sublayers[j].Weight {
+			return sublayers[i].Weight > sublayers[j].Weight
+		}
+		return sublayers[i].Key.String() < sublayers[j].Key.String()
+	})
+	bySublayer := make(map[GUID][]Filter)
+	for _, f := range filters {
+		if f.Layer == d.Layer {
+			bySublayer[f.Sublayer] = append(bySublayer[f.Sublayer], f)
+		}
+	}
+
+	for _, sublayer := range sublayers {
+		candidates := bySublayer[sublayer.Key]
+		// Ranks order like the 64-bit weights WFP gets, see filterWeight.
+		sort.Slice(candidates, func(i, j int) bool {
+			if candidates[i].Weight != candidates[j].Weight {
+				return candidates[i].Weight > candidates[j].Weight
+			}
+			return candidates[i].ID < candidates[j].ID
+		})
+
+		for _, f := range candidates {
+			step := DecisionStep{Sublayer: sublayer, Filter: f, Matched: f.matches(conn)}
+			if !step.Matched {
+				step.Outcome = "no match"
+				d.Steps = append(d.Steps, step)
+				continue
+			}
+			if !f.Action.Terminating() {
+				step.Outcome = "matched, not terminating"
+				d.Steps = append(d.Steps, step)
+				continue
+			}
+			step.Outcome = d.arbitrate(f)
+			d.Steps = append(d.Steps, step)
+			break
+		}
+	}
+
+	if d.Verdict == 0 {
+		d.Verdict = ActionPermit
+	}
+	return d
+}
+
+/*
+ * matches reports whether conn satisfies the conditions of f, on every
+ * field: as WFP ORs the conditions on the same field, one of them, but all
+ * of its negated ones.
+ */
+func (f *Filter) matches(conn Connection) bool {
+	_, byField := fieldValues(f.Conditions)
+	for _, conditions := range byField {
+		selected, selects := false, false
+		for _, c := range conditions {
+			switch {
+			case c.Match.negated():
+				if !c.matches(conn) {
+					return false
+				}
+			default:
+				selects = true
+				selected = selected || c.matches(conn)
+			}
+		}
+		if selects && !selected {
+			return false
+		}
+	}
+	return true
+}
+
+// arbitrate combines the verdict of a sublayer, given by f, with those of the
+// higher sublayers, and describes the outcome.
+func (d *Decision) arbitrate(f Filter) string {
+	switch {
+	case d.Verdict == 0:
+		d.Verdict, d.Filter = f.Action, &f
+		d.Hard = f.Action == ActionBlock || f.HardAction
+		return "decides"
+	case d.Verdict == ActionBlock:
+		return "overridden by an earlier block"
+	case f.Action == ActionPermit:
+		return "no effect, already permitted"
+	case d.Hard:
+		return "overridden by an earlier hard permit"
+	}
+	d.Verdict, d.Filter, d.Hard = ActionBlock, &f, true
+	return "decides, overrides an earlier soft permit"
+}
+
+/*
+ * WriteExplanation prints the filter chain that was evaluated and the final
+ * verdict:
+ *
+ *	outbound tcp * -> 10.2.2.3 at ALE_AUTH_CONNECT_V4
+ *	  sublayer "... - Permissive and blocking filters" (weight 65535)
+ *	    filter 2  weight 11  permit (hard)  remote_address=10.1.0.0/16  no match
+ *	    filter 1  weight 10  block (hard)   remote_address=10.0.0.0/8   decides
+ *	verdict: block by filter 1 "Block traffic to 10.0.0.0/8"
+ */
+func (d *Decision) WriteExplanation(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s at %s\n", d.Connection, d.Layer)
+	var sublayer GUID
+	for i, step := range d.Steps {
+		if i == 0 || step.Sublayer.Key != sublayer {
+			sublayer = step.Sublayer.Key
+			fmt.Fprintf(tw, "  sublayer %q (weight %d)\n", step.Sublayer.Description, step.Sublayer.Weight)
+		}
+		f := step.Filter
+		action := f.Action.String()
+		if f.HardAction {
+			action += " (hard)"
+		}
+		fmt.Fprintf(tw, "    filter %d\tweight %d\t%s\t%s\t%s\n", f.ID, f.Weight, action, conditionsString(f.Conditions), step.Outcome)
+	}
+	if d.Filter == nil {
+		fmt.Fprintf(tw, "verdict: %s, no filter matched (layer default)\n", d.Verdict)
+	} else {
+		fmt.Fprintf(tw, "verdict: %s by filter %d %q\n", d.Verdict, d.Filter.ID, d.Filter.Name)
+	}
+	return tw.Flush()
+}
+
+func conditionsString(conditions []Condition) string {
+	if len(conditions) == 0 {
+		return "(any)"
+	}
+	return formatConditions(conditions)
+}
+
+/*
+ * Simulator holds a policy loaded in a MemoryBackend, through the same code
+ * that applies it to WFP, so that the filters it decides on are the ones WFP
+ * would get.
+ */
+type Simulator struct {
+	backend *MemoryBackend
+	engine  *Engine
+}
+
+func NewSimulator(ctx context.Context, specs []RuleSpec) (*Simulator, error) {
+	backend := NewMemoryBackend()
+	engine, err := Open(ctx, WithBackend(backend))
+	if err != nil {
+		return nil, err
+	}
+	specs = ExpandExceptions(specs)
+	rules := make([]Rule, len(specs))
+	for i, spec := range specs {
+		rules[i] = spec.Rule()
+	}
+	summary, err := engine.Apply(ctx, rules, OnErrorAbort)
+	if err == nil && summary.RolledBack {
+		for _, result := range summary.Results {
+			if result.Err != nil {
+				err = result.Err
+			}
+		}
+	}
+	if err != nil {
+		engine.Close()
+		return nil, err
+	}
+	return &Simulator{backend: backend, engine: engine}, nil
+}
+
+// Decide classifies conn against the policy.
+func (s *Simulator) Decide(conn Connection) *Decision {
+	return decide(s.backend.Sublayers(), s.backend.Filters(), conn)
+}
+
+func (s *Simulator) Close() error {
+	return s.engine.Close()
+}
@@ -0,0 +1,123 @@
+package firewall
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func notRemote(cidr string) Condition {
+	c := RemoteAddress(netip.MustParsePrefix(cidr))
+	c.Match = MatchNotEqual
+	return c
+}
+
+// simFilter is a filter of TestDecide, in its high (0) or low (1) weight
+// sublayer.
+type simFilter struct {
+	sublayer   int
+	weight     uint8
+	action     Action
+	hard       bool
+	conditions []Condition
+}
+
+func TestDecide(t *testing.T) {
+	tenNet := RemoteAddress(netip.MustParsePrefix("10.0.0.0/8"))
+	tests := []struct {
+		name    string
+		filters []simFilter
+		want    Action
+		by      int // Index of the deciding filter, -1 for the layer default.
+	}{
+		{"higher filter weight first", []simFilter{
+			{0, 10, ActionBlock, true, []Condition{tenNet}},
+			{0, 20, ActionPermit, true, []Condition{RemoteAddress(netip.MustParsePrefix("10.1.0.0/16"))}},
+		}, ActionPermit, 1},
+		{"higher sublayer weight first", []simFilter{
+			{1, 200, ActionPermit, false, []Condition{tenNet}},
+			{0, 1, ActionBlock, false, []Condition{tenNet}},
+		}, ActionBlock, 1},
+		{"non-terminating match", []simFilter{
+			{0, 20, ActionContinue, false, []Condition{tenNet}},
+			{0, 10, ActionBlock, false, []Condition{tenNet}},
+		}, ActionBlock, 1},
+		{"lower block overrides soft permit", []simFilter{
+			{0, 10, ActionPermit, false, []Condition{tenNet}},
+			{1, 10, ActionBlock, false, []Condition{tenNet}},
+		}, ActionBlock, 1},
+		{"hard permit holds against lower block", []simFilter{
+			{0, 10, ActionPermit, true, []Condition{tenNet}},
+			{1, 10, ActionBlock, true, []Condition{tenNet}},
+		}, ActionPermit, 0},
+		{"block is final", []simFilter{
+			{0, 10, ActionBlock, false, []Condition{tenNet}},
+			{1, 10, ActionPermit, true, []Condition{tenNet}},
+		}, ActionBlock, 0},
+		{"OR on the same field", []simFilter{
+			{0, 10, ActionBlock, false, []Condition{RemotePort(80), RemotePort(443)}},
+		}, ActionBlock, 0},
+		{"AND across fields", []simFilter{
+			{0, 10, ActionBlock, false, []Condition{tenNet, Protocol(17), RemotePort(443)}},
+		}, ActionPermit, -1},
+		{"negated conditions all hold", []simFilter{
+			{0, 10, ActionBlock, false, []Condition{notRemote("192.168.0.0/16"), notRemote("172.16.0.0/12")}},
+		}, ActionBlock, 0},
+		{"one negated condition fails", []simFilter{
+			{0, 10, ActionBlock, false, []Condition{notRemote("192.168.0.0/16"), notRemote("10.1.0.0/16")}},
+		}, ActionPermit, -1},
+		{"negated and selecting conditions", []simFilter{
+			{0, 10, ActionBlock, false, []Condition{tenNet, notRemote("10.1.0.0/16")}},
+		}, ActionPermit, -1},
+		{"layer default", nil, ActionPermit, -1},
+	}
+	conn := Connection{
+		Direction:  "outbound",
+		Protocol:   6,
+		LocalAddr:  netip.MustParseAddr("10.0.0.7"),
+		LocalPort:  50123,
+		RemoteAddr: netip.MustParseAddr("10.1.2.3"),
+		RemotePort: 443,
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := NewMemoryBackend()
+			s := openMemorySession(t, backend, SessionConfig{Name: "test"})
+			provider := mustGUID(t)
+			if err := s.AddProvider(&Provider{Key: provider}); err != nil {
+				t.Fatal(err)
+			}
+			sublayers := []GUID{mustGUID(t), mustGUID(t)}
+			for i, weight := range []uint16{0xffff, 1} {
+				if err := s.AddSublayer(&Sublayer{Key: sublayers[i], Provider: provider, Weight: weight}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ids := make([]uint64, len(tt.filters))
+			for i, sf := range tt.filters {
+				f := testFilter(provider, sublayers[sf.sublayer])
+				f.Weight, f.Action, f.HardAction, f.Conditions = sf.weight, sf.action, sf.hard, sf.conditions
+				var err error
+				if ids[i], err = s.AddFilter(f); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// A block of another layer takes no part.
+			inbound := testFilter(provider, sublayers[0])
+			inbound.Layer, inbound.Weight = "ALE_AUTH_RECV_ACCEPT_V4", 0xff
+			if _, err := s.AddFilter(inbound); err != nil {
+				t.Fatal(err)
+			}
+
+			d := decide(backend.Sublayers(), backend.Filters(), conn)
+			if d.Verdict != tt.want {
+				t.Errorf("verdict = %s, want %s", d.Verdict, tt.want)
+			}
+			switch {
+			case tt.by < 0 && d.Filter != nil:
+				t.Errorf("decided by filter %d, want the layer default", d.Filter.ID)
+			case tt.by >= 0 && (d.Filter == nil || d.Filter.ID != ids[tt.by]):
+				t.Errorf("decided by %+v, want filter %d", d.Filter, ids[tt.by])
+			}
+		})
+	}
+}
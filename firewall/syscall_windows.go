@@ -0,0 +1,86 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019-2022 WireGuard LLC. All Rights Reserved.
+ */
+
+package firewall
+
+//go:generate go run golang.org/x/sys/windows/mkwinsyscall -output zsyscall_windows.go syscall_windows.go
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmengineopen0
+//sys	fwpmEngineOpen0(serverName *uint16, authnService wtRpcCAuthN, authIdentity *SecWinNTAuthIdentityW, session *wtFwpmSession0, engineHandle unsafe.Pointer) (ret error) = fwpuclnt.FwpmEngineOpen0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmengineclose0
+//sys	FwpmEngineClose0(engineHandle uintptr) (ret error) = fwpuclnt.FwpmEngineClose0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmenginegetoption0
+//sys	fwpmEngineGetOption0(engineHandle uintptr, option wtFwpmEngineOption, value **wtFwpValue0) (ret error) = fwpuclnt.FwpmEngineGetOption0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmenginesetoption0
+//sys	fwpmEngineSetOption0(engineHandle uintptr, option wtFwpmEngineOption, newValue *wtFwpValue0) (ret error) = fwpuclnt.FwpmEngineSetOption0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmsublayeradd0
+//sys	fwpmSubLayerAdd0(engineHandle uintptr, subLayer *wtFwpmSublayer0, sd uintptr) (ret error) = fwpuclnt.FwpmSubLayerAdd0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmgetappidfromfilename0
+//sys	fwpmGetAppIdFromFileName0(fileName *uint16, appID unsafe.Pointer) (ret error) = fwpuclnt.FwpmGetAppIdFromFileName0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfreememory0
+//sys	fwpmFreeMemory0(p unsafe.Pointer) = fwpuclnt.FwpmFreeMemory0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfilteradd0
+//sys	fwpmFilterAdd0(engineHandle uintptr, filter *wtFwpmFilter0, sd uintptr, id *uint64) (ret error) = fwpuclnt.FwpmFilterAdd0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfilterdeletebyid0
+//sys	fwpmFilterDeleteById0(engineHandle uintptr, id uint64) (ret error) = fwpuclnt.FwpmFilterDeleteById0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfiltercreateenumhandle0
+//sys	fwpmFilterCreateEnumHandle0(engineHandle uintptr, enumTemplate *wtFwpmFilterEnumTemplate0, enumHandle *uintptr) (ret error) = fwpuclnt.FwpmFilterCreateEnumHandle0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfilterenum0
+//sys	fwpmFilterEnum0(engineHandle uintptr, enumHandle uintptr, numEntriesRequested uint32, entries ***wtFwpmFilter0, numEntriesReturned *uint32) (ret error) = fwpuclnt.FwpmFilterEnum0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfilterdestroyenumhandle0
+//sys	fwpmFilterDestroyEnumHandle0(engineHandle uintptr, enumHandle uintptr) (ret error) = fwpuclnt.FwpmFilterDestroyEnumHandle0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfiltersubscribechanges0
+//sys	fwpmFilterSubscribeChanges0(engineHandle uintptr, subscription *wtFwpmFilterSubscription0, callback uintptr, context uintptr, changeHandle *uintptr) (ret error) = fwpuclnt.FwpmFilterSubscribeChanges0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfilterunsubscribechanges0
+//sys	fwpmFilterUnsubscribeChanges0(engineHandle uintptr, changeHandle uintptr) (ret error) = fwpuclnt.FwpmFilterUnsubscribeChanges0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmtransactionbegin0
+//sys	fwpmTransactionBegin0(engineHandle uintptr, flags uint32) (ret error) = fwpuclnt.FwpmTransactionBegin0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmtransactioncommit0
+//sys	fwpmTransactionCommit0(engineHandle uintptr) (ret error) = fwpuclnt.FwpmTransactionCommit0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmtransactionabort0
+//sys	fwpmTransactionAbort0(engineHandle uintptr) (ret error) = fwpuclnt.FwpmTransactionAbort0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmprovideradd0
+//sys	fwpmProviderAdd0(engineHandle uintptr, provider *wtFwpmProvider0, sd uintptr) (ret error) = fwpuclnt.FwpmProviderAdd0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmprovidersetsecurityinfobykey0
+//sys	fwpmProviderSetSecurityInfoByKey0(engineHandle uintptr, key *windows.GUID, securityInfo uint32, sidOwner uintptr, sidGroup uintptr, dacl uintptr, sacl uintptr) (ret error) = fwpuclnt.FwpmProviderSetSecurityInfoByKey0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmsublayersetsecurityinfobykey0
+//sys	fwpmSubLayerSetSecurityInfoByKey0(engineHandle uintptr, key *windows.GUID, securityInfo uint32, sidOwner uintptr, sidGroup uintptr, dacl uintptr, sacl uintptr) (ret error) = fwpuclnt.FwpmSubLayerSetSecurityInfoByKey0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfiltersetsecurityinfobykey0
+//sys	fwpmFilterSetSecurityInfoByKey0(engineHandle uintptr, key *windows.GUID, securityInfo uint32, sidOwner uintptr, sidGroup uintptr, dacl uintptr, sacl uintptr) (ret error) = fwpuclnt.FwpmFilterSetSecurityInfoByKey0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmneteventsubscribe0
+//sys	fwpmNetEventSubscribe0(engineHandle uintptr, subscription *wtFwpmNetEventSubscription0, callback uintptr, context uintptr, eventsHandle *uintptr) (ret error) = fwpuclnt.FwpmNetEventSubscribe0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmneteventsubscribe1
+//sys	fwpmNetEventSubscribe1(engineHandle uintptr, subscription *wtFwpmNetEventSubscription0, callback uintptr, context uintptr, eventsHandle *uintptr) (ret error) = fwpuclnt.FwpmNetEventSubscribe1
+
+// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmneteventunsubscribe0
+//sys	fwpmNetEventUnsubscribe0(engineHandle uintptr, eventsHandle uintptr) (ret error) = fwpuclnt.FwpmNetEventUnsubscribe0
+
+// https://learn.microsoft.com/en-us/windows/win32/api/netioapi/nf-netioapi-convertinterfacealiastoluid
+//sys	convertInterfaceAliasToLuid(alias *uint16, luid *uint64) (ret error) = iphlpapi.ConvertInterfaceAliasToLuid
+
+// https://learn.microsoft.com/en-us/windows/win32/api/netioapi/nf-netioapi-convertinterfaceindextoluid
+//sys	convertInterfaceIndexToLuid(index uint32, luid *uint64) (ret error) = iphlpapi.ConvertInterfaceIndexToLuid
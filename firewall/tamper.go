@@ -0,0 +1,288 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// FilterChangeType is the FWPM_CHANGE_TYPE of a FilterChange.
+type FilterChangeType uint32
+
+const (
+	FilterAdded   FilterChangeType = 1 // FWPM_CHANGE_ADD
+	FilterDeleted FilterChangeType = 2 // FWPM_CHANGE_DELETE
+)
+
+func (t FilterChangeType) String() string {
+	switch t {
+	case FilterAdded:
+		return "added"
+	case FilterDeleted:
+		return "deleted"
+	}
+	return fmt.Sprintf("FilterChangeType(%d)", uint32(t))
+}
+
+// FilterChange is an FWPM_FILTER_CHANGE0: a filter was added or deleted. WFP
+// filters cannot be modified in place, so a modified filter is deleted and
+// added again.
+type FilterChange struct {
+	Type FilterChangeType
+	Key  GUID
+	ID   uint64
+}
+
+// FilterChangeSource delivers filter changes until it is closed. The Windows
+// implementation is backed by FwpmFilterSubscribeChanges0.
+type FilterChangeSource interface {
+	Changes() <-chan FilterChange
+	Close() error
+}
+
+// TamperEvent is raised when a rule applied by this process was deleted, or
+// replaced by a different filter, by someone else.
+type TamperEvent struct {
+	Time        time.Time
+	Change      string   // "deleted" or "replaced".
+	Rule        RuleInfo // The rule as it was applied.
+	Replacement uint64   // For "replaced", the ID of the filter found in its place.
+	Repaired    bool     // The rule was applied again.
+}
+
+// Bounds of the checks of a Reconciler.
+const (
+	defaultTamperInterval = time.Minute
+	tamperSettle          = time.Second // Wait after a change for the others of the same transaction.
+)
+
+/*
+ * Reconciler watches the rules applied by this process for changes made
+ * behind its back, such as an admin deleting filters with netsh or other
+ * software replacing them. The filters of the provider are checked against
+ * the rules whenever WFP notifies a change to one of them, and every
+ * Interval in any case, since notifications are lost if the base filtering
+ * engine restarts and are not available on every engine.
+ *
+ * A rule is tampered with when its filter is gone: "replaced" when a filter
+ * of the provider with the same name but other conditions, action, weight or
+ * group took its place, "deleted" otherwise. A filter identical to the rule
+ * is taken over without an alert, which keeps rules whose group is disabled
+ * and enabled again with the group command. Each tampered rule is logged as
+ * an error, counted in Metrics and handed to OnTamper; with Repair, the rules
+ * are also applied again, the filters in their place deleted, in a single
+ * transaction.
+ *
+ * Hostname rules are kept by HostRules and not watched. Reconcile and Run
+ * must not be called concurrently.
+ */
+type Reconciler struct {
+	Engine   *Engine
+	Repair   bool              // Apply tampered rules again, rather than only alert.
+	Interval time.Duration     // Time between two checks without notifications; 0 for a minute.
+	Rules    *RuleIndex        // Kept up to date with the repaired rules, if set.
+	Metrics  *Metrics          // Tampered rules and repairs are counted, if set.
+	OnTamper func(TamperEvent) // Called for each tampered rule, if set.
+
+	rules []RuleInfo
+}
+
+// NewReconciler watches rules, as returned by Apply, in engine.
+func NewReconciler(engine *Engine, rules []RuleInfo) *Reconciler {
+	return &Reconciler{Engine: engine, rules: slices.Clone(rules)}
+}
+
+// Watched returns the rules being watched, with the IDs of their current filters.
+func (r *Reconciler) Watched() []RuleInfo {
+	return slices.Clone(r.rules)
+}
+
+/*
+ * Reconcile checks the rules against the filters in place, and returns the
+ * rules tampered with since the last check. With Repair, they are applied
+ * again; a failure to do so is logged and returned, and retried by the next
+ * check.
+ */
+func (r *Reconciler) Reconcile(ctx context.Context) ([]TamperEvent, error) {
+	installed, err := r.Engine.List(ctx)
+	if err != nil {
+		logger.Warn("failed to list rules for tamper detection", ErrAttr(err))
+		return nil, err
+	}
+	watched := make(map[uint64]bool, len(r.rules))
+	for _, rule := range r.rules {
+		watched[rule.FilterID] = true
+	}
+	byID := make(map[uint64]RuleInfo, len(installed))
+	for _, rule := range installed {
+		byID[rule.ID] = rule.Info()
+	}
+
+	var events []TamperEvent
+	var tampered []int
+	claimed := make(map[uint64]bool)
+	now := time.Now()
+	for i, rule := range r.rules {
+		if current, ok := byID[rule.FilterID]; ok && tamperKey(current) == tamperKey(rule) {
+			claimed[rule.FilterID] = true
+			continue
+		}
+		ev := TamperEvent{Time: now, Change: "deleted", Rule: rule}
+		for _, current := range installed {
+			if watched[current.ID] || claimed[current.ID] {
+				continue
+			}
+			info := current.Info()
+			if tamperKey(info) == tamperKey(rule) {
+				// Added again as it was, e.g. by the group command.
+				logger.Debug("rule found under another filter", "rule", rule.Name, "filter_id", rule.FilterID, "new_filter_id", info.FilterID)
+				if r.Rules != nil {
+					r.Rules.Remove(rule.FilterID)
+					r.Rules.Add(info)
+				}
+				r.rules[i] = info
+				claimed[info.FilterID] = true
+				ev.Change = ""
+				break
+			}
+			if info.Name == rule.Name && ev.Replacement == 0 {
+				ev.Change, ev.Replacement = "replaced", info.FilterID
+			}
+		}
+		if ev.Change == "" {
+			continue
+		}
+		if ev.Replacement != 0 {
+			claimed[ev.Replacement] = true
+		}
+		events = append(events, ev)
+		tampered = append(tampered, i)
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+
+	if r.Repair {
+		err = r.repair(ctx, events, tampered)
+	}
+	for _, ev := range events {
+		logger.Error("rule tampered with", "change", ev.Change, "rule", ev.Rule.Name, "filter_id", ev.Rule.FilterID,
+			"replacement", ev.Replacement, "group", ev.Rule.Group, "repaired", ev.Repaired)
+		if r.Metrics != nil {
+			r.Metrics.ObserveTamper(ev.Change)
+		}
+		if r.OnTamper != nil {
+			r.OnTamper(ev)
+		}
+	}
+	return events, err
+}
+
+// repair applies the rules of events again, at tampered in r.rules, deleting
+// the filters that replaced them.
+func (r *Reconciler) repair(ctx context.Context, events []TamperEvent, tampered []int) error {
+	var remove []uint64
+	add := make([]Rule, len(events))
+	for i, ev := range events {
+		if ev.Replacement != 0 {
+			remove = append(remove, ev.Replacement)
+		}
+		rule := ruleFromInfo(ev.Rule)
+		rule.ID, rule.Disabled = 0, false
+		add[i] = rule
+	}
+
+	start := time.Now()
+	summary, err := r.Engine.Update(ctx, remove, add, OnErrorAbort)
+	if err == nil && summary.RolledBack {
+		for _, result := range summary.Results {
+			if result.Err != nil {
+				err = result.Err
+			}
+		}
+	}
+	if r.Metrics != nil {
+		r.Metrics.ObserveReload(time.Since(start), err)
+	}
+	if err != nil {
+		logger.Warn("failed to repair tampered rules", "rules", len(add), ErrAttr(err))
+		return err
+	}
+
+	for i, result := range summary.Results {
+		old := r.rules[tampered[i]].FilterID
+		r.rules[tampered[i]] = result.Rule
+		events[i].Repaired = true
+		if r.Rules != nil {
+			r.Rules.Remove(old)
+			if events[i].Replacement != 0 {
+				r.Rules.Remove(events[i].Replacement)
+			}
+			r.Rules.Add(result.Rule)
+		}
+		logger.Info("tampered rule repaired", "rule", result.Rule.Name, "filter_id", result.Rule.FilterID)
+	}
+	return nil
+}
+
+/*
+ * Run checks the rules whenever their filters change and every Interval,
+ * until ctx is done. Without filter change notifications it falls back to the
+ * periodic checks alone.
+ */
+func (r *Reconciler) Run(ctx context.Context) {
+	if len(r.rules) == 0 {
+		return
+	}
+	interval := r.Interval
+	if interval <= 0 {
+		interval = defaultTamperInterval
+	}
+
+	var changes <-chan FilterChange
+	src, err := r.Engine.SubscribeFilterChanges(ctx)
+	if err != nil {
+		logger.Warn("failed to subscribe to filter changes, checking periodically only", "interval", interval, ErrAttr(err))
+	} else {
+		defer src.Close()
+		changes = src.Changes()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-changes:
+			if !ok {
+				logger.Warn("filter change notifications stopped, checking periodically only", "interval", interval)
+				changes = nil
+			} else if settle == nil {
+				settle = time.After(tamperSettle)
+			}
+			continue
+		case <-settle:
+			settle = nil
+		case <-ticker.C:
+		}
+		if _, err := r.Reconcile(ctx); err != nil && errors.Is(err, ErrClosed) {
+			return
+		}
+	}
+}
+
+// tamperKey identifies what a filter does, whatever its ID, name, metadata
+// and whether its group is disabled.
+func tamperKey(rule RuleInfo) string {
+	conditions := make([]string, len(rule.Conditions))
+	for i, c := range rule.Conditions {
+		conditions[i] = c.String()
+	}
+	slices.Sort(conditions)
+	return fmt.Sprintf("%s %s %d %q %s", rule.Action, rule.Layer, rule.Weight, rule.Group, strings.Join(conditions, " "))
+}
@@ -0,0 +1,177 @@
+package firewall
+
+import (
+	"context"
+	"testing"
+)
+
+// flakyBackend fails the transactions of its sessions while failing is set.
+type flakyBackend struct {
+	*MemoryBackend
+	failing bool
+}
+
+func (b *flakyBackend) Open(config SessionConfig) (Session, error) {
+	s, err := b.MemoryBackend.Open(config)
+	if err != nil {
+		return nil, err
+	}
+	return flakySession{s, b}, nil
+}
+
+type flakySession struct {
+	Session
+	backend *flakyBackend
+}
+
+func (s flakySession) BeginTransaction() error {
+	if s.backend.failing {
+		return memoryErr("FwpmTransactionBegin0", "", FWP_E_TIMEOUT)
+	}
+	return s.Session.BeginTransaction()
+}
+
+// watchRules applies a rule of group "a" and one of group "b", and returns a
+// Reconciler repairing them.
+func watchRules(t *testing.T, engine *Engine) *Reconciler {
+	t.Helper()
+	a, b := blockRule("10.0.0.0/8"), blockRule("192.0.2.0/24")
+	a.Group, b.Group = "a", "b"
+	summary, err := engine.Apply(context.Background(), []Rule{a, b}, OnErrorAbort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := make([]RuleInfo, len(summary.Results))
+	for i, result := range summary.Results {
+		rules[i] = result.Rule
+	}
+	r := NewReconciler(engine, rules)
+	r.Repair = true
+	return r
+}
+
+// reconcile checks r, and that it raises the events of changes, in order.
+func reconcile(t *testing.T, r *Reconciler, changes ...string) []TamperEvent {
+	t.Helper()
+	events, err := r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if len(events) != len(changes) {
+		t.Fatalf("Reconcile = %+v, want %v", events, changes)
+	}
+	for i, ev := range events {
+		if ev.Change != changes[i] || !ev.Repaired {
+			t.Errorf("event %d = %s, repaired %v; want %s, repaired", i, ev.Change, ev.Repaired, changes[i])
+		}
+	}
+	return events
+}
+
+func TestReconcileDeleted(t *testing.T) {
+	backend := NewMemoryBackend()
+	r := watchRules(t, openMemoryEngine(t, backend))
+	deleted := r.Watched()[0]
+	if err := backend.DeleteFilter(deleted.FilterID); err != nil {
+		t.Fatal(err)
+	}
+
+	events := reconcile(t, r, "deleted")
+	if events[0].Rule.FilterID != deleted.FilterID {
+		t.Errorf("event of filter %d, want %d", events[0].Rule.FilterID, deleted.FilterID)
+	}
+	repaired := r.Watched()[0]
+	if repaired.FilterID == deleted.FilterID || tamperKey(repaired) != tamperKey(deleted) {
+		t.Errorf("repaired rule = %+v, want %+v under a new filter", repaired, deleted)
+	}
+	if n := len(backend.Filters()); n != 2 {
+		t.Errorf("%d filters after the repair, want 2", n)
+	}
+	reconcile(t, r)
+}
+
+func TestReconcileReplaced(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	engine := openMemoryEngine(t, backend)
+	r := watchRules(t, engine)
+	original := r.Watched()[1]
+
+	// The same rule with another weight has the same name.
+	replacement := ruleFromInfo(original)
+	replacement.ID, replacement.Weight = 0, original.Weight+10
+	summary, err := engine.Update(ctx, []uint64{original.FilterID}, []Rule{replacement}, OnErrorAbort)
+	if err != nil || summary.Applied != 1 {
+		t.Fatalf("Update = %+v, %v", summary, err)
+	}
+	replacementID := summary.Results[0].Rule.FilterID
+	if summary.Results[0].Rule.Name != original.Name {
+		t.Fatalf("replacement named %q, want %q", summary.Results[0].Rule.Name, original.Name)
+	}
+
+	events := reconcile(t, r, "replaced")
+	if events[0].Replacement != replacementID {
+		t.Errorf("replacement = %d, want %d", events[0].Replacement, replacementID)
+	}
+	for _, f := range backend.Filters() {
+		if f.ID == replacementID {
+			t.Errorf("replacement filter %d kept", replacementID)
+		}
+	}
+	if repaired := r.Watched()[1]; tamperKey(repaired) != tamperKey(original) {
+		t.Errorf("repaired rule = %+v, want %+v", repaired, original)
+	}
+	reconcile(t, r)
+}
+
+func TestReconcileGroupCommand(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	engine := openMemoryEngine(t, backend)
+	r := watchRules(t, engine)
+	before := r.Watched()
+
+	// Disabling and enabling a group adds its rules again, identical.
+	for _, toggle := range []func(context.Context, string) (int, error){engine.DisableGroup, engine.EnableGroup} {
+		if n, err := toggle(ctx, "a"); err != nil || n != 1 {
+			t.Fatalf("group command = %d, %v", n, err)
+		}
+		reconcile(t, r)
+	}
+
+	after := r.Watched()
+	if after[0].FilterID == before[0].FilterID || after[1].FilterID != before[1].FilterID {
+		t.Errorf("watched filters %d, %d; want a new one for group a and %d", after[0].FilterID, after[1].FilterID, before[1].FilterID)
+	}
+	if n := len(backend.Filters()); n != 2 {
+		t.Errorf("%d filters, want 2", n)
+	}
+}
+
+func TestReconcileRepairRetried(t *testing.T) {
+	backend := &flakyBackend{MemoryBackend: NewMemoryBackend()}
+	r := watchRules(t, openMemoryEngine(t, backend))
+	deleted := r.Watched()[0]
+	if err := backend.DeleteFilter(deleted.FilterID); err != nil {
+		t.Fatal(err)
+	}
+
+	backend.failing = true
+	events, err := r.Reconcile(context.Background())
+	if !hasCode(err, FWP_E_TIMEOUT) {
+		t.Fatalf("Reconcile with a failing repair = %v, want FWP_E_TIMEOUT", err)
+	}
+	if len(events) != 1 || events[0].Change != "deleted" || events[0].Repaired {
+		t.Fatalf("events = %+v, want one deletion not repaired", events)
+	}
+	if r.Watched()[0].FilterID != deleted.FilterID {
+		t.Errorf("rule watched under filter %d after a failed repair", r.Watched()[0].FilterID)
+	}
+
+	backend.failing = false
+	reconcile(t, r, "deleted")
+	if n := len(backend.Filters()); n != 2 {
+		t.Errorf("%d filters after the retry, want 2", n)
+	}
+	reconcile(t, r)
+}
@@ -0,0 +1,54 @@
+package firewall
+
+import "net/netip"
+
+/*
+ * prefixTrie is a binary trie of IPv4 prefixes, one level per bit, which
+ * finds every prefix containing a given one in at most 32 steps. Values are
+ * indexes into a slice owned by the caller.
+ */
+type prefixTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	values   []int // Values inserted at exactly this prefix, in insertion order.
+}
+
+// prefixBit returns bit i of addr, counting from the most significant one.
+func prefixBit(addr netip.Addr, i int) int {
+	b := addr.As4()
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+// insert adds value at prefix, which must be IPv4; host bits are ignored.
+func (t *prefixTrie) insert(prefix netip.Prefix, value int) {
+	node := &t.root
+	addr := prefix.Addr()
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := prefixBit(addr, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.values = append(node.values, value)
+}
+
+// covering returns the values of the prefixes that contain prefix, itself
+// included, from the broadest one down.
+func (t *prefixTrie) covering(prefix netip.Prefix) []int {
+	var values []int
+	node := &t.root
+	addr := prefix.Addr()
+	for i := 0; ; i++ {
+		values = append(values, node.values...)
+		if i == prefix.Bits() {
+			return values
+		}
+		if node = node.children[prefixBit(addr, i)]; node == nil {
+			return values
+		}
+	}
+}
@@ -165,6 +165,30 @@ type wtFwpmL2Flags uint32
 
 const cFWP_CONDITION_L2_IS_VM2VM wtFwpmL2Flags = 0x00000010
 
+// d999e981-7948-4c83-b742-c84e3b678f8f
+var cFWPM_CONDITION_MAC_LOCAL_ADDRESS = windows.GUID{
+	Data1: 0xd999e981,
+	Data2: 0x7948,
+	Data3: 0x4c83,
+	Data4: [8]byte{0xb7, 0x42, 0xc8, 0x4e, 0x3b, 0x67, 0x8f, 0x8f},
+}
+
+// 408f2ed4-3a70-4b4d-92a6-415ac20e2f12
+var cFWPM_CONDITION_MAC_REMOTE_ADDRESS = windows.GUID{
+	Data1: 0x408f2ed4,
+	Data2: 0x3a70,
+	Data3: 0x4b4d,
+	Data4: [8]byte{0x92, 0xa6, 0x41, 0x5a, 0xc2, 0x0e, 0x2f, 0x12},
+}
+
+// fd08948d-a219-4d52-bb98-1a5540ee7b4e
+var cFWPM_CONDITION_ETHER_TYPE = windows.GUID{
+	Data1: 0xfd08948d,
+	Data2: 0xa219,
+	Data3: 0x4d52,
+	Data4: [8]byte{0xbb, 0x98, 0x1a, 0x55, 0x40, 0xee, 0x7b, 0x4e},
+}
+
 var cFWPM_CONDITION_FLAGS = windows.GUID{
 	Data1: 0x632ce23b,
 	Data2: 0x5167,
@@ -243,6 +267,25 @@ var cFWPM_LAYER_INBOUND_MAC_FRAME_NATIVE = windows.GUID{
 	Data4: [8]byte{0xae, 0x88, 0xb5, 0x6e, 0x85, 0x26, 0xdf, 0x50},
 }
 
+// The MAC addresses and EtherType of a frame are conditions of the Ethernet
+// layers; the native ones only see the interface and media type.
+
+// effb7edb-0055-4f9a-a231-4ff8131ad191
+var cFWPM_LAYER_INBOUND_MAC_FRAME_ETHERNET = windows.GUID{
+	Data1: 0xeffb7edb,
+	Data2: 0x0055,
+	Data3: 0x4f9a,
+	Data4: [8]byte{0xa2, 0x31, 0x4f, 0xf8, 0x13, 0x1a, 0xd1, 0x91},
+}
+
+// 694673bc-d6db-4870-adee-0acdbdb7f4b2
+var cFWPM_LAYER_OUTBOUND_MAC_FRAME_ETHERNET = windows.GUID{
+	Data1: 0x694673bc,
+	Data2: 0xd6db,
+	Data3: 0x4870,
+	Data4: [8]byte{0xad, 0xee, 0x0a, 0xcd, 0xbd, 0xb7, 0xf4, 0xb2},
+}
+
 // FWP_BITMAP_ARRAY64 defined in fwtypes.h
 type wtFwpBitmapArray64 struct {
 	bitmapArray64 [8]uint8 // Windows type: [8]UINT8
@@ -311,6 +354,13 @@ type wtFwpV6AddrAndMask struct {
 	prefixLength uint8
 }
 
+// FWP_RANGE0 defined in fwptypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwptypes/ns-fwptypes-fwp_range0).
+type wtFwpRange0 struct {
+	valueLow  wtFwpValue0
+	valueHigh wtFwpValue0
+}
+
 // FWP_VALUE0 defined in fwptypes.h
 // (https://docs.microsoft.com/en-us/windows/desktop/api/fwptypes/ns-fwptypes-fwp_value0_)
 type wtFwpValue0 struct {
@@ -362,6 +412,32 @@ type wtFwpmSession0 struct {
 	kernelMode           uint8   // Windows type: BOOL
 }
 
+// FWP_FILTER_ENUM_TYPE defined in fwptypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwptypes/ne-fwptypes-fwp_filter_enum_type)
+type wtFwpFilterEnumType uint32
+
+const (
+	cFWP_FILTER_ENUM_FULLY_CONTAINED wtFwpFilterEnumType = 0
+	cFWP_FILTER_ENUM_OVERLAPPING     wtFwpFilterEnumType = 1
+)
+
+// FWP_FILTER_ENUM_FLAG_* defined in fwptypes.h
+type wtFwpFilterEnumFlags uint32
+
+const (
+	cFWP_FILTER_ENUM_FLAG_BEST_TERMINATING_MATCH wtFwpFilterEnumFlags = 0x00000001
+	cFWP_FILTER_ENUM_FLAG_SORTED                 wtFwpFilterEnumFlags = 0x00000002
+	cFWP_FILTER_ENUM_FLAG_BOOTTIME_ONLY          wtFwpFilterEnumFlags = 0x00000004
+	cFWP_FILTER_ENUM_FLAG_INCLUDE_BOOTTIME       wtFwpFilterEnumFlags = 0x00000008
+	cFWP_FILTER_ENUM_FLAG_INCLUDE_DISABLED       wtFwpFilterEnumFlags = 0x00000010
+)
+
+type wtFwpmProviderFlags uint32
+
+const (
+	cFWPM_PROVIDER_FLAG_PERSISTENT wtFwpmProviderFlags = 0x00000001 // FWPM_PROVIDER_FLAG_PERSISTENT defined in fwpmtypes.h
+)
+
 type wtFwpmSublayerFlags uint32
 
 const (
@@ -393,7 +469,7 @@ const (
 type wtFwpmProvider0 struct {
 	providerKey  windows.GUID
 	displayData  wtFwpmDisplayData0
-	flags        uint32
+	flags        wtFwpmProviderFlags
 	providerData wtFwpByteBlob
 	serviceName  *uint16
 }
@@ -411,10 +487,8 @@ type SecWinNTAuthIdentityW struct {
 	Flags          uint32
 }
 
-type baseObjects struct {
-	provider windows.GUID
-	filters  windows.GUID
-}
+// Defined in rpcdce.h
+const cSEC_WINNT_AUTH_IDENTITY_UNICODE = 2
 
 const (
 	cIPPROTO_ICMP   wtIPProto = 1
@@ -426,3 +500,150 @@ const (
 const (
 	cFWP_ACTRL_MATCH_FILTER = 1
 )
+
+// FWPM_ENGINE_OPTION defined in fwpmtypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwpmtypes/ne-fwpmtypes-fwpm_engine_option)
+type wtFwpmEngineOption uint32
+
+const (
+	cFWPM_ENGINE_COLLECT_NET_EVENTS           wtFwpmEngineOption = 0
+	cFWPM_ENGINE_NET_EVENT_MATCH_ANY_KEYWORDS wtFwpmEngineOption = cFWPM_ENGINE_COLLECT_NET_EVENTS + 1
+	cFWPM_ENGINE_NAME_CACHE                   wtFwpmEngineOption = cFWPM_ENGINE_NET_EVENT_MATCH_ANY_KEYWORDS + 1
+	cFWPM_ENGINE_MONITOR_IPSEC_CONNECTIONS    wtFwpmEngineOption = cFWPM_ENGINE_NAME_CACHE + 1
+	cFWPM_ENGINE_PACKET_QUEUING               wtFwpmEngineOption = cFWPM_ENGINE_MONITOR_IPSEC_CONNECTIONS + 1
+	cFWPM_ENGINE_TXN_WATCHDOG_TIMEOUT_IN_MSEC wtFwpmEngineOption = cFWPM_ENGINE_PACKET_QUEUING + 1
+)
+
+// FWP_IP_VERSION defined in fwptypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwptypes/ne-fwptypes-fwp_ip_version)
+type wtFwpIPVersion uint32
+
+const (
+	cFWP_IP_VERSION_V4   wtFwpIPVersion = 0
+	cFWP_IP_VERSION_V6   wtFwpIPVersion = cFWP_IP_VERSION_V4 + 1
+	cFWP_IP_VERSION_NONE wtFwpIPVersion = cFWP_IP_VERSION_V6 + 1
+)
+
+// FWPM_NET_EVENT_TYPE defined in fwpmtypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwpmtypes/ne-fwpmtypes-fwpm_net_event_type)
+type wtFwpmNetEventType uint32
+
+const (
+	cFWPM_NET_EVENT_TYPE_IKEEXT_MM_FAILURE  wtFwpmNetEventType = 0
+	cFWPM_NET_EVENT_TYPE_IKEEXT_QM_FAILURE  wtFwpmNetEventType = cFWPM_NET_EVENT_TYPE_IKEEXT_MM_FAILURE + 1
+	cFWPM_NET_EVENT_TYPE_IKEEXT_EM_FAILURE  wtFwpmNetEventType = cFWPM_NET_EVENT_TYPE_IKEEXT_QM_FAILURE + 1
+	cFWPM_NET_EVENT_TYPE_CLASSIFY_DROP      wtFwpmNetEventType = cFWPM_NET_EVENT_TYPE_IKEEXT_EM_FAILURE + 1
+	cFWPM_NET_EVENT_TYPE_IPSEC_KERNEL_DROP  wtFwpmNetEventType = cFWPM_NET_EVENT_TYPE_CLASSIFY_DROP + 1
+	cFWPM_NET_EVENT_TYPE_IPSEC_DOSP_DROP    wtFwpmNetEventType = cFWPM_NET_EVENT_TYPE_IPSEC_KERNEL_DROP + 1
+	cFWPM_NET_EVENT_TYPE_CLASSIFY_ALLOW     wtFwpmNetEventType = cFWPM_NET_EVENT_TYPE_IPSEC_DOSP_DROP + 1
+	cFWPM_NET_EVENT_TYPE_CAPABILITY_DROP    wtFwpmNetEventType = cFWPM_NET_EVENT_TYPE_CLASSIFY_ALLOW + 1
+	cFWPM_NET_EVENT_TYPE_CAPABILITY_ALLOW   wtFwpmNetEventType = cFWPM_NET_EVENT_TYPE_CAPABILITY_DROP + 1
+	cFWPM_NET_EVENT_TYPE_CLASSIFY_DROP_MAC  wtFwpmNetEventType = cFWPM_NET_EVENT_TYPE_CAPABILITY_ALLOW + 1
+	cFWPM_NET_EVENT_TYPE_LPM_PACKET_ARRIVAL wtFwpmNetEventType = cFWPM_NET_EVENT_TYPE_CLASSIFY_DROP_MAC + 1
+)
+
+// FWPM_NET_EVENT_FLAG_* defined in fwpmtypes.h. They tell which header fields are valid.
+type wtFwpmNetEventFlags uint32
+
+const (
+	cFWPM_NET_EVENT_FLAG_IP_PROTOCOL_SET   wtFwpmNetEventFlags = 0x00000001
+	cFWPM_NET_EVENT_FLAG_LOCAL_ADDR_SET    wtFwpmNetEventFlags = 0x00000002
+	cFWPM_NET_EVENT_FLAG_REMOTE_ADDR_SET   wtFwpmNetEventFlags = 0x00000004
+	cFWPM_NET_EVENT_FLAG_LOCAL_PORT_SET    wtFwpmNetEventFlags = 0x00000008
+	cFWPM_NET_EVENT_FLAG_REMOTE_PORT_SET   wtFwpmNetEventFlags = 0x00000010
+	cFWPM_NET_EVENT_FLAG_APP_ID_SET        wtFwpmNetEventFlags = 0x00000020
+	cFWPM_NET_EVENT_FLAG_USER_ID_SET       wtFwpmNetEventFlags = 0x00000040
+	cFWPM_NET_EVENT_FLAG_SCOPE_ID_SET      wtFwpmNetEventFlags = 0x00000080
+	cFWPM_NET_EVENT_FLAG_IP_VERSION_SET    wtFwpmNetEventFlags = 0x00000100
+	cFWPM_NET_EVENT_FLAG_REAUTH_REASON_SET wtFwpmNetEventFlags = 0x00000200
+)
+
+// FWPM_NET_EVENT_KEYWORD_* defined in fwpmtypes.h. Used as the value of the
+// FWPM_ENGINE_NET_EVENT_MATCH_ANY_KEYWORDS engine option.
+type wtFwpmNetEventKeyword uint32
+
+const (
+	cFWPM_NET_EVENT_KEYWORD_INBOUND_MCAST      wtFwpmNetEventKeyword = 0x00000001
+	cFWPM_NET_EVENT_KEYWORD_INBOUND_BCAST      wtFwpmNetEventKeyword = 0x00000002
+	cFWPM_NET_EVENT_KEYWORD_CAPABILITY_DROP    wtFwpmNetEventKeyword = 0x00000004
+	cFWPM_NET_EVENT_KEYWORD_CAPABILITY_ALLOW   wtFwpmNetEventKeyword = 0x00000008
+	cFWPM_NET_EVENT_KEYWORD_CLASSIFY_ALLOW     wtFwpmNetEventKeyword = 0x00000010
+	cFWPM_NET_EVENT_KEYWORD_PORT_SCANNING_DROP wtFwpmNetEventKeyword = 0x00000020
+)
+
+// FWPM_NET_EVENT_CLASSIFY_DROP1 defined in fwpmtypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwpmtypes/ns-fwpmtypes-fwpm_net_event_classify_drop1)
+type wtFwpmNetEventClassifyDrop1 struct {
+	filterID        uint64
+	layerID         uint16
+	reauthReason    uint32
+	originalProfile uint32
+	currentProfile  uint32
+	msFwpDirection  uint32
+	isLoopback      int32 // Windows type: BOOL
+}
+
+// FWPM_NET_EVENT_CLASSIFY_ALLOW0 defined in fwpmtypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwpmtypes/ns-fwpmtypes-fwpm_net_event_classify_allow0).
+// FWPM_NET_EVENT_CLASSIFY_DROP2 starts with the same fields, so this type is
+// also used to read the common part of drop events delivered as FWPM_NET_EVENT2.
+type wtFwpmNetEventClassifyAllow0 struct {
+	filterID        uint64
+	layerID         uint16
+	reauthReason    uint32
+	originalProfile uint32
+	currentProfile  uint32
+	msFwpDirection  uint32
+	isLoopback      int32 // Windows type: BOOL
+}
+
+// FWPM_NET_EVENT_ENUM_TEMPLATE0 defined in fwpmtypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwpmtypes/ns-fwpmtypes-fwpm_net_event_enum_template0)
+type wtFwpmNetEventEnumTemplate0 struct {
+	startTime           windows.Filetime
+	endTime             windows.Filetime
+	numFilterConditions uint32
+	filterCondition     *wtFwpmFilterCondition0
+}
+
+// FWPM_CHANGE_TYPE defined in fwpmtypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwpmtypes/ne-fwpmtypes-fwpm_change_type)
+type wtFwpmChangeType uint32
+
+const (
+	cFWPM_CHANGE_ADD    wtFwpmChangeType = 1
+	cFWPM_CHANGE_DELETE wtFwpmChangeType = 2
+)
+
+// FWPM_SUBSCRIPTION_FLAG_* defined in fwpmtypes.h
+type wtFwpmSubscriptionFlags uint32
+
+const (
+	cFWPM_SUBSCRIPTION_FLAG_NOTIFY_ON_ADD    wtFwpmSubscriptionFlags = 0x00000001
+	cFWPM_SUBSCRIPTION_FLAG_NOTIFY_ON_DELETE wtFwpmSubscriptionFlags = 0x00000002
+)
+
+// FWPM_FILTER_CHANGE0 defined in fwpmtypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwpmtypes/ns-fwpmtypes-fwpm_filter_change0)
+type wtFwpmFilterChange0 struct {
+	changeType wtFwpmChangeType
+	filterKey  windows.GUID // Windows type: GUID
+	offset1    [4]byte      // Layout correction field
+	filterID   uint64
+}
+
+// FWPM_FILTER_SUBSCRIPTION0 defined in fwpmtypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwpmtypes/ns-fwpmtypes-fwpm_filter_subscription0)
+type wtFwpmFilterSubscription0 struct {
+	enumTemplate *wtFwpmFilterEnumTemplate0
+	flags        wtFwpmSubscriptionFlags // Windows type: UINT32
+	sessionKey   windows.GUID
+}
+
+// FWPM_NET_EVENT_SUBSCRIPTION0 defined in fwpmtypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwpmtypes/ns-fwpmtypes-fwpm_net_event_subscription0)
+type wtFwpmNetEventSubscription0 struct {
+	enumTemplate *wtFwpmNetEventEnumTemplate0
+	flags        uint32
+	sessionKey   windows.GUID
+}
@@ -1,4 +1,4 @@
-//go:build amd64 || arm64
+//go:build windows && (amd64 || arm64)
 
 /* SPDX-License-Identifier: MIT
  *
@@ -35,6 +35,35 @@ const (
 	wtFwpmFilter0_filterID_Offset            = 176
 	wtFwpmFilter0_effectiveWeight_Offset     = 184
 
+	wtFwpmFilterEnumTemplate0_Size                           = 72
+	wtFwpmFilterEnumTemplate0_layerKey_Offset                = 8
+	wtFwpmFilterEnumTemplate0_enumType_Offset                = 24
+	wtFwpmFilterEnumTemplate0_flags_Offset                   = 28
+	wtFwpmFilterEnumTemplate0_providerContextTemplate_Offset = 32
+	wtFwpmFilterEnumTemplate0_numFilterConditions_Offset     = 40
+	wtFwpmFilterEnumTemplate0_filterCondition_Offset         = 48
+	wtFwpmFilterEnumTemplate0_actionMask_Offset              = 56
+	wtFwpmFilterEnumTemplate0_calloutKey_Offset              = 64
+
+	wtFwpmNetEventHeader1_Size              = 144
+	wtFwpmNetEventHeader1_localAddr_Offset  = 20
+	wtFwpmNetEventHeader1_remoteAddr_Offset = 36
+	wtFwpmNetEventHeader1_localPort_Offset  = 52
+	wtFwpmNetEventHeader1_appID_Offset      = 64
+	wtFwpmNetEventHeader1_userID_Offset     = 80
+
+	wtFwpmNetEvent1_Size         = 160
+	wtFwpmNetEvent1_type_Offset  = 144
+	wtFwpmNetEvent1_union_Offset = 152
+
+	wtFwpmNetEventHeader2_Size                 = 104
+	wtFwpmNetEventHeader2_addressFamily_Offset = 88
+	wtFwpmNetEventHeader2_packageSid_Offset    = 96
+
+	wtFwpmNetEvent2_Size         = 120
+	wtFwpmNetEvent2_type_Offset  = 104
+	wtFwpmNetEvent2_union_Offset = 112
+
 	wtFwpmFilterCondition0_Size                  = 40
 	wtFwpmFilterCondition0_matchType_Offset      = 16
 	wtFwpmFilterCondition0_conditionValue_Offset = 24
@@ -85,3 +114,70 @@ type wtFwpmFilter0 struct {
 	filterID            uint64
 	effectiveWeight     wtFwpValue0
 }
+
+// FWPM_FILTER_ENUM_TEMPLATE0 defined in fwpmtypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwpmtypes/ns-fwpmtypes-fwpm_filter_enum_template0).
+type wtFwpmFilterEnumTemplate0 struct {
+	providerKey             *windows.GUID // Windows type: *GUID
+	layerKey                windows.GUID  // Windows type: GUID
+	enumType                wtFwpFilterEnumType
+	flags                   wtFwpFilterEnumFlags
+	providerContextTemplate uintptr // Windows type: *FWPM_PROVIDER_CONTEXT_ENUM_TEMPLATE0
+	numFilterConditions     uint32
+	filterCondition         *wtFwpmFilterCondition0
+	actionMask              uint32
+	calloutKey              *windows.GUID // Windows type: *GUID
+}
+
+// FWPM_NET_EVENT_HEADER1 defined in fwpmtypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwpmtypes/ns-fwpmtypes-fwpm_net_event_header1).
+type wtFwpmNetEventHeader1 struct {
+	timeStamp  windows.Filetime    // Windows type: FILETIME
+	flags      wtFwpmNetEventFlags // Windows type: UINT32
+	ipVersion  wtFwpIPVersion
+	ipProtocol uint8
+	offset1    [3]byte  // Layout correction field
+	localAddr  [16]byte // Windows type: union { UINT32 localAddrV4; FWP_BYTE_ARRAY16 localAddrV6; }
+	remoteAddr [16]byte // Windows type: union { UINT32 remoteAddrV4; FWP_BYTE_ARRAY16 remoteAddrV6; }
+	localPort  uint16
+	remotePort uint16
+	scopeID    uint32
+	appID      wtFwpByteBlob
+	userID     *windows.SID
+	reserved   [56]byte // Windows type: anonymous union of reserved fields
+}
+
+// FWPM_NET_EVENT1 defined in fwpmtypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwpmtypes/ns-fwpmtypes-fwpm_net_event1).
+type wtFwpmNetEvent1 struct {
+	header       wtFwpmNetEventHeader1
+	_type        wtFwpmNetEventType
+	classifyDrop *wtFwpmNetEventClassifyDrop1 // Windows type: union of pointers to the type-specific event data
+}
+
+// FWPM_NET_EVENT_HEADER2 defined in fwpmtypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwpmtypes/ns-fwpmtypes-fwpm_net_event_header2).
+type wtFwpmNetEventHeader2 struct {
+	timeStamp     windows.Filetime    // Windows type: FILETIME
+	flags         wtFwpmNetEventFlags // Windows type: UINT32
+	ipVersion     wtFwpIPVersion
+	ipProtocol    uint8
+	offset1       [3]byte  // Layout correction field
+	localAddr     [16]byte // Windows type: union { UINT32 localAddrV4; FWP_BYTE_ARRAY16 localAddrV6; }
+	remoteAddr    [16]byte // Windows type: union { UINT32 remoteAddrV4; FWP_BYTE_ARRAY16 remoteAddrV6; }
+	localPort     uint16
+	remotePort    uint16
+	scopeID       uint32
+	appID         wtFwpByteBlob
+	userID        *windows.SID
+	addressFamily uint32 // Windows type: FWP_AF
+	packageSid    *windows.SID
+}
+
+// FWPM_NET_EVENT2 defined in fwpmtypes.h
+// (https://learn.microsoft.com/en-us/windows/win32/api/fwpmtypes/ns-fwpmtypes-fwpm_net_event2).
+type wtFwpmNetEvent2 struct {
+	header   wtFwpmNetEventHeader2
+	_type    wtFwpmNetEventType
+	classify *wtFwpmNetEventClassifyAllow0 // Windows type: union of pointers to the type-specific event data
+}
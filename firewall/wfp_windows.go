@@ -0,0 +1,738 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// The Backend of Open when none is given: the WFP engine of the machine.
+func defaultBackend() Backend {
+	return wfpBackend{}
+}
+
+// wfpBackend is the Windows Filtering Platform.
+type wfpBackend struct{}
+
+// wfpSession is a WFP session handle.
+type wfpSession struct {
+	handle uintptr
+}
+
+// WFP layers, by name.
+var layerKeys = map[string]windows.GUID{
+	"ALE_AUTH_CONNECT_V4":         cFWPM_LAYER_ALE_AUTH_CONNECT_V4,
+	"ALE_AUTH_CONNECT_V6":         cFWPM_LAYER_ALE_AUTH_CONNECT_V6,
+	"ALE_AUTH_RECV_ACCEPT_V4":     cFWPM_LAYER_ALE_AUTH_RECV_ACCEPT_V4,
+	"ALE_AUTH_RECV_ACCEPT_V6":     cFWPM_LAYER_ALE_AUTH_RECV_ACCEPT_V6,
+	"INBOUND_MAC_FRAME_ETHERNET":  cFWPM_LAYER_INBOUND_MAC_FRAME_ETHERNET,
+	"OUTBOUND_MAC_FRAME_ETHERNET": cFWPM_LAYER_OUTBOUND_MAC_FRAME_ETHERNET,
+}
+
+// Number of filters fetched per FwpmFilterEnum0 call.
+const filterEnumBatch = 64
+
+/*
+ * Creates a new WFP session on the engine designated by config.Remote, which
+ * may be the local one.
+ */
+func (wfpBackend) Open(config SessionConfig) (Session, error) {
+	if err := config.Remote.Validate(); err != nil {
+		return nil, err
+	}
+	remote := config.Remote
+
+	description := config.Name + " - persistent session"
+	flags := wtFwpmSessionFlagsValue(0)
+	if config.Dynamic {
+		description = config.Name + " - dynamic session"
+		flags = cFWPM_SESSION_FLAG_DYNAMIC
+	}
+	sessionDisplayData, err := createWtFwpmDisplayData0(config.Name, description)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+
+	txnWaitTimeoutInMSec := uint32(windows.INFINITE)
+	if config.TxnTimeout > 0 {
+		txnWaitTimeoutInMSec = uint32(min(config.TxnTimeout.Milliseconds(), windows.INFINITE-1))
+	}
+
+	session := wtFwpmSession0{
+		displayData:          *sessionDisplayData,  // *wtFwpmDisplayData0: A pointer to a FWPM_DISPLAY_DATA0 structure that contains the display data for the session.
+		flags:                flags,                // cFWPM_SESSION_FLAG_DYNAMIC: The session is dynamic and will be automatically deleted when the session handle is closed.
+		txnWaitTimeoutInMSec: txnWaitTimeoutInMSec, // windows.INFINITE: The wait time is infinite.
+	}
+
+	var serverName *uint16
+	if !remote.IsLocal() {
+		serverName, err = windows.UTF16PtrFromString(remote.Host)
+		if err != nil {
+			return nil, wrapErr(err)
+		}
+	}
+
+	authnService := cRPC_C_AUTHN_WINNT
+	if remote.Auth == "default" {
+		authnService = cRPC_C_AUTHN_DEFAULT
+	}
+
+	authIdentity, err := createSecWinNTAuthIdentityW(remote)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+
+	sessionHandle := uintptr(0)
+
+	// fwpmEngineOpen0: Opens a session with the filter engine.
+	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmengineopen0
+	err = fwpmEngineOpen0(serverName, authnService, authIdentity, &session, unsafe.Pointer(&sessionHandle))
+	if err != nil {
+		return nil, wfpErr("FwpmEngineOpen0", remote.Host, err)
+	}
+
+	logger.Debug("WFP session opened", "dynamic", config.Dynamic, "host", remote.Host, "user", remote.User)
+
+	return &wfpSession{handle: sessionHandle}, nil
+}
+
+func (s *wfpSession) AddProvider(p *Provider) error {
+	displayData, err := createWtFwpmDisplayData0(p.Name, p.Description)
+	if err != nil {
+		return wrapErr(err)
+	}
+	provider := wtFwpmProvider0{
+		providerKey: windows.GUID(p.Key), // *windows.GUID: A pointer to a GUID that uniquely identifies the provider.
+		displayData: *displayData,        // *wtFwpmDisplayData0: A pointer to a FWPM_DISPLAY_DATA0 structure that contains the display data for the provider.
+	}
+	if p.Persistent {
+		provider.flags = cFWPM_PROVIDER_FLAG_PERSISTENT // cFWPM_PROVIDER_FLAG_PERSISTENT: The provider survives the session and reboots.
+	}
+
+	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmprovideradd0
+	err = fwpmProviderAdd0(s.handle, &provider, sdPointer(p.SecurityDescriptor))
+	runtime.KeepAlive(p.SecurityDescriptor)
+	if err != nil {
+		return wfpErr("FwpmProviderAdd0", p.Key.String(), err)
+	}
+	return nil
+}
+
+func (s *wfpSession) AddSublayer(sl *Sublayer) error {
+	displayData, err := createWtFwpmDisplayData0(sl.Name, sl.Description)
+	if err != nil {
+		return wrapErr(err)
+	}
+	sublayer := wtFwpmSublayer0{
+		subLayerKey: windows.GUID(sl.Key), // *windows.GUID: A pointer to a GUID that uniquely identifies the sublayer.
+		displayData: *displayData,         // *wtFwpmDisplayData0: A pointer to a FWPM_DISPLAY_DATA0 structure that contains the display data for the sublayer.
+		weight:      sl.Weight,            // weight: The weight of the sublayer.
+	}
+	if !sl.Provider.IsZero() {
+		providerKey := windows.GUID(sl.Provider)
+		sublayer.providerKey = &providerKey // *windows.GUID: A pointer to a GUID that uniquely identifies the provider.
+	}
+	if sl.Persistent {
+		sublayer.flags = cFWPM_SUBLAYER_FLAG_PERSISTENT // cFWPM_SUBLAYER_FLAG_PERSISTENT: The sublayer survives the session and reboots.
+	}
+
+	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmsublayeradd0
+	err = fwpmSubLayerAdd0(s.handle, &sublayer, sdPointer(sl.SecurityDescriptor))
+	runtime.KeepAlive(sl.SecurityDescriptor)
+	if err != nil {
+		return wfpErr("FwpmSubLayerAdd0", sl.Key.String(), err)
+	}
+	return nil
+}
+
+func (s *wfpSession) AddFilter(f *Filter) (uint64, error) {
+	layerKey, ok := layerKeys[f.Layer]
+	if !ok {
+		return 0, wfpErr("FwpmFilterAdd0", f.Layer, windows.Errno(FWP_E_LAYER_NOT_FOUND))
+	}
+
+	// Condition values are referenced by pointer, they must stay alive until
+	// the call returns.
+	conditions := make([]wtFwpmFilterCondition0, len(f.Conditions))
+	addrMasks := make([]wtFwpV4AddrAndMask, len(f.Conditions))
+	addr6Masks := make([]wtFwpV6AddrAndMask, len(f.Conditions))
+	ranges := make([]wtFwpRange0, len(f.Conditions))
+	appIDs := make([]wtFwpByteBlob, len(f.Conditions))
+	luids := make([]uint64, len(f.Conditions))
+	macs := make([]wtFwpByteArray6, len(f.Conditions))
+	for i, condition := range f.Conditions {
+		matchType, ok := matchTypes[condition.Match]
+		if !ok {
+			return 0, wfpErr("FwpmFilterAdd0", condition.String(), windows.Errno(FWP_E_MATCH_TYPE_MISMATCH))
+		}
+		addressKey, isAddress := addressFields[condition.Field]
+		numberField, isNumber := numberFields[condition.Field]
+		macKey, isMAC := macFields[condition.Field]
+		switch {
+		case isAddress && condition.Range != (AddressRange{}):
+			if !condition.Range.IsValid() {
+				return 0, wfpErr("FwpmFilterAdd0", condition.String(), windows.Errno(FWP_E_INVALID_RANGE))
+			}
+			// Addresses are compared as UINT32, in host order like FWP_V4_ADDR_AND_MASK
+			ranges[i] = wtFwpRange0{
+				valueLow:  wtFwpValue0{_type: cFWP_UINT32, value: uintptr(addrUint32(condition.Range.From))}, // The first address of the range.
+				valueHigh: wtFwpValue0{_type: cFWP_UINT32, value: uintptr(addrUint32(condition.Range.To))},   // The last address of the range.
+			}
+			conditions[i].fieldKey = addressKey                                      // addressKey: The remote or local IP address of the connection.
+			conditions[i].matchType = matchType                                      // cFWP_MATCH_RANGE: The value lies within the range, bounds included.
+			conditions[i].conditionValue._type = cFWP_RANGE_TYPE                     // cFWP_RANGE_TYPE: The data type of the condition value.
+			conditions[i].conditionValue.value = uintptr(unsafe.Pointer(&ranges[i])) // uintptr(unsafe.Pointer(&ranges[i])): A pointer to the FWP_RANGE0.
+		case isAddress && condition.Network.Addr().Is6():
+			addr6Masks[i] = wtFwpV6AddrAndMask{
+				addr:         condition.Network.Addr().As16(),
+				prefixLength: uint8(condition.Network.Bits()),
+			}
+			conditions[i].fieldKey = addressKey                                          // addressKey: The remote or local IP address of the connection.
+			conditions[i].matchType = matchType                                          // cFWP_MATCH_EQUAL or cFWP_MATCH_NOT_EQUAL: The match type of the condition.
+			conditions[i].conditionValue._type = cFWP_V6_ADDR_MASK                       // cFWP_V6_ADDR_MASK: The data type of the condition value.
+			conditions[i].conditionValue.value = uintptr(unsafe.Pointer(&addr6Masks[i])) // uintptr(unsafe.Pointer(&addr6Masks[i])): The value of the condition.
+		case isAddress:
+			if !condition.Network.Addr().Is4() {
+				return 0, wfpErr("FwpmFilterAdd0", condition.String(), windows.Errno(FWP_E_INVALID_NET_MASK))
+			}
+			// Convert the IP address and Mask to UINT32
+			addr := condition.Network.Addr().As4()
+			mask := net.CIDRMask(condition.Network.Bits(), 32) // e.g.: 255.255.255.0 if Bits() = 24
+			addrMasks[i] = wtFwpV4AddrAndMask{
+				addr: binary.BigEndian.Uint32(addr[:]),
+				mask: binary.BigEndian.Uint32(mask),
+			}
+			conditions[i].fieldKey = addressKey                                         // addressKey: The remote or local IP address of the connection.
+			conditions[i].matchType = matchType                                         // cFWP_MATCH_EQUAL or cFWP_MATCH_NOT_EQUAL: The match type of the condition.
+			conditions[i].conditionValue._type = cFWP_V4_ADDR_MASK                      // cFWP_V4_ADDR_MASK: The data type of the condition value.
+			conditions[i].conditionValue.value = uintptr(unsafe.Pointer(&addrMasks[i])) // uintptr(unsafe.Pointer(&addrMasks[i])): The value of the condition.
+		case isNumber && condition.Match == MatchRange:
+			ranges[i] = wtFwpRange0{
+				valueLow:  wtFwpValue0{_type: numberField.dataType, value: uintptr(condition.number())}, // The first value of the range.
+				valueHigh: wtFwpValue0{_type: numberField.dataType, value: uintptr(condition.To)},       // The last value of the range.
+			}
+			conditions[i].fieldKey = numberField.key                                 // numberField.key: The field of the condition, e.g. cFWPM_CONDITION_IP_REMOTE_PORT.
+			conditions[i].matchType = matchType                                      // cFWP_MATCH_RANGE: The value lies within the range, bounds included.
+			conditions[i].conditionValue._type = cFWP_RANGE_TYPE                     // cFWP_RANGE_TYPE: The data type of the condition value.
+			conditions[i].conditionValue.value = uintptr(unsafe.Pointer(&ranges[i])) // uintptr(unsafe.Pointer(&ranges[i])): A pointer to the FWP_RANGE0.
+		case isNumber:
+			conditions[i].fieldKey = numberField.key                         // numberField.key: The field of the condition, e.g. cFWPM_CONDITION_IP_PROTOCOL.
+			conditions[i].matchType = matchType                              // matchType: The match type of the condition, e.g. cFWP_MATCH_FLAGS_ALL_SET.
+			conditions[i].conditionValue._type = numberField.dataType        // numberField.dataType: The data type of the condition value, e.g. cFWP_UINT8.
+			conditions[i].conditionValue.value = uintptr(condition.number()) // uintptr(condition.number()): The value itself, for types that fit.
+		case condition.Field == FieldApp:
+			id, err := appID(condition.App, condition.Match == MatchPrefix || condition.Match == MatchNotPrefix)
+			if err != nil {
+				return 0, wfpErr("FwpmFilterAdd0", condition.String(), err)
+			}
+			appIDs[i] = createWtFwpByteBlob(id)
+			conditions[i].fieldKey = cFWPM_CONDITION_ALE_APP_ID                      // cFWPM_CONDITION_ALE_APP_ID: The fully qualified device path of the application.
+			conditions[i].matchType = matchType                                      // matchType: The match type of the condition, e.g. cFWP_MATCH_PREFIX.
+			conditions[i].conditionValue._type = cFWP_BYTE_BLOB_TYPE                 // cFWP_BYTE_BLOB_TYPE: The data type of the condition value.
+			conditions[i].conditionValue.value = uintptr(unsafe.Pointer(&appIDs[i])) // uintptr(unsafe.Pointer(&appIDs[i])): A pointer to the FWP_BYTE_BLOB.
+		case condition.Field == FieldLocalInterface:
+			luids[i] = condition.Interface
+			conditions[i].fieldKey = cFWPM_CONDITION_IP_LOCAL_INTERFACE             // cFWPM_CONDITION_IP_LOCAL_INTERFACE: The LUID of the network interface of the local address.
+			conditions[i].matchType = matchType                                     // cFWP_MATCH_EQUAL or cFWP_MATCH_NOT_EQUAL: The match type of the condition.
+			conditions[i].conditionValue._type = cFWP_UINT64                        // cFWP_UINT64: The data type of the condition value.
+			conditions[i].conditionValue.value = uintptr(unsafe.Pointer(&luids[i])) // uintptr(unsafe.Pointer(&luids[i])): A pointer to the UINT64.
+		case isMAC:
+			macs[i] = wtFwpByteArray6{byteArray6: condition.MAC}
+			conditions[i].fieldKey = macKey                                        // macKey: The local or remote MAC address of the frame.
+			conditions[i].matchType = matchType                                    // cFWP_MATCH_EQUAL or cFWP_MATCH_NOT_EQUAL: The match type of the condition.
+			conditions[i].conditionValue._type = cFWP_BYTE_ARRAY6_TYPE             // cFWP_BYTE_ARRAY6_TYPE: The data type of the condition value.
+			conditions[i].conditionValue.value = uintptr(unsafe.Pointer(&macs[i])) // uintptr(unsafe.Pointer(&macs[i])): A pointer to the FWP_BYTE_ARRAY6.
+		default:
+			return 0, wfpErr("FwpmFilterAdd0", condition.String(), windows.Errno(FWP_E_CONDITION_NOT_FOUND))
+		}
+	}
+
+	displayData, err := createWtFwpmDisplayData0(f.Name, f.Description)
+	if err != nil {
+		return 0, wrapErr(err)
+	}
+
+	weight := filterWeight(f.Weight)
+	filter := wtFwpmFilter0{
+		filterKey:           windows.GUID(f.Key),                                                      // *windows.GUID: A pointer to a GUID that uniquely identifies the filter.
+		displayData:         *displayData,                                                             // *wtFwpmDisplayData0: A pointer to a FWPM_DISPLAY_DATA0 structure that contains the display data for the filter.
+		providerData:        createWtFwpByteBlob(f.ProviderData),                                      // wtFwpByteBlob: The rule metadata, see RuleMetadata.
+		layerKey:            layerKey,                                                                 // *windows.GUID: A pointer to a GUID that uniquely identifies the layer.
+		subLayerKey:         windows.GUID(f.Sublayer),                                                 // *windows.GUID: A pointer to a GUID that uniquely identifies the sublayer.
+		weight:              wtFwpValue0{_type: cFWP_UINT64, value: uintptr(unsafe.Pointer(&weight))}, // cFWP_UINT64: A pointer to the explicit weight, see filterWeight.
+		numFilterConditions: uint32(len(conditions)),                                                  // uint32(len(conditions)): The number of conditions in the filter.
+		action:              wtFwpmAction0{_type: cFWP_ACTION_BLOCK},                                  // cFWP_ACTION_BLOCK: The action type of the filter.
+	}
+	if len(conditions) > 0 {
+		filter.filterCondition = &conditions[0] // *wtFwpmFilterCondition0: A pointer to an array of FWPM_FILTER_CONDITION0 structures that contain the conditions for the filter.
+	}
+	if !f.Provider.IsZero() {
+		providerKey := windows.GUID(f.Provider)
+		filter.providerKey = &providerKey // *windows.GUID: A pointer to a GUID that uniquely identifies the provider.
+	}
+	switch f.Action {
+	case ActionPermit:
+		filter.action._type = cFWP_ACTION_PERMIT // cFWP_ACTION_PERMIT: The action type of the filter.
+	case ActionContinue:
+		filter.action._type = cFWP_ACTION_CONTINUE // cFWP_ACTION_CONTINUE: The action type of the filter.
+	}
+	if f.HardAction {
+		filter.flags |= cFWPM_FILTER_FLAG_CLEAR_ACTION_RIGHT // Make the rule "hard" (complex to overwrite)
+	}
+	if f.Persistent {
+		filter.flags |= cFWPM_FILTER_FLAG_PERSISTENT // cFWPM_FILTER_FLAG_PERSISTENT: The filter survives the session and reboots.
+	}
+
+	var filterID uint64
+
+	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfilteradd0
+	err = fwpmFilterAdd0(s.handle, &filter, sdPointer(f.SecurityDescriptor), &filterID)
+	runtime.KeepAlive(f.SecurityDescriptor)
+	runtime.KeepAlive(&weight)
+	runtime.KeepAlive(addrMasks)
+	runtime.KeepAlive(addr6Masks)
+	runtime.KeepAlive(ranges)
+	runtime.KeepAlive(appIDs)
+	runtime.KeepAlive(luids)
+	runtime.KeepAlive(macs)
+	if err != nil {
+		return 0, wfpErr("FwpmFilterAdd0", f.Key.String(), err)
+	}
+	return filterID, nil
+}
+
+// sdPointer returns the sd argument of the Fwpm*Add0 functions for sd: its
+// address, or 0 for the default security descriptor.
+func sdPointer(sd SecurityDescriptor) uintptr {
+	if len(sd) == 0 {
+		return 0
+	}
+	return uintptr(unsafe.Pointer(&sd[0]))
+}
+
+/*
+ * setSecurity calls one of the Fwpm*SetSecurityInfoByKey0 functions with the
+ * parts sd has, pointing into it; securityInfo tells which, and whether the
+ * DACL inherits. There is no SACL: ParseSDDL does not make them.
+ */
+func (s *wfpSession) setSecurity(op string, key GUID, sd SecurityDescriptor, set func(uintptr, *windows.GUID, uint32, uintptr, uintptr, uintptr, uintptr) error) error {
+	parts, err := sd.parts()
+	if err != nil {
+		return wfpErr(op, key.String(), windows.Errno(ERROR_INVALID_SECURITY_DESCR))
+	}
+	var securityInfo windows.SECURITY_INFORMATION
+	var owner, group, dacl uintptr
+	if parts.owner != nil {
+		securityInfo |= windows.OWNER_SECURITY_INFORMATION
+		owner = uintptr(unsafe.Pointer(&parts.owner[0]))
+	}
+	if parts.group != nil {
+		securityInfo |= windows.GROUP_SECURITY_INFORMATION
+		group = uintptr(unsafe.Pointer(&parts.group[0]))
+	}
+	if parts.dacl != nil {
+		securityInfo |= windows.DACL_SECURITY_INFORMATION
+		dacl = uintptr(unsafe.Pointer(&parts.dacl[0]))
+		if parts.control&seDACLProtected != 0 {
+			securityInfo |= windows.PROTECTED_DACL_SECURITY_INFORMATION
+		} else {
+			securityInfo |= windows.UNPROTECTED_DACL_SECURITY_INFORMATION
+		}
+	}
+
+	windowsKey := windows.GUID(key)
+	err = set(s.handle, &windowsKey, uint32(securityInfo), owner, group, dacl, 0)
+	runtime.KeepAlive(sd)
+	if err != nil {
+		return wfpErr(op, key.String(), err)
+	}
+	return nil
+}
+
+func (s *wfpSession) SetProviderSecurity(key GUID, sd SecurityDescriptor) error {
+	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmprovidersetsecurityinfobykey0
+	return s.setSecurity("FwpmProviderSetSecurityInfoByKey0", key, sd, fwpmProviderSetSecurityInfoByKey0)
+}
+
+func (s *wfpSession) SetSublayerSecurity(key GUID, sd SecurityDescriptor) error {
+	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmsublayersetsecurityinfobykey0
+	return s.setSecurity("FwpmSubLayerSetSecurityInfoByKey0", key, sd, fwpmSubLayerSetSecurityInfoByKey0)
+}
+
+func (s *wfpSession) SetFilterSecurity(key GUID, sd SecurityDescriptor) error {
+	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfiltersetsecurityinfobykey0
+	return s.setSecurity("FwpmFilterSetSecurityInfoByKey0", key, sd, fwpmFilterSetSecurityInfoByKey0)
+}
+
+func (s *wfpSession) DeleteFilter(id uint64) error {
+	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfilterdeletebyid0
+	err := fwpmFilterDeleteById0(s.handle, id)
+	if err != nil {
+		return wfpErr("FwpmFilterDeleteById0", "", err)
+	}
+	return nil
+}
+
+func (s *wfpSession) Filters(provider GUID, layer string) ([]Filter, error) {
+	layerKey, ok := layerKeys[layer]
+	if !ok {
+		return nil, wfpErr("FwpmFilterCreateEnumHandle0", layer, windows.Errno(FWP_E_LAYER_NOT_FOUND))
+	}
+	providerKey := windows.GUID(provider)
+	template := wtFwpmFilterEnumTemplate0{
+		providerKey: &providerKey,                 // *windows.GUID: Only the filters of provider.
+		layerKey:    layerKey,                     // windows.GUID: The layer to enumerate.
+		enumType:    cFWP_FILTER_ENUM_OVERLAPPING, // cFWP_FILTER_ENUM_OVERLAPPING: With no conditions, every filter of the layer.
+		actionMask:  0xFFFFFFFF,                   // 0xFFFFFFFF: Filters with any action.
+	}
+
+	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfiltercreateenumhandle0
+	var enumHandle uintptr
+	err := fwpmFilterCreateEnumHandle0(s.handle, &template, &enumHandle)
+	if err != nil {
+		return nil, wfpErr("FwpmFilterCreateEnumHandle0", layer, err)
+	}
+	defer fwpmFilterDestroyEnumHandle0(s.handle, enumHandle)
+
+	var filters []Filter
+	for {
+		// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmfilterenum0
+		var entries **wtFwpmFilter0
+		var n uint32
+		err := fwpmFilterEnum0(s.handle, enumHandle, filterEnumBatch, &entries, &n)
+		if err != nil {
+			return nil, wfpErr("FwpmFilterEnum0", layer, err)
+		}
+		if n > 0 {
+			for _, filter := range unsafe.Slice(entries, n) {
+				filters = append(filters, decodeWtFwpmFilter0(layer, filter))
+			}
+		}
+		if entries != nil {
+			fwpmFreeMemory0(unsafe.Pointer(&entries))
+		}
+		if n < filterEnumBatch {
+			return filters, nil
+		}
+	}
+}
+
+// decodeWtFwpmFilter0 copies a filter out of WFP-owned memory.
+func decodeWtFwpmFilter0(layer string, filter *wtFwpmFilter0) Filter {
+	f := Filter{
+		ID:          filter.filterID,
+		Key:         GUID(filter.filterKey),
+		Name:        windows.UTF16PtrToString(filter.displayData.name),
+		Description: windows.UTF16PtrToString(filter.displayData.description),
+		Layer:       layer,
+		Sublayer:    GUID(filter.subLayerKey),
+		Action:      ActionBlock,
+		HardAction:  filter.flags&cFWPM_FILTER_FLAG_CLEAR_ACTION_RIGHT != 0,
+		Persistent:  filter.flags&cFWPM_FILTER_FLAG_PERSISTENT != 0,
+	}
+	if filter.providerKey != nil {
+		f.Provider = GUID(*filter.providerKey)
+	}
+	if filter.providerData.size > 0 {
+		f.ProviderData = append([]byte(nil), unsafe.Slice(filter.providerData.data, filter.providerData.size)...)
+	}
+	switch filter.action._type {
+	case cFWP_ACTION_PERMIT:
+		f.Action = ActionPermit
+	case cFWP_ACTION_CONTINUE:
+		f.Action = ActionContinue
+	}
+	switch filter.weight._type {
+	case cFWP_UINT64:
+		f.Weight = uint8(**(**uint64)(unsafe.Pointer(&filter.weight.value)) >> 56)
+	case cFWP_UINT8:
+		f.Weight = uint8(filter.weight.value) // Range index, from filters added with one.
+	}
+	if filter.numFilterConditions > 0 {
+		for _, condition := range unsafe.Slice(filter.filterCondition, filter.numFilterConditions) {
+			if c, ok := decodeWtFwpmFilterCondition0(condition); ok {
+				f.Conditions = append(f.Conditions, c)
+			}
+		}
+	}
+	return f
+}
+
+// decodeWtFwpmFilterCondition0 copies a condition out of WFP-owned memory;
+// false for the conditions the package does not add.
+func decodeWtFwpmFilterCondition0(condition wtFwpmFilterCondition0) (Condition, bool) {
+	var match MatchType
+	known := false
+	for m, matchType := range matchTypes {
+		if matchType == condition.matchType {
+			match, known = m, true
+		}
+	}
+	if !known {
+		return Condition{}, false
+	}
+	value := condition.conditionValue
+	for field, key := range addressFields {
+		if condition.fieldKey != key {
+			continue
+		}
+		c := Condition{Field: field, Match: match}
+		switch value._type {
+		case cFWP_V4_ADDR_MASK:
+			addrMask := *(**wtFwpV4AddrAndMask)(unsafe.Pointer(&value.value))
+			var addr [4]byte
+			binary.BigEndian.PutUint32(addr[:], addrMask.addr)
+			c.Network = netip.PrefixFrom(netip.AddrFrom4(addr), bits.OnesCount32(addrMask.mask))
+			return c, true
+		case cFWP_V6_ADDR_MASK:
+			addrMask := *(**wtFwpV6AddrAndMask)(unsafe.Pointer(&value.value))
+			c.Network = netip.PrefixFrom(netip.AddrFrom16(addrMask.addr), int(addrMask.prefixLength))
+			return c, true
+		case cFWP_RANGE_TYPE:
+			r := *(**wtFwpRange0)(unsafe.Pointer(&value.value))
+			if r.valueLow._type == cFWP_UINT32 && r.valueHigh._type == cFWP_UINT32 {
+				c.Range = AddressRange{uint32Addr(uint32(r.valueLow.value)), uint32Addr(uint32(r.valueHigh.value))}
+				return c, true
+			}
+		}
+		return Condition{}, false
+	}
+	for field, key := range macFields {
+		if condition.fieldKey == key && value._type == cFWP_BYTE_ARRAY6_TYPE {
+			mac := *(**wtFwpByteArray6)(unsafe.Pointer(&value.value))
+			return Condition{Field: field, Match: match, MAC: mac.byteArray6}, true
+		}
+	}
+	switch {
+	case condition.fieldKey == cFWPM_CONDITION_IP_LOCAL_INTERFACE && value._type == cFWP_UINT64:
+		return Condition{Field: FieldLocalInterface, Match: match, Interface: **(**uint64)(unsafe.Pointer(&value.value))}, true
+	case condition.fieldKey == cFWPM_CONDITION_ALE_APP_ID && value._type == cFWP_BYTE_BLOB_TYPE:
+		blob := *(**wtFwpByteBlob)(unsafe.Pointer(&value.value))
+		id := make([]uint16, blob.size/2)
+		for i := range id {
+			id[i] = binary.LittleEndian.Uint16(unsafe.Slice(blob.data, blob.size)[2*i:])
+		}
+		return Condition{Field: FieldApp, Match: match, App: windows.UTF16ToString(id)}, true
+	}
+	for field, numberField := range numberFields {
+		if condition.fieldKey != numberField.key {
+			continue
+		}
+		c := Condition{Field: field, Match: match}
+		switch value._type {
+		case numberField.dataType:
+			c.setNumber(uint32(value.value))
+			return c, true
+		case cFWP_RANGE_TYPE:
+			r := *(**wtFwpRange0)(unsafe.Pointer(&value.value))
+			if r.valueLow._type == numberField.dataType && r.valueHigh._type == numberField.dataType {
+				c.setNumber(uint32(r.valueLow.value))
+				c.To = uint32(r.valueHigh.value)
+				return c, true
+			}
+		}
+	}
+	return Condition{}, false
+}
+
+// FWP_MATCH_TYPE of each MatchType.
+var matchTypes = map[MatchType]wtFwpMatchType{
+	MatchEqual:        cFWP_MATCH_EQUAL,
+	MatchNotEqual:     cFWP_MATCH_NOT_EQUAL,
+	MatchRange:        cFWP_MATCH_RANGE,
+	MatchPrefix:       cFWP_MATCH_PREFIX,
+	MatchNotPrefix:    cFWP_MATCH_NOT_PREFIX,
+	MatchFlagsAllSet:  cFWP_MATCH_FLAGS_ALL_SET,
+	MatchFlagsAnySet:  cFWP_MATCH_FLAGS_ANY_SET,
+	MatchFlagsNoneSet: cFWP_MATCH_FLAGS_NONE_SET,
+}
+
+// Field key of the address fields.
+var addressFields = map[ConditionField]windows.GUID{
+	FieldRemoteAddress: cFWPM_CONDITION_IP_REMOTE_ADDRESS,
+	FieldLocalAddress:  cFWPM_CONDITION_IP_LOCAL_ADDRESS,
+}
+
+// Field key and data type of the unsigned integer fields.
+var numberFields = map[ConditionField]struct {
+	key      windows.GUID
+	dataType wtFwpDataType
+}{
+	FieldProtocol:   {cFWPM_CONDITION_IP_PROTOCOL, cFWP_UINT8},
+	FieldRemotePort: {cFWPM_CONDITION_IP_REMOTE_PORT, cFWP_UINT16},
+	FieldFlags:      {cFWPM_CONDITION_FLAGS, cFWP_UINT32},
+	FieldEtherType:  {cFWPM_CONDITION_ETHER_TYPE, cFWP_UINT16},
+	FieldL2Flags:    {cFWPM_CONDITION_L2_FLAGS, cFWP_UINT32},
+}
+
+// Field key of the MAC address fields.
+var macFields = map[ConditionField]windows.GUID{
+	FieldLocalMAC:  cFWPM_CONDITION_MAC_LOCAL_ADDRESS,
+	FieldRemoteMAC: cFWPM_CONDITION_MAC_REMOTE_ADDRESS,
+}
+
+/*
+ * appID converts the path of an application to its FWPM_CONDITION_ALE_APP_ID
+ * as FwpmGetAppIdFromFileName0 does, but without the file having to exist,
+ * so that a directory can be given too: the device path in lower case, e.g.
+ * \device\harddiskvolume3\tools\curl.exe for C:\Tools\curl.exe, as a
+ * null-terminated UTF-16 string. A prefix leaves the terminator out, since
+ * the paths it matches go on. Device paths are taken as they are.
+ */
+func appID(path string, prefix bool) ([]byte, error) {
+	if len(path) >= 2 && path[1] == ':' {
+		drive, err := windows.UTF16PtrFromString(path[:2])
+		if err != nil {
+			return nil, err
+		}
+		device := make([]uint16, windows.MAX_PATH)
+
+		// https://learn.microsoft.com/en-us/windows/win32/api/fileapi/nf-fileapi-querydosdevicew
+		if _, err := windows.QueryDosDevice(drive, &device[0], uint32(len(device))); err != nil {
+			return nil, err
+		}
+		path = windows.UTF16ToString(device) + path[2:]
+	}
+	id, err := windows.UTF16FromString(strings.ToLower(path))
+	if err != nil {
+		return nil, err
+	}
+	if prefix {
+		id = id[:len(id)-1]
+	}
+	blob := make([]byte, 0, 2*len(id))
+	for _, c := range id {
+		blob = binary.LittleEndian.AppendUint16(blob, c)
+	}
+	return blob, nil
+}
+
+func (s *wfpSession) BeginTransaction() error {
+	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmtransactionbegin0
+	err := fwpmTransactionBegin0(s.handle, 0)
+	if err != nil {
+		return wfpErr("FwpmTransactionBegin0", "", err)
+	}
+	return nil
+}
+
+func (s *wfpSession) CommitTransaction() error {
+	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmtransactioncommit0
+	err := fwpmTransactionCommit0(s.handle)
+	if err != nil {
+		return wfpErr("FwpmTransactionCommit0", "", err)
+	}
+	return nil
+}
+
+func (s *wfpSession) AbortTransaction() error {
+	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmtransactionabort0
+	err := fwpmTransactionAbort0(s.handle)
+	if err != nil {
+		return wfpErr("FwpmTransactionAbort0", "", err)
+	}
+	return nil
+}
+
+/*
+ * SubscribeNetEvents changes machine-wide engine options, which outlive the
+ * process; those it turns on are turned off again when the source is closed.
+ */
+func (s *wfpSession) SubscribeNetEvents(allow bool) (NetEventSource, error) {
+	var restore []func() error
+	undo, err := enableNetEvents(s.handle)
+	if err != nil {
+		return nil, err
+	}
+	if undo != nil {
+		restore = append(restore, undo)
+	}
+	if allow {
+		undo, err := enableAllowEvents(s.handle)
+		if err != nil {
+			return nil, errors.Join(err, restoreEngineOptions(restore))
+		}
+		if undo != nil {
+			restore = append(restore, undo)
+		}
+	}
+	return subscribeNetEvents(s.handle, restore)
+}
+
+func (s *wfpSession) SubscribeFilterChanges(provider GUID) (FilterChangeSource, error) {
+	return subscribeFilterChanges(s.handle, provider)
+}
+
+func (s *wfpSession) Close() error {
+	// https://learn.microsoft.com/en-us/windows/win32/api/fwpmu/nf-fwpmu-fwpmengineclose0
+	err := FwpmEngineClose0(s.handle)
+	if err != nil {
+		return wfpErr("FwpmEngineClose0", "", err)
+	}
+	return nil
+}
+
+/*
+ * Builds the SEC_WINNT_AUTH_IDENTITY_W for the explicit credentials of remote,
+ * or returns nil to use those of the calling process.
+ */
+func createSecWinNTAuthIdentityW(remote Remote) (*SecWinNTAuthIdentityW, error) {
+	if remote.User == "" {
+		return nil, nil
+	}
+	user, err := windows.UTF16FromString(remote.User)
+	if err != nil {
+		return nil, err
+	}
+	domain, err := windows.UTF16FromString(remote.Domain)
+	if err != nil {
+		return nil, err
+	}
+	password, err := windows.UTF16FromString(remote.Password)
+	if err != nil {
+		return nil, err
+	}
+	return &SecWinNTAuthIdentityW{
+		User:           &user[0],                         // &user[0]: A pointer to the null-terminated user name.
+		UserLength:     uint32(len(user) - 1),            // uint32(len(user) - 1): The length of the user name, without the terminating null.
+		Domain:         &domain[0],                       // &domain[0]: A pointer to the null-terminated domain or workgroup name.
+		DomainLength:   uint32(len(domain) - 1),          // uint32(len(domain) - 1): The length of the domain name, without the terminating null.
+		Password:       &password[0],                     // &password[0]: A pointer to the null-terminated password.
+		PasswordLength: uint32(len(password) - 1),        // uint32(len(password) - 1): The length of the password, without the terminating null.
+		Flags:          cSEC_WINNT_AUTH_IDENTITY_UNICODE, // cSEC_WINNT_AUTH_IDENTITY_UNICODE: The strings are UTF-16.
+	}, nil
+}
+
+func createWtFwpByteBlob(data []byte) wtFwpByteBlob {
+	if len(data) == 0 {
+		return wtFwpByteBlob{}
+	}
+	return wtFwpByteBlob{
+		size: uint32(len(data)), // uint32(len(data)): The number of bytes in the blob.
+		data: &data[0],          // &data[0]: A pointer to the bytes.
+	}
+}
+
+func createWtFwpmDisplayData0(name, description string) (*wtFwpmDisplayData0, error) {
+	return &wtFwpmDisplayData0{
+		name:        windows.StringToUTF16Ptr(name),        // windows.StringToUTF16Ptr(name): A pointer to a null-terminated Unicode string that contains the name of the object.
+		description: windows.StringToUTF16Ptr(description), // windows.StringToUTF16Ptr(description): A pointer to a null-terminated Unicode string that contains the description of the object.
+	}, nil
+}
+
+/*
+ * filterWeight returns the FWP_UINT64 weight of a filter of rank weight. An
+ * FWP_UINT8 weight is a range index, 0 to 15, the engine picking the weight
+ * within the range; rules have up to 256 ranks, so they are given an explicit
+ * 64-bit weight instead, the rank in its high byte, which keeps their order.
+ */
+func filterWeight(weight uint8) uint64 {
+	return uint64(weight) << 56
+}
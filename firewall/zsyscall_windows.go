@@ -39,39 +39,128 @@ func errnoErr(e syscall.Errno) error {
 
 var (
 	modfwpuclnt = windows.NewLazySystemDLL("fwpuclnt.dll")
+	modiphlpapi = windows.NewLazySystemDLL("iphlpapi.dll")
 
-	procFwpmEngineClose0          = modfwpuclnt.NewProc("FwpmEngineClose0")
-	procFwpmEngineOpen0           = modfwpuclnt.NewProc("FwpmEngineOpen0")
-	procFwpmFilterAdd0            = modfwpuclnt.NewProc("FwpmFilterAdd0")
-	procFwpmFreeMemory0           = modfwpuclnt.NewProc("FwpmFreeMemory0")
-	procFwpmGetAppIdFromFileName0 = modfwpuclnt.NewProc("FwpmGetAppIdFromFileName0")
-	procFwpmProviderAdd0          = modfwpuclnt.NewProc("FwpmProviderAdd0")
-	procFwpmSubLayerAdd0          = modfwpuclnt.NewProc("FwpmSubLayerAdd0")
-	procFwpmTransactionAbort0     = modfwpuclnt.NewProc("FwpmTransactionAbort0")
-	procFwpmTransactionBegin0     = modfwpuclnt.NewProc("FwpmTransactionBegin0")
-	procFwpmTransactionCommit0    = modfwpuclnt.NewProc("FwpmTransactionCommit0")
+	procFwpmEngineClose0                  = modfwpuclnt.NewProc("FwpmEngineClose0")
+	procFwpmEngineGetOption0              = modfwpuclnt.NewProc("FwpmEngineGetOption0")
+	procFwpmEngineOpen0                   = modfwpuclnt.NewProc("FwpmEngineOpen0")
+	procFwpmEngineSetOption0              = modfwpuclnt.NewProc("FwpmEngineSetOption0")
+	procFwpmFilterAdd0                    = modfwpuclnt.NewProc("FwpmFilterAdd0")
+	procFwpmFilterCreateEnumHandle0       = modfwpuclnt.NewProc("FwpmFilterCreateEnumHandle0")
+	procFwpmFilterDeleteById0             = modfwpuclnt.NewProc("FwpmFilterDeleteById0")
+	procFwpmFilterDestroyEnumHandle0      = modfwpuclnt.NewProc("FwpmFilterDestroyEnumHandle0")
+	procFwpmFilterEnum0                   = modfwpuclnt.NewProc("FwpmFilterEnum0")
+	procFwpmFilterSetSecurityInfoByKey0   = modfwpuclnt.NewProc("FwpmFilterSetSecurityInfoByKey0")
+	procFwpmFilterSubscribeChanges0       = modfwpuclnt.NewProc("FwpmFilterSubscribeChanges0")
+	procFwpmFilterUnsubscribeChanges0     = modfwpuclnt.NewProc("FwpmFilterUnsubscribeChanges0")
+	procFwpmFreeMemory0                   = modfwpuclnt.NewProc("FwpmFreeMemory0")
+	procFwpmGetAppIdFromFileName0         = modfwpuclnt.NewProc("FwpmGetAppIdFromFileName0")
+	procFwpmNetEventSubscribe0            = modfwpuclnt.NewProc("FwpmNetEventSubscribe0")
+	procFwpmNetEventSubscribe1            = modfwpuclnt.NewProc("FwpmNetEventSubscribe1")
+	procFwpmNetEventUnsubscribe0          = modfwpuclnt.NewProc("FwpmNetEventUnsubscribe0")
+	procFwpmProviderAdd0                  = modfwpuclnt.NewProc("FwpmProviderAdd0")
+	procFwpmProviderSetSecurityInfoByKey0 = modfwpuclnt.NewProc("FwpmProviderSetSecurityInfoByKey0")
+	procFwpmSubLayerAdd0                  = modfwpuclnt.NewProc("FwpmSubLayerAdd0")
+	procFwpmSubLayerSetSecurityInfoByKey0 = modfwpuclnt.NewProc("FwpmSubLayerSetSecurityInfoByKey0")
+	procFwpmTransactionAbort0             = modfwpuclnt.NewProc("FwpmTransactionAbort0")
+	procFwpmTransactionBegin0             = modfwpuclnt.NewProc("FwpmTransactionBegin0")
+	procFwpmTransactionCommit0            = modfwpuclnt.NewProc("FwpmTransactionCommit0")
+	procConvertInterfaceAliasToLuid       = modiphlpapi.NewProc("ConvertInterfaceAliasToLuid")
+	procConvertInterfaceIndexToLuid       = modiphlpapi.NewProc("ConvertInterfaceIndexToLuid")
 )
 
-func FwpmEngineClose0(engineHandle uintptr) (err error) {
-	r1, _, e1 := syscall.Syscall(procFwpmEngineClose0.Addr(), 1, uintptr(engineHandle), 0, 0)
-	if r1 != 0 {
-		err = errnoErr(e1)
+func FwpmEngineClose0(engineHandle uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall(procFwpmEngineClose0.Addr(), 1, uintptr(engineHandle), 0, 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
 	}
 	return
 }
 
-func fwpmEngineOpen0(serverName *uint16, authnService wtRpcCAuthN, authIdentity *uintptr, session *wtFwpmSession0, engineHandle unsafe.Pointer) (err error) {
-	r1, _, e1 := syscall.Syscall6(procFwpmEngineOpen0.Addr(), 5, uintptr(unsafe.Pointer(serverName)), uintptr(authnService), uintptr(unsafe.Pointer(authIdentity)), uintptr(unsafe.Pointer(session)), uintptr(engineHandle), 0)
-	if r1 != 0 {
-		err = errnoErr(e1)
+func fwpmEngineGetOption0(engineHandle uintptr, option wtFwpmEngineOption, value **wtFwpValue0) (ret error) {
+	r0, _, _ := syscall.Syscall(procFwpmEngineGetOption0.Addr(), 3, uintptr(engineHandle), uintptr(option), uintptr(unsafe.Pointer(value)))
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
 	}
 	return
 }
 
-func fwpmFilterAdd0(engineHandle uintptr, filter *wtFwpmFilter0, sd uintptr, id *uint64) (err error) {
-	r1, _, e1 := syscall.Syscall6(procFwpmFilterAdd0.Addr(), 4, uintptr(engineHandle), uintptr(unsafe.Pointer(filter)), uintptr(sd), uintptr(unsafe.Pointer(id)), 0, 0)
-	if r1 != 0 {
-		err = errnoErr(e1)
+func fwpmEngineOpen0(serverName *uint16, authnService wtRpcCAuthN, authIdentity *SecWinNTAuthIdentityW, session *wtFwpmSession0, engineHandle unsafe.Pointer) (ret error) {
+	r0, _, _ := syscall.Syscall6(procFwpmEngineOpen0.Addr(), 5, uintptr(unsafe.Pointer(serverName)), uintptr(authnService), uintptr(unsafe.Pointer(authIdentity)), uintptr(unsafe.Pointer(session)), uintptr(engineHandle), 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmEngineSetOption0(engineHandle uintptr, option wtFwpmEngineOption, newValue *wtFwpValue0) (ret error) {
+	r0, _, _ := syscall.Syscall(procFwpmEngineSetOption0.Addr(), 3, uintptr(engineHandle), uintptr(option), uintptr(unsafe.Pointer(newValue)))
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmFilterAdd0(engineHandle uintptr, filter *wtFwpmFilter0, sd uintptr, id *uint64) (ret error) {
+	r0, _, _ := syscall.Syscall6(procFwpmFilterAdd0.Addr(), 4, uintptr(engineHandle), uintptr(unsafe.Pointer(filter)), uintptr(sd), uintptr(unsafe.Pointer(id)), 0, 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmFilterCreateEnumHandle0(engineHandle uintptr, enumTemplate *wtFwpmFilterEnumTemplate0, enumHandle *uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall(procFwpmFilterCreateEnumHandle0.Addr(), 3, uintptr(engineHandle), uintptr(unsafe.Pointer(enumTemplate)), uintptr(unsafe.Pointer(enumHandle)))
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmFilterDeleteById0(engineHandle uintptr, id uint64) (ret error) {
+	r0, _, _ := syscall.Syscall(procFwpmFilterDeleteById0.Addr(), 2, uintptr(engineHandle), uintptr(id), 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmFilterDestroyEnumHandle0(engineHandle uintptr, enumHandle uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall(procFwpmFilterDestroyEnumHandle0.Addr(), 2, uintptr(engineHandle), uintptr(enumHandle), 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmFilterEnum0(engineHandle uintptr, enumHandle uintptr, numEntriesRequested uint32, entries ***wtFwpmFilter0, numEntriesReturned *uint32) (ret error) {
+	r0, _, _ := syscall.Syscall6(procFwpmFilterEnum0.Addr(), 5, uintptr(engineHandle), uintptr(enumHandle), uintptr(numEntriesRequested), uintptr(unsafe.Pointer(entries)), uintptr(unsafe.Pointer(numEntriesReturned)), 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmFilterSetSecurityInfoByKey0(engineHandle uintptr, key *windows.GUID, securityInfo uint32, sidOwner uintptr, sidGroup uintptr, dacl uintptr, sacl uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall9(procFwpmFilterSetSecurityInfoByKey0.Addr(), 7, uintptr(engineHandle), uintptr(unsafe.Pointer(key)), uintptr(securityInfo), uintptr(sidOwner), uintptr(sidGroup), uintptr(dacl), uintptr(sacl), 0, 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmFilterSubscribeChanges0(engineHandle uintptr, subscription *wtFwpmFilterSubscription0, callback uintptr, context uintptr, changeHandle *uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall6(procFwpmFilterSubscribeChanges0.Addr(), 5, uintptr(engineHandle), uintptr(unsafe.Pointer(subscription)), uintptr(callback), uintptr(context), uintptr(unsafe.Pointer(changeHandle)), 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmFilterUnsubscribeChanges0(engineHandle uintptr, changeHandle uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall(procFwpmFilterUnsubscribeChanges0.Addr(), 2, uintptr(engineHandle), uintptr(changeHandle), 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
 	}
 	return
 }
@@ -81,50 +170,106 @@ func fwpmFreeMemory0(p unsafe.Pointer) {
 	return
 }
 
-func fwpmGetAppIdFromFileName0(fileName *uint16, appID unsafe.Pointer) (err error) {
-	r1, _, e1 := syscall.Syscall(procFwpmGetAppIdFromFileName0.Addr(), 2, uintptr(unsafe.Pointer(fileName)), uintptr(appID), 0)
-	if r1 != 0 {
-		err = errnoErr(e1)
+func fwpmGetAppIdFromFileName0(fileName *uint16, appID unsafe.Pointer) (ret error) {
+	r0, _, _ := syscall.Syscall(procFwpmGetAppIdFromFileName0.Addr(), 2, uintptr(unsafe.Pointer(fileName)), uintptr(appID), 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmNetEventSubscribe0(engineHandle uintptr, subscription *wtFwpmNetEventSubscription0, callback uintptr, context uintptr, eventsHandle *uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall6(procFwpmNetEventSubscribe0.Addr(), 5, uintptr(engineHandle), uintptr(unsafe.Pointer(subscription)), uintptr(callback), uintptr(context), uintptr(unsafe.Pointer(eventsHandle)), 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmNetEventSubscribe1(engineHandle uintptr, subscription *wtFwpmNetEventSubscription0, callback uintptr, context uintptr, eventsHandle *uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall6(procFwpmNetEventSubscribe1.Addr(), 5, uintptr(engineHandle), uintptr(unsafe.Pointer(subscription)), uintptr(callback), uintptr(context), uintptr(unsafe.Pointer(eventsHandle)), 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmNetEventUnsubscribe0(engineHandle uintptr, eventsHandle uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall(procFwpmNetEventUnsubscribe0.Addr(), 2, uintptr(engineHandle), uintptr(eventsHandle), 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmProviderAdd0(engineHandle uintptr, provider *wtFwpmProvider0, sd uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall(procFwpmProviderAdd0.Addr(), 3, uintptr(engineHandle), uintptr(unsafe.Pointer(provider)), uintptr(sd))
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmProviderSetSecurityInfoByKey0(engineHandle uintptr, key *windows.GUID, securityInfo uint32, sidOwner uintptr, sidGroup uintptr, dacl uintptr, sacl uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall9(procFwpmProviderSetSecurityInfoByKey0.Addr(), 7, uintptr(engineHandle), uintptr(unsafe.Pointer(key)), uintptr(securityInfo), uintptr(sidOwner), uintptr(sidGroup), uintptr(dacl), uintptr(sacl), 0, 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmSubLayerAdd0(engineHandle uintptr, subLayer *wtFwpmSublayer0, sd uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall(procFwpmSubLayerAdd0.Addr(), 3, uintptr(engineHandle), uintptr(unsafe.Pointer(subLayer)), uintptr(sd))
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func fwpmSubLayerSetSecurityInfoByKey0(engineHandle uintptr, key *windows.GUID, securityInfo uint32, sidOwner uintptr, sidGroup uintptr, dacl uintptr, sacl uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall9(procFwpmSubLayerSetSecurityInfoByKey0.Addr(), 7, uintptr(engineHandle), uintptr(unsafe.Pointer(key)), uintptr(securityInfo), uintptr(sidOwner), uintptr(sidGroup), uintptr(dacl), uintptr(sacl), 0, 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
 	}
 	return
 }
 
-func fwpmProviderAdd0(engineHandle uintptr, provider *wtFwpmProvider0, sd uintptr) (err error) {
-	r1, _, e1 := syscall.Syscall(procFwpmProviderAdd0.Addr(), 3, uintptr(engineHandle), uintptr(unsafe.Pointer(provider)), uintptr(sd))
-	if r1 != 0 {
-		err = errnoErr(e1)
+func fwpmTransactionAbort0(engineHandle uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall(procFwpmTransactionAbort0.Addr(), 1, uintptr(engineHandle), 0, 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
 	}
 	return
 }
 
-func fwpmSubLayerAdd0(engineHandle uintptr, subLayer *wtFwpmSublayer0, sd uintptr) (err error) {
-	r1, _, e1 := syscall.Syscall(procFwpmSubLayerAdd0.Addr(), 3, uintptr(engineHandle), uintptr(unsafe.Pointer(subLayer)), uintptr(sd))
-	if r1 != 0 {
-		err = errnoErr(e1)
+func fwpmTransactionBegin0(engineHandle uintptr, flags uint32) (ret error) {
+	r0, _, _ := syscall.Syscall(procFwpmTransactionBegin0.Addr(), 2, uintptr(engineHandle), uintptr(flags), 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
 	}
 	return
 }
 
-func fwpmTransactionAbort0(engineHandle uintptr) (err error) {
-	r1, _, e1 := syscall.Syscall(procFwpmTransactionAbort0.Addr(), 1, uintptr(engineHandle), 0, 0)
-	if r1 != 0 {
-		err = errnoErr(e1)
+func fwpmTransactionCommit0(engineHandle uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall(procFwpmTransactionCommit0.Addr(), 1, uintptr(engineHandle), 0, 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
 	}
 	return
 }
 
-func fwpmTransactionBegin0(engineHandle uintptr, flags uint32) (err error) {
-	r1, _, e1 := syscall.Syscall(procFwpmTransactionBegin0.Addr(), 2, uintptr(engineHandle), uintptr(flags), 0)
-	if r1 != 0 {
-		err = errnoErr(e1)
+func convertInterfaceAliasToLuid(alias *uint16, luid *uint64) (ret error) {
+	r0, _, _ := syscall.Syscall(procConvertInterfaceAliasToLuid.Addr(), 2, uintptr(unsafe.Pointer(alias)), uintptr(unsafe.Pointer(luid)), 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
 	}
 	return
 }
 
-func fwpmTransactionCommit0(engineHandle uintptr) (err error) {
-	r1, _, e1 := syscall.Syscall(procFwpmTransactionCommit0.Addr(), 1, uintptr(engineHandle), 0, 0)
-	if r1 != 0 {
-		err = errnoErr(e1)
+func convertInterfaceIndexToLuid(index uint32, luid *uint64) (ret error) {
+	r0, _, _ := syscall.Syscall(procConvertInterfaceIndexToLuid.Addr(), 2, uintptr(index), uintptr(unsafe.Pointer(luid)), 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
 	}
 	return
 }
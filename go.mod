@@ -2,4 +2,4 @@ module prg
 
 go 1.24.0
 
-require golang.org/x/sys v0.30.0 // indirect
+require golang.org/x/sys v0.30.0
@@ -1,77 +1,1049 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"os/user"
 	"prg/firewall"
+	"slices"
+	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// How often the audit report is written to disk while running.
+const auditSaveInterval = 10 * time.Minute
+
+// Environment variable holding the password of -user, so that it does not show
+// up in the process list.
+const passwordEnv = "WFP_PASSWORD"
+
+// Exit codes
+const (
+	exitOK         = 0 // All rules applied.
+	exitError      = 1 // Setup or WFP session failure.
+	exitUsage      = 2 // Invalid flags or CIDRs; nothing was applied.
+	exitPartial    = 3 // -on-error=continue and some rules failed.
+	exitRolledBack = 4 // -on-error=abort and a rule failed; nothing was applied.
+	exitTestFailed = 5 // test found cases whose verdict is not the expected one.
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run does the work of main, returning the exit code instead of exiting, so
+// that deferred cleanup (closing the WFP session, saving reports) always runs.
+func run() int {
 	// Define command line flags
 	permitFlag := flag.Bool("permit", false, "Permit traffic for specified CIDRs")
 	blockFlag := flag.Bool("block", false, "Block traffic for specified CIDRs")
+	logDropsFlag := flag.Bool("log-drops", false, "Log packets dropped by WFP, correlated with the rules added by this program")
+	auditFlag := flag.Bool("audit", false, "Do not enforce -block rules; log and report the traffic they would have blocked")
+	auditReportFlag := flag.String("audit-report", "", "File where the audit report is accumulated across runs")
+	auditSummaryFlag := flag.String("audit-summary", "", "Print the summary of an audit report file and exit")
+	metricsAddrFlag := flag.String("metrics-addr", "", "Serve Prometheus metrics on this address (e.g. :9100) at /metrics")
+	logFormatFlag := flag.String("log-format", "text", "Log output format: text or json")
+	logLevelFlag := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	hostFlag := flag.String("host", "", "Manage the WFP engine of this remote machine instead of the local one")
+	userFlag := flag.String("user", "", `Account used on -host, as DOMAIN\user or user@domain; the password is read from `+passwordEnv)
+	authFlag := flag.String("auth", "", "RPC authentication for -host: winnt (NTLM, default) or default (negotiate)")
+	credentialsFlag := flag.String("credentials", "", "JSON file with host, user, password and auth, overridden by the flags")
+	groupFlag := flag.String("group", "", "Put the rules in this named group")
+	replaceFlag := flag.Bool("replace", false, "With -group, replace the current rules of the group instead of adding to them")
+	persistentFlag := flag.Bool("persistent", false, "Keep the rules after the program exits, until deleted with the group command")
+	ttlFlag := flag.Duration("ttl", 0, "Record in the rules that they expire after this long (e.g. 72h); shown by list")
+	tagsFlag := flag.String("tags", "", "Comma-separated tags recorded in the rules")
+	onErrorFlag := flag.String("on-error", "abort", "When a rule fails: abort (roll back every rule) or continue (keep the others)")
+	aggregateFlag := flag.Bool("aggregate", false, "Merge adjacent and nested CIDRs of the same action and group into fewer filters")
+	policyFlag := flag.String("policy", "", "JSON policy file with the rules to apply, instead of -permit/-block CIDRs; also read by explain")
+	protoFlag := flag.String("proto", "", "Only match these comma-separated protocols (tcp, udp, icmp, icmpv6 or numbers)")
+	portFlag := flag.String("port", "", "Only match these comma-separated remote ports; needs -proto tcp and/or udp")
+	directionFlag := flag.String("direction", "outbound", "Match traffic in this direction: outbound, inbound, or both (a filter each)")
+	vm2vmFlag := flag.String("vm2vm", "", "Match Ethernet frames between Hyper-V virtual machines (only) or the others (exclude); needs no CIDR")
+	dryRunFlag := flag.Bool("dry-run", false, "Print the filters the rules would add, with their conditions, without touching WFP")
+	var matchFlags []string
+	flag.Func("match", "Only match traffic satisfying this condition, e.g. remote_port!=53 or app^=C:\\Tools\\; repeatable", func(s string) error {
+		matchFlags = append(matchFlags, s)
+		return nil
+	})
+	dnsServerFlag := flag.String("dns-server", "", "Resolve hostname rules with this DNS server (ADDR or ADDR:PORT) instead of the system resolver")
+	dnsRefreshFlag := flag.Duration("dns-refresh", 0, "Resolve hostname rules again at this interval instead of when their TTL expires")
+	tamperFlag := flag.String("tamper", "", "Watch the applied rules for deletions and replacements by others: alert, or repair (re-apply them and alert)")
+	tamperIntervalFlag := flag.Duration("tamper-interval", time.Minute, "With -tamper, check the rules at this interval besides when WFP notifies a change")
+	sddlFlag := flag.String("sddl", "", "Security descriptor of the provider, sublayers and filters, in SDDL, e.g. O:BAG:BAD:P(A;;GA;;;SID)(A;;GRGX;;;BA)")
+	sdPrincipalFlag := flag.String("sd-principal", "", "Let only this principal change or delete the rules: a SID or NT SERVICE\\NAME; administrators can only read them, and unlock them")
 	flag.Parse()
 
-	// Check if at least one CIDR is provided as argument
-	if flag.NArg() < 1 {
-		log.Fatal("Usage: program [-permit|-block] CIDR1 [CIDR2 CIDR3 ...]")
+	// Set up logging for both the program and the firewall package
+	logger, err := newLogger(*logFormatFlag, *logLevelFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	slog.SetDefault(logger)
+	firewall.SetLogger(logger)
+
+	// Print an audit summary
+	if *auditSummaryFlag != "" {
+		report, err := firewall.LoadAuditReport(*auditSummaryFlag)
+		if err != nil {
+			logger.Error("failed to load audit report", "path", *auditSummaryFlag, firewall.ErrAttr(err))
+			return exitError
+		}
+		if err := report.WriteSummary(os.Stdout); err != nil {
+			logger.Error("failed to print audit summary", firewall.ErrAttr(err))
+			return exitError
+		}
+		return exitOK
 	}
 
-	// Get CIDRs from arguments
-	cidrs := flag.Args()
+	// Select the engine to manage
+	remote, err := remoteFromFlags(*credentialsFlag, *hostFlag, *userFlag, *authFlag)
+	if err != nil {
+		logger.Error("invalid remote engine options", firewall.ErrAttr(err))
+		return exitUsage
+	}
 
-	// Check if exactly one flag is specified
-	if (*permitFlag && *blockFlag) || (!*permitFlag && !*blockFlag) {
-		log.Fatal("Exactly one flag (-permit or -block) must be specified")
+	// Commands working on a policy file, without touching WFP
+	switch flag.Arg(0) {
+	case "explain":
+		return runExplain(logger, *policyFlag, flag.Args()[1:])
+	case "test":
+		return runTest(logger, *policyFlag, flag.Args()[1:])
+	case "analyze":
+		return runAnalyze(logger, *policyFlag)
+	}
+
+	// Commands managing the persistent rules
+	switch flag.Arg(0) {
+	case "list":
+		return runList(logger, remote)
+	case "group":
+		return runGroup(logger, remote, flag.Args()[1:])
+	case "unlock":
+		return runUnlock(logger, remote)
 	}
 
-	// Create WFP session
-	session, err := firewall.CreateWfpSession()
+	// Check if at least one CIDR is provided as argument
+	if *policyFlag == "" && flag.NArg() < 1 && *vm2vmFlag == "" {
+		logger.Error("usage: program [-permit|-block] [-audit] [-dry-run] [-persistent] [-group NAME [-replace]] [-on-error abort|continue] [-direction outbound|inbound|both] [-proto PROTOS [-port PORTS]] [-match COND]... [-vm2vm only|exclude] [-dns-server ADDR] [-dns-refresh DURATION] [-tamper alert|repair] [-sddl SDDL|-sd-principal PRINCIPAL] CIDR1|HOST1|MAC1 [except CIDR,...] [CIDR2|HOST2|MAC2 ...] | [-dry-run] -policy FILE | list | group enable|disable|delete NAME | unlock | -policy FILE explain [flags] ADDR[:PORT] | -policy FILE test [-v] CASES... | -policy FILE analyze")
+		return exitUsage
+	}
+
+	// Check if exactly one flag is specified
+	if *policyFlag != "" {
+		if *permitFlag || *blockFlag || flag.NArg() > 0 {
+			logger.Error("-policy cannot be used with -permit, -block or CIDR arguments")
+			return exitUsage
+		}
+		if *auditFlag {
+			logger.Error("-audit cannot be used with -policy")
+			return exitUsage
+		}
+		if *protoFlag != "" || *portFlag != "" || matchFlags != nil || *directionFlag != "outbound" || *vm2vmFlag != "" {
+			logger.Error("-proto, -port, -match, -direction and -vm2vm cannot be used with -policy, whose rules have their own")
+			return exitUsage
+		}
+	} else if (*permitFlag && *blockFlag) || (!*permitFlag && !*blockFlag) {
+		logger.Error("exactly one flag (-permit or -block) must be specified")
+		return exitUsage
+	}
+	if *auditFlag && !*blockFlag {
+		logger.Error("-audit can only be used with -block")
+		return exitUsage
+	}
+	if *auditFlag && (*protoFlag != "" || *portFlag != "" || matchFlags != nil || *directionFlag != "outbound") {
+		logger.Error("-audit only evaluates outbound addresses, it cannot be used with -proto, -port, -match or -direction")
+		return exitUsage
+	}
+	if *tamperFlag != "" && *tamperFlag != "alert" && *tamperFlag != "repair" {
+		logger.Error("invalid -tamper: must be alert or repair", "tamper", *tamperFlag)
+		return exitUsage
+	}
+	if *tamperFlag != "" && (*auditFlag || *dryRunFlag) {
+		logger.Error("-tamper watches the filters added, it cannot be used with -audit or -dry-run")
+		return exitUsage
+	}
+	sd, err := securityFromFlags(*sddlFlag, *sdPrincipalFlag)
 	if err != nil {
-		log.Fatalf("Failed to create WFP session: %v", err)
+		logger.Error("invalid security descriptor", firewall.ErrAttr(err))
+		return exitUsage
+	}
+	if sd != nil && (*auditFlag || *dryRunFlag) {
+		logger.Error("-sddl and -sd-principal protect the filters added, they cannot be used with -audit or -dry-run")
+		return exitUsage
+	}
+	if *auditFlag && *dryRunFlag {
+		logger.Error("-audit adds no filters, it cannot be used with -dry-run")
+		return exitUsage
 	}
-	defer func() {
-		if err := firewall.FwpmEngineClose0(session); err != nil {
-			log.Printf("Warning: Failed to close WFP session: %v", err)
+	if *auditFlag && (*persistentFlag || *replaceFlag) {
+		logger.Error("-audit adds no filters, it cannot be used with -persistent or -replace")
+		return exitUsage
+	}
+	if *replaceFlag && *groupFlag == "" {
+		logger.Error("-replace requires -group")
+		return exitUsage
+	}
+	if *directionFlag != "outbound" && *directionFlag != "inbound" && *directionFlag != "both" {
+		logger.Error("invalid -direction: must be outbound, inbound or both", "direction", *directionFlag)
+		return exitUsage
+	}
+	onError, err := firewall.ParseOnError(*onErrorFlag)
+	if err != nil {
+		logger.Error("invalid -on-error", firewall.ErrAttr(err))
+		return exitUsage
+	}
+
+	// Validate every CIDR before touching WFP
+	var specs []firewall.RuleSpec
+	if *policyFlag != "" {
+		specs, err = loadPolicySpecs(*policyFlag)
+		if err != nil {
+			logger.Error("invalid policy, nothing applied", "path", *policyFlag, firewall.ErrAttr(err))
+			return exitUsage
+		}
+		for i := range specs {
+			if specs[i].Group == "" {
+				specs[i].Group = *groupFlag
+			}
+		}
+	} else {
+		action := "block"
+		if *permitFlag {
+			action = "permit"
+		}
+		if flag.NArg() > 0 {
+			specs, err = firewall.ParseRuleSpecs(action, *groupFlag, flag.Args())
+			if err != nil {
+				logger.Error("invalid CIDR arguments, nothing applied", firewall.ErrAttr(err))
+				return exitUsage
+			}
+		} else {
+			// -vm2vm alone: one rule on every Ethernet frame it matches.
+			specs = []firewall.RuleSpec{{Action: action, Group: *groupFlag}}
+		}
+		constraints, err := firewall.ParseConstraints(*protoFlag, *portFlag, matchFlags...)
+		if err != nil {
+			logger.Error("invalid -proto, -port or -match, nothing applied", firewall.ErrAttr(err))
+			return exitUsage
+		}
+		if *vm2vmFlag != "" {
+			vm2vm, err := firewall.ParseVM2VM(*vm2vmFlag)
+			if err != nil {
+				logger.Error("invalid -vm2vm, nothing applied", firewall.ErrAttr(err))
+				return exitUsage
+			}
+			constraints = append(constraints, vm2vm)
+		}
+		directions := []string{*directionFlag}
+		if *directionFlag == "both" {
+			directions = []string{"outbound", "inbound"}
+		}
+		var directed []firewall.RuleSpec
+		var errs []error
+		for i, spec := range specs {
+			// The condition of a MAC address argument comes first.
+			spec.Conditions = append(slices.Clip(spec.Conditions), constraints...)
+			for _, direction := range directions {
+				spec.Direction = direction
+				if err := spec.Validate(); err != nil {
+					errs = append(errs, fmt.Errorf("rule %d: %w", i+1, err))
+					break
+				}
+				directed = append(directed, spec)
+			}
+			if *auditFlag && spec.Host == "" && len(spec.Networks()) == 0 {
+				errs = append(errs, fmt.Errorf("rule %d: -audit only evaluates addresses, it cannot be used with MAC addresses", i+1))
+			}
+		}
+		if len(errs) > 0 {
+			logger.Error("invalid rules, nothing applied", firewall.ErrAttr(errors.Join(errs...)))
+			return exitUsage
 		}
-	}()
+		specs = directed
+	}
+	source := "cli"
+	if *policyFlag != "" {
+		source = "policy:" + *policyFlag
+	}
+	meta := ruleMetadata(specs, source, *ttlFlag, *tagsFlag)
+	for i := range specs {
+		specs[i].Meta = meta
+	}
+	specs = firewall.ExpandExceptions(specs)
+	if *aggregateFlag {
+		aggregation, err := firewall.Aggregate(specs)
+		if err != nil {
+			logger.Error("failed to aggregate rules", firewall.ErrAttr(err))
+			return exitError
+		}
+		logger.Info("rules aggregated", "before", aggregation.Before, "after", aggregation.After, "address_conditions", aggregation.Ranges)
+		specs = aggregation.Specs
+	}
 
-	// Register base objects
-	baseObjects, err := firewall.RegisterBaseObjects(session)
+	// Hostname rules get their filters once resolved, the others right away
+	var hostSpecs, staticSpecs []firewall.RuleSpec
+	for _, spec := range specs {
+		if spec.Host != "" {
+			hostSpecs = append(hostSpecs, spec)
+		} else {
+			staticSpecs = append(staticSpecs, spec)
+		}
+	}
+	specs = staticSpecs
+	if *auditFlag && len(hostSpecs) > 0 {
+		logger.Error("-audit cannot be used with hostnames")
+		return exitUsage
+	}
+	if *dryRunFlag {
+		return runDryRun(logger, specs, hostSpecs, onError)
+	}
+	resolver, err := newResolver(*dnsServerFlag)
 	if err != nil {
-		log.Fatalf("Failed to register base objects: %v", err)
+		logger.Error("invalid -dns-server", firewall.ErrAttr(err))
+		return exitUsage
 	}
 
-	// Apply rules for each CIDR
-	for i, cidr := range cidrs {
-		// Use index as part of weight to ensure unique rules
-		weight := uint8(10 + i)
+	// Open the WFP engine
+	ctx := context.Background()
+	engine, err := openEngine(ctx, remote, *persistentFlag, sd)
+	if err != nil {
+		logger.Error("failed to open WFP engine", "host", remote.Host, firewall.ErrAttr(err))
+		return exitError
+	}
+	defer closeEngine(engine)
 
-		if *permitFlag {
-			err = firewall.PermitCIDR(session, baseObjects, weight, cidr)
+	// Protect the rules of earlier runs too, new ones get the descriptor when added
+	if sd != nil && *persistentFlag {
+		n, err := engine.SetSecurity(ctx, sd)
+		if err != nil {
+			logger.Error("failed to set the security descriptor of the persistent rules", "rules", n, firewall.ErrAttr(err))
+			return exitError
+		}
+		logger.Debug("security descriptor set on the persistent rules", "rules", n)
+	}
+
+	// Keep track of the filters we add, so that net events can be matched to rules
+	rules := firewall.NewRuleIndex()
+
+	// Expose metrics
+	metrics := firewall.NewMetrics(rules)
+	if *metricsAddrFlag != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			if err := http.ListenAndServe(*metricsAddrFlag, mux); err != nil {
+				logger.Error("failed to serve metrics", "addr", *metricsAddrFlag, firewall.ErrAttr(err))
+			}
+		}()
+	}
+
+	// In audit mode, block rules are evaluated against allowed traffic instead of being added
+	var auditor *firewall.Auditor
+	if *auditFlag {
+		report := firewall.NewAuditReport()
+		if *auditReportFlag != "" {
+			report, err = firewall.LoadAuditReport(*auditReportFlag)
 			if err != nil {
-				log.Fatalf("Failed to add permit rule for %s: %v", cidr, err)
+				logger.Error("failed to load audit report", "path", *auditReportFlag, firewall.ErrAttr(err))
+				return exitError
+			}
+		}
+		auditor = &firewall.Auditor{Report: report, Logger: logger}
+	}
+
+	// Apply rules; in audit mode they are only evaluated against allowed traffic
+	exitCode := exitOK
+	var reconciler *firewall.Reconciler
+	if auditor != nil {
+		for _, spec := range specs {
+			for _, network := range spec.Networks() {
+				rule, err := firewall.NewAuditRule(spec.Weight, network.String())
+				if err != nil {
+					logger.Error("failed to add audit rule", "cidr", network.String(), firewall.ErrAttr(err))
+					return exitError
+				}
+				auditor.Rules = append(auditor.Rules, rule)
+				auditor.Report.Track(rule)
+				logger.Info("audit rule added, not enforced", "rule", rule.Name, "cidr", rule.Network.String(), "layer", rule.Layer)
 			}
-			fmt.Printf("Permit rule for %s successfully added\n", cidr)
+		}
+	} else {
+		applyStart := time.Now()
+		var summary *firewall.ApplySummary
+		batch := make([]firewall.Rule, len(specs))
+		for i, spec := range specs {
+			batch[i] = spec.Rule()
+		}
+		if *replaceFlag {
+			summary, err = engine.ReplaceGroup(ctx, *groupFlag, batch, onError)
 		} else {
-			err = firewall.BlockCIDR(session, baseObjects, weight, cidr)
-			if err != nil {
-				log.Fatalf("Failed to add block rule for %s: %v", cidr, err)
+			summary, err = engine.Apply(ctx, batch, onError)
+		}
+		metrics.ObserveApply(time.Since(applyStart))
+		exitCode = logApplySummary(logger, summary, onError, err)
+		if exitCode == exitRolledBack || exitCode == exitError {
+			return exitCode
+		}
+		if *tamperFlag != "" {
+			var applied []firewall.RuleInfo
+			for _, result := range summary.Results {
+				if result.Err == nil {
+					applied = append(applied, result.Rule)
+				}
+			}
+			reconciler = firewall.NewReconciler(engine, applied)
+			reconciler.Repair = *tamperFlag == "repair"
+			reconciler.Interval = *tamperIntervalFlag
+			reconciler.Rules = rules
+			reconciler.Metrics = metrics
+		}
+
+		// Index what is in WFP, which in persistent mode includes earlier runs
+		installed, err := engine.List(ctx)
+		if err != nil {
+			logger.Warn("failed to list installed rules", firewall.ErrAttr(err))
+			for _, result := range summary.Results {
+				if result.Err == nil {
+					rules.Add(result.Rule)
+				}
 			}
-			fmt.Printf("Block rule for %s successfully added\n", cidr)
+		} else {
+			infos := make([]firewall.RuleInfo, len(installed))
+			for i, rule := range installed {
+				infos[i] = rule.Info()
+			}
+			rules.Set(infos)
+		}
+	}
+
+	// Resolve the hostname rules; they are kept up to date while running
+	var hostRules *firewall.HostRules
+	if len(hostSpecs) > 0 {
+		hostRules = firewall.NewHostRules(engine, resolver, hostSpecs)
+		hostRules.Interval = *dnsRefreshFlag
+		hostRules.Rules = rules
+		hostRules.Metrics = metrics
+		if err := hostRules.Refresh(ctx); err != nil && exitCode == exitOK {
+			exitCode = exitPartial
 		}
 	}
 
-	fmt.Println("Rules will remain active until termination signal is received")
+	// Persistent rules stay in place: only wait when there is something to do meanwhile
+	if *persistentFlag && !*logDropsFlag && *metricsAddrFlag == "" && hostRules == nil && reconciler == nil {
+		logger.Info("persistent rules applied", "rules", len(rules.Rules()), "host", remote.Host)
+		return exitCode
+	}
+
+	// Subscribe to net events for drop logging and auditing
+	var handlers []firewall.NetEventHandler
+	if *logDropsFlag {
+		handlers = append(handlers, &firewall.DropLogger{Rules: rules, Logger: logger})
+	}
+	if auditor != nil {
+		handlers = append(handlers, auditor)
+	}
+	if len(handlers) > 0 {
+		// Drop counts are exported whenever events are being collected anyway
+		if *metricsAddrFlag != "" {
+			handlers = append(handlers, metrics)
+		}
+		events, err := engine.SubscribeNetEvents(ctx, auditor != nil)
+		if err != nil {
+			logger.Error("failed to subscribe to net events", firewall.ErrAttr(err))
+			return exitError
+		}
+		defer events.Close()
+
+		go firewall.DispatchNetEvents(ctx, events, handlers...)
+	}
+
+	// Periodically persist the audit report, and write it one last time on exit
+	if auditor != nil && *auditReportFlag != "" {
+		go func() {
+			for range time.Tick(auditSaveInterval) {
+				if err := auditor.Report.Save(*auditReportFlag); err != nil {
+					logger.Warn("failed to save audit report", "path", *auditReportFlag, firewall.ErrAttr(err))
+				}
+			}
+		}()
+		defer func() {
+			if err := auditor.Report.Save(*auditReportFlag); err != nil {
+				logger.Warn("failed to save audit report", "path", *auditReportFlag, firewall.ErrAttr(err))
+			}
+		}()
+	}
+
+	if hostRules != nil {
+		refreshCtx, stopRefresh := context.WithCancel(ctx)
+		defer stopRefresh()
+		go hostRules.Run(refreshCtx)
+	}
+
+	// Watch the rules for tampering; the subscription is closed before the engine
+	if reconciler != nil {
+		watchCtx, stopWatch := context.WithCancel(ctx)
+		watchDone := make(chan struct{})
+		go func() {
+			reconciler.Run(watchCtx)
+			close(watchDone)
+		}()
+		defer func() {
+			stopWatch()
+			<-watchDone
+		}()
+	}
+
+	logger.Info("rules will remain active until termination signal is received", "rules", len(rules.Rules()), "host", remote.Host)
 
 	// Wait for termination signal
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	fmt.Println("Waiting for termination signal...")
-	<-sigs
-	fmt.Println("Termination signal received.")
+	sig := <-sigs
+	logger.Info("termination signal received", "signal", sig.String())
+
+	if auditor != nil {
+		if err := auditor.Report.WriteSummary(os.Stdout); err != nil {
+			logger.Error("failed to print audit summary", firewall.ErrAttr(err))
+			exitCode = exitError
+		}
+	}
+
+	return exitCode
+}
+
+// newResolver returns the resolver of hostname rules: the system one, or a
+// DNS server given as ADDR or ADDR:PORT.
+func newResolver(server string) (firewall.Resolver, error) {
+	if server == "" {
+		return firewall.SystemResolver{}, nil
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		if _, err := netip.ParseAddr(server); err != nil {
+			return nil, fmt.Errorf("%q is neither ADDR nor ADDR:PORT", server)
+		}
+		server = net.JoinHostPort(server, "53")
+	}
+	return firewall.DNSResolver{Server: server}, nil
+}
+
+// ruleMetadata is what is recorded in the filters added from the command line
+// or a policy file, as told by source.
+func ruleMetadata(specs []firewall.RuleSpec, source string, ttl time.Duration, tags string) firewall.RuleMetadata {
+	meta := firewall.RuleMetadata{
+		Source:     source,
+		Owner:      owner(),
+		Created:    time.Now().UTC(),
+		PolicyHash: firewall.PolicyHash(specs),
+	}
+	if ttl > 0 {
+		meta.Expires = meta.Created.Add(ttl)
+	}
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			meta.Tags = append(meta.Tags, tag)
+		}
+	}
+	return meta
+}
+
+// owner returns user@host for the current process, as far as it is known.
+func owner() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return name + "@" + host
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+// openEngine opens the engine to manage, the persistent rules if persistent is
+// set. Its objects and filters get sd, unless nil.
+func openEngine(ctx context.Context, remote firewall.Remote, persistent bool, sd firewall.SecurityDescriptor) (*firewall.Engine, error) {
+	opts := []firewall.Option{firewall.WithRemote(remote)}
+	if persistent {
+		opts = append(opts, firewall.WithPersistence())
+	}
+	if sd != nil {
+		opts = append(opts, firewall.WithSecurityDescriptor(sd))
+	}
+	return firewall.Open(ctx, opts...)
+}
+
+// securityFromFlags returns the security descriptor of -sddl or -sd-principal,
+// nil if neither is set.
+func securityFromFlags(sddl, principal string) (firewall.SecurityDescriptor, error) {
+	switch {
+	case sddl != "" && principal != "":
+		return nil, fmt.Errorf("-sddl and -sd-principal cannot be used together")
+	case principal != "":
+		sid, err := firewall.ParsePrincipal(principal)
+		if err != nil {
+			return nil, err
+		}
+		sddl = firewall.ProtectedSDDL(sid)
+	case sddl == "":
+		return nil, nil
+	}
+	return firewall.ParseSDDL(sddl)
+}
+
+func closeEngine(engine *firewall.Engine) {
+	if err := engine.Close(); err != nil {
+		slog.Warn("failed to close WFP engine", firewall.ErrAttr(err))
+	}
+}
+
+// runList prints the persistent rules, with their group and state.
+func runList(logger *slog.Logger, remote firewall.Remote) int {
+	ctx := context.Background()
+	engine, err := openEngine(ctx, remote, true, nil)
+	if err != nil {
+		logger.Error("failed to open WFP engine", "host", remote.Host, firewall.ErrAttr(err))
+		return exitError
+	}
+	defer closeEngine(engine)
+
+	rules, err := engine.List(ctx)
+	if err != nil {
+		logger.Error("failed to list rules", firewall.ErrAttr(err))
+		return exitError
+	}
+
+	if err := writeRules(os.Stdout, rules); err != nil {
+		logger.Error("failed to print rules", firewall.ErrAttr(err))
+		return exitError
+	}
+	return exitOK
+}
+
+/*
+ * runDryRun applies the rules to an engine in memory rather than WFP, and
+ * prints the filters they add like list, conditions included. Hostname rules
+ * have no filters until resolved, so they are only counted.
+ */
+func runDryRun(logger *slog.Logger, specs, hostSpecs []firewall.RuleSpec, onError firewall.OnError) int {
+	ctx := context.Background()
+	engine, err := firewall.Open(ctx, firewall.WithBackend(firewall.NewMemoryBackend()))
+	if err != nil {
+		logger.Error("failed to open the engine in memory", firewall.ErrAttr(err))
+		return exitError
+	}
+	defer closeEngine(engine)
+
+	batch := make([]firewall.Rule, len(specs))
+	for i, spec := range specs {
+		batch[i] = spec.Rule()
+	}
+	summary, err := engine.Apply(ctx, batch, onError)
+	if exitCode := logApplySummary(logger, summary, onError, err); exitCode == exitRolledBack || exitCode == exitError {
+		return exitCode
+	}
+	if len(hostSpecs) > 0 {
+		logger.Info("hostname rules not shown, they get their filters once resolved", "rules", len(hostSpecs))
+	}
+
+	rules, err := engine.List(ctx)
+	if err != nil {
+		logger.Error("failed to list rules", firewall.ErrAttr(err))
+		return exitError
+	}
+	if err := writeRules(os.Stdout, rules); err != nil {
+		logger.Error("failed to print rules", firewall.ErrAttr(err))
+		return exitError
+	}
+	return exitOK
+}
+
+// writeRules writes rules as a table, with their group and state.
+func writeRules(out io.Writer, rules []firewall.Rule) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FILTER ID\tGROUP\tSTATE\tACTION\tCIDR\tCONDITIONS\tLAYER\tWEIGHT\tSOURCE\tOWNER\tCREATED\tEXPIRES\tTAGS\tRULE")
+	now := time.Now()
+	for _, rule := range rules {
+		info := rule.Info()
+		state := "enabled"
+		if rule.Disabled {
+			state = "disabled"
+		} else if rule.Metadata.Expired(now) {
+			state = "expired"
+		}
+		meta := rule.Metadata
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			info.FilterID, orDash(info.Group), state, info.Action, orDash(info.Network), orDash(info.Constraints()), info.Layer, info.Weight,
+			orDash(meta.Source), orDash(meta.Owner), formatTime(meta.Created), formatTime(meta.Expires), orDash(strings.Join(meta.Tags, ",")), orDash(meta.Intent))
+	}
+	return w.Flush()
+}
+
+// runGroup enables, disables or deletes a group of persistent rules.
+func runGroup(logger *slog.Logger, remote firewall.Remote, args []string) int {
+	if len(args) != 2 {
+		logger.Error("usage: program group enable|disable|delete NAME")
+		return exitUsage
+	}
+	op, group := args[0], args[1]
+	if op != "enable" && op != "disable" && op != "delete" {
+		logger.Error("unknown group operation: must be enable, disable or delete", "op", op)
+		return exitUsage
+	}
+	if err := firewall.ValidateGroupName(group); err != nil {
+		logger.Error("invalid group name", firewall.ErrAttr(err))
+		return exitUsage
+	}
+
+	ctx := context.Background()
+	engine, err := openEngine(ctx, remote, true, nil)
+	if err != nil {
+		logger.Error("failed to open WFP engine", "host", remote.Host, firewall.ErrAttr(err))
+		return exitError
+	}
+	defer closeEngine(engine)
+
+	var n int
+	switch op {
+	case "enable":
+		n, err = engine.EnableGroup(ctx, group)
+	case "disable":
+		n, err = engine.DisableGroup(ctx, group)
+	case "delete":
+		n, err = engine.DeleteGroup(ctx, group)
+	}
+	if err != nil {
+		logger.Error("group operation failed", "op", op, "group", group, firewall.ErrAttr(err))
+		return exitError
+	}
+	logger.Info("group operation done", "op", op, "group", group, "rules", n, "host", remote.Host)
+	return exitOK
+}
+
+/*
+ * runUnlock is the break-glass path for rules protected with -sddl or
+ * -sd-principal: it gives the persistent provider, sublayers and rules back to
+ * the administrators and the system, after which the group command deletes
+ * them. It only changes their DACL, which their owner, the administrators,
+ * may always do whatever the DACL says.
+ */
+func runUnlock(logger *slog.Logger, remote firewall.Remote) int {
+	sd, err := firewall.ParseSDDL(firewall.UnlockedSDDL)
+	if err != nil {
+		logger.Error("invalid security descriptor", firewall.ErrAttr(err))
+		return exitError
+	}
+
+	ctx := context.Background()
+	engine, err := openEngine(ctx, remote, true, nil)
+	if err != nil {
+		logger.Error("failed to open WFP engine", "host", remote.Host, firewall.ErrAttr(err))
+		return exitError
+	}
+	defer closeEngine(engine)
+
+	n, err := engine.SetSecurity(ctx, sd)
+	if err != nil {
+		logger.Error("failed to unlock rules", "rules", n, firewall.ErrAttr(err))
+		return exitError
+	}
+	logger.Info("rules unlocked", "rules", n, "host", remote.Host)
+	return exitOK
+}
+
+func loadPolicySpecs(path string) ([]firewall.RuleSpec, error) {
+	policy, err := firewall.LoadPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+	return policy.Specs()
+}
+
+// runExplain prints how the rules of a policy decide one connection.
+func runExplain(logger *slog.Logger, policyPath string, args []string) int {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	inbound := fs.Bool("inbound", false, "The connection is accepted rather than initiated by this machine")
+	proto := fs.String("proto", "tcp", "Protocol: tcp, udp, icmp, icmpv6 or a number")
+	local := fs.String("local", "", "Local address, as ADDR or ADDR:PORT")
+	app := fs.String("app", "", "Path of the application making the connection")
+	flags := fs.String("flags", "", "Flags of the connection joined by +, e.g. loopback")
+	iface := fs.String("interface", "", "Local interface of the connection: alias, index:N or luid:N")
+	remoteMAC := fs.String("remote-mac", "", "Explain an Ethernet frame instead, to or from this MAC address")
+	localMAC := fs.String("local-mac", "", "Explain an Ethernet frame instead, from or to this MAC address of this machine")
+	etherType := fs.String("ether-type", "", "Explain an Ethernet frame instead, of this EtherType: ipv4, arp, vlan, ipv6, lldp or a number")
+	l2Flags := fs.String("l2-flags", "", "Explain an Ethernet frame instead, with these L2 flags joined by +, e.g. vm2vm")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	frame := *remoteMAC != "" || *localMAC != "" || *etherType != "" || *l2Flags != ""
+	if policyPath == "" || fs.NArg() != 1 && !(frame && fs.NArg() == 0) {
+		logger.Error("usage: program -policy FILE explain [-inbound] [-proto PROTO] [-local ADDR[:PORT]] [-app PATH] [-flags FLAGS] [-interface IFACE] ADDR[:PORT] | -policy FILE explain [-inbound] [-remote-mac MAC] [-local-mac MAC] [-ether-type TYPE] [-l2-flags FLAGS]")
+		return exitUsage
+	}
+
+	conn := firewall.Connection{Direction: "outbound", App: *app}
+	if *inbound {
+		conn.Direction = "inbound"
+	}
+	var err error
+	if conn.Protocol, err = firewall.ParseProtocol(*proto); err != nil {
+		logger.Error("invalid -proto", firewall.ErrAttr(err))
+		return exitUsage
+	}
+	if fs.NArg() == 1 {
+		if conn.RemoteAddr, conn.RemotePort, err = firewall.ParseEndpoint(fs.Arg(0)); err != nil {
+			logger.Error("invalid remote endpoint", firewall.ErrAttr(err))
+			return exitUsage
+		}
+	}
+	if *remoteMAC != "" {
+		if conn.RemoteMAC, err = firewall.ParseMAC(*remoteMAC); err != nil {
+			logger.Error("invalid -remote-mac", firewall.ErrAttr(err))
+			return exitUsage
+		}
+	}
+	if *localMAC != "" {
+		if conn.LocalMAC, err = firewall.ParseMAC(*localMAC); err != nil {
+			logger.Error("invalid -local-mac", firewall.ErrAttr(err))
+			return exitUsage
+		}
+	}
+	if *etherType != "" {
+		if conn.EtherType, err = firewall.ParseEtherType(*etherType); err != nil {
+			logger.Error("invalid -ether-type", firewall.ErrAttr(err))
+			return exitUsage
+		}
+	}
+	if *l2Flags != "" {
+		if conn.L2Flags, err = firewall.ParseL2Flags(*l2Flags); err != nil {
+			logger.Error("invalid -l2-flags", firewall.ErrAttr(err))
+			return exitUsage
+		}
+	}
+	if *local != "" {
+		if conn.LocalAddr, conn.LocalPort, err = firewall.ParseEndpoint(*local); err != nil {
+			logger.Error("invalid -local", firewall.ErrAttr(err))
+			return exitUsage
+		}
+	}
+	if *flags != "" {
+		if conn.Flags, err = firewall.ParseFlags(*flags); err != nil {
+			logger.Error("invalid -flags", firewall.ErrAttr(err))
+			return exitUsage
+		}
+	}
+	if *iface != "" {
+		if conn.Interface, err = firewall.ParseInterface(*iface); err != nil {
+			logger.Error("invalid -interface", firewall.ErrAttr(err))
+			return exitUsage
+		}
+	}
+
+	specs, err := loadPolicySpecs(policyPath)
+	if err != nil {
+		logger.Error("invalid policy", "path", policyPath, firewall.ErrAttr(err))
+		return exitUsage
+	}
+	sim, err := firewall.NewSimulator(context.Background(), specs)
+	if err != nil {
+		logger.Error("failed to load policy in the simulator", firewall.ErrAttr(err))
+		return exitError
+	}
+	defer sim.Close()
+
+	if err := sim.Decide(conn).WriteExplanation(os.Stdout); err != nil {
+		logger.Error("failed to print explanation", firewall.ErrAttr(err))
+		return exitError
+	}
+	return exitOK
+}
+
+// runAnalyze reports the conflicting, shadowed and duplicate rules of a policy.
+func runAnalyze(logger *slog.Logger, policyPath string) int {
+	if policyPath == "" || flag.NArg() != 1 {
+		logger.Error("usage: program -policy FILE analyze")
+		return exitUsage
+	}
+	specs, err := loadPolicySpecs(policyPath)
+	if err != nil {
+		logger.Error("invalid policy", "path", policyPath, firewall.ErrAttr(err))
+		return exitUsage
+	}
+	if err := firewall.Analyze(specs).WriteReport(os.Stdout); err != nil {
+		logger.Error("failed to print analysis", firewall.ErrAttr(err))
+		return exitError
+	}
+	return exitOK
+}
+
+// runTest checks the test cases of files against the rules of a policy.
+func runTest(logger *slog.Logger, policyPath string, args []string) int {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	verbose := fs.Bool("v", false, "Also print the cases that passed")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if policyPath == "" || fs.NArg() < 1 {
+		logger.Error("usage: program -policy FILE test [-v] CASES...")
+		return exitUsage
+	}
+
+	specs, err := loadPolicySpecs(policyPath)
+	if err != nil {
+		logger.Error("invalid policy", "path", policyPath, firewall.ErrAttr(err))
+		return exitUsage
+	}
+	var tests []*firewall.PolicyTest
+	for _, path := range fs.Args() {
+		test, err := firewall.LoadPolicyTest(path)
+		if err != nil {
+			logger.Error("invalid test file", "path", path, firewall.ErrAttr(err))
+			return exitUsage
+		}
+		tests = append(tests, test)
+	}
+	sim, err := firewall.NewSimulator(context.Background(), specs)
+	if err != nil {
+		logger.Error("failed to load policy in the simulator", firewall.ErrAttr(err))
+		return exitError
+	}
+	defer sim.Close()
+
+	var results []firewall.TestResult
+	for i, test := range tests {
+		r, err := firewall.RunPolicyTest(sim, test)
+		if err != nil {
+			logger.Error("invalid test cases", "path", fs.Arg(i), firewall.ErrAttr(err))
+			return exitUsage
+		}
+		results = append(results, r...)
+	}
+	if err := firewall.WriteTestReport(os.Stdout, results, *verbose); err != nil {
+		logger.Error("failed to print test report", firewall.ErrAttr(err))
+		return exitError
+	}
+	for _, r := range results {
+		if !r.Passed() {
+			return exitTestFailed
+		}
+	}
+	return exitOK
+}
+
+func newLogger(format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid -log-level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid -log-format %q: must be text or json", format)
+}
+
+// remoteFromFlags combines the credentials file, the flags and the password
+// environment variable, in increasing order of precedence.
+func remoteFromFlags(credentials, host, user, auth string) (firewall.Remote, error) {
+	var remote firewall.Remote
+	if credentials != "" {
+		var err error
+		remote, err = firewall.LoadRemote(credentials)
+		if err != nil {
+			return firewall.Remote{}, err
+		}
+	}
+	if host != "" {
+		remote.Host = host
+	}
+	if user != "" {
+		remote.Domain = ""
+		remote.SetUser(user)
+	}
+	if password, ok := os.LookupEnv(passwordEnv); ok {
+		remote.Password = password
+	}
+	if auth != "" {
+		remote.Auth = auth
+	}
+	return remote, remote.Validate()
+}
+
+/*
+ * logApplySummary logs the outcome of every rule and of the batch as a whole,
+ * and returns the exit code it calls for.
+ */
+func logApplySummary(logger *slog.Logger, summary *firewall.ApplySummary, onError firewall.OnError, err error) int {
+	for _, result := range summary.Results {
+		if result.Err != nil {
+			logger.Error("failed to add rule", "action", result.Spec.Action, "cidr", result.Spec.Network.String(), firewall.ErrAttr(result.Err))
+		} else if summary.RolledBack {
+			logger.Info("rule rolled back", ruleAttrs(result.Rule)...)
+		} else {
+			logger.Info("rule added", ruleAttrs(result.Rule)...)
+		}
+	}
+
+	attrs := []any{
+		"requested", len(summary.Results),
+		"applied", summary.Applied,
+		"failed", summary.Failed,
+		"replaced", summary.Replaced,
+		"rolled_back", summary.RolledBack,
+		"on_error", string(onError),
+	}
+	switch {
+	case err != nil:
+		logger.Error("apply failed", append(attrs, firewall.ErrAttr(err))...)
+		return exitError
+	case summary.RolledBack:
+		logger.Error("apply aborted, no rule applied", attrs...)
+		return exitRolledBack
+	case summary.Failed > 0:
+		logger.Warn("apply finished with failures", attrs...)
+		return exitPartial
+	}
+	logger.Info("apply finished", attrs...)
+	return exitOK
+}
+
+func ruleAttrs(rule firewall.RuleInfo) []any {
+	return []any{
+		"rule", rule.Name,
+		"action", rule.Action,
+		"cidr", rule.Network,
+		"layer", rule.Layer,
+		"filter_id", rule.FilterID,
+		"group", rule.Group,
+	}
 }